@@ -0,0 +1,205 @@
+package cmd
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"sync"
+	"time"
+
+	gagliardetto "github.com/gagliardetto/solana-go"
+	gagliardettorpc "github.com/gagliardetto/solana-go/rpc"
+	"github.com/go-logr/logr"
+	"github.com/workbenchapp/worknet/daoctl/lib/apiauth"
+	"github.com/workbenchapp/worknet/daoctl/lib/options"
+	"github.com/workbenchapp/worknet/daoctl/lib/solana"
+	"github.com/workbenchapp/worknet/daoctl/lib/solana/anchor/generated/worknet"
+	"github.com/workbenchapp/worknet/daoctl/lib/solana/smartwalletutils"
+	"github.com/workbenchapp/worknet/daoctl/lib/workgroup"
+)
+
+// apiAuthority is who can use an agent API route
+type apiAuthority int
+
+const (
+	// apiAuthDevice is the device's own authority key
+	apiAuthDevice apiAuthority = 1 << iota
+	// apiAuthWorkgroup is an owner of the smart wallet that's the workgroup's
+	// authority, if that wallet only needs one owner to approve its transactions.
+	// A request carries one signature, so on a multisig workgroup (threshold > 1)
+	// nobody gets this, the agent won't let one owner do what the rest haven't
+	// agreed to.
+	apiAuthWorkgroup
+)
+
+// smartWalletOwnersTTL is how long the agent believes the owners (and threshold) it looked up
+const smartWalletOwnersTTL = time.Minute
+
+// maxSignedBody is the most of a request body the agent will read to check its signature
+const maxSignedBody = 1 << 20
+
+// apiAuth checks the signed requests to this device's agent API
+type apiAuth struct {
+	ctx      context.Context
+	device   *worknet.Device
+	verifier *apiauth.Verifier
+
+	mu     sync.Mutex
+	owners map[gagliardetto.PublicKey]cachedOwners
+}
+
+type cachedOwners struct {
+	owners    []gagliardetto.PublicKey
+	threshold uint64
+	at        time.Time
+}
+
+func newAPIAuth(ctx context.Context, device *worknet.Device) *apiAuth {
+	return &apiAuth{
+		ctx:      ctx,
+		device:   device,
+		verifier: apiauth.NewVerifier(device.DeviceAuthority.String()),
+		owners:   map[gagliardetto.PublicKey]cachedOwners{},
+	}
+}
+
+// authorize reads req's body and checks it's signed by one of allowed. If it
+// isn't, it's answered the request itself and ok is false.
+func (a *apiAuth) authorize(w http.ResponseWriter, req *http.Request, allowed apiAuthority) (body []byte, signed *apiauth.Signed, ok bool) {
+	log := logr.FromContextOrDiscard(a.ctx)
+
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, maxSignedBody+1))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("couldn't read request: %s", err), http.StatusBadRequest)
+		return nil, nil, false
+	}
+	if len(body) > maxSignedBody {
+		http.Error(w, "request too large", http.StatusRequestEntityTooLarge)
+		return nil, nil, false
+	}
+	signed, err = a.verifier.Verify(req, body)
+	if err != nil {
+		log.V(1).Info("rejected API request", "path", req.URL.Path, "err", err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return nil, nil, false
+	}
+
+	if allowed&apiAuthDevice != 0 && signed.SmartWallet == nil && signed.Signer.Equals(a.device.DeviceAuthority) {
+		return body, signed, true
+	}
+	if allowed&apiAuthWorkgroup != 0 && signed.SmartWallet != nil {
+		isAuthority, err := a.isWorkgroupAuthority(signed)
+		if err != nil {
+			log.Error(err, "couldn't check workgroup authority", "signer", signed.Signer)
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return nil, nil, false
+		}
+		if isAuthority {
+			return body, signed, true
+		}
+	}
+	log.Info("refused API request", "path", req.URL.Path, "signer", signed.Signer)
+	http.Error(w, fmt.Sprintf("%s isn't allowed to do that", signed.Signer), http.StatusForbidden)
+	return nil, nil, false
+}
+
+// isWorkgroupAuthority says if signed is from an owner of the smart wallet
+// that the workgroup's authority is derived from, and that owner can act alone
+func (a *apiAuth) isWorkgroupAuthority(signed *apiauth.Signed) (bool, error) {
+	log := logr.FromContextOrDiscard(a.ctx)
+	group := workgroup.GetCachedWorkGroupInfo()
+	if group == nil {
+		return false, errors.New("workgroup not loaded yet")
+	}
+	derived, err := smartwalletutils.DerivedWallet(a.ctx, *signed.SmartWallet)
+	if err != nil {
+		return false, err
+	}
+	if !derived.Equals(group.GroupAuthority) {
+		return false, nil
+	}
+	wallet, err := a.smartWalletOwners(*signed.SmartWallet)
+	if err != nil {
+		return false, err
+	}
+	if wallet.threshold > 1 {
+		// TODO: take a threshold's worth of owner signatures
+		log.Info("workgroup smart wallet needs more than one owner to approve, the agent API only takes single owner requests",
+			"smartWallet", signed.SmartWallet, "threshold", wallet.threshold)
+		return false, nil
+	}
+	for _, owner := range wallet.owners {
+		if owner.Equals(signed.Signer) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (a *apiAuth) smartWalletOwners(smartWallet gagliardetto.PublicKey) (cachedOwners, error) {
+	a.mu.Lock()
+	cached, ok := a.owners[smartWallet]
+	a.mu.Unlock()
+	if ok && time.Since(cached.at) < smartWalletOwnersTTL {
+		return cached, nil
+	}
+
+	ctx, cancel := context.WithTimeout(a.ctx, 10*time.Second)
+	defer cancel()
+	client := gagliardettorpc.New(options.SolanaCluster(ctx).RPC)
+	owners, threshold, err := smartwalletutils.SmartWalletOwners(ctx, client, smartWallet)
+	if err != nil {
+		return cachedOwners{}, err
+	}
+	cached = cachedOwners{owners: owners, threshold: threshold, at: time.Now()}
+	a.mu.Lock()
+	a.owners[smartWallet] = cached
+	a.mu.Unlock()
+	return cached, nil
+}
+
+// requireJSON refuses requests that aren't application/json, a browser can't
+// send that cross origin without a preflight
+func requireJSON(w http.ResponseWriter, req *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/json" {
+		http.Error(w, "use Content-Type: application/json", http.StatusUnsupportedMediaType)
+		return false
+	}
+	return true
+}
+
+// apiSigner is the --key-file wallet, and the --smart-wallet it's an owner of (if any)
+func apiSigner(gOpts *options.GlobalOptions) (ed25519.PrivateKey, *gagliardetto.PublicKey, error) {
+	ctx := gOpts.Ctx
+	key, _, err := solana.MustGetWallet(ctx, gOpts)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get your wallet: %s", err)
+	}
+	var smartWallet *gagliardetto.PublicKey
+	if address, _ := ctx.Value(options.SmartWalletAddress).(string); address != "" {
+		pubKey, err := gagliardetto.PublicKeyFromBase58(address)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid smart wallet %q: %s", address, err)
+		}
+		smartWallet = &pubKey
+	}
+	return ed25519.PrivateKey(*key), smartWallet, nil
+}
+
+// signAPIRequest signs req, with body, for the device with authority device.
+// It's signed by the --key-file wallet, as the workgroup authority if there's
+// a --smart-wallet.
+func signAPIRequest(gOpts *options.GlobalOptions, req *http.Request, body []byte, device string) error {
+	key, smartWallet, err := apiSigner(gOpts)
+	if err != nil {
+		return err
+	}
+	apiauth.Sign(req, body, key, device, smartWallet)
+	return nil
+}
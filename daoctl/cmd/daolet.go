@@ -1,20 +1,15 @@
 package cmd
 
 import (
-	"bufio"
 	"context"
-	"crypto/sha256"
-	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"io/ioutil"
-	"net/http"
 	"os"
-	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -28,16 +23,18 @@ import (
 	"github.com/go-logr/logr"
 	"github.com/honeycombio/opentelemetry-go-contrib/launcher"
 	"github.com/portto/solana-go-sdk/types"
-	serviceimpl "github.com/workbenchapp/worknet/daoctl/cmd/service"
-	"github.com/workbenchapp/worknet/daoctl/lib/networking/dns"
+	"github.com/workbenchapp/worknet/daoctl/lib/agentstate"
 	"github.com/workbenchapp/worknet/daoctl/lib/networking/ice"
+	netproxy "github.com/workbenchapp/worknet/daoctl/lib/networking/proxy"
 	"github.com/workbenchapp/worknet/daoctl/lib/networking/pubip"
 	"github.com/workbenchapp/worknet/daoctl/lib/options"
 	"github.com/workbenchapp/worknet/daoctl/lib/proxy"
 	"github.com/workbenchapp/worknet/daoctl/lib/solana"
 	"github.com/workbenchapp/worknet/daoctl/lib/solana/anchor/generated/worknet"
 	"github.com/workbenchapp/worknet/daoctl/lib/solana/program"
+	"github.com/workbenchapp/worknet/daoctl/lib/specstore"
 	"github.com/workbenchapp/worknet/daoctl/lib/workgroup"
+	"github.com/workbenchapp/worknet/daoctl/lib/workload"
 	"go.opentelemetry.io/otel"
 )
 
@@ -51,78 +48,45 @@ const (
 )
 
 type DaoletCmd struct {
-	PollInterval  uint     `help:"Device deployment and Peer Poll interval in seconds" default:"120" yaml:"poll-interval"`
-	ListenAddress string   `help:"Port to listen to for DAPP magic" default:"localhost:9495" yaml:"listenaddress"`
-	FeatureFlags  []string `help:"Enable/Disable experimental features (disabledns|deployment)" default:"" yaml:"featureflags"`
-	SignalServer  string   `help:"NAT busting connection negotiation service" default:"http://signal.daonetes.org:8080" yaml:"signalserver"`
-}
-
-type PrefixWriter struct {
-	io.Writer
-}
-
-func NewPrefixWriter(w io.Writer, prefix string) *PrefixWriter {
-	pipeReader, pipeWriter := io.Pipe()
-	scanner := bufio.NewScanner(pipeReader)
-	go func() {
-		for scanner.Scan() {
-			if _, err := w.Write([]byte(prefix + scanner.Text() + "\n")); err != nil {
-				panic(err)
-			}
-		}
-	}()
-	return &PrefixWriter{
-		Writer: pipeWriter,
-	}
-}
-
-func (pw *PrefixWriter) Write(p []byte) (n int, err error) {
-	return pw.Writer.Write(p)
-}
-
-func downloadSpec(filepath string, url string) error {
-	resp, err := http.Get(url)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-
-	out, err := os.Create(filepath)
-	if err != nil {
-		return err
-	}
-	defer out.Close()
-
-	_, err = io.Copy(out, resp.Body)
-	return err
-}
-
-func validateSpecChecksum(localSpecPath string, checksum string) error {
-	specFile, err := os.Open(localSpecPath)
-	if err != nil {
-		return err
-	}
-	defer specFile.Close()
-
-	specHash := sha256.New()
-	if _, err := io.Copy(specHash, specFile); err != nil {
-		return err
-	}
-
-	strHash := hex.EncodeToString(specHash.Sum(nil))
-	if strHash != checksum {
-		return fmt.Errorf(
-			"checksum mismatch with spec: expected=%s actual=%s",
-			strHash,
-			checksum,
-		)
-	}
-
-	return nil
+	PollInterval      uint     `help:"Device deployment and Peer Poll interval in seconds, used when the chain subscription is down" default:"120" yaml:"poll-interval"`
+	ResyncInterval    uint     `help:"Full resync interval in seconds while the chain subscription is up" default:"900" yaml:"resync-interval"`
+	HeartbeatInterval uint     `help:"Seconds between checks that the other devices are still answering" default:"30" yaml:"heartbeat-interval"`
+	DelinquentAfter   uint     `help:"Seconds a device can go without answering before it's flagged delinquent" default:"300" yaml:"delinquent-after"`
+	HealthInterval    uint     `help:"Seconds between health checks of the deployed services" default:"10" yaml:"health-interval"`
+	ListenAddress     string   `help:"Port to listen to for DAPP magic" default:"localhost:9495" yaml:"listenaddress"`
+	FeatureFlags      []string `help:"Enable/Disable experimental features (disabledns|deployment)" default:"" yaml:"featureflags"`
+	SignalServer      string   `help:"NAT busting connection negotiation service" default:"http://signal.daonetes.org:8080" yaml:"signalserver"`
+	SpecTimeout       uint     `help:"Spec download timeout in seconds" default:"60" yaml:"spec-timeout"`
+	SpecMaxSize       int64    `help:"Largest spec in bytes the agent will download" default:"10485760" yaml:"spec-max-size"`
+	ForceUpdate       bool     `help:"Redeploy every deployment once at startup, even if nothing changed" yaml:"force-update"`
+	DrainTimeout      uint     `help:"Seconds to let proxied connections finish when stopping or restarting" default:"30" yaml:"drain-timeout"`
+	UDPIdleTimeout    uint     `help:"Seconds a forwarded UDP session is kept without any datagrams" default:"120" yaml:"udp-idle-timeout"`
+	IngressAddress    string   `help:"Address of the HTTP ingress that routes <service>.<host>.dmesh to the http publishers, empty to turn it off" default:"127.1.0.1:80" yaml:"ingress-address"`
+	IngressCORS       []string `help:"Origins browsers can call the http publishers from, the ingress answers CORS for all of them instead of the services (default none, it's left to each service)" yaml:"ingress-cors"`
+	Runtime           string   `help:"How to run docker-compose specs (docker|compose), docker uses the Docker Engine API, compose execs docker-compose" default:"docker" enum:"docker,compose" yaml:"runtime"`
+	MeshAddressing    string   `help:"How the devices get their mesh addresses (index|key), index is by position in the workgroup's device list, key derives them from the device keys so they don't move when devices join or leave, has to be the same on every device in the workgroup" default:"index" enum:"index,key" yaml:"mesh-addressing"`
+	MeshCIDR          string   `help:"Private IPv4 range the devices' mesh addresses come from, has to be the same on every device in the workgroup (default 192.169.99.0/24 for index addressing, 10.99.0.0/16 for key)" yaml:"mesh-cidr"`
+	MeshCIDR6         string   `help:"IPv6 ULA range the devices' mesh addresses come from, has to be the same on every device in the workgroup" default:"fdda:99::/64" yaml:"mesh-cidr6"`
+	WireguardMode     string   `help:"How to run the mesh (netstack|kernel), kernel makes a wireguard interface so containers and host tools can reach the peers directly (Linux, root, the wireguard module and iptables), falling back to netstack" default:"netstack" enum:"netstack,kernel" yaml:"wireguard-mode"`
+
+	specResolver *specstore.Resolver
+	forcedUpdate bool
+	state        *agentstate.DB
+	workDirs     string
+	secretsDir   string
+	config       *options.AgentConfig
+	reloads      chan struct{}
+	dnsCancel    context.CancelFunc
+	lifecycle    chan lifecycleRequest
+	health       *workload.HealthMonitor
 }
 
 func (r *DaoletCmd) featureFlagEnabled(flag string) bool {
-	for _, f := range r.FeatureFlags {
+	flags := r.FeatureFlags
+	if r.config != nil {
+		flags = append(flags[:len(flags):len(flags)], r.config.FeatureFlags...)
+	}
+	for _, f := range flags {
 		if f == flag {
 			return true
 		}
@@ -134,33 +98,62 @@ func (r *DaoletCmd) Run(gOpts *options.GlobalOptions) error {
 	parentCtx := gOpts.Ctx
 	ctx, cancel := context.WithCancel(parentCtx)
 	gOpts.Ctx = ctx
+	r.reloads = make(chan struct{}, 1)
+	r.lifecycle = make(chan lifecycleRequest)
+	stopping := make(chan struct{})
 	signalChan := make(chan os.Signal, 1)
-	signal.Notify(signalChan, syscall.SIGHUP) // add SINGHUP to reload configs..
+	signal.Notify(signalChan, syscall.SIGHUP, syscall.SIGTERM, os.Interrupt)
 	go func() {
 		for {
-
-			// TODO: this needs to be a switch so we can do different things depending on context.
-			// OR, use different channels...
-			s := <-signalChan // first signal, cancel context
+			s := <-signalChan
 			//signal.Stop(signalChan) // Don't stop the signals
-			gOpts.Log.Info("Received Signal restarting", "signal", s.String())
-			// not sure what to set the code to when "legitimately" interrupted,
-			// should send 130 (128+2) _if_ running interactively, but actually, we're mostly a service using Systemd etc
-			// https://unix.stackexchange.com/questions/251996/why-does-bash-set-exit-status-to-non-zero-on-ctrl-c-or-ctrl-z
+			if s == syscall.SIGHUP {
+				gOpts.Log.Info("Received Signal, reloading config", "signal", s.String())
+				select {
+				case r.reloads <- struct{}{}:
+				default: // one reload pending is enough
+				}
+				continue
+			}
+			gOpts.Log.Info("Received Signal, shutting down", "signal", s.String())
+			select {
+			case <-stopping:
+				// second one, they really mean it
+				// not sure what to set the code to when "legitimately" interrupted,
+				// should send 130 (128+2) _if_ running interactively, but actually, we're mostly a service using Systemd etc
+				// https://unix.stackexchange.com/questions/251996/why-does-bash-set-exit-status-to-non-zero-on-ctrl-c-or-ctrl-z
+				os.Exit(1)
+			default:
+				close(stopping)
+			}
 			cancel()
 		}
 	}()
 
+	// opened once, bbolt only lets one of us have it
+	if err := r.openAgentState(ctx); err != nil {
+		return fmt.Errorf("error opening agent state: %s", err)
+	}
+	defer r.state.Close()
+
 	var err error
 	for {
 		gOpts.Log.Info("RestartableRun loop")
 
-		workgroup.InitDeviceCache() // start with a fresh info cache
+		workgroup.InitDeviceCache(ctx, r.state) // start with what we knew before
 
 		err = r.RestartableRun(gOpts)
-		if err != nil {
+		cancel()
+		r.stopSubsystems(ctx)
+
+		select {
+		case <-stopping:
+			gOpts.Log.Info("Agent stopped")
+			return nil
+		default:
+		}
+		if err != nil && err != errConfigRestart {
 			gOpts.Log.Info("RestartableRun break", "err", err)
-			cancel()
 			//break
 
 			gOpts.Log.Info("WAIT 10s to restart loop") // TODO: this is to allow things to stop and for debugging (tune downwards)
@@ -173,7 +166,6 @@ func (r *DaoletCmd) Run(gOpts *options.GlobalOptions) error {
 		ctx, cancel = context.WithCancel(parentCtx)
 		gOpts.Ctx = ctx
 	}
-	return err
 }
 
 func (r *DaoletCmd) RestartableRun(gOpts *options.GlobalOptions) error {
@@ -190,8 +182,10 @@ func (r *DaoletCmd) RestartableRun(gOpts *options.GlobalOptions) error {
 	gOpts.Log.Info(
 		"Agent starting",
 		"poll_interval", r.PollInterval,
+		"resync_interval", r.ResyncInterval,
 		"listen_address", r.ListenAddress,
 		"signalserver", r.SignalServer,
+		"runtime", r.Runtime,
 	)
 
 	// TODO: test that ListenAddress is valid...
@@ -199,26 +193,24 @@ func (r *DaoletCmd) RestartableRun(gOpts *options.GlobalOptions) error {
 	// TODO: Sven claims this is essentially safe, as its the same as the data on the chain
 	// BUT - its a lie, this endpoint confirms that this is a specific account on chain
 	proxy.ListenAndServeLocalhost(ctx, r.ListenAddress)
-	if !serviceimpl.Admin() {
-		gOpts.Log.Info(".dmesh DNS disabled, not running as root/Admin")
-	} else {
-		if !r.featureFlagEnabled("disabledns") {
-			// TODO: test if we have permission to listen on port 53
-			err := dns.EnsureDNSConfigured()
-			if err != nil {
-				panic(err)
-			}
-			go dns.RunDnsService(ctx)
-		}
-	}
 
 	agentConfig, err := options.Config()
 	if err != nil {
 		return fmt.Errorf("error getting or creating agent config: %s", err)
 	}
+	r.config = agentConfig
+	r.updateDNS(ctx)
 
 	gOpts.Log.Info("Starting new mesh", "mesh name", agentConfig.ActiveNet)
 
+	specResolver, err := r.newSpecResolver(agentConfig)
+	if err != nil {
+		return fmt.Errorf("error setting up spec cache: %s", err)
+	}
+	r.specResolver = specResolver
+	// peers fetch specs they can't get elsewhere from us, over the mesh
+	proxy.AddAPIHandler(specsAPIPath+"/", specResolver.Store.ServeHTTP)
+
 	activeNet, err := agentConfig.Active()
 	if err != nil {
 		return err
@@ -229,6 +221,14 @@ func (r *DaoletCmd) RestartableRun(gOpts *options.GlobalOptions) error {
 		return err
 	}
 
+	specResolver.Peers = func() []string {
+		peers := []string{}
+		for _, peer := range proxy.PeerAPIURLs(ourWallet.PublicKey.String()) {
+			peers = append(peers, peer+specsAPIPath)
+		}
+		return peers
+	}
+
 	seeds := [][]byte{
 		ourWallet.PublicKey.Bytes(),
 	}
@@ -247,6 +247,7 @@ func (r *DaoletCmd) RestartableRun(gOpts *options.GlobalOptions) error {
 	client := gagliardettorpc.New(options.SolanaCluster(ctx).RPC)
 
 	var deviceAccountResp *gagliardettorpc.GetAccountInfoResult
+	var cachedDevice *worknet.Device
 	for {
 		deviceAccountResp, err = client.GetAccountInfo(ctx, deviceInfoKey)
 		if err == nil {
@@ -254,6 +255,13 @@ func (r *DaoletCmd) RestartableRun(gOpts *options.GlobalOptions) error {
 		}
 		if err == gagliardettorpc.ErrNotFound {
 			err = errors.New("no PDA found. Must register device:\ndaoctl device register " + ourWallet.PublicKey.String())
+		} else if status := workgroup.GetCachedDeviceStatusInfo(""); status != nil &&
+			(status.DeviceInfo.Status == worknet.DeviceStatusRegistered || status.DeviceInfo.Status == worknet.DeviceStatusCordoned) &&
+			status.DeviceInfo.DeviceAuthority.String() == ourWallet.PublicKey.String() {
+			// carry on with what we knew before the restart, the watcher catches us up once the chain is back
+			gOpts.Log.Info("Chain unreachable, using saved device account", "err", err)
+			cachedDevice = &status.DeviceInfo
+			break
 		}
 		gOpts.Log.Info("Getting local device account info", "state", err.Error())
 
@@ -269,10 +277,14 @@ func (r *DaoletCmd) RestartableRun(gOpts *options.GlobalOptions) error {
 	gOpts.Log.Info("Device account found on chain", "devicePDA", deviceInfoKey.String())
 
 	device := &worknet.Device{}
-	deviceAccount := deviceAccountResp.Value
-	decoder := bin.NewDecoderWithEncoding(deviceAccount.Data.GetBinary(), bin.EncodingBorsh)
-	if err := device.UnmarshalWithDecoder(decoder); err != nil {
-		return err
+	if cachedDevice != nil {
+		*device = *cachedDevice
+	} else {
+		deviceAccount := deviceAccountResp.Value
+		decoder := bin.NewDecoderWithEncoding(deviceAccount.Data.GetBinary(), bin.EncodingBorsh)
+		if err := device.UnmarshalWithDecoder(decoder); err != nil {
+			return err
+		}
 	}
 
 	if device.Status == worknet.DeviceStatusRegistrationRequested {
@@ -286,33 +298,193 @@ func (r *DaoletCmd) RestartableRun(gOpts *options.GlobalOptions) error {
 	workgroup.GetDeviceInfo(ctx)
 	// TODO: this should be integrated into the device chain metadata
 	/*myWireguardPublicKey :=*/
-	proxy.EnsureOnchainWireguardPeerKey(ctx, ourWallet)
+	proxy.EnsureOnchainWireguardPeerKey(ctx, r.state, ourWallet)
+	if err := proxy.SetupMeshAddresses(ctx, r.state, r.MeshAddressing, r.MeshCIDR, r.MeshCIDR6); err != nil {
+		return err
+	}
+	proxy.WireguardMode = r.WireguardMode
+	netproxy.UDPIdleTimeout = time.Duration(r.UDPIdleTimeout) * time.Second
+	proxy.IngressAddress = r.IngressAddress
+	proxy.IngressCORSOrigins = r.IngressCORS
+	if err := proxy.StartIngress(ctx); err != nil {
+		return err
+	}
+	auth := newAPIAuth(ctx, device)
+	r.addDeploymentHandlers(ctx, auth)
+	r.addDeviceLifecycleHandler(ctx, auth)
+	r.addRegistryAuthHandler(ctx, auth, device, ourWallet.PrivateKey)
+	r.addSecretsHandler(ctx, auth, device, ourWallet.PrivateKey)
 	gOpts.Ctx = context.WithValue(ctx, ice.GetSignalServerContextKey, r.SignalServer)
 	go ice.ListenForICEConnectionRequest(ctx, ourWallet.PublicKey.String()+"Server", "127.0.0.1:12912")
+
+	// Reconcile as soon as the chain tells us something changed, and only poll
+	// on PollInterval when the subscription is down
+	watcher := workgroup.NewChainWatcher(
+		options.SolanaCluster(ctx).WS,
+		deviceInfoKey,
+		device.WorkGroup,
+		gagliardetto.PublicKeyFromBytes(ourWallet.PublicKey.Bytes()),
+	)
+	go watcher.Run(ctx)
+
+	runtimeEvents := r.setupRuntimes(ctx, &registryCredentials{r: r, device: device, key: ourWallet.PrivateKey})
+	r.health = workload.NewHealthMonitor(workload.DefaultRegistry)
+	healthChecks := time.NewTicker(time.Duration(r.HealthInterval) * time.Second)
+	defer healthChecks.Stop()
+
+	workgroup.DelinquentAfter = time.Duration(r.DelinquentAfter) * time.Second
+	heartbeats := time.NewTicker(time.Duration(r.HeartbeatInterval) * time.Second)
+	defer heartbeats.Stop()
+
 	// Cool, we're ready to accept work, LFG
+	var resync <-chan time.Time
+	reconcile := true
 	for {
 		// TODO: want to make one polling system that only requests data from the chain or its peers
 		// TODO: and everything else listens to see if the cached info means it needs to act.
 
-		proxy.ProxyToDevices(ctx, ourWallet, r.ListenAddress) // TODO: so this should probably move to its own event system
+		if reconcile {
+			proxy.ProxyToDevices(ctx, ourWallet, r.ListenAddress) // TODO: so this should probably move to its own event system
 
-		if err := r.UpdateDeployments(ctx, client, device, ourWallet, activeNet); err != nil {
-			gOpts.Log.Error(err, "Update loop", "client", client, "device", device, "wallet", ourWallet)
-		}
+			// the config can change under us on SIGHUP, but not the active net
+			activeNet, _ = r.config.Active()
+			if err := r.UpdateDeployments(ctx, client, device, ourWallet, activeNet); err != nil {
+				gOpts.Log.Error(err, "Update loop", "client", client, "device", device, "wallet", ourWallet)
+			}
 
-		// TODO: we should have WS subscription(s) instead of polling
-		//time.Sleep(time.Duration(r.PollInterval) * time.Second)
-		fmt.Println("main agent loop")
+			interval := time.Duration(r.PollInterval) * time.Second
+			if watcher.Subscribed() {
+				interval = time.Duration(r.ResyncInterval) * time.Second
+			}
+			gOpts.Log.V(1).Info("main agent loop", "next_resync", interval)
+			resync = time.After(interval)
+		}
+		reconcile = true
 		select {
 		case <-ctx.Done():
 			fmt.Println("context canceled")
 			return fmt.Errorf("Main agent loop context canceled")
-		case <-time.After(time.Duration(r.PollInterval) * time.Second):
+		case change := <-watcher.Changes:
+			// a drop makes the reconcile set resync to the PollInterval, a resubscribe catches up
+			gOpts.Log.Info("Chain changed, reconciling", "source", change.Source, "account", change.Account, "slot", change.Slot)
+			// the token program sends a burst of updates for one schedule, so let them settle
+			sources := drainChainChanges(watcher.Changes, time.Second)
+			sources[change.Source] = true
+			if sources[workgroup.SourceSubscribed] {
+				// we missed whatever changed while we weren't subscribed
+				sources["device"], sources["workgroup"] = true, true
+			}
+			if sources["device"] {
+				if err := refreshDevice(ctx, client, deviceInfoKey, device); err != nil {
+					gOpts.Log.Error(err, "Couldn't refresh device account", "devicePDA", deviceInfoKey)
+				}
+			}
+			if sources["device"] || sources["workgroup"] {
+				workgroup.GetDeviceInfo(ctx)
+			}
+		case <-r.reloads:
+			restart, err := r.reloadConfig(ctx)
+			if err != nil {
+				gOpts.Log.Error(err, "Couldn't reload config, keeping the old one")
+			} else if restart {
+				return errConfigRestart
+			}
+		case request := <-r.lifecycle:
+			err := r.handleLifecycle(ctx, client, device, ourWallet, deviceInfoKey, request.action)
+			request.reply <- err
+			if err != nil {
+				gOpts.Log.Error(err, "Device lifecycle change failed", "action", request.action)
+			}
+			workgroup.GetDeviceInfo(ctx)
+		case <-healthChecks.C:
+			r.checkHealth(ctx)
+			reconcile = false
+		case <-heartbeats.C:
+			proxy.CheckHeartbeats(ctx, ourWallet)
+			// only the heartbeat, nothing to reconcile
+			reconcile = false
+		case event, ok := <-runtimeEvents:
+			if !ok {
+				runtimeEvents = nil
+				break
+			}
+			gOpts.Log.Info("Workload changed, refreshing", "name", event.Name, "service", event.Service, "action", event.Action)
+			drainRuntimeEvents(runtimeEvents, time.Second)
+		case <-resync:
 			fmt.Println("timed out")
+			workgroup.GetDeviceInfo(ctx)
 		}
 	}
 }
 
+// setupRuntimes picks the docker-compose runtime, falling back to exec'ing
+// docker-compose if the Docker API isn't reachable. The returned channel is nil
+// (so never fires) if the runtime can't tell us about changes. credentials are
+// the registry logins for pulls.
+func (r *DaoletCmd) setupRuntimes(ctx context.Context, credentials workload.Credentials) <-chan workload.Event {
+	log := logr.FromContextOrDiscard(ctx)
+
+	if r.Runtime != "docker" {
+		workload.Register(worknet.WorkTypeDockerCompose, &workload.ComposeRuntime{Credentials: credentials})
+		return nil
+	}
+	docker, err := workload.NewDockerRuntime()
+	if err == nil {
+		err = docker.DockerAvailable(ctx)
+	}
+	if err != nil {
+		log.Error(err, "Docker API not available, falling back to docker-compose")
+		workload.Register(worknet.WorkTypeDockerCompose, &workload.ComposeRuntime{Credentials: credentials})
+		return nil
+	}
+	docker.Credentials = credentials
+	workload.Register(worknet.WorkTypeDockerCompose, docker)
+	return docker.Events(ctx)
+}
+
+// drainRuntimeEvents swallows any events that arrive within settle of each other,
+// a `docker rm -f` of a project is several events
+func drainRuntimeEvents(events <-chan workload.Event, settle time.Duration) {
+	for {
+		select {
+		case _, ok := <-events:
+			if !ok {
+				return
+			}
+		case <-time.After(settle):
+			return
+		}
+	}
+}
+
+// drainChainChanges swallows any changes that arrive within settle of each
+// other, and says which sources they came from
+func drainChainChanges(changes <-chan workgroup.ChainChange, settle time.Duration) map[string]bool {
+	sources := map[string]bool{}
+	for {
+		select {
+		case change := <-changes:
+			sources[change.Source] = true
+		case <-time.After(settle):
+			return sources
+		}
+	}
+}
+
+func refreshDevice(ctx context.Context, client *gagliardettorpc.Client, deviceInfoKey gagliardetto.PublicKey, device *worknet.Device) error {
+	deviceAccountResp, err := client.GetAccountInfo(ctx, deviceInfoKey)
+	if err != nil {
+		return err
+	}
+	updated := worknet.Device{}
+	decoder := bin.NewDecoderWithEncoding(deviceAccountResp.Value.Data.GetBinary(), bin.EncodingBorsh)
+	if err := updated.UnmarshalWithDecoder(decoder); err != nil {
+		return err
+	}
+	*device = updated
+	return nil
+}
+
 func (r *DaoletCmd) UpdateDeployments(
 	ctx context.Context,
 	client *gagliardettorpc.Client,
@@ -337,18 +509,60 @@ func (r *DaoletCmd) UpdateDeployments(
 		return err
 	}
 
+	capacity := workload.GetDeviceCapacity(r.workDirs, r.config.Labels)
+	workgroup.SetDeviceCapacity(ctx, capacity)
+
+	// cordoned devices keep running what they have, draining ones stop everything
+	// and then hand the tokens back, see devicelifecycle.go
+	lifecycle := r.loadLifecycle()
+	workgroup.SetDeviceDraining(ctx, lifecycle.Draining)
+	cordoned := device.Status == worknet.DeviceStatusCordoned
+	held := []heldTokens{}
+	running := make(map[string]bool)
+	started, err := r.newReconciler().Records()
+	if err == nil {
+		for _, record := range started {
+			running[deployStateKey(record.DeploymentPDA, record.Replica)] = true
+		}
+	}
+
+	// workloads that are still backed by a token we hold - anything else we started gets torn down
+	desired := []*workload.Workload{}
+	deployInfo := make(map[string]workgroup.DeploymentInfo)
+	// why each workload isn't what it should be, keyed by name
+	lastErrs := make(map[string]error)
+	// deployment PDAs of the tokens we couldn't look up this time, their workloads
+	// are held as they are. "" is a token we couldn't even tell the deployment of.
+	unresolved := make(map[string]bool)
+	skip := func(err error, tokenAccount gagliardetto.PublicKey, deploymentPDA string) {
+		log.Error(err, "Couldn't look up deployment token, leaving its workloads as they are",
+			"tokenAccount", tokenAccount,
+			"deploymentPDA", deploymentPDA,
+		)
+		unresolved[deploymentPDA] = true
+	}
+
 	for _, tokenAccount := range deviceDeployTokenAccounts.Value {
-		// TODO: these "return err" should also be "continue" - maybe extract to function?
-		// TODO: or better yet, move to "device" module, and then have a "deployment" module?
+		// TODO: move to "device" module, and then have a "deployment" module?
 		tokenWallet := &token.Account{}
 		decoder := bin.NewDecoderWithEncoding(tokenAccount.Account.Data.GetBinary(), bin.EncodingBorsh)
 		if err := tokenWallet.UnmarshalWithDecoder(decoder); err != nil {
-			return fmt.Errorf("couldn't decode token account: %s", err)
+			skip(fmt.Errorf("couldn't decode token account: %s", err), tokenAccount.Pubkey, "")
+			continue
+		}
+		if tokenWallet.Amount == 0 {
+			// burned or transferred away, the account just hasn't been closed
+			continue
 		}
 
 		deploymentMintAccountInfoResp, err := client.GetAccountInfo(ctx, tokenWallet.Mint)
+		if err == gagliardettorpc.ErrNotFound {
+			log.Info("Deployment mint closed, skipping", "tokenAccount", tokenAccount.Pubkey, "tokenWallet.Mint", tokenWallet.Mint)
+			continue
+		}
 		if err != nil {
-			return fmt.Errorf("couldn't get deployment mint account: %s", err)
+			skip(fmt.Errorf("couldn't get deployment mint account: %s", err), tokenAccount.Pubkey, "")
+			continue
 		}
 
 		mint := &token.Mint{}
@@ -357,12 +571,24 @@ func (r *DaoletCmd) UpdateDeployments(
 			bin.EncodingBorsh,
 		)
 		if err := mint.UnmarshalWithDecoder(decoder); err != nil {
-			return fmt.Errorf("couldn't decode deployment mint account: %s", err)
+			skip(fmt.Errorf("couldn't decode deployment mint account: %s", err), tokenAccount.Pubkey, "")
+			continue
+		}
+
+		if mint.MintAuthority == nil {
+			log.Info("Deployment mint has no authority, skipping", "tokenAccount", tokenAccount.Pubkey, "tokenWallet.Mint", tokenWallet.Mint)
+			continue
 		}
 
 		deploymentAccountInfoResp, err := client.GetAccountInfo(ctx, *mint.MintAuthority)
+		if err == gagliardettorpc.ErrNotFound {
+			// CloseDeployment ran, but we still hold its tokens
+			log.Info("Deployment account closed, skipping", "tokenAccount", tokenAccount.Pubkey, "mint.MintAuthority", mint.MintAuthority)
+			continue
+		}
 		if err != nil {
-			return fmt.Errorf("couldn't get deployment mint account: %s", err)
+			skip(fmt.Errorf("couldn't get deployment account: %s", err), tokenAccount.Pubkey, mint.MintAuthority.String())
+			continue
 		}
 
 		deployment := &worknet.Deployment{}
@@ -371,7 +597,8 @@ func (r *DaoletCmd) UpdateDeployments(
 			bin.EncodingBorsh,
 		)
 		if err := deployment.UnmarshalWithDecoder(decoder); err != nil {
-			return fmt.Errorf("couldn't decode deployment account: %s", err)
+			skip(fmt.Errorf("couldn't decode deployment account: %s", err), tokenAccount.Pubkey, mint.MintAuthority.String())
+			continue
 		}
 
 		// device is getting group authority
@@ -385,7 +612,8 @@ func (r *DaoletCmd) UpdateDeployments(
 			[]byte("deployment"),
 		}, program.WORKNET_V1_PROGRAM_PUBKEY)
 		if err != nil {
-			return fmt.Errorf("couldn't get deployment PDA: %s", err)
+			skip(fmt.Errorf("couldn't get deployment PDA: %s", err), tokenAccount.Pubkey, mint.MintAuthority.String())
+			continue
 		}
 
 		// make sure deployment and deployment_mint are issued from
@@ -404,9 +632,25 @@ func (r *DaoletCmd) UpdateDeployments(
 			continue
 		}
 
+		if lifecycle.Draining {
+			_, deploymentTokens, err := deploymentTokenPDAs(deploymentPDA)
+			if err != nil {
+				skip(err, tokenAccount.Pubkey, deploymentPDA.String())
+				continue
+			}
+			held = append(held, heldTokens{
+				account:          tokenAccount.Pubkey,
+				deploymentTokens: deploymentTokens,
+				amount:           tokenWallet.Amount,
+				deploymentName:   deployment.Name,
+			})
+			continue
+		}
+
 		specAccountInfoResp, err := client.GetAccountInfo(ctx, deployment.Spec)
 		if err != nil {
-			return fmt.Errorf("couldn't get spec account: %s", err)
+			skip(fmt.Errorf("couldn't get spec account: %s", err), tokenAccount.Pubkey, deploymentPDA.String())
+			continue
 		}
 
 		spec := &worknet.WorkSpec{}
@@ -415,14 +659,125 @@ func (r *DaoletCmd) UpdateDeployments(
 			bin.EncodingBorsh,
 		)
 		if err := spec.UnmarshalWithDecoder(decoder); err != nil {
-			return fmt.Errorf("couldn't decode spec account: %s", err)
+			skip(fmt.Errorf("couldn't decode spec account: %s", err), tokenAccount.Pubkey, deploymentPDA.String())
+			continue
 		}
-		err = r.updateDeployment(ctx, spec, deployment, deploymentPDA)
+		// one token per replica that the group wants running on this device
+		for replica := 0; replica < int(tokenWallet.Amount); replica++ {
+			if cordoned && !running[deployStateKey(deploymentPDA.String(), replica)] {
+				log.Info("Device is cordoned, not starting new workload",
+					"deployment.Name", deployment.Name,
+					"replica", replica,
+				)
+				continue
+			}
+			w, err := r.prepareWorkload(ctx, spec, deployment, deploymentPDA, replica)
+			if err == nil {
+				err = checkRequirements(w, capacity, device.Hostname)
+			}
+			if err == nil {
+				err = r.prepareSecrets(w, device.WorkGroup.String(), ourWallet.PrivateKey)
+			}
+			if err != nil {
+				log.Error(err, "error updating deployment",
+					"deployment.Name", deployment.Name,
+					"deploymentPDA", deploymentPDA,
+					"replica", replica,
+				)
+				if w == nil {
+					continue
+				}
+				// don't deploy a spec we couldn't fetch (or run), but don't tear down what's running either
+				w.Hold = true
+				lastErrs[w.Name] = err
+			}
+			desired = append(desired, w)
+			deployInfo[w.Name] = workgroup.DeploymentInfo{
+				Deployment:    *deployment,
+				Spec:          *spec,
+				DeploymentPDA: deploymentPDA.String(),
+				Replica:       replica,
+			}
+		}
+	}
+
+	desired = append(desired, heldWorkloads(started, desired, unresolved)...)
+
+	reconciler := r.newReconciler()
+	if r.featureFlagEnabled("deployment") {
+		// only the first pass after the agent starts, after that it's drift detection's job
+		reconciler.Force = r.ForceUpdate && !r.forcedUpdate
+		r.forcedUpdate = true
+		// let /device show that something's happening, pulls can take a while
+		reconciler.OnDeploy = func(w *workload.Workload) {
+			info := deployInfo[w.Name]
+			info.Phase = workgroup.PhasePulling
+			now := time.Now()
+			info.UpdatedAt = &now
+			if current := currentDeployState(w); current != nil {
+				info.States = current.States
+				info.LastError, info.LastErrorAt = current.LastError, current.LastErrorAt
+			}
+			workgroup.UpdateDeployState(ctx, "", deployStateKey(w.DeploymentPDA, w.Replica), info)
+		}
+		reconciler.OnPull = func(w *workload.Workload, pulls []workgroup.PullProgress) {
+			info := currentDeployState(w)
+			if info == nil {
+				return
+			}
+			now := time.Now()
+			info.Pulls = pulls
+			info.UpdatedAt = &now
+			workgroup.UpdateDeployState(ctx, "", deployStateKey(w.DeploymentPDA, w.Replica), *info)
+		}
+		stopped, err := reconciler.Reconcile(ctx, desired)
 		if err != nil {
-			return fmt.Errorf("error updating deployment: %s", err)
+			log.Error(err, "Reconciling deployments failed")
+		}
+		for name, err := range reconciler.Errors {
+			lastErrs[name] = err
+		}
+		for _, w := range stopped {
+			workgroup.RemoveDeployState(ctx, "", deployStateKey(w.DeploymentPDA, w.Replica))
+			r.health.Forget(w.Name)
+			if w.SecretsDir != "" {
+				os.RemoveAll(w.SecretsDir)
+			}
+		}
+
+		if lifecycle.Draining {
+			if err != nil {
+				log.Info("Draining, waiting for workloads to stop before returning their tokens", "err", err.Error())
+			} else if len(unresolved) > 0 {
+				log.Info("Draining, waiting to look up all our deployment tokens before returning them")
+			} else if err := r.finishDrain(ctx, client, ourWallet, held); err != nil {
+				log.Error(err, "Couldn't finish draining")
+			} else {
+				workgroup.SetDeviceDraining(ctx, false)
+			}
 		}
 	}
 
+	records, err := reconciler.Records()
+	if err != nil {
+		log.Error(err, "Couldn't read started workloads")
+	}
+	for _, w := range desired {
+		info, ok := deployInfo[w.Name]
+		if !ok {
+			// held because we couldn't look it up, it keeps its last state
+			continue
+		}
+		record, ok := records[w.Name]
+		if ok {
+			info.StartedAt = &record.StartedAt
+			if !record.DeployedAt.IsZero() {
+				info.DeployedAt = &record.DeployedAt
+			}
+		}
+		r.saveState(ctx, w, info, lastErrs[w.Name])
+	}
+
 	workgroup.UpdateDeployState(ctx, "", "local", workgroup.DeploymentInfo{
 		Deployment: worknet.Deployment{},
 		Spec:       worknet.WorkSpec{},
@@ -434,9 +789,47 @@ func (r *DaoletCmd) UpdateDeployments(
 	return nil
 }
 
-func saveState(ctx context.Context, deploymentPDA gagliardetto.PublicKey, spec *worknet.WorkSpec, deployment *worknet.Deployment, scheduleWorkDirPath, localSpecPath, projectName string) {
+// heldWorkloads are the started workloads of the unresolved deployments, held
+// as they are rather than torn down because we couldn't see their tokens
+func heldWorkloads(started map[string]workload.StartedWorkload, desired []*workload.Workload, unresolved map[string]bool) []*workload.Workload {
+	if len(unresolved) == 0 {
+		return nil
+	}
+	wanted := make(map[string]bool)
+	for _, w := range desired {
+		wanted[w.Name] = true
+	}
+	held := []*workload.Workload{}
+	for name, record := range started {
+		if wanted[name] || !(unresolved[""] || unresolved[record.DeploymentPDA]) {
+			continue
+		}
+		w := record.Workload
+		w.Hold = true
+		held = append(held, &w)
+	}
+	return held
+}
+
+func currentDeployState(w *workload.Workload) *workgroup.DeploymentInfo {
+	status := workgroup.GetCachedDeviceStatusInfo("local")
+	if status == nil {
+		return nil
+	}
+	info, ok := status.DeployState[deployStateKey(w.DeploymentPDA, w.Replica)]
+	if !ok {
+		return nil
+	}
+	return &info
+}
+
+// saveState writes the workload's chain info and runtime state into its work
+// dir, and publishes its status for /device. lastErr is why it isn't what it
+// should be, if we know.
+func (r *DaoletCmd) saveState(ctx context.Context, w *workload.Workload, info workgroup.DeploymentInfo, lastErr error) {
 	log := logr.FromContextOrDiscard(ctx)
-	specPath := filepath.Join(scheduleWorkDirPath, "spec.json")
+	spec, deployment := &info.Spec, &info.Deployment
+	specPath := filepath.Join(w.WorkDir, "spec.json")
 	// TODO: skip if already written
 	// TODO: log if the onchain spec has changed...
 	specJSON, _ := json.MarshalIndent(*spec, "", " ") // TODO: json err...
@@ -446,7 +839,7 @@ func saveState(ctx context.Context, deploymentPDA gagliardetto.PublicKey, spec *
 			"specPath", specPath,
 		)
 	}
-	deploymentPath := filepath.Join(scheduleWorkDirPath, "deployment.json")
+	deploymentPath := filepath.Join(w.WorkDir, "deployment.json")
 	// TODO: skip if already written
 	// TODO: log if the onchain spec has changed...
 	deploymentJSON, _ := json.MarshalIndent(*deployment, "", " ") // TODO: json err...
@@ -456,70 +849,83 @@ func saveState(ctx context.Context, deploymentPDA gagliardetto.PublicKey, spec *
 			"deploymentPath", deploymentPath,
 		)
 	}
-	// And now get the compose state
-	statePath := filepath.Join(scheduleWorkDirPath, "state.json")
-	stateCmd := exec.Command(
-		"docker-compose", "--project-name", projectName,
-		"--file", localSpecPath, "ps", "--all", "--format", "json",
-	)
-
-	stateBytes, err := stateCmd.Output()
-	if err != nil {
-		log.Error(err,
-			"Getting compose ps failed",
-			"projectName",
-			projectName,
+	// And now get the runtime's state
+	statePath := filepath.Join(w.WorkDir, "state.json")
+	// the health monitor restarts what's unhealthy while it's at it
+	states, statusErr := r.health.Status(ctx, w)
+	if states == nil {
+		states = []workgroup.DeployState{}
+	}
+	if statusErr != nil {
+		log.Error(statusErr,
+			"Getting workload status failed",
+			"name",
+			w.Name,
 		)
 	}
 
-	states := []workgroup.DeployState{}
-	json.Unmarshal(stateBytes, &states)                 // TODO: json err...
 	stateJSON, _ := json.MarshalIndent(states, "", " ") // TODO: json err...
-	if err = ioutil.WriteFile(statePath, stateJSON, 0644); err != nil {
+	if err := ioutil.WriteFile(statePath, stateJSON, 0644); err != nil {
 		log.Error(err,
 			"Could not write state JSON",
 			"statePath", statePath,
 		)
 	}
-	// TODO: how do i get the error...
 
-	workgroup.UpdateDeployState(ctx, "", deploymentPDA.String(), workgroup.DeploymentInfo{
-		Deployment: *deployment,
-		Spec:       *spec,
-		States:     states,
-	})
+	now := time.Now()
+	if lastErr == nil && statusErr != nil {
+		lastErr = fmt.Errorf("getting status failed: %s", statusErr)
+	}
+	info.States = states
+	info.Phase = workgroup.PhaseFromStates(states, lastErr)
+	info.UpdatedAt = &now
+	info.Restarts = countRestarts(states)
+	// keep showing how the last pull went, failures especially
+	if current := currentDeployState(w); current != nil {
+		info.Pulls = current.Pulls
+	}
+	if lastErr != nil {
+		info.LastError = lastErr.Error()
+		info.LastErrorAt = &now
+		// keep when it first happened, it's retried every pass
+		if current := currentDeployState(w); current != nil && current.LastError == info.LastError {
+			info.LastErrorAt = current.LastErrorAt
+		}
+	}
+
+	workgroup.UpdateDeployState(ctx, "", deployStateKey(w.DeploymentPDA, w.Replica), info)
 }
 
-func (r *DaoletCmd) updateDeployment(ctx context.Context, spec *worknet.WorkSpec, deployment *worknet.Deployment, deploymentPDA gagliardetto.PublicKey) error {
+// prepareWorkload gets the spec for one replica of a deployment into its work
+// dir, and works out if it needs (re)deploying. The workload is returned even on
+// error once its work dir is known, so the caller can still report on it.
+func (r *DaoletCmd) prepareWorkload(ctx context.Context, spec *worknet.WorkSpec, deployment *worknet.Deployment, deploymentPDA gagliardetto.PublicKey, replica int) (*workload.Workload, error) {
 	log := logr.FromContextOrDiscard(ctx)
-	// compose/swarm doesn't like long names
-	projectName := "daonetes" + strings.ToLower(deploymentPDA.String()[:16])
 
-	specWorkDirsPath := "specworkdirs"
-	if _, err := os.Stat(specWorkDirsPath); errors.Is(err, os.ErrNotExist) {
-		err := os.Mkdir(specWorkDirsPath, os.ModePerm)
+	if _, err := os.Stat(r.workDirs); errors.Is(err, os.ErrNotExist) {
+		err := os.MkdirAll(r.workDirs, os.ModePerm)
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
 
-	// TODO: this means that an agent can only have one deployment of a specific spec
-	//       what happens if there is more than on on a device? or even 2 replicas?
-	//       Sven suspects should at least be based on the deployment token ata (so that _if_ someone starts 2 different agents from the same dir, we don't clash)
+	// keyed by deployment and replica, so two deployments of the same spec, or
+	// two replicas of one deployment, each get their own spec copy and state
 	scheduleWorkDirPath := filepath.Join(
-		specWorkDirsPath,
-		deployment.Spec.String(),
+		r.workDirs,
+		deploymentPDA.String(),
+		strconv.Itoa(replica),
 	)
 
 	if _, err := os.Stat(scheduleWorkDirPath); errors.Is(err, os.ErrNotExist) {
-		err := os.Mkdir(scheduleWorkDirPath, os.ModePerm)
+		err := os.MkdirAll(scheduleWorkDirPath, os.ModePerm)
 		if err != nil {
 			log.Error(err, "Couldn't make directory", "dirpath", scheduleWorkDirPath)
 		}
 	}
 
 	localSpecPath := filepath.Join(scheduleWorkDirPath, "spec")
-	if strings.HasPrefix(spec.UrlOrContents, "https://") {
+	if strings.Contains(spec.UrlOrContents, "://") {
 		splitURL := strings.Split(spec.UrlOrContents, "/")
 
 		// tack on "-docker-compose.yaml", etc
@@ -529,78 +935,56 @@ func (r *DaoletCmd) updateDeployment(ctx context.Context, spec *worknet.WorkSpec
 		// TODO: rename this to the right type, based on spec.workType
 	}
 
-	// TODO: save where updateDeployment got up to too
-	defer saveState(ctx, deploymentPDA, spec, deployment, scheduleWorkDirPath, localSpecPath, projectName)
+	w := &workload.Workload{
+		Name:          deploymentProjectName(deploymentPDA, replica),
+		DeploymentPDA: deploymentPDA.String(),
+		Replica:       replica,
+		WorkType:      spec.WorkType,
+		WorkDir:       scheduleWorkDirPath,
+		SpecPath:      localSpecPath,
+		SpecSha256:    spec.ContentsSha256,
+		// let specs tell their replicas apart, e.g. for published ports: "80${DAONETES_REPLICA}80:80"
+		Env: []string{
+			"DAONETES_DEPLOYMENT=" + deploymentPDA.String(),
+			"DAONETES_REPLICA=" + strconv.Itoa(replica),
+		},
+	}
+
+	// one spec deployed many times, with different settings
+	argsEnv, err := workload.DeploymentArgsEnv(deployment.Args)
+	if err != nil {
+		return w, fmt.Errorf("invalid deployment args: %s", err)
+	}
+	w.Env = append(w.Env, argsEnv...)
 
+	// UpToDate only means we don't need to fetch the spec again, the reconciler
+	// still redeploys if the args changed or the containers drifted from the spec
 	if stat, err := os.Stat(localSpecPath); err == nil {
 		// TODO: at this point, this doesn't point at the downloaded filename ...
 		specLastModified := time.Unix(int64(spec.ModifiedAt), 0)
-
-		// TODO We might want to periodically re-apply the spec,
-		// or force an update with some type of agent --force-update
-		// flag. Will have to revisit + check libcompose code to see
-		// how elegantly it diffs.
-		// For now, you can force it by deleteing the spec file
 		if stat.ModTime().After(specLastModified) {
-			return err
+			w.UpToDate = true
+			return w, nil
 		}
 	}
-	if r.featureFlagEnabled("deployment") {
+	if !r.featureFlagEnabled("deployment") {
 		// Don't start / stop things that are deployed.
-		// TODO: can we check if it's deployed / running / dead? (and is knowing that useful?)
-
-		// TODO: download, then check checksum, if its incorrect, don't overwrite the old spec, (cos we do want to know what _was_ deployed, not what wasn't)
-		if strings.HasPrefix(spec.UrlOrContents, "https://") {
-			if err := downloadSpec(localSpecPath, spec.UrlOrContents); err != nil {
-				log.Error(err,
-					"Could not download spec",
-					"specURL", spec.UrlOrContents,
-					"specPDA", deployment.Spec.String(),
-					err,
-				)
-				return err
-			}
-		} else {
-			if err := ioutil.WriteFile(localSpecPath, []byte(spec.UrlOrContents), 0644); err != nil {
-				log.Error(err, "Could not write spec contents", "specPDA", deployment.Spec.String())
-				return err
-			}
-		}
-
-		if err := validateSpecChecksum(localSpecPath, spec.ContentsSha256); err != nil {
-			log.Error(err,
-				"Could not validate spec checksum",
-				"specPDA",
-				deployment.Spec.String(),
-			)
-			return err
-		}
-
-		if spec.WorkType == worknet.WorkTypeDockerCompose {
-			log.Info("Docker Compose worknet spec", "specName", spec.Name)
+		w.UpToDate = true
+		return w, nil
+	}
 
-			// Groan, stack deploy is a magic abstraction that
-			// doesn't exist first class in the Docker API. See
-			// https://stackoverflow.com/questions/42155978/docker-stack-deploy-using-the-client-api
-			//
-			// So we just send it and exec for now.
-			// TODO: Be more elegant.
-			deployCmd := exec.Command(
-				"docker-compose", "--project-name", projectName,
-				"--file", localSpecPath, "up", "-d",
-			)
-			deployCmd.Stdout = NewPrefixWriter(os.Stdout, "DOCKEROUT => ")
-			deployCmd.Stderr = NewPrefixWriter(os.Stderr, "DOCKERERR => ")
-			log.Info("Deploying Compose spec", "specName", spec.Name, "specPath", localSpecPath)
-			if err := deployCmd.Run(); err != nil {
-				log.Error(err, "Deploying spec failed", "specName", spec.Name, "specPDA", deployment.Spec.String())
-				return err
-			}
-		} else {
-			log.Info("Unknown worknet spec", "spec", spec)
-		}
+	// a bad download leaves the last good spec in place, so we still know what was deployed
+	if err := r.fetchSpec(ctx, localSpecPath, spec); err != nil {
+		log.Error(err,
+			"Could not fetch spec",
+			"specURL", spec.UrlOrContents,
+			"specPDA", deployment.Spec.String(),
+		)
+		return w, err
 	}
-	return nil
+
+	log.Info("Worknet spec ready to deploy", "specName", spec.Name, "workType", spec.WorkType, "name", w.Name)
+	return w, nil
 }
 
 func RegisterDevice(
@@ -658,11 +1042,18 @@ func RegisterDevice(
 		"Announcing device to worknet",
 		"device_pubkey", devicePubKey,
 		"device_hostname", hostname,
-		"device_ipv4", ip,
+		"device_ip", ip,
 	)
-	ipv4Bytes := []byte(ip.To4())
+	// the device account only has room for an IPv4 address, IPv6 only devices
+	// leave it 0.0.0.0, the mesh finds them with ICE anyway
+	var ipv4 [4]byte
+	if ip4 := ip.To4(); ip4 != nil {
+		ipv4 = [4]byte{ip4[0], ip4[1], ip4[2], ip4[3]}
+	} else {
+		gOpts.Log.Info("No public IPv4 address, only announcing the hostname", "device_ip", ip)
+	}
 	updateDeviceInst, err := worknet.NewUpdateDeviceInstruction(
-		[4]byte{ipv4Bytes[0], ipv4Bytes[1], ipv4Bytes[2], ipv4Bytes[3]},
+		ipv4,
 		strings.ToLower(hostname),
 		deviceBump,
 		worknet.DeviceStatusRegistered,
@@ -222,36 +222,7 @@ func (r *DeployCmdSchedule) Run(gOpts *options.GlobalOptions) error {
 
 	deviceAuthority := gagliardetto.MustPublicKeyFromBase58(r.NodePubKey)
 
-	devicePDA, _, err := gagliardetto.FindProgramAddress([][]byte{
-		deviceAuthority.Bytes(),
-	}, program.WORKNET_V1_PROGRAM_PUBKEY)
-	if err != nil {
-		return fmt.Errorf("couldn't find device authority PDA: %s", err)
-	}
-
-	deviceTokens, _, err := gagliardetto.FindProgramAddress([][]byte{
-		deviceAuthority.Bytes(),
-		deployPDA.Deployment.Bytes(),
-		[]byte("device_tokens"),
-	}, program.WORKNET_V1_PROGRAM_PUBKEY)
-	if err != nil {
-		return fmt.Errorf("couldn't find device authority PDA: %s", err)
-	}
-
-	scheduleInst, err := worknet.NewScheduleInstruction(
-		r.Replicas,
-		pdas.DerivedWallet.Key,
-		deployPDA.WorkGroup,
-		deployPDA.Deployment,
-		deployPDA.DeploymentMint,
-		deployPDA.DeploymentTokens,
-		devicePDA,
-		deviceAuthority,
-		deviceTokens,
-		gagliardetto.SystemProgramID,
-		gagliardetto.TokenProgramID,
-		gagliardetto.SysVarRentPubkey,
-	).ValidateAndBuild()
+	scheduleInst, err := newScheduleInstruction(pdas, deployPDA.Deployment, deviceAuthority, r.Replicas)
 	if err != nil {
 		return err
 	}
@@ -278,3 +249,84 @@ func (r *DeployCmdSchedule) Run(gOpts *options.GlobalOptions) error {
 
 	return nil
 }
+
+// newScheduleInstruction sends replicas of the deployment's unscheduled tokens to the device
+func newScheduleInstruction(
+	pdas *smartwalletutils.SmartWalletAndGroupAccounts,
+	deployment gagliardetto.PublicKey,
+	deviceAuthority gagliardetto.PublicKey,
+	replicas uint8,
+) (gagliardetto.Instruction, error) {
+	groupPDA, _, err := gagliardetto.FindProgramAddress([][]byte{
+		pdas.DerivedWallet.Key.Bytes(),
+		[]byte("work_group"),
+	}, program.WORKNET_V1_PROGRAM_PUBKEY)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't find PDA: %s", err)
+	}
+
+	deploymentMintPDA, deploymentTokensPDA, err := deploymentTokenPDAs(deployment)
+	if err != nil {
+		return nil, err
+	}
+
+	devicePDA, _, err := gagliardetto.FindProgramAddress([][]byte{
+		deviceAuthority.Bytes(),
+	}, program.WORKNET_V1_PROGRAM_PUBKEY)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't find device authority PDA: %s", err)
+	}
+
+	deviceTokens, err := deviceTokensPDA(deviceAuthority, deployment)
+	if err != nil {
+		return nil, err
+	}
+
+	return worknet.NewScheduleInstruction(
+		replicas,
+		pdas.DerivedWallet.Key,
+		groupPDA,
+		deployment,
+		deploymentMintPDA,
+		deploymentTokensPDA,
+		devicePDA,
+		deviceAuthority,
+		deviceTokens,
+		gagliardetto.SystemProgramID,
+		gagliardetto.TokenProgramID,
+		gagliardetto.SysVarRentPubkey,
+	).ValidateAndBuild()
+}
+
+// deploymentTokenPDAs are the deployment's mint, and the account holding its unscheduled tokens
+func deploymentTokenPDAs(deployment gagliardetto.PublicKey) (mint gagliardetto.PublicKey, tokens gagliardetto.PublicKey, err error) {
+	mint, _, err = gagliardetto.FindProgramAddress([][]byte{
+		deployment.Bytes(),
+		[]byte("deployment_mint"),
+	}, program.WORKNET_V1_PROGRAM_PUBKEY)
+	if err != nil {
+		return mint, tokens, fmt.Errorf("couldn't find deployment mint PDA: %s", err)
+	}
+
+	tokens, _, err = gagliardetto.FindProgramAddress([][]byte{
+		deployment.Bytes(),
+		[]byte("deployment_tokens"),
+	}, program.WORKNET_V1_PROGRAM_PUBKEY)
+	if err != nil {
+		return mint, tokens, fmt.Errorf("couldn't find deployment token account PDA: %s", err)
+	}
+	return mint, tokens, nil
+}
+
+// deviceTokensPDA is the account holding the deployment's tokens scheduled on the device
+func deviceTokensPDA(deviceAuthority gagliardetto.PublicKey, deployment gagliardetto.PublicKey) (gagliardetto.PublicKey, error) {
+	deviceTokens, _, err := gagliardetto.FindProgramAddress([][]byte{
+		deviceAuthority.Bytes(),
+		deployment.Bytes(),
+		[]byte("device_tokens"),
+	}, program.WORKNET_V1_PROGRAM_PUBKEY)
+	if err != nil {
+		return deviceTokens, fmt.Errorf("couldn't find device authority PDA: %s", err)
+	}
+	return deviceTokens, nil
+}
@@ -0,0 +1,190 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/go-logr/logr"
+	"github.com/workbenchapp/worknet/daoctl/lib/proxy"
+	"github.com/workbenchapp/worknet/daoctl/lib/workgroup"
+	"github.com/workbenchapp/worknet/daoctl/lib/workload"
+)
+
+// addDeploymentHandlers serves /deployments/{deployment}/... on the device API.
+// {deployment} is the deployment PDA, its on chain name, or its project name,
+// and ?proxy=<hostname> forwards the request to that device over the mesh.
+// logs and exec have to be signed by the device's authority or the
+// workgroup's, and web pages don't get CORS headers for any of it.
+func (r *DaoletCmd) addDeploymentHandlers(ctx context.Context, auth *apiAuth) {
+	log := logr.FromContextOrDiscard(ctx)
+
+	proxy.AddPrivateAPIHandler("/deployments/", func(w http.ResponseWriter, req *http.Request) {
+		if proxyDevice := req.URL.Query().Get("proxy"); proxyDevice != "" && proxyDevice != "localhost" {
+			log.V(2).Info("proxying deployment request", "proxy", proxyDevice, "path", req.URL.Path)
+			proxy.ForwardToDevice(w, req, proxyDevice)
+			return
+		}
+		// before anything else, so the answers don't say what's running here.
+		// exec's stdin comes after the upgrade, so its signed body is empty
+		_, signed, ok := auth.authorize(w, req, apiAuthDevice|apiAuthWorkgroup)
+		if !ok {
+			return
+		}
+
+		parts := strings.Split(strings.Trim(strings.TrimPrefix(req.URL.Path, "/deployments/"), "/"), "/")
+		if len(parts) != 2 {
+			http.NotFound(w, req)
+			return
+		}
+		replica := 0
+		if replicaParam := req.URL.Query().Get("replica"); replicaParam != "" {
+			var err error
+			if replica, err = strconv.Atoi(replicaParam); err != nil {
+				http.Error(w, "invalid replica: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		wl, err := r.findWorkload(parts[0], replica)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		runtime, err := workload.Get(wl.WorkType)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		switch parts[1] {
+		case "logs":
+			serveLogs(w, req, runtime, wl)
+		case "exec":
+			log.Info("Exec requested", "name", wl.Name, "signer", signed.Signer)
+			serveExec(ctx, w, req, runtime, wl)
+		default:
+			http.NotFound(w, req)
+		}
+	})
+}
+
+// findWorkload looks through the workloads we've started for one replica of a deployment
+func (r *DaoletCmd) findWorkload(deployment string, replica int) (*workload.Workload, error) {
+	pda := deployment
+	// let people use the name they gave it
+	if status := workgroup.GetCachedDeviceStatusInfo("local"); status != nil {
+		for _, info := range status.DeployState {
+			if info.Deployment.Name == deployment && info.DeploymentPDA != "" {
+				pda = info.DeploymentPDA
+			}
+		}
+	}
+
+	started, err := r.newReconciler().Started()
+	if err != nil {
+		return nil, err
+	}
+	for _, w := range started {
+		if w.Name == deployment || (w.DeploymentPDA == pda && w.Replica == replica) {
+			return w, nil
+		}
+	}
+	return nil, fmt.Errorf("deployment %s replica %d isn't running on this device", deployment, replica)
+}
+
+func serveLogs(w http.ResponseWriter, req *http.Request, runtime workload.Runtime, wl *workload.Workload) {
+	follow := req.URL.Query().Get("follow") == "true"
+	logs, err := runtime.Logs(req.Context(), wl, follow)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer logs.Close()
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	// the request context ends the stream when the client goes away
+	io.Copy(newFlushWriter(w), logs)
+}
+
+// execUpgrade is the Upgrade protocol for /exec, after the 101 the connection
+// carries the command's stdin one way, and its output the other
+const execUpgrade = "daonetes-exec"
+
+// serveExec runs ?cmd=...&cmd=... in ?service=, attaching stdin if ?stdin=true,
+// and with a tty if ?tty=true. Output is raw with a tty, and multiplexed with
+// pkg/stdcopy without one, the same as the Docker API does it.
+func serveExec(ctx context.Context, w http.ResponseWriter, req *http.Request, runtime workload.Runtime, wl *workload.Workload) {
+	log := logr.FromContextOrDiscard(ctx)
+
+	execer, ok := runtime.(workload.Execer)
+	if !ok {
+		http.Error(w, "this workload's runtime can't exec", http.StatusNotImplemented)
+		return
+	}
+	if !strings.EqualFold(req.Header.Get("Upgrade"), execUpgrade) {
+		http.Error(w, "exec needs Upgrade: "+execUpgrade, http.StatusUpgradeRequired)
+		return
+	}
+	query := req.URL.Query()
+	service := query.Get("service")
+	cmd := query["cmd"]
+	if service == "" || len(cmd) == 0 {
+		http.Error(w, "service and cmd are required", http.StatusBadRequest)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "connection can't be hijacked", http.StatusInternalServerError)
+		return
+	}
+	conn, buffered, err := hijacker.Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: %s\r\n\r\n", execUpgrade)
+
+	var in io.Reader
+	if query.Get("stdin") == "true" {
+		// the client may have sent stdin along with the request
+		in = buffered
+	}
+	tty := query.Get("tty") == "true"
+	errOut := io.Writer(conn)
+	if !tty {
+		errOut = stdcopy.NewStdWriter(conn, stdcopy.Stderr)
+	}
+
+	log.Info("Exec in workload", "name", wl.Name, "service", service, "cmd", cmd)
+	// the request's context isn't tied to the hijacked connection, so use the agent's
+	if err := execer.Exec(ctx, wl, service, cmd, tty, in, conn); err != nil {
+		log.Error(err, "Exec failed", "name", wl.Name, "service", service)
+		fmt.Fprintf(errOut, "exec failed: %s\r\n", err)
+	}
+}
+
+// flushWriter sends each write to the client straight away, for following logs
+type flushWriter struct {
+	w       io.Writer
+	flusher http.Flusher
+}
+
+func newFlushWriter(w http.ResponseWriter) io.Writer {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return w
+	}
+	return &flushWriter{w: w, flusher: flusher}
+}
+
+func (f *flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	f.flusher.Flush()
+	return n, err
+}
@@ -0,0 +1,107 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	gagliardetto "github.com/gagliardetto/solana-go"
+	"github.com/go-logr/logr"
+	"github.com/workbenchapp/worknet/daoctl/lib/solana/anchor/generated/worknet"
+	"github.com/workbenchapp/worknet/daoctl/lib/workgroup"
+	"github.com/workbenchapp/worknet/daoctl/lib/workload"
+)
+
+// the agent's per deployment work dirs, in the WorkNet config dir
+const specWorkDirsPath = "specworkdirs"
+
+// deploymentProjectName is the workload name for one replica of a deployment.
+// Replica 0 keeps the original name so workloads started before replicas were
+// supported aren't restarted.
+func deploymentProjectName(deploymentPDA gagliardetto.PublicKey, replica int) string {
+	// compose/swarm doesn't like long names
+	projectName := "daonetes" + strings.ToLower(deploymentPDA.String()[:16])
+	if replica == 0 {
+		return projectName
+	}
+	return fmt.Sprintf("%s-%d", projectName, replica)
+}
+
+// deployStateKey is the DeviceStatusInfo.DeployState key for one replica of a deployment
+func deployStateKey(deploymentPDA string, replica int) string {
+	if replica == 0 {
+		return deploymentPDA
+	}
+	return fmt.Sprintf("%s-%d", deploymentPDA, replica)
+}
+
+// checkRequirements refuses workloads whose spec asks for more than the device
+// has, or has placement constraints it doesn't meet
+func checkRequirements(w *workload.Workload, capacity workgroup.DeviceCapacity, hostname string) error {
+	if w.WorkType != worknet.WorkTypeDockerCompose {
+		return nil
+	}
+	if _, err := os.Stat(w.SpecPath); err != nil {
+		// not fetched, so it won't be deployed anyway
+		return nil
+	}
+	compose, err := workload.LoadComposeFile(w.SpecPath, w.Env)
+	if err != nil {
+		return err
+	}
+	req, err := compose.Requirements()
+	if err != nil {
+		return err
+	}
+	if err := req.Check(capacity, hostname); err != nil {
+		return fmt.Errorf("can't run on this device: %s", err)
+	}
+	return nil
+}
+
+// countRestarts adds up the restarts of a deployment's services, by docker and by the health checks
+func countRestarts(states []workgroup.DeployState) int {
+	restarts := 0
+	for _, state := range states {
+		restarts += state.RestartCount + state.HealthRestarts
+	}
+	return restarts
+}
+
+// checkHealth runs the health checks of the workloads we've started (restarting
+// the unhealthy ones), and publishes their states for /device and the proxies
+func (r *DaoletCmd) checkHealth(ctx context.Context) {
+	log := logr.FromContextOrDiscard(ctx)
+
+	started, err := r.newReconciler().Started()
+	if err != nil {
+		log.Error(err, "Couldn't read started workloads")
+		return
+	}
+	for _, w := range started {
+		info := currentDeployState(w)
+		if info == nil {
+			// the next reconcile publishes it
+			continue
+		}
+		states, err := r.health.Status(ctx, w)
+		if err != nil {
+			log.V(1).Info("Couldn't get workload status", "name", w.Name, "err", err)
+			continue
+		}
+		var lastErr error
+		if info.LastError != "" {
+			lastErr = errors.New(info.LastError)
+		}
+		now := time.Now()
+		updated := *info
+		updated.States = states
+		updated.Phase = workgroup.PhaseFromStates(states, lastErr)
+		updated.Restarts = countRestarts(states)
+		updated.UpdatedAt = &now
+		workgroup.UpdateDeployState(ctx, "", deployStateKey(w.DeploymentPDA, w.Replica), updated)
+	}
+}
@@ -2,7 +2,11 @@ package cmd
 
 import (
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
 	"os"
+	"strings"
 	"text/tabwriter"
 
 	bin "github.com/gagliardetto/binary"
@@ -22,9 +26,75 @@ type DeviceCmdRegisterCmd struct {
 type DeviceCmd struct {
 	List     DeviceCmdListCmd     `cmd:"" default:"1" help:"List registered devices"`
 	Register DeviceCmdRegisterCmd `cmd:"" help:"Register device"`
+	Cordon   DeviceCmdCordonCmd   `cmd:"" help:"Stop a device from taking on new work"`
+	Uncordon DeviceCmdUncordonCmd `cmd:"" help:"Let a cordoned device take on new work again"`
+	Drain    DeviceCmdDrainCmd    `cmd:"" help:"Cordon a device, stop its workloads, and hand their tokens back for rescheduling"`
 	// transfer device
 }
 
+// DeviceLifecycleOptions picks the device, the agent on it does the work as only it can update its account
+type DeviceLifecycleOptions struct {
+	Device string `arg:"" optional:"" default:"localhost" help:"Hostname or device authority of the device (default this one)"`
+	Node   string `help:"Agent to send the request through (it forwards over the mesh)" default:"localhost" yaml:"node"`
+}
+
+type DeviceCmdCordonCmd struct {
+	DeviceLifecycleOptions
+}
+type DeviceCmdUncordonCmd struct {
+	DeviceLifecycleOptions
+}
+type DeviceCmdDrainCmd struct {
+	DeviceLifecycleOptions
+}
+
+func (r *DeviceCmdCordonCmd) Run(gOpts *options.GlobalOptions) error {
+	return r.request(gOpts, lifecycleCordon)
+}
+
+func (r *DeviceCmdUncordonCmd) Run(gOpts *options.GlobalOptions) error {
+	return r.request(gOpts, lifecycleUncordon)
+}
+
+func (r *DeviceCmdDrainCmd) Run(gOpts *options.GlobalOptions) error {
+	if err := r.request(gOpts, lifecycleDrain); err != nil {
+		return err
+	}
+	fmt.Println("Workloads are stopped, and their tokens handed back, on the agent's next pass - see `daoctl info --show deployments`")
+	return nil
+}
+
+// request asks the device's agent to do action, signed by the --key-file
+// wallet, which has to be the device's authority or (with --smart-wallet)
+// the workgroup's
+func (r *DeviceLifecycleOptions) request(gOpts *options.GlobalOptions, action string) error {
+	_, authority, err := findDevice(r.Node, r.Device)
+	if err != nil {
+		return err
+	}
+	query := url.Values{}
+	query.Set("action", action)
+	query.Set("proxy", r.Device)
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("http://%s:9495%s?%s", r.Node, deviceLifecycleAPIPath, query.Encode()), nil)
+	if err != nil {
+		return err
+	}
+	if err := signAPIRequest(gOpts, req, nil, authority); err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("couldn't reach the agent: %s", err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s failed (%s): %s", action, r.Device, resp.Status, strings.TrimSpace(string(body)))
+	}
+	fmt.Printf("%s: %s", r.Device, body)
+	return nil
+}
+
 func (r *DeviceCmdListCmd) Run(gOpts *options.GlobalOptions) error {
 	ctx := gOpts.Ctx
 
@@ -0,0 +1,255 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	gagliardetto "github.com/gagliardetto/solana-go"
+	"github.com/gagliardetto/solana-go/programs/token"
+	gagliardettorpc "github.com/gagliardetto/solana-go/rpc"
+	sendandconfirmtransaction "github.com/gagliardetto/solana-go/rpc/sendAndConfirmTransaction"
+	gagliardettorws "github.com/gagliardetto/solana-go/rpc/ws"
+	"github.com/go-logr/logr"
+	"github.com/portto/solana-go-sdk/types"
+	"github.com/workbenchapp/worknet/daoctl/lib/agentstate"
+	"github.com/workbenchapp/worknet/daoctl/lib/options"
+	"github.com/workbenchapp/worknet/daoctl/lib/proxy"
+	"github.com/workbenchapp/worknet/daoctl/lib/solana/anchor/generated/worknet"
+)
+
+// What `daoctl device cordon|uncordon|drain` asks the agent to do. Only the
+// device can change its own status on chain, so the agent does it.
+const (
+	// lifecycleCordon sets the device Cordoned, it keeps what it runs, but doesn't start anything new
+	lifecycleCordon = "cordon"
+	// lifecycleUncordon sets the device back to Registered
+	lifecycleUncordon = "uncordon"
+	// lifecycleDrain cordons the device, stops its workloads, and then hands their
+	// tokens back to the deployments so the scheduler can put them somewhere else
+	lifecycleDrain = "drain"
+
+	deviceLifecycleAPIPath = "/device/lifecycle"
+)
+
+type lifecycleRequest struct {
+	action string
+	reply  chan error
+}
+
+// lifecycleState is what the chain doesn't record, kept so a drain carries on after a restart
+type lifecycleState struct {
+	Draining       bool       `json:"draining"`
+	DrainStartedAt *time.Time `json:"drain_started_at,omitempty"`
+}
+
+const lifecycleStateKey = "local"
+
+// heldTokens is a token account of ours, and where its tokens go back to when draining
+type heldTokens struct {
+	account          gagliardetto.PublicKey
+	deploymentTokens gagliardetto.PublicKey
+	amount           uint64
+	deploymentName   string
+}
+
+// addDeviceLifecycleHandler serves POST /device/lifecycle?action=cordon|uncordon|drain,
+// ?proxy=<hostname> forwards it to that device over the mesh. It has to be signed
+// by the device's authority or the workgroup's, the signature headers also mean
+// a browser can't send it without a preflight, which the route doesn't answer.
+func (r *DaoletCmd) addDeviceLifecycleHandler(ctx context.Context, auth *apiAuth) {
+	log := logr.FromContextOrDiscard(ctx)
+
+	proxy.AddPrivateAPIHandler(deviceLifecycleAPIPath, func(w http.ResponseWriter, req *http.Request) {
+		if proxyDevice := req.URL.Query().Get("proxy"); proxyDevice != "" && proxyDevice != "localhost" {
+			log.V(2).Info("proxying lifecycle request", "proxy", proxyDevice)
+			proxy.ForwardToDevice(w, req, proxyDevice)
+			return
+		}
+		if req.Method != http.MethodPost {
+			http.Error(w, "use POST", http.StatusMethodNotAllowed)
+			return
+		}
+		action := req.URL.Query().Get("action")
+		switch action {
+		case lifecycleCordon, lifecycleUncordon, lifecycleDrain:
+		default:
+			http.Error(w, fmt.Sprintf("unknown action %q", action), http.StatusBadRequest)
+			return
+		}
+		_, signed, ok := auth.authorize(w, req, apiAuthDevice|apiAuthWorkgroup)
+		if !ok {
+			return
+		}
+		log.Info("Device lifecycle request", "action", action, "signer", signed.Signer)
+
+		// the main loop owns the device account, so it does the work
+		request := lifecycleRequest{action: action, reply: make(chan error, 1)}
+		select {
+		case r.lifecycle <- request:
+		case <-req.Context().Done():
+			return
+		}
+		select {
+		case err := <-request.reply:
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			fmt.Fprintf(w, "%s done\n", action)
+		case <-req.Context().Done():
+		}
+	})
+}
+
+// handleLifecycle changes the device's status on chain, and starts or stops draining
+func (r *DaoletCmd) handleLifecycle(
+	ctx context.Context,
+	client *gagliardettorpc.Client,
+	device *worknet.Device,
+	ourWallet *types.Account,
+	deviceInfoKey gagliardetto.PublicKey,
+	action string,
+) error {
+	log := logr.FromContextOrDiscard(ctx)
+	log.Info("Device lifecycle change requested", "action", action, "status", device.Status)
+
+	status := worknet.DeviceStatusCordoned
+	state := lifecycleState{}
+	switch action {
+	case lifecycleUncordon:
+		status = worknet.DeviceStatusRegistered
+	case lifecycleDrain:
+		now := time.Now()
+		state = lifecycleState{Draining: true, DrainStartedAt: &now}
+	}
+
+	if device.Status != status {
+		if err := setDeviceStatus(ctx, client, device, ourWallet, deviceInfoKey, status); err != nil {
+			return fmt.Errorf("couldn't set device %s: %s", status, err)
+		}
+		if err := refreshDevice(ctx, client, deviceInfoKey, device); err != nil {
+			// the watcher will catch up
+			log.Error(err, "Couldn't refresh device account", "devicePDA", deviceInfoKey)
+			device.Status = status
+		}
+	}
+	return r.saveLifecycle(state)
+}
+
+func (r *DaoletCmd) loadLifecycle() lifecycleState {
+	state := lifecycleState{}
+	if r.state == nil {
+		return state
+	}
+	// a bad record just means we're not draining
+	r.state.Get(agentstate.Lifecycle, lifecycleStateKey, &state)
+	return state
+}
+
+func (r *DaoletCmd) saveLifecycle(state lifecycleState) error {
+	if r.state == nil {
+		return nil
+	}
+	if err := r.state.Put(agentstate.Lifecycle, lifecycleStateKey, state); err != nil {
+		return fmt.Errorf("couldn't save lifecycle state: %s", err)
+	}
+	return nil
+}
+
+// finishDrain hands the tokens we hold back to their deployments, once our workloads have stopped
+func (r *DaoletCmd) finishDrain(
+	ctx context.Context,
+	client *gagliardettorpc.Client,
+	ourWallet *types.Account,
+	held []heldTokens,
+) error {
+	log := logr.FromContextOrDiscard(ctx)
+	devicePubKey := gagliardetto.PublicKeyFromBytes(ourWallet.PublicKey.Bytes())
+
+	insts := []gagliardetto.Instruction{}
+	for _, h := range held {
+		log.Info("Returning deployment tokens", "deployment", h.deploymentName, "tokenAccount", h.account, "amount", h.amount)
+		inst, err := token.NewTransferInstruction(
+			h.amount,
+			h.account,
+			h.deploymentTokens,
+			devicePubKey,
+			[]gagliardetto.PublicKey{},
+		).ValidateAndBuild()
+		if err != nil {
+			return err
+		}
+		insts = append(insts, inst)
+	}
+	if len(insts) > 0 {
+		if err := sendDeviceTransaction(ctx, client, ourWallet, insts); err != nil {
+			return fmt.Errorf("couldn't return deployment tokens: %s", err)
+		}
+	}
+	log.Info("Device drained")
+	return r.saveLifecycle(lifecycleState{})
+}
+
+// setDeviceStatus updates our device account with status, keeping everything else
+func setDeviceStatus(
+	ctx context.Context,
+	client *gagliardettorpc.Client,
+	device *worknet.Device,
+	ourWallet *types.Account,
+	deviceInfoKey gagliardetto.PublicKey,
+	status worknet.DeviceStatus,
+) error {
+	updateDeviceInst, err := worknet.NewUpdateDeviceInstruction(
+		device.Ipv4,
+		device.Hostname,
+		device.Bump,
+		status,
+		gagliardetto.PublicKeyFromBytes(ourWallet.PublicKey.Bytes()),
+		deviceInfoKey,
+	).ValidateAndBuild()
+	if err != nil {
+		return err
+	}
+	return sendDeviceTransaction(ctx, client, ourWallet, []gagliardetto.Instruction{updateDeviceInst})
+}
+
+// sendDeviceTransaction sends instructions signed (and paid for) by the device
+func sendDeviceTransaction(
+	ctx context.Context,
+	client *gagliardettorpc.Client,
+	ourWallet *types.Account,
+	insts []gagliardetto.Instruction,
+) error {
+	wsClient, err := gagliardettorws.Connect(ctx, options.SolanaCluster(ctx).WS)
+	if err != nil {
+		return err
+	}
+	defer wsClient.Close()
+
+	blockHash, err := client.GetRecentBlockhash(ctx, gagliardettorpc.CommitmentFinalized)
+	if err != nil {
+		return err
+	}
+
+	txn, err := gagliardetto.NewTransaction(insts, blockHash.Value.Blockhash)
+	if err != nil {
+		return err
+	}
+
+	_, err = txn.Sign(func(key gagliardetto.PublicKey) *gagliardetto.PrivateKey {
+		return (*gagliardetto.PrivateKey)(&ourWallet.PrivateKey)
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = sendandconfirmtransaction.SendAndConfirmTransaction(
+		ctx,
+		client,
+		wsClient,
+		txn,
+	)
+	return err
+}
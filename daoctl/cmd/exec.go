@@ -0,0 +1,102 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/workbenchapp/worknet/daoctl/lib/options"
+	"golang.org/x/term"
+)
+
+type ExecCmd struct {
+	Deployment  string   `arg:"" help:"Deployment name or PDA"`
+	Service     string   `arg:"" help:"Service in the deployment's spec to run the command in"`
+	Command     []string `arg:"" passthrough:"" help:"Command to run, after --"`
+	Device      string   `help:"Hostname or device authority of the device running the deployment (default: this one)" yaml:"device"`
+	Replica     int      `help:"Which replica of the deployment" default:"0" yaml:"replica"`
+	Interactive bool     `help:"Send stdin to the command" short:"i" yaml:"interactive"`
+	TTY         bool     `help:"Give the command a terminal" short:"t" name:"tty" yaml:"tty"`
+}
+
+func (r *ExecCmd) Run(gOpts *options.GlobalOptions) error {
+	command := r.Command
+	if len(command) > 0 && command[0] == "--" {
+		command = command[1:]
+	}
+	if len(command) == 0 {
+		return fmt.Errorf("no command given, e.g. daoctl exec %s %s -- sh", r.Deployment, r.Service)
+	}
+
+	address, authority, err := findDevice("localhost", r.Device)
+	if err != nil {
+		return err
+	}
+	conn, err := (&net.Dialer{}).DialContext(gOpts.Ctx, "tcp", address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	U := url.URL{
+		Path: "/deployments/" + url.PathEscape(r.Deployment) + "/exec",
+		RawQuery: url.Values{
+			"service": []string{r.Service},
+			"cmd":     command,
+			"replica": []string{strconv.Itoa(r.Replica)},
+			"stdin":   []string{strconv.FormatBool(r.Interactive)},
+			"tty":     []string{strconv.FormatBool(r.TTY)},
+		}.Encode(),
+	}
+	req, err := http.NewRequest(http.MethodPost, U.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Host = address
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", execUpgrade)
+	if err := signAPIRequest(gOpts, req, nil, authority); err != nil {
+		return err
+	}
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return fmt.Errorf("%s: %s", resp.Status, body)
+	}
+
+	if r.TTY && term.IsTerminal(int(os.Stdin.Fd())) {
+		oldState, err := term.MakeRaw(int(os.Stdin.Fd()))
+		if err != nil {
+			return err
+		}
+		defer term.Restore(int(os.Stdin.Fd()), oldState)
+	}
+	if r.Interactive {
+		// TODO: there's no way to tell the command stdin is done without closing
+		// our side, which the mesh forwarding takes as the end of the whole exec
+		go io.Copy(conn, os.Stdin)
+	}
+
+	if r.TTY {
+		_, err = io.Copy(os.Stdout, reader)
+	} else {
+		_, err = stdcopy.StdCopy(os.Stdout, os.Stderr, reader)
+	}
+	return err
+}
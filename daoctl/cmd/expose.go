@@ -14,7 +14,7 @@ import (
 
 type ExposeCmd struct {
 	Port     int    `help:"Port to expose"`
-	Protocol string `help:"Protocol type to expose (tcp, http)" default:"tcp"`
+	Protocol string `help:"Protocol type to expose (tcp, udp, http)" default:"tcp"`
 	Driver   string `help:"Expose all local ports from Docker or Kubernetes instead of a specific port" default:"none"`
 	Name     string `help:"Name of the service"`
 
@@ -51,13 +51,13 @@ func (r *ExposeCmd) Run(gOpts *options.GlobalOptions) error {
 	}
 
 	validProtocol := false
-	for _, exposeType := range []string{"tcp", "http"} {
+	for _, exposeType := range []string{"tcp", "udp", "http"} {
 		if r.Protocol == exposeType {
 			validProtocol = true
 		}
 	}
 	if !validProtocol {
-		return fmt.Errorf("invalid protocol type: %q (supported: tcp, http)", r.Protocol)
+		return fmt.Errorf("invalid protocol type: %q (supported: tcp, udp, http)", r.Protocol)
 	}
 
 	if r.Port != 0 {
@@ -77,6 +77,9 @@ func (r *ExposeCmd) Run(gOpts *options.GlobalOptions) error {
 			Protocol:      r.Protocol,
 			Name:          r.Name,
 		})
+		if r.Protocol == "http" {
+			log.Info("HTTP services are also routed by name by each agent's ingress", "name", r.Name+".<device hostname>.dmesh")
+		}
 	} else {
 		validDriver := false
 		for _, driverType := range []string{"docker", "kubernetes"} {
@@ -105,7 +108,7 @@ func (r *ExposeCmd) Run(gOpts *options.GlobalOptions) error {
 
 			for _, container := range containers {
 				for _, port := range container.Ports {
-					if port.PublicPort == 0 || port.Type != "tcp" {
+					if port.PublicPort == 0 || (port.Type != "tcp" && port.Type != "udp") {
 						continue
 					}
 
@@ -115,7 +118,7 @@ func (r *ExposeCmd) Run(gOpts *options.GlobalOptions) error {
 						// remove leading slash
 						Name:     "docker-" + strings.Replace(container.Names[0][1:], "_", "-", -1),
 						URL:      "0.0.0.0",
-						Protocol: "tcp",
+						Protocol: port.Type,
 					})
 				}
 			}
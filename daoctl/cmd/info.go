@@ -5,19 +5,21 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"sort"
 	"time"
 
 	"github.com/davecgh/go-spew/spew"
 	"github.com/workbenchapp/worknet/daoctl/lib/options"
 	"github.com/workbenchapp/worknet/daoctl/lib/proxy"
+	"github.com/workbenchapp/worknet/daoctl/lib/solana/anchor/generated/worknet"
 	"github.com/workbenchapp/worknet/daoctl/lib/workgroup"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
 type InfoCmd struct {
 	Format string `help:"Output format: [default, json, spew]" default:"default" yaml:"format"`
-	Show   string `help:"Show info about: [device, network]" default:"network" yaml:"show"`
+	Show   string `help:"Show info about: [device, network, deployments]" default:"network" yaml:"show"`
 	Node   string `help:"request network infor from selected node (use 127.1.0.x)" default:"localhost" yaml:"Node"`
 }
 
@@ -38,6 +40,17 @@ func (r *InfoCmd) Run(gOpts *options.GlobalOptions) error {
 	case "device":
 		fmt.Printf("Device info:\n\n") // From Solana - this assumes we have access to the on disk device wallet, and other crimes.
 		result, err = workgroup.GetDeviceInfo(ctx)
+	case "deployments":
+		status, err := getDeviceStatus(r.Node)
+		if err != nil {
+			fmt.Printf("ERROR: %s\n", err)
+			return err
+		}
+		if r.Format == "default" {
+			printDeployments(status)
+			return nil
+		}
+		result = status
 	case "network":
 		// TODO: iterate through all nodes, and show who's connected to whom
 		url := fmt.Sprintf("http://%s:9495/wireguard", r.Node)
@@ -183,3 +196,94 @@ func (r *InfoCmd) Run(gOpts *options.GlobalOptions) error {
 
 	return nil
 }
+
+func getDeviceStatus(node string) (*workgroup.DeviceStatusInfo, error) {
+	return getProxiedDeviceStatus(node, "")
+}
+
+// getProxiedDeviceStatus asks node for the status of another device (by hostname), which it gets over the mesh
+func getProxiedDeviceStatus(node, hostname string) (*workgroup.DeviceStatusInfo, error) {
+	resp, err := http.Get(fmt.Sprintf("http://%s:9495/device?proxy=%s", node, url.QueryEscape(hostname)))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("%s: %s", resp.Status, body)
+	}
+	status := &workgroup.DeviceStatusInfo{}
+	if err := json.Unmarshal(body, status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+func printDeployments(status *workgroup.DeviceStatusInfo) {
+	capacity := status.Capacity
+	fmt.Printf("Device %s: %d cpus, %.1f GiB memory, %.1f GiB disk free, %d gpus, %s/%s\n",
+		status.DeviceInfo.Hostname, capacity.CPUs,
+		float64(capacity.MemoryBytes)/(1<<30), float64(capacity.DiskBytes)/(1<<30),
+		capacity.GPUs, capacity.OS, capacity.Arch,
+	)
+	switch {
+	case status.Draining:
+		fmt.Printf("Device is draining, its workloads are stopping and their tokens going back\n")
+	case status.DeviceInfo.Status == worknet.DeviceStatusCordoned:
+		fmt.Printf("Device is cordoned, it won't start any new workloads\n")
+	case workgroup.IsDelinquent(status):
+		fmt.Printf("Device is delinquent, last seen %s\n", status.LastSeen)
+	}
+	fmt.Printf("Deployments on %s:\n\n", status.DeviceInfo.Hostname)
+
+	keys := make([]string, 0)
+	for key, info := range status.DeployState {
+		if key == "local" && info.Phase == "" {
+			continue // the agent config's ports, not a deployment
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		info := status.DeployState[key]
+		fmt.Printf("  %s (replica %d)\n", info.Deployment.Name, info.Replica)
+		fmt.Printf("    Phase:\t%s\n", info.Phase)
+		fmt.Printf("    Spec:\t%s\n", info.Spec.Name)
+		fmt.Printf("    Restarts:\t%d\n", info.Restarts)
+		if info.DeployedAt != nil {
+			fmt.Printf("    Deployed:\t%s ago\n", time.Since(*info.DeployedAt).Round(time.Second))
+		}
+		if info.UpdatedAt != nil {
+			fmt.Printf("    Updated:\t%s ago\n", time.Since(*info.UpdatedAt).Round(time.Second))
+		}
+		if info.LastError != "" {
+			since := ""
+			if info.LastErrorAt != nil {
+				since = fmt.Sprintf(" (since %s ago)", time.Since(*info.LastErrorAt).Round(time.Second))
+			}
+			fmt.Printf("    Error:\t%s%s\n", info.LastError, since)
+		}
+		for _, pull := range info.Pulls {
+			switch {
+			case pull.Status == workgroup.PullPulled:
+				continue
+			case pull.Error != "":
+				fmt.Printf("    Pull:\t%s %s: %s\n", pull.Image, pull.Status, pull.Error)
+			case pull.Total > 0:
+				fmt.Printf("    Pull:\t%s %s %.1f/%.1f MiB\n", pull.Image, pull.Status, float64(pull.Current)/(1<<20), float64(pull.Total)/(1<<20))
+			default:
+				fmt.Printf("    Pull:\t%s %s\n", pull.Image, pull.Status)
+			}
+		}
+		for _, state := range info.States {
+			health := ""
+			if state.Health != "" {
+				health = " (" + state.Health + ")"
+			}
+			fmt.Printf("    Service:\t%s %s%s restarts=%d\n", state.Service, state.State, health, state.RestartCount)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"time"
+
+	"github.com/go-logr/logr"
+	serviceimpl "github.com/workbenchapp/worknet/daoctl/cmd/service"
+	"github.com/workbenchapp/worknet/daoctl/lib/networking/dns"
+	netproxy "github.com/workbenchapp/worknet/daoctl/lib/networking/proxy"
+	"github.com/workbenchapp/worknet/daoctl/lib/options"
+	"github.com/workbenchapp/worknet/daoctl/lib/proxy"
+	"github.com/workbenchapp/worknet/daoctl/lib/specstore"
+)
+
+// errConfigRestart is RestartableRun returning because a reloaded config needs a fresh start
+var errConfigRestart = errors.New("config changed, restarting")
+
+// reloadConfig re-reads config.yaml (on SIGHUP) and applies what changed.
+// Changing the active net, or its key, means a different wallet and mesh, so
+// that needs a restart. New ports get picked up by the next pass of the main loop.
+func (r *DaoletCmd) reloadConfig(ctx context.Context) (restart bool, err error) {
+	log := logr.FromContextOrDiscard(ctx)
+
+	newConfig, err := options.Config()
+	if err != nil {
+		return false, err
+	}
+	if err := options.ValidateAgentConfig(newConfig); err != nil {
+		return false, err
+	}
+	oldConfig := r.config
+	oldNet, err := oldConfig.Active()
+	if err != nil {
+		return true, nil
+	}
+	newNet, err := newConfig.Active()
+	if err != nil {
+		return false, err
+	}
+	if newConfig.ActiveNet != oldConfig.ActiveNet || newNet.KeyFile != oldNet.KeyFile {
+		log.Info("Active net changed, restarting", "from", oldConfig.ActiveNet, "to", newConfig.ActiveNet)
+		return true, nil
+	}
+
+	r.config = newConfig
+	if !reflect.DeepEqual(oldNet.Ports, newNet.Ports) {
+		log.Info("Published ports changed", "ports", newNet.Ports)
+	}
+	if !reflect.DeepEqual(oldConfig.FeatureFlags, newConfig.FeatureFlags) {
+		log.Info("Feature flags changed", "flags", newConfig.FeatureFlags)
+		r.updateDNS(ctx)
+	}
+	if !reflect.DeepEqual(oldConfig.Specs, newConfig.Specs) {
+		log.Info("Spec sources changed", "specs", newConfig.Specs)
+		r.specResolver.IPFSGateways = newConfig.Specs.IPFSGateways
+		r.specResolver.ArweaveGateways = newConfig.Specs.ArweaveGateways
+		r.specResolver.Mirrors = newConfig.Specs.Mirrors
+		if len(r.specResolver.IPFSGateways) == 0 {
+			r.specResolver.IPFSGateways = specstore.DefaultIPFSGateways
+		}
+		if len(r.specResolver.ArweaveGateways) == 0 {
+			r.specResolver.ArweaveGateways = specstore.DefaultArweaveGateways
+		}
+	}
+	return false, nil
+}
+
+// updateDNS starts or stops the .dmesh DNS service to match the disabledns feature flag
+func (r *DaoletCmd) updateDNS(ctx context.Context) {
+	log := logr.FromContextOrDiscard(ctx)
+	if !serviceimpl.Admin() {
+		log.Info(".dmesh DNS disabled, not running as root/Admin")
+		return
+	}
+	wanted := !r.featureFlagEnabled("disabledns")
+	switch {
+	case wanted && r.dnsCancel == nil:
+		// TODO: test if we have permission to listen on port 53
+		err := dns.EnsureDNSConfigured()
+		if err != nil {
+			panic(err)
+		}
+		dnsCtx, cancel := context.WithCancel(ctx)
+		r.dnsCancel = cancel
+		go dns.RunDnsService(dnsCtx)
+	case !wanted && r.dnsCancel != nil:
+		r.dnsCancel()
+		r.dnsCancel = nil
+	}
+}
+
+// stopSubsystems finishes shutting down what RestartableRun started, once its
+// context is cancelled. By then the listeners and the API server have stopped
+// taking new connections, so let the proxied ones finish (up to DrainTimeout)
+// before taking down the wireguard device they go over.
+func (r *DaoletCmd) stopSubsystems(ctx context.Context) {
+	log := logr.FromContextOrDiscard(ctx)
+
+	if r.dnsCancel != nil {
+		r.dnsCancel()
+		r.dnsCancel = nil
+	}
+	timeout := time.Duration(r.DrainTimeout) * time.Second
+	log.Info("Draining proxied connections", "timeout", timeout)
+	if !netproxy.Drain(ctx, timeout) {
+		log.Info("Some proxied connections were cut off")
+	}
+	proxy.CloseWireGuard(ctx)
+}
@@ -0,0 +1,93 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+
+	"github.com/workbenchapp/worknet/daoctl/lib/options"
+	"github.com/workbenchapp/worknet/daoctl/lib/proxy"
+)
+
+type LogsCmd struct {
+	Deployment string `arg:"" help:"Deployment name or PDA"`
+	Device     string `help:"Hostname or device authority of the device running the deployment (default: this one)" yaml:"device"`
+	Replica    int    `help:"Which replica of the deployment" default:"0" yaml:"replica"`
+	Follow     bool   `help:"Keep streaming new output" short:"f" yaml:"follow"`
+}
+
+// findDevice asks the agent on node about device, for the host:port of its
+// agent API from there (other devices are reached over the mesh, on the
+// ProxyAddress the agent gave them), and its device authority, which requests
+// to it are signed for
+func findDevice(node, device string) (address, authority string, err error) {
+	resp, err := http.Get(fmt.Sprintf("http://%s:9495/wireguard", node))
+	if err != nil {
+		return "", "", fmt.Errorf("couldn't ask the agent about the mesh: %s", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", "", err
+	}
+	var network proxy.NetworkStatusAPIInfo
+	if err := json.Unmarshal(body, &network); err != nil {
+		return "", "", fmt.Errorf("couldn't decode mesh info (%s): %s", resp.Header.Get("Error"), err)
+	}
+	nodeAddress := fmt.Sprintf("%s:9495", node)
+	if device == "" || device == "localhost" {
+		return nodeAddress, network.DeviceWallet, nil
+	}
+	for _, pDev := range network.ProxyDevices {
+		if pDev.Info == nil {
+			continue
+		}
+		if pDev.Info.Hostname == device || pDev.Info.DeviceAuthority.String() == device {
+			authority := pDev.Info.DeviceAuthority.String()
+			if authority == network.DeviceWallet {
+				return nodeAddress, authority, nil
+			}
+			return fmt.Sprintf("%s:%d", pDev.ProxyAddress, 9495), authority, nil // ALWAYS listen to port 9495 on the wireguard network
+		}
+	}
+	return "", "", fmt.Errorf("no device %q in the workgroup", device)
+}
+
+func (r *LogsCmd) Run(gOpts *options.GlobalOptions) error {
+	address, authority, err := findDevice("localhost", r.Device)
+	if err != nil {
+		return err
+	}
+	U := url.URL{
+		Scheme: "http",
+		Host:   address,
+		Path:   "/deployments/" + url.PathEscape(r.Deployment) + "/logs",
+		RawQuery: url.Values{
+			"follow":  []string{strconv.FormatBool(r.Follow)},
+			"replica": []string{strconv.Itoa(r.Replica)},
+		}.Encode(),
+	}
+	req, err := http.NewRequestWithContext(gOpts.Ctx, http.MethodGet, U.String(), nil)
+	if err != nil {
+		return err
+	}
+	if err := signAPIRequest(gOpts, req, nil, authority); err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, body)
+	}
+	_, err = io.Copy(os.Stdout, resp.Body)
+	return err
+}
@@ -45,11 +45,16 @@ var cli struct {
 	// Commandline options
 	Agent DaoletCmd `cmd:"" help:"Run the Daolet agent (workload runner)"`
 	//Deploy DeployCmd `cmd:"" help:"Manage deployments based on workspecs in the cluster"`
-	//Device DeviceCmd `cmd:"" help:"Inspect and register devices on daonet"`
-	Group GroupCmd `cmd:"" help:"Manage deployed networks"`
+	Device DeviceCmd `cmd:"" help:"Inspect, register, cordon and drain devices on daonet"`
+	Group  GroupCmd  `cmd:"" help:"Manage deployed networks"`
 	//Spec SpecCmd `cmd:"" help:"Define workload specifications on daonet"`
-	Expose ExposeCmd `cmd:"" help:"Expose a local port to the cluster"`
-	Info   InfoCmd   `cmd:"" help:"Inspect daonet info"`
+	Expose    ExposeCmd    `cmd:"" help:"Expose a local port to the cluster"`
+	Info      InfoCmd      `cmd:"" help:"Inspect daonet info"`
+	Logs      LogsCmd      `cmd:"" help:"Show a deployment's logs, on this or another device"`
+	Exec      ExecCmd      `cmd:"" help:"Run a command in a deployment's service, on this or another device"`
+	Scheduler SchedulerCmd `cmd:"" help:"Place deployment replicas onto workgroup devices. Replicas on delinquent or cordoned devices are only replaced from the deployment's unscheduled tokens, and there's no unschedule, so if such a device comes back the extra replicas are reported, not taken back"`
+	Registry  RegistryCmd  `cmd:"" help:"Manage the workgroup's private registry logins on its devices"`
+	Secret    SecretCmd    `cmd:"" help:"Manage the workgroup's secrets on its devices"`
 
 	// OS Service commands
 	Status    StatusServiceCmd    `cmd:"" help:"Status of the Daolet agent OS Service"`
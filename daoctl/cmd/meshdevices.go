@@ -0,0 +1,117 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/workbenchapp/worknet/daoctl/lib/options"
+	"github.com/workbenchapp/worknet/daoctl/lib/solana"
+	"github.com/workbenchapp/worknet/daoctl/lib/solana/anchor/generated/worknet"
+	"github.com/workbenchapp/worknet/daoctl/lib/solana/smartwalletutils"
+)
+
+// MeshDeviceOptions picks devices to send agent API requests to, every device on the mesh by default
+type MeshDeviceOptions struct {
+	Devices []string `help:"Hostnames or device authorities of the devices (default every device in the workgroup)" yaml:"devices"`
+	Node    string   `help:"Agent to send the requests through (it forwards over the mesh)" default:"localhost" yaml:"node"`
+}
+
+// eachDevice calls fn for each of the chosen devices that's on the mesh, with
+// what to set ?proxy= to, and reports how each went
+func (r *MeshDeviceOptions) eachDevice(ctx context.Context, fn func(device worknet.Device, proxyDevice string) error) error {
+	pdas, err := smartwalletutils.SmartWalletAndGroupPDAs(ctx, nil)
+	if err != nil {
+		return err
+	}
+	sender, err := solana.NewTransactionSender(ctx)
+	if err != nil {
+		return fmt.Errorf("couldn't create transaction sender: %s", err)
+	}
+	group, _, err := solana.WorkGroupFromPubKey(ctx, pdas.DerivedWallet.Key)
+	if err != nil {
+		return fmt.Errorf("couldn't get workgroup from pubkey (%s): %s", pdas.DerivedWallet.Key.String(), err)
+	}
+	devices, err := getDevices(ctx, sender, group)
+	if err != nil {
+		return err
+	}
+	// the node answers for itself, it can't proxy to its own hostname
+	localHostname := ""
+	if status, err := getDeviceStatus(r.Node); err == nil {
+		localHostname = status.DeviceInfo.Hostname
+	}
+
+	wanted := map[string]bool{}
+	for _, device := range r.Devices {
+		wanted[device] = true
+	}
+	failed := 0
+	for _, device := range devices {
+		if len(wanted) > 0 && !wanted[device.Hostname] && !wanted[device.DeviceAuthority.String()] {
+			continue
+		}
+		delete(wanted, device.Hostname)
+		delete(wanted, device.DeviceAuthority.String())
+		if device.Status != worknet.DeviceStatusRegistered && device.Status != worknet.DeviceStatusCordoned {
+			fmt.Printf("%s: skipped, device is %s\n", device.Hostname, device.Status)
+			continue
+		}
+		proxyDevice := device.Hostname
+		if proxyDevice == localHostname {
+			proxyDevice = ""
+		}
+		if err := fn(device, proxyDevice); err != nil {
+			fmt.Printf("%s: %s\n", device.Hostname, err)
+			failed++
+		}
+	}
+	for device := range wanted {
+		fmt.Printf("%s: not a device in the workgroup\n", device)
+		failed++
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d devices failed", failed)
+	}
+	return nil
+}
+
+// request sends an agent API request to the device, through the node
+// request sends one device's agent an API request, signed for that device
+func (r *MeshDeviceOptions) request(gOpts *options.GlobalOptions, method string, apiPath string, device worknet.Device, proxyDevice string, query url.Values, body []byte) error {
+	if query == nil {
+		query = url.Values{}
+	}
+	if proxyDevice != "" {
+		query.Set("proxy", proxyDevice)
+	}
+	req, err := http.NewRequest(method, fmt.Sprintf("http://%s:9495%s?%s", r.Node, apiPath, query.Encode()), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if err := signAPIRequest(gOpts, req, body, device.DeviceAuthority.String()); err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("couldn't reach the agent: %s", err)
+	}
+	defer resp.Body.Close()
+	reply, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed (%s): %s", resp.Status, strings.TrimSpace(string(reply)))
+	}
+	name := proxyDevice
+	if name == "" {
+		name = r.Node
+	}
+	fmt.Printf("%s: %s", name, reply)
+	return nil
+}
@@ -0,0 +1,146 @@
+package cmd
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	gagliardetto "github.com/gagliardetto/solana-go"
+	"github.com/workbenchapp/worknet/daoctl/lib/apiauth"
+	"github.com/workbenchapp/worknet/daoctl/lib/options"
+	"github.com/workbenchapp/worknet/daoctl/lib/sealbox"
+	"github.com/workbenchapp/worknet/daoctl/lib/solana/anchor/generated/worknet"
+	"github.com/workbenchapp/worknet/daoctl/lib/workload"
+	"golang.org/x/term"
+)
+
+// RegistryCmd hands the workgroup's devices the logins for private registries,
+// sealed to each device's key, so nobody has to `docker login` on every device
+type RegistryCmd struct {
+	List   RegistryCmdList   `cmd:"" default:"1" help:"List the registries a device has logins for"`
+	Login  RegistryCmdLogin  `cmd:"" help:"Send a registry login to the workgroup's devices"`
+	Logout RegistryCmdLogout `cmd:"" help:"Remove a registry login from the workgroup's devices"`
+}
+
+type RegistryCmdList struct {
+	Device string `arg:"" optional:"" default:"localhost" help:"Hostname of the device (default this one)"`
+	Node   string `help:"Agent to send the request through (it forwards over the mesh)" default:"localhost" yaml:"node"`
+}
+
+type RegistryCmdLogin struct {
+	Registry      string `arg:"" help:"Registry to log in to, eg ghcr.io (docker.io for Docker Hub)"`
+	Username      string `short:"u" required:"" help:"Registry username"`
+	PasswordStdin bool   `help:"Read the password (or token) from stdin"`
+	MeshDeviceOptions
+}
+
+type RegistryCmdLogout struct {
+	Registry string `arg:"" help:"Registry to log out of"`
+	MeshDeviceOptions
+}
+
+func (r *RegistryCmdList) Run(gOpts *options.GlobalOptions) error {
+	query := url.Values{}
+	query.Set("proxy", r.Device)
+	resp, err := http.Get(fmt.Sprintf("http://%s:9495%s?%s", r.Node, registryAuthAPIPath, query.Encode()))
+	if err != nil {
+		return fmt.Errorf("couldn't reach the agent: %s", err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("listing registries on %s failed (%s): %s", r.Device, resp.Status, strings.TrimSpace(string(body)))
+	}
+	registries := []sealedCredential{}
+	if err := json.Unmarshal(body, &registries); err != nil {
+		return fmt.Errorf("couldn't decode registries: %s", err)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 10, 1, 3, ' ', 0)
+	defer tw.Flush()
+	fmt.Fprintln(tw, "REGISTRY\tUPDATED")
+	for _, registry := range registries {
+		fmt.Fprintf(tw, "%s\t%s ago\n", registry.Registry, time.Since(registry.UpdatedAt).Round(time.Second))
+	}
+	return nil
+}
+
+func (r *RegistryCmdLogin) Run(gOpts *options.GlobalOptions) error {
+	password, err := readPassword(r.PasswordStdin)
+	if err != nil {
+		return err
+	}
+	registry := workload.NormalizeRegistry(r.Registry)
+	credential, err := json.Marshal(workload.RegistryCredential{
+		Registry: registry,
+		Username: r.Username,
+		Password: password,
+	})
+	if err != nil {
+		return err
+	}
+	// the devices only take logins from the workgroup authority
+	key, smartWallet, err := apiSigner(gOpts)
+	if err != nil {
+		return err
+	}
+	if smartWallet == nil {
+		return errors.New("registry logins are sent by the workgroup authority, use --smart-wallet")
+	}
+	signer := gagliardetto.PublicKeyFromBytes(key.Public().(ed25519.PublicKey))
+
+	return r.eachDevice(gOpts.Ctx, func(device worknet.Device, proxyDevice string) error {
+		sealed, err := sealbox.Seal(ed25519.PublicKey(device.DeviceAuthority.Bytes()), credential)
+		if err != nil {
+			return err
+		}
+		body, err := json.Marshal(sealedCredential{
+			Registry:    registry,
+			Sealed:      sealed,
+			Signer:      signer.String(),
+			SmartWallet: smartWallet.String(),
+			Signature:   apiauth.SignPayload(key, credentialPayloadKind, []byte(registry), sealed),
+		})
+		if err != nil {
+			return err
+		}
+		return r.request(gOpts, http.MethodPost, registryAuthAPIPath, device, proxyDevice, nil, body)
+	})
+}
+
+func (r *RegistryCmdLogout) Run(gOpts *options.GlobalOptions) error {
+	query := url.Values{}
+	query.Set("registry", workload.NormalizeRegistry(r.Registry))
+	return r.eachDevice(gOpts.Ctx, func(device worknet.Device, proxyDevice string) error {
+		return r.request(gOpts, http.MethodDelete, registryAuthAPIPath, device, proxyDevice, query, nil)
+	})
+}
+
+// readPassword reads the password from stdin, or prompts for it on a terminal
+func readPassword(fromStdin bool) (string, error) {
+	if fromStdin {
+		data, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return "", fmt.Errorf("couldn't read password: %s", err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return "", fmt.Errorf("no terminal to ask for the password on, use --password-stdin")
+	}
+	fmt.Fprint(os.Stderr, "Password: ")
+	data, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", fmt.Errorf("couldn't read password: %s", err)
+	}
+	return string(data), nil
+}
@@ -0,0 +1,185 @@
+package cmd
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/workbenchapp/worknet/daoctl/lib/agentstate"
+	"github.com/workbenchapp/worknet/daoctl/lib/apiauth"
+	"github.com/workbenchapp/worknet/daoctl/lib/proxy"
+	"github.com/workbenchapp/worknet/daoctl/lib/sealbox"
+	"github.com/workbenchapp/worknet/daoctl/lib/solana/anchor/generated/worknet"
+	"github.com/workbenchapp/worknet/daoctl/lib/workload"
+)
+
+// registryAuthAPIPath is where `daoctl registry` sends a device its workgroup's registry logins
+const registryAuthAPIPath = "/registry/auth"
+
+// maxRegistryAuthSize is plenty for a username and a token
+const maxRegistryAuthSize = 64 * 1024
+
+// sealedCredential is a workload.RegistryCredential as JSON, sealed to the device's
+// key by whoever sent it, and kept that way until a pull needs it
+type sealedCredential struct {
+	Registry  string    `json:"registry"`
+	Sealed    []byte    `json:"sealed"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// Signer signed the registry and the sealed credential, as an owner of
+	// SmartWallet, the smart wallet the workgroup authority is derived from
+	Signer      string `json:"signer,omitempty"`
+	SmartWallet string `json:"smart_wallet,omitempty"`
+	Signature   []byte `json:"signature,omitempty"`
+}
+
+// credentialPayloadKind is what sealedCredential signatures are for, see apiauth.SignPayload
+const credentialPayloadKind = "registry-credential"
+
+// verifyCredential checks the credential was signed by who signed the request adding it
+func verifyCredential(sealed sealedCredential, signed *apiauth.Signed) error {
+	if signed.SmartWallet == nil || sealed.Signer != signed.Signer.String() || sealed.SmartWallet != signed.SmartWallet.String() {
+		return errors.New("credential isn't signed by the workgroup authority sending it")
+	}
+	if !apiauth.VerifyPayload(signed.Signer, sealed.Signature, credentialPayloadKind, []byte(sealed.Registry), sealed.Sealed) {
+		return errors.New("bad credential signature")
+	}
+	return nil
+}
+
+// registryCredentials are the logins our workgroup sent us, for the runtimes' pulls
+type registryCredentials struct {
+	r      *DaoletCmd
+	device *worknet.Device
+	key    ed25519.PrivateKey
+}
+
+func registryAuthKey(workGroup, registry string) string {
+	return workGroup + "/" + registry
+}
+
+func (c *registryCredentials) Credential(registry string) (*workload.RegistryCredential, error) {
+	if c.r.state == nil {
+		return nil, nil
+	}
+	sealed := sealedCredential{}
+	found, err := c.r.state.Get(agentstate.RegistryAuth, registryAuthKey(c.device.WorkGroup.String(), registry), &sealed)
+	if err != nil || !found {
+		return nil, err
+	}
+	return openCredential(c.key, sealed)
+}
+
+func openCredential(key ed25519.PrivateKey, sealed sealedCredential) (*workload.RegistryCredential, error) {
+	data, err := sealbox.Open(key, sealed.Sealed)
+	if err != nil {
+		return nil, err
+	}
+	credential := &workload.RegistryCredential{}
+	if err := json.Unmarshal(data, credential); err != nil {
+		return nil, fmt.Errorf("couldn't decode credential: %s", err)
+	}
+	if credential.Registry != sealed.Registry {
+		return nil, fmt.Errorf("credential is for %s, not %s", credential.Registry, sealed.Registry)
+	}
+	return credential, nil
+}
+
+// addRegistryAuthHandler serves /registry/auth, POST a sealedCredential to add or
+// replace a login, DELETE ?registry= to remove one, GET lists the registries we
+// have logins for. ?proxy=<hostname> forwards it to that device over the mesh.
+// Adding and removing them has to be signed by the workgroup authority, and
+// the logins it adds are signed by it too. That's an owner of a smart wallet
+// with a threshold of 1, see apiAuthWorkgroup.
+func (r *DaoletCmd) addRegistryAuthHandler(ctx context.Context, auth *apiAuth, device *worknet.Device, key ed25519.PrivateKey) {
+	log := logr.FromContextOrDiscard(ctx)
+
+	proxy.AddPrivateAPIHandler(registryAuthAPIPath, func(w http.ResponseWriter, req *http.Request) {
+		if proxyDevice := req.URL.Query().Get("proxy"); proxyDevice != "" && proxyDevice != "localhost" {
+			log.V(2).Info("proxying registry auth request", "proxy", proxyDevice)
+			proxy.ForwardToDevice(w, req, proxyDevice)
+			return
+		}
+		if r.state == nil {
+			http.Error(w, "no agent state db", http.StatusServiceUnavailable)
+			return
+		}
+		workGroup := device.WorkGroup.String()
+
+		switch req.Method {
+		case http.MethodGet:
+			registries := []sealedCredential{}
+			err := r.state.ForEach(agentstate.RegistryAuth, func(key string, data []byte) error {
+				sealed := sealedCredential{}
+				if err := json.Unmarshal(data, &sealed); err != nil {
+					return err
+				}
+				if key != registryAuthKey(workGroup, sealed.Registry) {
+					// another workgroup's
+					return nil
+				}
+				// no need to send it back out
+				sealed.Sealed = nil
+				registries = append(registries, sealed)
+				return nil
+			})
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(registries)
+		case http.MethodPost:
+			if !requireJSON(w, req) {
+				return
+			}
+			body, signed, ok := auth.authorize(w, req, apiAuthWorkgroup)
+			if !ok {
+				return
+			}
+			if len(body) > maxRegistryAuthSize {
+				http.Error(w, "credential too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			sealed := sealedCredential{}
+			if err := json.Unmarshal(body, &sealed); err != nil {
+				http.Error(w, fmt.Sprintf("couldn't decode credential: %s", err), http.StatusBadRequest)
+				return
+			}
+			if err := verifyCredential(sealed, signed); err != nil {
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+			// make sure it's for us now, rather than at the next pull
+			if _, err := openCredential(key, sealed); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			sealed.UpdatedAt = time.Now()
+			if err := r.state.Put(agentstate.RegistryAuth, registryAuthKey(workGroup, sealed.Registry), sealed); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			log.Info("Registry login added", "registry", sealed.Registry, "signer", sealed.Signer)
+			fmt.Fprintf(w, "logged in to %s\n", sealed.Registry)
+		case http.MethodDelete:
+			_, signed, ok := auth.authorize(w, req, apiAuthWorkgroup)
+			if !ok {
+				return
+			}
+			registry := req.URL.Query().Get("registry")
+			if err := r.state.Delete(agentstate.RegistryAuth, registryAuthKey(workGroup, registry)); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			log.Info("Registry login removed", "registry", registry, "signer", signed.Signer)
+			fmt.Fprintf(w, "logged out of %s\n", registry)
+		default:
+			http.Error(w, "use GET, POST or DELETE", http.StatusMethodNotAllowed)
+		}
+	})
+}
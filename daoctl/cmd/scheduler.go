@@ -0,0 +1,390 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"time"
+
+	bin "github.com/gagliardetto/binary"
+	gagliardetto "github.com/gagliardetto/solana-go"
+	"github.com/gagliardetto/solana-go/programs/token"
+	"github.com/go-logr/logr"
+	"github.com/workbenchapp/worknet/daoctl/lib/options"
+	"github.com/workbenchapp/worknet/daoctl/lib/scheduler"
+	"github.com/workbenchapp/worknet/daoctl/lib/solana"
+	"github.com/workbenchapp/worknet/daoctl/lib/solana/anchor/generated/worknet"
+	"github.com/workbenchapp/worknet/daoctl/lib/solana/smartwalletutils"
+	"github.com/workbenchapp/worknet/daoctl/lib/specstore"
+	"github.com/workbenchapp/worknet/daoctl/lib/workgroup"
+	"github.com/workbenchapp/worknet/daoctl/lib/workload"
+)
+
+// SchedulerCmd hands out deployment tokens to devices, so `deploy schedule` doesn't need doing by hand.
+// TODO: there's no unschedule instruction, so replicas on Delinquent / Cordoned devices only get
+// replaced from the deployment's unscheduled tokens - anything else is reported as short, and a
+// device that comes back after its replicas were replaced leaves the deployment over-replicated,
+// which is only reported (see the command's help in main.go)
+type SchedulerCmd struct {
+	Strategy string `help:"How to place replicas: [spread, binpack]" enum:"spread,binpack" default:"spread" yaml:"strategy"`
+	Interval uint   `help:"Seconds between scheduling passes" default:"60" yaml:"interval"`
+	Node     string `help:"Agent to ask for device status (it forwards over the mesh)" default:"localhost" yaml:"node"`
+	Grace    uint   `help:"Seconds a device has to be unreachable or delinquent before its replicas are placed elsewhere, counted from when the scheduler first sees it (so --once only replaces them with --grace 0)" default:"300" yaml:"grace"`
+	DryRun   bool   `help:"Only show where replicas would go" yaml:"dry-run"`
+	Once     bool   `help:"Do one scheduling pass and exit" yaml:"once"`
+
+	// when each device (by authority) was first seen unreachable or delinquent
+	missingSince map[string]time.Time
+}
+
+func (r *SchedulerCmd) Run(gOpts *options.GlobalOptions) error {
+	ctx := gOpts.Ctx
+	log := logr.FromContextOrDiscard(ctx)
+
+	agentConfig, err := options.Config()
+	if err != nil {
+		return fmt.Errorf("couldn't read agent config: %s", err)
+	}
+	// same limits the agent uses
+	resolver, err := openSpecResolver(agentConfig, 60*time.Second, 10*1024*1024)
+	if err != nil {
+		return fmt.Errorf("couldn't open spec store: %s", err)
+	}
+
+	r.missingSince = make(map[string]time.Time)
+	for {
+		if err := r.schedule(ctx, gOpts, resolver); err != nil {
+			if r.Once {
+				return err
+			}
+			log.Error(err, "scheduling pass failed")
+		}
+		if r.Once {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(time.Duration(r.Interval) * time.Second):
+		}
+	}
+}
+
+// schedule does one pass: work out where unplaced replicas go, then send their tokens there
+func (r *SchedulerCmd) schedule(ctx context.Context, gOpts *options.GlobalOptions, resolver *specstore.Resolver) error {
+	log := logr.FromContextOrDiscard(ctx)
+
+	pdas, err := smartwalletutils.SmartWalletAndGroupPDAs(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	sender, err := solana.NewTransactionSender(ctx)
+	if err != nil {
+		return fmt.Errorf("couldn't create transaction sender: %s", err)
+	}
+
+	group, _, err := solana.WorkGroupFromPubKey(ctx, pdas.DerivedWallet.Key)
+	if err != nil {
+		return fmt.Errorf("couldn't get workgroup from pubkey (%s): %s", pdas.DerivedWallet.Key.String(), err)
+	}
+	if len(group.Devices) == 0 || len(group.Deployments) == 0 {
+		log.Info("Nothing to schedule", "devices", len(group.Devices), "deployments", len(group.Deployments))
+		return nil
+	}
+
+	devices, err := getDevices(ctx, sender, group)
+	if err != nil {
+		return err
+	}
+	deployments, err := r.getDeployments(ctx, sender, resolver, group)
+	if err != nil {
+		return err
+	}
+	nodes, err := r.getNodes(ctx, sender, devices, deployments)
+	if err != nil {
+		return err
+	}
+
+	// before Plan, which adds its placements to the nodes
+	excess := scheduler.Excess(nodes, deployments)
+	placements, short, err := scheduler.Plan(scheduler.Strategy(r.Strategy), nodes, deployments)
+	if err != nil {
+		return err
+	}
+	names := make(map[string]string)
+	for _, d := range deployments {
+		names[d.Key] = d.Name
+	}
+	for key, count := range short {
+		log.Info("Not enough tokens or capacity to place all replicas", "deployment", names[key], "short", count)
+	}
+	for key, count := range excess {
+		log.Info("More replicas running than wanted, they have to be taken back by hand", "deployment", names[key], "excess", count)
+	}
+	if len(placements) == 0 {
+		return nil
+	}
+
+	byDeployment := make(map[string][]gagliardetto.Instruction)
+	order := []string{}
+	for _, p := range placements {
+		log.Info("Placing replicas", "deployment", names[p.Deployment], "device", p.Node, "replicas", p.Replicas, "dryRun", r.DryRun)
+		if r.DryRun {
+			continue
+		}
+		if _, ok := byDeployment[p.Deployment]; !ok {
+			order = append(order, p.Deployment)
+		}
+		// the instruction only takes a u8
+		for left := p.Replicas; left > 0; left -= math.MaxUint8 {
+			count := left
+			if count > math.MaxUint8 {
+				count = math.MaxUint8
+			}
+			inst, err := newScheduleInstruction(
+				pdas,
+				gagliardetto.MustPublicKeyFromBase58(p.Deployment),
+				gagliardetto.MustPublicKeyFromBase58(p.Node),
+				uint8(count),
+			)
+			if err != nil {
+				return err
+			}
+			byDeployment[p.Deployment] = append(byDeployment[p.Deployment], inst)
+		}
+	}
+	if r.DryRun {
+		return nil
+	}
+
+	walletPrivKey, walletPubKey, err := solana.MustGetWallet(ctx, gOpts)
+	if err != nil {
+		return fmt.Errorf("failed to get your wallet: %s", err)
+	}
+	// one transaction per deployment, so one that fails doesn't hold up the rest
+	for _, key := range order {
+		insts, err := smartwalletutils.WrapTransactions(
+			ctx,
+			sender.Client,
+			*walletPubKey,
+			pdas,
+			byDeployment[key],
+		)
+		if err != nil {
+			log.Error(err, "couldn't wrap schedule instructions", "deployment", names[key])
+			continue
+		}
+		_, err = sender.SendAndConfirmTransaction(
+			ctx,
+			insts,
+			solana.SignerKeys{*walletPubKey: walletPrivKey},
+		)
+		if err != nil {
+			log.Error(err, "sending and confirming transaction failed", "deployment", names[key])
+		}
+	}
+	return nil
+}
+
+// getDevices decodes the group's device accounts
+func getDevices(ctx context.Context, sender *solana.TransactionSender, group *worknet.WorkGroup) ([]worknet.Device, error) {
+	devices := []worknet.Device{}
+	resp, err := sender.Client.GetMultipleAccounts(ctx, group.Devices...)
+	if err != nil {
+		return nil, fmt.Errorf("failed getting device accounts: %s", err)
+	}
+	for i, account := range resp.Value {
+		// unused slots in the group's device list
+		if account == nil || group.Devices[i].IsZero() {
+			continue
+		}
+		device := worknet.Device{}
+		decoder := bin.NewDecoderWithEncoding(account.Data.GetBinary(), bin.EncodingBorsh)
+		if err := device.UnmarshalWithDecoder(decoder); err != nil {
+			return nil, fmt.Errorf("decoding device failed: %s", err)
+		}
+		devices = append(devices, device)
+	}
+	return devices, nil
+}
+
+func (r *SchedulerCmd) getDeployments(ctx context.Context, sender *solana.TransactionSender, resolver *specstore.Resolver, group *worknet.WorkGroup) ([]*scheduler.Deployment, error) {
+	log := logr.FromContextOrDiscard(ctx)
+
+	resp, err := sender.Client.GetMultipleAccounts(ctx, group.Deployments...)
+	if err != nil {
+		return nil, fmt.Errorf("failed getting deployment accounts: %s", err)
+	}
+	deployments := []*scheduler.Deployment{}
+	for i, account := range resp.Value {
+		if account == nil {
+			continue
+		}
+		key := group.Deployments[i]
+		deployment := worknet.Deployment{}
+		decoder := bin.NewDecoderWithEncoding(account.Data.GetBinary(), bin.EncodingBorsh)
+		if err := deployment.UnmarshalWithDecoder(decoder); err != nil {
+			return nil, fmt.Errorf("decoding deployment failed: %s", err)
+		}
+
+		_, tokensPDA, err := deploymentTokenPDAs(key)
+		if err != nil {
+			return nil, err
+		}
+		unscheduled, err := tokenBalances(ctx, sender, []gagliardetto.PublicKey{tokensPDA})
+		if err != nil {
+			return nil, err
+		}
+		requirements, err := r.getRequirements(ctx, sender, resolver, key, &deployment)
+		if err != nil {
+			// can't tell where it fits, so leave it alone this time
+			log.Error(err, "skipping deployment", "deployment", deployment.Name)
+			continue
+		}
+
+		deployments = append(deployments, &scheduler.Deployment{
+			Key:          key.String(),
+			Name:         deployment.Name,
+			Replicas:     int(deployment.Replicas),
+			Unscheduled:  unscheduled[0],
+			Requirements: requirements,
+		})
+	}
+	return deployments, nil
+}
+
+// getRequirements reads what one replica needs from the deployment's spec
+// TODO: only compose specs say what they need, everything else fits anywhere
+func (r *SchedulerCmd) getRequirements(ctx context.Context, sender *solana.TransactionSender, resolver *specstore.Resolver, key gagliardetto.PublicKey, deployment *worknet.Deployment) (workload.Requirements, error) {
+	specAccount, err := sender.Client.GetAccountInfo(ctx, deployment.Spec)
+	if err != nil {
+		return workload.Requirements{}, fmt.Errorf("couldn't get spec account: %s", err)
+	}
+	spec := worknet.WorkSpec{}
+	decoder := bin.NewDecoderWithEncoding(specAccount.Value.Data.GetBinary(), bin.EncodingBorsh)
+	if err := spec.UnmarshalWithDecoder(decoder); err != nil {
+		return workload.Requirements{}, fmt.Errorf("decoding spec failed: %s", err)
+	}
+	if spec.WorkType != worknet.WorkTypeDockerCompose {
+		return workload.Requirements{}, nil
+	}
+
+	src, err := resolver.Open(ctx, spec.UrlOrContents, spec.ContentsSha256)
+	if err != nil {
+		return workload.Requirements{}, fmt.Errorf("couldn't fetch spec: %s", err)
+	}
+	defer src.Close()
+	data, err := ioutil.ReadAll(src)
+	if err != nil {
+		return workload.Requirements{}, fmt.Errorf("couldn't read spec: %s", err)
+	}
+
+	env := []string{
+		"DAONETES_DEPLOYMENT=" + key.String(),
+		"DAONETES_REPLICA=0",
+	}
+	argsEnv, err := workload.DeploymentArgsEnv(deployment.Args)
+	if err != nil {
+		return workload.Requirements{}, fmt.Errorf("invalid deployment args: %s", err)
+	}
+	compose, err := workload.ParseComposeFile(data, append(env, argsEnv...))
+	if err != nil {
+		return workload.Requirements{}, err
+	}
+	return compose.Requirements()
+}
+
+// getNodes gets each device's replicas from its token accounts, and its capacity and status from the mesh
+func (r *SchedulerCmd) getNodes(ctx context.Context, sender *solana.TransactionSender, devices []worknet.Device, deployments []*scheduler.Deployment) ([]*scheduler.Node, error) {
+	log := logr.FromContextOrDiscard(ctx)
+
+	nodes := []*scheduler.Node{}
+	for _, device := range devices {
+		node := &scheduler.Node{
+			Key:      device.DeviceAuthority.String(),
+			Hostname: device.Hostname,
+			Replicas: make(map[string]int),
+		}
+
+		tokenAccounts := []gagliardetto.PublicKey{}
+		for _, d := range deployments {
+			tokens, err := deviceTokensPDA(device.DeviceAuthority, gagliardetto.MustPublicKeyFromBase58(d.Key))
+			if err != nil {
+				return nil, err
+			}
+			tokenAccounts = append(tokenAccounts, tokens)
+		}
+		balances, err := tokenBalances(ctx, sender, tokenAccounts)
+		if err != nil {
+			return nil, err
+		}
+		for i, d := range deployments {
+			if balances[i] > 0 {
+				node.Replicas[d.Key] = balances[i]
+			}
+		}
+
+		missing := false
+		if device.Status == worknet.DeviceStatusRegistered {
+			status, err := getProxiedDeviceStatus(r.Node, device.Hostname)
+			switch {
+			case err != nil:
+				log.Info("Couldn't get device status, not scheduling on it", "device", device.Hostname, "err", err)
+				missing = true
+			case status.DeviceInfo.DeviceAuthority != device.DeviceAuthority:
+				log.Info("Device status is for another device, not scheduling on it", "device", device.Hostname, "got", status.DeviceInfo.DeviceAuthority)
+				missing = true
+			case workgroup.IsDelinquent(status):
+				log.Info("Device is delinquent, not scheduling on it", "device", device.Hostname, "lastSeen", status.LastSeen)
+				missing = true
+			case status.DeviceInfo.Status != worknet.DeviceStatusRegistered || status.Draining:
+				// the chain (or our copy of it) hasn't caught up with a cordon yet
+				log.Info("Device is cordoned, not scheduling on it", "device", device.Hostname)
+			default:
+				node.Schedulable = true
+				node.Capacity = status.Capacity
+			}
+		}
+		// a cordon is on purpose, but a device that's gone missing might be back in a moment
+		if !missing {
+			delete(r.missingSince, node.Key)
+		} else {
+			since, ok := r.missingSince[node.Key]
+			if !ok {
+				since = time.Now()
+				r.missingSince[node.Key] = since
+			}
+			if time.Since(since) < time.Duration(r.Grace)*time.Second {
+				node.Grace = true
+			}
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
+
+// tokenBalances gets the amount in each token account, 0 for ones that don't exist (yet)
+func tokenBalances(ctx context.Context, sender *solana.TransactionSender, accounts []gagliardetto.PublicKey) ([]int, error) {
+	balances := make([]int, len(accounts))
+	if len(accounts) == 0 {
+		return balances, nil
+	}
+	resp, err := sender.Client.GetMultipleAccounts(ctx, accounts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed getting token accounts: %s", err)
+	}
+	for i, account := range resp.Value {
+		if account == nil {
+			continue
+		}
+		tokenWallet := &token.Account{}
+		decoder := bin.NewDecoderWithEncoding(account.Data.GetBinary(), bin.EncodingBorsh)
+		if err := tokenWallet.UnmarshalWithDecoder(decoder); err != nil {
+			return nil, fmt.Errorf("couldn't decode token account: %s", err)
+		}
+		balances[i] = int(tokenWallet.Amount)
+	}
+	return balances, nil
+}
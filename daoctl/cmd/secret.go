@@ -0,0 +1,146 @@
+package cmd
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	gagliardetto "github.com/gagliardetto/solana-go"
+	"github.com/workbenchapp/worknet/daoctl/lib/apiauth"
+	"github.com/workbenchapp/worknet/daoctl/lib/options"
+	"github.com/workbenchapp/worknet/daoctl/lib/sealbox"
+	"github.com/workbenchapp/worknet/daoctl/lib/solana/anchor/generated/worknet"
+	"golang.org/x/term"
+)
+
+// SecretCmd hands the workgroup's devices secrets for their workloads, sealed to
+// each device's key, compose specs use them as external secrets
+type SecretCmd struct {
+	List SecretCmdList `cmd:"" default:"1" help:"List the secrets a device has"`
+	Set  SecretCmdSet  `cmd:"" help:"Send a secret (or a new version of it) to the workgroup's devices"`
+	Rm   SecretCmdRm   `cmd:"" help:"Remove a secret from the workgroup's devices"`
+}
+
+type SecretCmdList struct {
+	Device string `arg:"" optional:"" default:"localhost" help:"Hostname of the device (default this one)"`
+	Node   string `help:"Agent to send the request through (it forwards over the mesh)" default:"localhost" yaml:"node"`
+}
+
+type SecretCmdSet struct {
+	Name     string `arg:"" help:"Name of the secret"`
+	FromFile string `type:"existingfile" help:"Read the secret from a file (default stdin, or ask for it on a terminal)"`
+	Version  int    `help:"Version to set, it has to be newer than the device's (default one more than the device's)"`
+	MeshDeviceOptions
+}
+
+type SecretCmdRm struct {
+	Name string `arg:"" help:"Name of the secret"`
+	MeshDeviceOptions
+}
+
+func (r *SecretCmdList) Run(gOpts *options.GlobalOptions) error {
+	query := url.Values{}
+	query.Set("proxy", r.Device)
+	resp, err := http.Get(fmt.Sprintf("http://%s:9495%s?%s", r.Node, secretsAPIPath, query.Encode()))
+	if err != nil {
+		return fmt.Errorf("couldn't reach the agent: %s", err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("listing secrets on %s failed (%s): %s", r.Device, resp.Status, strings.TrimSpace(string(body)))
+	}
+	secrets := []sealedSecret{}
+	if err := json.Unmarshal(body, &secrets); err != nil {
+		return fmt.Errorf("couldn't decode secrets: %s", err)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 10, 1, 3, ' ', 0)
+	defer tw.Flush()
+	fmt.Fprintln(tw, "NAME\tVERSION\tUPDATED")
+	for _, secret := range secrets {
+		fmt.Fprintf(tw, "%s\t%d\t%s ago\n", secret.Name, secret.Version, time.Since(secret.UpdatedAt).Round(time.Second))
+	}
+	return nil
+}
+
+func (r *SecretCmdSet) Run(gOpts *options.GlobalOptions) error {
+	if !secretNameRe.MatchString(r.Name) {
+		return fmt.Errorf("invalid secret name %q, use letters, numbers, '.', '_' and '-'", r.Name)
+	}
+	value, err := r.readValue()
+	if err != nil {
+		return err
+	}
+	if len(value) > maxSecretSize {
+		return fmt.Errorf("secret is %d bytes, the most is %d", len(value), maxSecretSize)
+	}
+	payload, err := json.Marshal(secretPayload{Name: r.Name, Value: value})
+	if err != nil {
+		return err
+	}
+	// the devices only take secrets from the workgroup authority
+	key, smartWallet, err := apiSigner(gOpts)
+	if err != nil {
+		return err
+	}
+	if smartWallet == nil {
+		return errors.New("secrets are set by the workgroup authority, use --smart-wallet")
+	}
+	signer := gagliardetto.PublicKeyFromBytes(key.Public().(ed25519.PublicKey))
+
+	return r.eachDevice(gOpts.Ctx, func(device worknet.Device, proxyDevice string) error {
+		sealed, err := sealbox.Seal(ed25519.PublicKey(device.DeviceAuthority.Bytes()), payload)
+		if err != nil {
+			return err
+		}
+		body, err := json.Marshal(sealedSecret{
+			Name:        r.Name,
+			Version:     r.Version,
+			Sealed:      sealed,
+			Signer:      signer.String(),
+			SmartWallet: smartWallet.String(),
+			Signature:   apiauth.SignPayload(key, secretPayloadKind, []byte(r.Name), sealed),
+		})
+		if err != nil {
+			return err
+		}
+		return r.request(gOpts, http.MethodPost, secretsAPIPath, device, proxyDevice, nil, body)
+	})
+}
+
+func (r *SecretCmdSet) readValue() ([]byte, error) {
+	if r.FromFile != "" {
+		return ioutil.ReadFile(r.FromFile)
+	}
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		value, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read secret: %s", err)
+		}
+		return value, nil
+	}
+	fmt.Fprintf(os.Stderr, "%s: ", r.Name)
+	value, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read secret: %s", err)
+	}
+	return value, nil
+}
+
+func (r *SecretCmdRm) Run(gOpts *options.GlobalOptions) error {
+	query := url.Values{}
+	query.Set("name", r.Name)
+	return r.eachDevice(gOpts.Ctx, func(device worknet.Device, proxyDevice string) error {
+		return r.request(gOpts, http.MethodDelete, secretsAPIPath, device, proxyDevice, query, nil)
+	})
+}
@@ -0,0 +1,124 @@
+package cmd
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/workbenchapp/worknet/daoctl/lib/options"
+	"github.com/workbenchapp/worknet/daoctl/lib/solana/anchor/generated/worknet"
+	"github.com/workbenchapp/worknet/daoctl/lib/specstore"
+)
+
+const (
+	// where failed spec fetches are kept for inspection, inside the work dir
+	failedSpecsDir = "failed"
+
+	// where the device API serves the spec cache, <specsAPIPath>/sha256/<hash>
+	specsAPIPath = "/specs"
+)
+
+func (r *DaoletCmd) newSpecResolver(agentConfig *options.AgentConfig) (*specstore.Resolver, error) {
+	return openSpecResolver(agentConfig, time.Duration(r.SpecTimeout)*time.Second, r.SpecMaxSize)
+}
+
+// openSpecResolver sets up a resolver over the spec cache in the WorkNet config dir
+func openSpecResolver(agentConfig *options.AgentConfig, timeout time.Duration, maxSize int64) (*specstore.Resolver, error) {
+	configDir, err := options.GetConfigDir("WorkNet")
+	if err != nil {
+		return nil, err
+	}
+	store, err := specstore.NewStore(filepath.Join(configDir, "specs"))
+	if err != nil {
+		return nil, err
+	}
+	resolver := &specstore.Resolver{
+		Store:           store,
+		IPFSGateways:    agentConfig.Specs.IPFSGateways,
+		ArweaveGateways: agentConfig.Specs.ArweaveGateways,
+		Mirrors:         agentConfig.Specs.Mirrors,
+		Timeout:         timeout,
+		MaxSize:         maxSize,
+	}
+	if len(resolver.IPFSGateways) == 0 {
+		resolver.IPFSGateways = specstore.DefaultIPFSGateways
+	}
+	if len(resolver.ArweaveGateways) == 0 {
+		resolver.ArweaveGateways = specstore.DefaultArweaveGateways
+	}
+	return resolver, nil
+}
+
+// fetchSpec gets the spec into localSpecPath through a staging file, which only
+// replaces localSpecPath once its checksum matches. Failed attempts are moved
+// to the work dir's failed dir.
+func (r *DaoletCmd) fetchSpec(ctx context.Context, localSpecPath string, spec *worknet.WorkSpec) error {
+	dir := filepath.Dir(localSpecPath)
+	staging, err := ioutil.TempFile(dir, filepath.Base(localSpecPath)+".staging-*")
+	if err != nil {
+		return err
+	}
+	stagingPath := staging.Name()
+
+	// TempFile is 0600, keep the spec readable like it used to be
+	err = staging.Chmod(0644)
+	if err == nil {
+		err = r.stageSpec(ctx, staging, spec)
+	}
+	if closeErr := staging.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = validateSpecChecksum(stagingPath, spec.ContentsSha256)
+	}
+	if err != nil {
+		specstore.KeepFailed(stagingPath, filepath.Join(dir, failedSpecsDir), filepath.Base(stagingPath))
+		return err
+	}
+	return os.Rename(stagingPath, localSpecPath)
+}
+
+// stageSpec copies the spec out of the content addressed cache, fetching it
+// from its url, mirrors or peers first if need be
+func (r *DaoletCmd) stageSpec(ctx context.Context, out *os.File, spec *worknet.WorkSpec) error {
+	src, err := r.specResolver.Open(ctx, spec.UrlOrContents, spec.ContentsSha256)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	if _, err := io.Copy(out, src); err != nil {
+		return err
+	}
+	return out.Sync()
+}
+
+func validateSpecChecksum(localSpecPath string, checksum string) error {
+	specFile, err := os.Open(localSpecPath)
+	if err != nil {
+		return err
+	}
+	defer specFile.Close()
+
+	specHash := sha256.New()
+	if _, err := io.Copy(specHash, specFile); err != nil {
+		return err
+	}
+
+	strHash := hex.EncodeToString(specHash.Sum(nil))
+	if strHash != checksum {
+		return fmt.Errorf(
+			"checksum mismatch with spec: expected=%s actual=%s",
+			checksum,
+			strHash,
+		)
+	}
+
+	return nil
+}
@@ -0,0 +1,148 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"github.com/workbenchapp/worknet/daoctl/lib/agentstate"
+	"github.com/workbenchapp/worknet/daoctl/lib/options"
+	"github.com/workbenchapp/worknet/daoctl/lib/workload"
+)
+
+// openAgentState opens the agent's state db, and sets up the work dirs next to
+// it, moving in what older agents left in ./specworkdirs
+func (r *DaoletCmd) openAgentState(ctx context.Context) error {
+	dbPath, err := agentstate.DefaultPath()
+	if err != nil {
+		return err
+	}
+	db, err := agentstate.Open(dbPath)
+	if err != nil {
+		return err
+	}
+	configDir, err := options.GetConfigDir("WorkNet")
+	if err != nil {
+		db.Close()
+		return err
+	}
+	r.state = db
+	r.workDirs = filepath.Join(configDir, specWorkDirsPath)
+	r.secretsDir = filepath.Join(configDir, secretsDirPath)
+	if err := r.migrateLegacyWorkDirs(ctx); err != nil {
+		// we'll just redeploy, and lose track of anything only the old records knew about
+		logr.FromContextOrDiscard(ctx).Error(err, "Couldn't move old work dirs into the state db", "dir", specWorkDirsPath)
+	}
+	return nil
+}
+
+// migrateLegacyWorkDirs moves the relative specworkdirs dir older agents used
+// (in whatever dir they were started in) to r.workDirs, and its started.json
+// into the state db
+func (r *DaoletCmd) migrateLegacyWorkDirs(ctx context.Context) error {
+	log := logr.FromContextOrDiscard(ctx)
+
+	legacyDir, err := filepath.Abs(specWorkDirsPath)
+	if err != nil || legacyDir == r.workDirs {
+		return err
+	}
+	startedFile := filepath.Join(legacyDir, workload.StartedWorkloadsFile)
+	data, err := ioutil.ReadFile(startedFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	records := make(map[string]workload.StartedWorkload)
+	if err := json.Unmarshal(data, &records); err != nil {
+		return fmt.Errorf("couldn't decode %s: %s", startedFile, err)
+	}
+
+	moved := false
+	if _, err := os.Stat(r.workDirs); errors.Is(err, os.ErrNotExist) {
+		if err := os.MkdirAll(filepath.Dir(r.workDirs), os.ModePerm); err != nil {
+			return err
+		}
+		// TODO: fails across filesystems, then the records keep pointing at the old dir
+		if err := os.Rename(legacyDir, r.workDirs); err != nil {
+			log.Error(err, "Couldn't move old work dirs, leaving them", "from", legacyDir, "to", r.workDirs)
+		} else {
+			moved = true
+		}
+	}
+	store := &workloadRecords{db: r.state}
+	current, err := store.LoadRecords()
+	if err != nil {
+		return err
+	}
+	for name, record := range records {
+		if _, ok := current[name]; ok {
+			continue
+		}
+		if moved {
+			record.WorkDir = movedPath(record.WorkDir, specWorkDirsPath, r.workDirs)
+			record.SpecPath = movedPath(record.SpecPath, specWorkDirsPath, r.workDirs)
+		} else {
+			record.WorkDir = movedPath(record.WorkDir, specWorkDirsPath, legacyDir)
+			record.SpecPath = movedPath(record.SpecPath, specWorkDirsPath, legacyDir)
+		}
+		current[name] = record
+	}
+	if err := store.SaveRecords(current); err != nil {
+		return err
+	}
+	log.Info("Moved old work dirs into the state db", "from", legacyDir, "records", len(records), "moved", moved)
+
+	// so we don't do it again
+	startedFile = filepath.Join(legacyDir, workload.StartedWorkloadsFile)
+	if moved {
+		startedFile = filepath.Join(r.workDirs, workload.StartedWorkloadsFile)
+	}
+	return os.Rename(startedFile, startedFile+".migrated")
+}
+
+func movedPath(path, from, to string) string {
+	if rel := strings.TrimPrefix(path, from+string(filepath.Separator)); rel != path {
+		return filepath.Join(to, rel)
+	}
+	return path
+}
+
+func (r *DaoletCmd) newReconciler() *workload.Reconciler {
+	reconciler := workload.NewReconciler(workload.DefaultRegistry, r.workDirs)
+	reconciler.Store = &workloadRecords{db: r.state}
+	return reconciler
+}
+
+// workloadRecords keeps the reconciler's records in the state db
+type workloadRecords struct {
+	db *agentstate.DB
+}
+
+func (s *workloadRecords) LoadRecords() (map[string]workload.StartedWorkload, error) {
+	records := make(map[string]workload.StartedWorkload)
+	err := s.db.ForEach(agentstate.Workloads, func(name string, data []byte) error {
+		record := workload.StartedWorkload{}
+		if err := json.Unmarshal(data, &record); err != nil {
+			return fmt.Errorf("couldn't decode workload %s: %s", name, err)
+		}
+		records[name] = record
+		return nil
+	})
+	return records, err
+}
+
+func (s *workloadRecords) SaveRecords(records map[string]workload.StartedWorkload) error {
+	all := make(map[string]interface{}, len(records))
+	for name, record := range records {
+		all[name] = record
+	}
+	return s.db.ReplaceAll(agentstate.Workloads, all)
+}
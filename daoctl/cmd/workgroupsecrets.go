@@ -0,0 +1,248 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/workbenchapp/worknet/daoctl/lib/agentstate"
+	"github.com/workbenchapp/worknet/daoctl/lib/apiauth"
+	"github.com/workbenchapp/worknet/daoctl/lib/proxy"
+	"github.com/workbenchapp/worknet/daoctl/lib/sealbox"
+	"github.com/workbenchapp/worknet/daoctl/lib/solana/anchor/generated/worknet"
+	"github.com/workbenchapp/worknet/daoctl/lib/workload"
+)
+
+const (
+	// secretsAPIPath is where `daoctl secret` sends a device the workgroup's secrets
+	secretsAPIPath = "/secrets"
+	// the decrypted secrets of the running workloads, in the WorkNet config dir
+	secretsDirPath = "secrets"
+	// certificates and keys fit, anything bigger should be a volume
+	maxSecretSize = 512 * 1024
+)
+
+// secretNames end up as file names, so no paths
+var secretNameRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// sealedSecret is a secretPayload sealed to the device's key by whoever set it,
+// and kept that way until a workload needs it
+type sealedSecret struct {
+	Name string `json:"name"`
+	// Version goes up each time the secret is set, a new one redeploys the workloads using it
+	Version   int       `json:"version"`
+	Sealed    []byte    `json:"sealed,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// Signer signed the name and the sealed payload, as an owner of SmartWallet,
+	// the smart wallet the workgroup authority is derived from
+	Signer      string `json:"signer,omitempty"`
+	SmartWallet string `json:"smart_wallet,omitempty"`
+	Signature   []byte `json:"signature,omitempty"`
+}
+
+// secretPayloadKind is what sealedSecret signatures are for, see apiauth.SignPayload
+const secretPayloadKind = "secret"
+
+// verifySecret checks the secret was signed by who signed the request setting it
+func verifySecret(secret sealedSecret, signed *apiauth.Signed) error {
+	if signed.SmartWallet == nil || secret.Signer != signed.Signer.String() || secret.SmartWallet != signed.SmartWallet.String() {
+		return errors.New("secret isn't signed by the workgroup authority setting it")
+	}
+	if !apiauth.VerifyPayload(signed.Signer, secret.Signature, secretPayloadKind, []byte(secret.Name), secret.Sealed) {
+		return errors.New("bad secret signature")
+	}
+	return nil
+}
+
+// secretPayload is what's sealed, the name is in it so a secret can't be passed off as another
+type secretPayload struct {
+	Name  string `json:"name"`
+	Value []byte `json:"value"`
+}
+
+func secretKey(workGroup, name string) string {
+	return workGroup + "/" + name
+}
+
+func openSecret(key ed25519.PrivateKey, sealed sealedSecret) ([]byte, error) {
+	data, err := sealbox.Open(key, sealed.Sealed)
+	if err != nil {
+		return nil, err
+	}
+	payload := secretPayload{}
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return nil, fmt.Errorf("couldn't decode secret: %s", err)
+	}
+	if payload.Name != sealed.Name {
+		return nil, fmt.Errorf("secret is %s, not %s", payload.Name, sealed.Name)
+	}
+	return payload.Value, nil
+}
+
+// addSecretsHandler serves /secrets, POST a sealedSecret to set one (its version
+// is one more than the last, unless it says), DELETE ?name= to remove one, GET
+// lists the secret names and versions. ?proxy=<hostname> forwards it to that
+// device over the mesh. Setting and removing them has to be signed by the
+// workgroup authority, and the secrets it sets are signed by it too. That's an
+// owner of a smart wallet with a threshold of 1, see apiAuthWorkgroup.
+func (r *DaoletCmd) addSecretsHandler(ctx context.Context, auth *apiAuth, device *worknet.Device, key ed25519.PrivateKey) {
+	log := logr.FromContextOrDiscard(ctx)
+
+	proxy.AddPrivateAPIHandler(secretsAPIPath, func(w http.ResponseWriter, req *http.Request) {
+		if proxyDevice := req.URL.Query().Get("proxy"); proxyDevice != "" && proxyDevice != "localhost" {
+			log.V(2).Info("proxying secrets request", "proxy", proxyDevice)
+			proxy.ForwardToDevice(w, req, proxyDevice)
+			return
+		}
+		if r.state == nil {
+			http.Error(w, "no agent state db", http.StatusServiceUnavailable)
+			return
+		}
+		workGroup := device.WorkGroup.String()
+
+		switch req.Method {
+		case http.MethodGet:
+			secrets := []sealedSecret{}
+			err := r.state.ForEach(agentstate.Secrets, func(key string, data []byte) error {
+				secret := sealedSecret{}
+				if err := json.Unmarshal(data, &secret); err != nil {
+					return err
+				}
+				if key != secretKey(workGroup, secret.Name) {
+					// another workgroup's
+					return nil
+				}
+				secret.Sealed = nil
+				secrets = append(secrets, secret)
+				return nil
+			})
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(secrets)
+		case http.MethodPost:
+			if !requireJSON(w, req) {
+				return
+			}
+			body, signed, ok := auth.authorize(w, req, apiAuthWorkgroup)
+			if !ok {
+				return
+			}
+			secret := sealedSecret{}
+			if err := json.Unmarshal(body, &secret); err != nil {
+				http.Error(w, fmt.Sprintf("couldn't decode secret: %s", err), http.StatusBadRequest)
+				return
+			}
+			if !secretNameRe.MatchString(secret.Name) {
+				http.Error(w, fmt.Sprintf("invalid secret name %q", secret.Name), http.StatusBadRequest)
+				return
+			}
+			if err := verifySecret(secret, signed); err != nil {
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+			// make sure it's for us now, rather than at the next deploy
+			if _, err := openSecret(key, secret); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			current := sealedSecret{}
+			if _, err := r.state.Get(agentstate.Secrets, secretKey(workGroup, secret.Name), &current); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			switch {
+			case secret.Version == 0:
+				secret.Version = current.Version + 1
+			case secret.Version <= current.Version:
+				http.Error(w, fmt.Sprintf("%s is already at version %d", secret.Name, current.Version), http.StatusConflict)
+				return
+			}
+			secret.UpdatedAt = time.Now()
+			if err := r.state.Put(agentstate.Secrets, secretKey(workGroup, secret.Name), secret); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			log.Info("Secret set", "name", secret.Name, "version", secret.Version, "signer", secret.Signer)
+			fmt.Fprintf(w, "%s set to version %d\n", secret.Name, secret.Version)
+			// the workloads using it get redeployed on the next pass
+		case http.MethodDelete:
+			_, signed, ok := auth.authorize(w, req, apiAuthWorkgroup)
+			if !ok {
+				return
+			}
+			name := req.URL.Query().Get("name")
+			if err := r.state.Delete(agentstate.Secrets, secretKey(workGroup, name)); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			log.Info("Secret removed", "name", name, "signer", signed.Signer)
+			fmt.Fprintf(w, "%s removed\n", name)
+		default:
+			http.Error(w, "use GET, POST or DELETE", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+// prepareSecrets decrypts the workgroup secrets the workload's spec uses into
+// its own dir in secretsDirPath, for the runtime to mount
+func (r *DaoletCmd) prepareSecrets(w *workload.Workload, workGroup string, key ed25519.PrivateKey) error {
+	w.SecretsDir, w.SecretVersions = "", nil
+	if w.WorkType != worknet.WorkTypeDockerCompose {
+		return nil
+	}
+	compose, err := workload.LoadComposeFile(w.SpecPath, append(os.Environ(), w.Env...))
+	if err != nil {
+		// the deploy will say what's wrong with it
+		return nil
+	}
+	names := compose.WorkgroupSecrets()
+	if len(names) == 0 {
+		return nil
+	}
+	if r.state == nil {
+		return errors.New("spec uses secrets, but there's no agent state db to keep them in")
+	}
+
+	dir := filepath.Join(r.secretsDir, w.Name)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	versions := map[string]int{}
+	for _, name := range names {
+		secret := sealedSecret{}
+		found, err := r.state.Get(agentstate.Secrets, secretKey(workGroup, name), &secret)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return fmt.Errorf("secret %s hasn't been sent to this device, see `daoctl secret set`", name)
+		}
+		value, err := openSecret(key, secret)
+		if err != nil {
+			return fmt.Errorf("couldn't open secret %s: %s", name, err)
+		}
+		path := filepath.Join(dir, name)
+		// it's bind mounted, so only touch it when it changes
+		if current, err := ioutil.ReadFile(path); err != nil || !bytes.Equal(current, value) {
+			if err := ioutil.WriteFile(path, value, 0600); err != nil {
+				return err
+			}
+		}
+		versions[name] = secret.Version
+	}
+	w.SecretsDir, w.SecretVersions = dir, versions
+	return nil
+}
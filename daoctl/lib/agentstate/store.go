@@ -0,0 +1,209 @@
+// Package agentstate is the agent's on disk state, so restarts can pick up
+// where they left off instead of asking the chain (and docker) for everything again.
+package agentstate
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/workbenchapp/worknet/daoctl/lib/options"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// DBFile is the state db's name in the agent's config dir
+	DBFile = "agent.db"
+
+	// SchemaVersion is the version of the buckets and records below, bump it and
+	// add to migrations when changing them
+	SchemaVersion = 5
+)
+
+// Buckets, each one holds JSON records
+const (
+	// Workloads are the workload.StartedWorkload records, keyed by workload name
+	Workloads = "workloads"
+	// Devices are the workgroup.DeviceStatusInfo cache, keyed by device token account ("local" for us)
+	Devices = "devices"
+	// Peers is what we last knew about each mesh peer, keyed by device authority
+	Peers = "peers"
+	// WireGuard has the local device's wireguard info (public key, listen port...)
+	WireGuard = "wireguard"
+	// Lifecycle is what's been asked of the local device (draining...), that the chain doesn't record
+	Lifecycle = "lifecycle"
+	// RegistryAuth has the registry logins the workgroup sent us, still sealed to the device key, keyed by workgroup/registry
+	RegistryAuth = "registry_auth"
+	// Secrets has the workgroup secrets we've been sent, still sealed to the device key, keyed by workgroup/name
+	Secrets = "secrets"
+	// MeshAddresses are the mesh addresses handed out to the workgroup's devices, keyed by device key
+	MeshAddresses = "mesh_addresses"
+
+	metaBucket       = "meta"
+	schemaVersionKey = "schema_version"
+)
+
+// migrations[n] takes the db from schema version n to n+1
+var migrations = []func(tx *bolt.Tx) error{
+	func(tx *bolt.Tx) error {
+		for _, bucket := range []string{Workloads, Devices, Peers, WireGuard} {
+			if _, err := tx.CreateBucketIfNotExists([]byte(bucket)); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+	func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(Lifecycle))
+		return err
+	},
+	func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(RegistryAuth))
+		return err
+	},
+	func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(Secrets))
+		return err
+	},
+	func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(MeshAddresses))
+		return err
+	},
+}
+
+// DB is a bbolt db, only one process can have it open at a time
+type DB struct {
+	db *bolt.DB
+}
+
+// DefaultPath is the state db in the WorkNet config dir
+func DefaultPath() (string, error) {
+	configDir, err := options.GetConfigDir("WorkNet")
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, DBFile), nil
+}
+
+// Open opens (or makes) the state db at path, and migrates it to SchemaVersion
+func Open(path string) (*DB, error) {
+	// the timeout is for another agent already having it open
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("couldn't open state db %s: %s", path, err)
+	}
+	s := &DB{db: db}
+	if err := s.migrate(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("couldn't migrate state db %s: %s", path, err)
+	}
+	return s, nil
+}
+
+func (s *DB) Close() error {
+	return s.db.Close()
+}
+
+func (s *DB) migrate() error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists([]byte(metaBucket))
+		if err != nil {
+			return err
+		}
+		version := 0
+		if v := meta.Get([]byte(schemaVersionKey)); v != nil {
+			if version, err = strconv.Atoi(string(v)); err != nil {
+				return fmt.Errorf("bad schema version %q: %s", v, err)
+			}
+		}
+		if version > len(migrations) {
+			return fmt.Errorf("schema version %d is newer than this agent (%d), downgrade not supported", version, SchemaVersion)
+		}
+		for ; version < len(migrations); version++ {
+			if err := migrations[version](tx); err != nil {
+				return fmt.Errorf("migrating to version %d: %s", version+1, err)
+			}
+		}
+		return meta.Put([]byte(schemaVersionKey), []byte(strconv.Itoa(version)))
+	})
+}
+
+// Version is the db's schema version
+func (s *DB) Version() (int, error) {
+	version := 0
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket([]byte(metaBucket)).Get([]byte(schemaVersionKey))
+		var err error
+		version, err = strconv.Atoi(string(v))
+		return err
+	})
+	return version, err
+}
+
+// Get decodes the record at bucket/key into v, and says if there was one
+func (s *DB) Get(bucket, key string, v interface{}) (bool, error) {
+	found := false
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket([]byte(bucket)).Get([]byte(key))
+		if data == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(data, v)
+	})
+	if err != nil {
+		return found, fmt.Errorf("couldn't read %s/%s: %s", bucket, key, err)
+	}
+	return found, nil
+}
+
+// Put stores v at bucket/key as JSON
+func (s *DB) Put(bucket, key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(bucket)).Put([]byte(key), data)
+	})
+}
+
+func (s *DB) Delete(bucket, key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(bucket)).Delete([]byte(key))
+	})
+}
+
+// ForEach calls fn with each record in bucket, fn must decode data before returning
+func (s *DB) ForEach(bucket string, fn func(key string, data []byte) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(bucket)).ForEach(func(k, v []byte) error {
+			return fn(string(k), v)
+		})
+	})
+}
+
+// ReplaceAll swaps the contents of bucket for records, in one transaction
+func (s *DB) ReplaceAll(bucket string, records map[string]interface{}) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket([]byte(bucket)); err != nil {
+			return err
+		}
+		b, err := tx.CreateBucket([]byte(bucket))
+		if err != nil {
+			return err
+		}
+		for key, v := range records {
+			data, err := json.Marshal(v)
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(key), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,55 @@
+package agentstate
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), DBFile)
+	db, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type record struct {
+		Name string
+	}
+	if err := db.Put(Workloads, "a", record{Name: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.ReplaceAll(Peers, map[string]interface{}{"p1": record{"1"}, "p2": record{"2"}}); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	// reopening shouldn't migrate, or lose anything
+	db, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if version, err := db.Version(); err != nil || version != SchemaVersion {
+		t.Errorf("version = %d, %v, want %d", version, err, SchemaVersion)
+	}
+	var got record
+	if found, err := db.Get(Workloads, "a", &got); err != nil || !found || got.Name != "a" {
+		t.Errorf("Get(a) = %v, %v, %+v", found, err, got)
+	}
+	if found, _ := db.Get(Workloads, "missing", &got); found {
+		t.Errorf("Get(missing) found something")
+	}
+	peers := 0
+	if err := db.ForEach(Peers, func(key string, data []byte) error {
+		peers++
+		return nil
+	}); err != nil || peers != 2 {
+		t.Errorf("ForEach(peers) = %d, %v", peers, err)
+	}
+	if err := db.Delete(Workloads, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if found, _ := db.Get(Workloads, "a", &got); found {
+		t.Errorf("Get(a) found it after Delete")
+	}
+}
@@ -0,0 +1,181 @@
+// Package apiauth signs agent API requests with a wallet's ed25519 key, so an
+// agent can tell who's asking before it changes the device or lets them into
+// its workloads.
+//
+// The signature covers the method, path, query (without ?proxy=, so it can be
+// forwarded over the mesh), the device it's meant for, the time, and the body.
+// The headers it needs are never CORS safelisted, so a browser has to preflight
+// a signed request, and the agent's API doesn't allow that.
+package apiauth
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	gagliardetto "github.com/gagliardetto/solana-go"
+)
+
+const (
+	// SignerHeader is the signing key, base58
+	SignerHeader = "X-Daonetes-Signer"
+	// SmartWalletHeader is the smart wallet the signer says it's an owner of, for
+	// requests made as the workgroup authority
+	SmartWalletHeader = "X-Daonetes-Smart-Wallet"
+	// DeviceHeader is the device authority of the device the request is for, so
+	// it can't be replayed to another one
+	DeviceHeader    = "X-Daonetes-Device"
+	TimestampHeader = "X-Daonetes-Timestamp"
+	SignatureHeader = "X-Daonetes-Signature"
+)
+
+// MaxAge is how far a request's timestamp can be from the agent's clock
+var MaxAge = 5 * time.Minute
+
+// ErrUnsigned is from Verify for a request without a signature
+var ErrUnsigned = errors.New("request isn't signed, see `daoctl --key-file`")
+
+// Signed is who a verified request is from
+type Signed struct {
+	Signer      gagliardetto.PublicKey
+	SmartWallet *gagliardetto.PublicKey
+}
+
+// Sign adds the signature headers to req for body, from key, for the device
+// with authority device. smartWallet can be nil.
+func Sign(req *http.Request, body []byte, key ed25519.PrivateKey, device string, smartWallet *gagliardetto.PublicKey) {
+	signer := gagliardetto.PublicKeyFromBytes(key.Public().(ed25519.PublicKey))
+	req.Header.Set(SignerHeader, signer.String())
+	if smartWallet != nil {
+		req.Header.Set(SmartWalletHeader, smartWallet.String())
+	} else {
+		req.Header.Del(SmartWalletHeader)
+	}
+	req.Header.Set(DeviceHeader, device)
+	req.Header.Set(TimestampHeader, strconv.FormatInt(time.Now().Unix(), 10))
+	signature := ed25519.Sign(key, signedMessage(req, body))
+	req.Header.Set(SignatureHeader, base64.StdEncoding.EncodeToString(signature))
+}
+
+// signedMessage is what's signed, one line per part
+func signedMessage(req *http.Request, body []byte) []byte {
+	query := req.URL.Query()
+	query.Del("proxy")
+	digest := sha256.Sum256(body)
+
+	var b bytes.Buffer
+	for _, part := range []string{
+		"daonetes-api/1",
+		req.Method,
+		req.URL.EscapedPath(),
+		query.Encode(),
+		req.Header.Get(DeviceHeader),
+		req.Header.Get(SmartWalletHeader),
+		req.Header.Get(TimestampHeader),
+		hex.EncodeToString(digest[:]),
+	} {
+		b.WriteString(part)
+		b.WriteByte('\n')
+	}
+	return b.Bytes()
+}
+
+// Verifier checks the requests for one device, and that each is only used once
+type Verifier struct {
+	device string
+
+	mu   sync.Mutex
+	seen map[string]time.Time
+	now  func() time.Time
+}
+
+func NewVerifier(device string) *Verifier {
+	return &Verifier{device: device, seen: map[string]time.Time{}, now: time.Now}
+}
+
+// Verify checks req's signature over body, and says who signed it. It's up to
+// the caller to decide if they're allowed to do what they asked.
+func (v *Verifier) Verify(req *http.Request, body []byte) (*Signed, error) {
+	if req.Header.Get(SignatureHeader) == "" {
+		return nil, ErrUnsigned
+	}
+	signer, err := gagliardetto.PublicKeyFromBase58(req.Header.Get(SignerHeader))
+	if err != nil {
+		return nil, fmt.Errorf("invalid signer: %s", err)
+	}
+	signed := &Signed{Signer: signer}
+	if smartWallet := req.Header.Get(SmartWalletHeader); smartWallet != "" {
+		key, err := gagliardetto.PublicKeyFromBase58(smartWallet)
+		if err != nil {
+			return nil, fmt.Errorf("invalid smart wallet: %s", err)
+		}
+		signed.SmartWallet = &key
+	}
+	if device := req.Header.Get(DeviceHeader); device != v.device {
+		return nil, fmt.Errorf("request is for device %q, not this one", device)
+	}
+	timestamp, err := strconv.ParseInt(req.Header.Get(TimestampHeader), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timestamp: %s", err)
+	}
+	now := v.now()
+	at := time.Unix(timestamp, 0)
+	if at.Before(now.Add(-MaxAge)) || at.After(now.Add(MaxAge)) {
+		return nil, fmt.Errorf("request timestamp %s is too far from %s", at.UTC().Format(time.RFC3339), now.UTC().Format(time.RFC3339))
+	}
+	signature, err := base64.StdEncoding.DecodeString(req.Header.Get(SignatureHeader))
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature: %s", err)
+	}
+	if !ed25519.Verify(ed25519.PublicKey(signer.Bytes()), signedMessage(req, body), signature) {
+		return nil, errors.New("bad signature")
+	}
+
+	// ed25519 signatures are deterministic, so a replay has the same one
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for seen, expires := range v.seen {
+		if now.After(expires) {
+			delete(v.seen, seen)
+		}
+	}
+	key := string(signature)
+	if _, ok := v.seen[key]; ok {
+		return nil, errors.New("request already used")
+	}
+	v.seen[key] = at.Add(MaxAge)
+	return signed, nil
+}
+
+// SignPayload signs something that's kept, like a sealed secret, rather than a
+// request. kind keeps one sort of payload from being passed off as another.
+func SignPayload(key ed25519.PrivateKey, kind string, parts ...[]byte) []byte {
+	return ed25519.Sign(key, payloadMessage(kind, parts))
+}
+
+// VerifyPayload checks a SignPayload signature
+func VerifyPayload(signer gagliardetto.PublicKey, signature []byte, kind string, parts ...[]byte) bool {
+	return ed25519.Verify(ed25519.PublicKey(signer.Bytes()), payloadMessage(kind, parts), signature)
+}
+
+func payloadMessage(kind string, parts [][]byte) []byte {
+	var b bytes.Buffer
+	b.WriteString("daonetes-payload/1\n")
+	b.WriteString(kind)
+	b.WriteByte('\n')
+	for _, part := range parts {
+		// length prefixed, so the parts can't be shuffled between each other
+		binary.Write(&b, binary.BigEndian, uint64(len(part)))
+		b.Write(part)
+	}
+	return b.Bytes()
+}
@@ -0,0 +1,93 @@
+package apiauth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	gagliardetto "github.com/gagliardetto/solana-go"
+)
+
+const testDevice = "9xQeWvG816bUx9EPjHmaT23yvVM2ZWbrrpZb9PusVFin"
+
+func signedRequest(t *testing.T, key ed25519.PrivateKey, body string) *http.Request {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, "http://localhost:9495/secrets?proxy=laptop&name=db", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	Sign(req, []byte(body), key, testDevice, nil)
+	return req
+}
+
+func TestVerify(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	v := NewVerifier(testDevice)
+
+	req := signedRequest(t, key, `{"name":"db"}`)
+	// forwarded over the mesh, without ?proxy=
+	req.URL.RawQuery = "name=db"
+	signed, err := v.Verify(req, []byte(`{"name":"db"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !signed.Signer.Equals(gagliardetto.PublicKeyFromBytes(key.Public().(ed25519.PublicKey))) {
+		t.Errorf("signer %s", signed.Signer)
+	}
+	if _, err := v.Verify(req, []byte(`{"name":"db"}`)); err == nil {
+		t.Error("expected a replay to fail")
+	}
+}
+
+func TestVerifyRejects(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	for name, tamper := range map[string]func(req *http.Request) ([]byte, *Verifier){
+		"unsigned": func(req *http.Request) ([]byte, *Verifier) {
+			req.Header.Del(SignatureHeader)
+			return []byte("body"), NewVerifier(testDevice)
+		},
+		"body": func(req *http.Request) ([]byte, *Verifier) {
+			return []byte("other"), NewVerifier(testDevice)
+		},
+		"query": func(req *http.Request) ([]byte, *Verifier) {
+			req.URL.RawQuery = "name=other"
+			return []byte("body"), NewVerifier(testDevice)
+		},
+		"method": func(req *http.Request) ([]byte, *Verifier) {
+			req.Method = http.MethodDelete
+			return []byte("body"), NewVerifier(testDevice)
+		},
+		"other device": func(req *http.Request) ([]byte, *Verifier) {
+			return []byte("body"), NewVerifier("11111111111111111111111111111111")
+		},
+		"old": func(req *http.Request) ([]byte, *Verifier) {
+			v := NewVerifier(testDevice)
+			v.now = func() time.Time { return time.Now().Add(2 * MaxAge) }
+			return []byte("body"), v
+		},
+	} {
+		req := signedRequest(t, key, "body")
+		body, v := tamper(req)
+		if _, err := v.Verify(req, body); err == nil {
+			t.Errorf("%s: expected it to fail", name)
+		}
+	}
+}
+
+func TestPayload(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	signer := gagliardetto.PublicKeyFromBytes(key.Public().(ed25519.PublicKey))
+	signature := SignPayload(key, "secret", []byte("db"), []byte("sealed"))
+	if !VerifyPayload(signer, signature, "secret", []byte("db"), []byte("sealed")) {
+		t.Error("expected it to verify")
+	}
+	if VerifyPayload(signer, signature, "secret", []byte("dbs"), []byte("ealed")) {
+		t.Error("moving bytes between the parts shouldn't verify")
+	}
+	if VerifyPayload(signer, signature, "registry", []byte("db"), []byte("sealed")) {
+		t.Error("another kind shouldn't verify")
+	}
+}
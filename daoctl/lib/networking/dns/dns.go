@@ -13,20 +13,25 @@ import (
 var dnsPort = ":53"
 var tld = "dmesh."
 
-// global struct to store dns entries
-var hostmap = map[string]net.IP{
-	"local." + tld: net.ParseIP("127.0.0.1"),
+// global struct to store dns entries, IPv4 and IPv6 ones
+var hostmap = map[string][]net.IP{
+	"local." + tld: {net.ParseIP("127.0.0.1"), net.IPv6loopback},
 }
 
-// updateDnsInfo
-func UpdateDnsHostRecord(hostname string, ip net.IP) error {
+// updateDnsInfo sets the addresses for hostname, A records for the IPv4 ones and AAAA for the IPv6 ones
+func UpdateDnsHostRecord(hostname string, ips ...net.IP) error {
 	// TODO: yeah, better to be careful about testing if its already fully qualified, if it ends in a dot, or has the tld etc
 	fullname := fmt.Sprintf("%s.%s", hostname, tld)
 	//fmt.Printf("--- DNS entry %s to %s\n", fullname, ip.String())
-	hostmap[fullname] = ip
+	hostmap[fullname] = ips
 	return nil
 }
 
+// RemoveDnsHostRecord stops answering for hostname
+func RemoveDnsHostRecord(hostname string) {
+	delete(hostmap, fmt.Sprintf("%s.%s", hostname, tld))
+}
+
 // Installer stub that calls the OS specific implementation to tell the OS to use it...
 // https://minikube.sigs.k8s.io/docs/handbook/addons/ingress-dns/
 
@@ -53,20 +58,23 @@ func RunDnsService(ctx context.Context) {
 func handleRequest(w dns.ResponseWriter, request *dns.Msg) {
 	reply := new(dns.Msg)
 	reply.SetReply(request)
-	if ip, ok := hostmap[request.Question[0].Name]; ok {
-		if request.Question[0].Qtype == dns.TypeA {
-			// who me, care about IPv6?
-			reply.Authoritative = true
-			aRec := &dns.A{
-				Hdr: dns.RR_Header{
-					Name:   request.Question[0].Name,
-					Rrtype: dns.TypeA,
-					Class:  dns.ClassINET,
-					Ttl:    0,
-				},
-				A: ip, //net.ParseIP(fmt.Sprintf("127.1.0.%d", 11)).To4(),
+	question := request.Question[0]
+	if ips, ok := hostmap[question.Name]; ok {
+		// it's ours, so no answer means there's no address of that type (NODATA), not NXDOMAIN
+		reply.Authoritative = true
+		for _, ip := range ips {
+			header := dns.RR_Header{
+				Name:   question.Name,
+				Rrtype: question.Qtype,
+				Class:  dns.ClassINET,
+				Ttl:    0,
+			}
+			switch {
+			case question.Qtype == dns.TypeA && ip.To4() != nil:
+				reply.Answer = append(reply.Answer, &dns.A{Hdr: header, A: ip.To4()})
+			case question.Qtype == dns.TypeAAAA && ip.To4() == nil:
+				reply.Answer = append(reply.Answer, &dns.AAAA{Hdr: header, AAAA: ip})
 			}
-			reply.Answer = append(reply.Answer, aRec)
 		}
 	}
 	w.WriteMsg(reply)
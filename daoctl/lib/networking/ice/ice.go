@@ -7,6 +7,7 @@ import (
 	"net"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	//"github.com/davecgh/go-spew/spew"
@@ -18,6 +19,34 @@ import (
 	"go.opentelemetry.io/otel/trace"
 )
 
+// iceTCPPort is where the (passive) ICE-TCP candidates are accepted, for all the connections
+const iceTCPPort = 12914
+
+var (
+	tcpMuxOnce sync.Once
+	tcpMux     ice.TCPMux
+)
+
+// getTCPMux starts listening for ICE-TCP the first time it's needed, it's nil
+// if that didn't work, and the connections make do with UDP
+func getTCPMux(ctx context.Context) ice.TCPMux {
+	tcpMuxOnce.Do(func() {
+		log := logr.FromContextOrDiscard(ctx)
+		listener, err := net.Listen("tcp", fmt.Sprintf(":%d", iceTCPPort))
+		if err != nil {
+			log.Error(err, "Couldn't listen for ICE-TCP, only using UDP", "port", iceTCPPort)
+			return
+		}
+		log.Info("Listening for ICE-TCP", "port", iceTCPPort)
+		tcpMux = ice.NewTCPMuxDefault(ice.TCPMuxParams{
+			Listener:        listener,
+			ReadBufferSize:  8,
+			WriteBufferSize: 4 * 1024 * 1024,
+		})
+	})
+	return tcpMux
+}
+
 // So the connection flow is:
 // new client sends their auth info to SvenServer_auth
 // server side starts its agent, sends its auth to SvenClient_auth
@@ -208,8 +237,15 @@ func (conn *Conection) iceConnectionRequest(
 		log.Info("CancelService() done")
 	}()
 
+	// IPv6 for the devices behind CGNAT that have nothing else, TCP for networks that drop UDP
+	networkTypes := []ice.NetworkType{ice.NetworkTypeUDP4, ice.NetworkTypeUDP6}
+	tcpMux := getTCPMux(ctx)
+	if tcpMux != nil {
+		networkTypes = append(networkTypes, ice.NetworkTypeTCP4, ice.NetworkTypeTCP6)
+	}
 	iceAgent, err := ice.NewAgent(&ice.AgentConfig{
-		NetworkTypes: []ice.NetworkType{ice.NetworkTypeUDP4},
+		NetworkTypes: networkTypes,
+		TCPMux:       tcpMux,
 	})
 	if err != nil {
 		return err
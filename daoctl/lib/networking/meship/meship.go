@@ -0,0 +1,182 @@
+// Package meship hands out the devices' mesh addresses. Each device's address is
+// derived from its key, and collisions go to the device that joined first, so
+// every agent works out the same one from the chain without asking anyone, and
+// it doesn't move when devices join or leave the workgroup.
+package meship
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+)
+
+// maxProbes is how many addresses a key tries before the prefix counts as full
+const maxProbes = 1024
+
+// Allocator gives each key an address in prefix. Two keys can hash to the same
+// address, then the one that joined first keeps it and the other probes on. That
+// only depends on the device list, so every agent agrees, and a device that
+// joins never moves one that was there before it.
+type Allocator struct {
+	prefix   netip.Prefix
+	reserved map[netip.Addr]bool
+}
+
+// New makes an Allocator for prefix, which needs room for at least a couple of devices
+func New(prefix netip.Prefix) (*Allocator, error) {
+	if !prefix.IsValid() {
+		return nil, fmt.Errorf("invalid mesh prefix")
+	}
+	prefix = prefix.Masked()
+	if prefix.Addr().BitLen()-prefix.Bits() < 2 {
+		return nil, fmt.Errorf("mesh prefix %s is too small", prefix)
+	}
+	return &Allocator{
+		prefix:   prefix,
+		reserved: map[netip.Addr]bool{},
+	}, nil
+}
+
+// ParsePrefix is netip.ParsePrefix, with an error that says what it was for
+func ParsePrefix(cidr string) (netip.Prefix, error) {
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return prefix, fmt.Errorf("invalid mesh CIDR %q: %s", cidr, err)
+	}
+	return prefix, nil
+}
+
+func (a *Allocator) Prefix() netip.Prefix {
+	return a.prefix
+}
+
+// Reserve keeps addr from being handed out, eg for a DNS server
+func (a *Allocator) Reserve(addr netip.Addr) {
+	a.reserved[addr] = true
+}
+
+// Assign gives each of keys an address. keys are in the order the devices
+// joined (the workgroup's device list), each one probes until it finds an
+// address none of the ones before it have, so its address only depends on them.
+func (a *Allocator) Assign(keys []string) (map[string]netip.Addr, error) {
+	addrs := make(map[string]netip.Addr, len(keys))
+	taken := map[netip.Addr]bool{}
+	for _, key := range keys {
+		if _, ok := addrs[key]; ok {
+			// listed twice
+			continue
+		}
+		for i := uint32(0); ; i++ {
+			if i == maxProbes {
+				return nil, fmt.Errorf("no free address in %s for %s", a.prefix, key)
+			}
+			addr := Candidate(a.prefix, key, i)
+			if a.usable(addr) && !taken[addr] {
+				taken[addr] = true
+				addrs[key] = addr
+				break
+			}
+		}
+	}
+	return addrs, nil
+}
+
+// usable says if addr can be handed out at all
+func (a *Allocator) usable(addr netip.Addr) bool {
+	if !addr.IsValid() || !a.prefix.Contains(addr) || a.reserved[addr] {
+		return false
+	}
+	host := hostBits(a.prefix, addr)
+	if isZero(host) {
+		// the network address (the subnet router anycast address in IPv6)
+		return false
+	}
+	if addr.Is4() && isAllOnes(host, a.prefix.Addr().BitLen()-a.prefix.Bits()) {
+		// broadcast
+		return false
+	}
+	return true
+}
+
+// Nth is prefix's network address plus n, the old way of giving the devices
+// addresses by where they are in the workgroup's device list
+func (a *Allocator) Nth(n uint32) (netip.Addr, error) {
+	addr := a.prefix.Addr().AsSlice()
+	carry := uint64(n)
+	for b := len(addr) - 1; b >= 0 && carry > 0; b-- {
+		carry += uint64(addr[b])
+		addr[b] = byte(carry)
+		carry >>= 8
+	}
+	result, _ := netip.AddrFromSlice(addr)
+	if carry > 0 || !a.usable(result) {
+		return netip.Addr{}, fmt.Errorf("no address %d in %s", n, a.prefix)
+	}
+	return result, nil
+}
+
+// Candidate is the i'th address key tries in prefix, the prefix's network bits
+// with the host bits from sha256(key, i)
+func Candidate(prefix netip.Prefix, key string, i uint32) netip.Addr {
+	h := sha256.New()
+	h.Write([]byte(key))
+	binary.Write(h, binary.BigEndian, i)
+	sum := h.Sum(nil)
+
+	network := prefix.Masked().Addr().AsSlice()
+	bits := prefix.Bits()
+	addr := make([]byte, len(network))
+	for b := range addr {
+		// how many bits of this byte are network bits
+		n := bits - b*8
+		switch {
+		case n >= 8:
+			addr[b] = network[b]
+		case n <= 0:
+			addr[b] = sum[b]
+		default:
+			mask := byte(0xff << (8 - n))
+			addr[b] = network[b]&mask | sum[b]&^mask
+		}
+	}
+	result, _ := netip.AddrFromSlice(addr)
+	return result
+}
+
+func hostBits(prefix netip.Prefix, addr netip.Addr) []byte {
+	network := prefix.Masked().Addr().AsSlice()
+	host := addr.AsSlice()
+	for b := range host {
+		host[b] &^= network[b]
+		if n := prefix.Bits() - b*8; n >= 8 {
+			host[b] = 0
+		} else if n > 0 {
+			host[b] &= 0xff >> n
+		}
+	}
+	return host
+}
+
+func isZero(bytes []byte) bool {
+	for _, b := range bytes {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func isAllOnes(host []byte, hostLen int) bool {
+	for b := len(host) - 1; b >= 0 && hostLen > 0; b-- {
+		want := byte(0xff)
+		if hostLen < 8 {
+			want = 0xff >> (8 - hostLen)
+		}
+		if host[b]&want != want {
+			return false
+		}
+		hostLen -= 8
+	}
+	return true
+}
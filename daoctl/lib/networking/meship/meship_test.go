@@ -0,0 +1,120 @@
+package meship
+
+import (
+	"fmt"
+	"net/netip"
+	"testing"
+)
+
+func TestAssignIsStable(t *testing.T) {
+	keys := []string{"dev-a", "dev-b", "dev-c", "dev-d"}
+	for _, cidr := range []string{"10.99.0.0/16", "fdda:99::/64"} {
+		a, err := New(netip.MustParsePrefix(cidr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		addrs, err := a.Assign(keys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for key, addr := range addrs {
+			if !a.Prefix().Contains(addr) {
+				t.Errorf("%s: %s isn't in %s", key, addr, cidr)
+			}
+		}
+
+		// another agent, once one of them has left
+		b, _ := New(netip.MustParsePrefix(cidr))
+		reordered, err := b.Assign([]string{"dev-a", "dev-c", "dev-d"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for key, addr := range reordered {
+			if addrs[key] != addr {
+				t.Errorf("%s: %s moved to %s", key, addrs[key], addr)
+			}
+		}
+	}
+}
+
+func TestAssignCollisions(t *testing.T) {
+	// a /29 has 6 usable addresses, so 6 devices have to collide and probe
+	a, err := New(netip.MustParsePrefix("10.0.0.0/29"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []string{}
+	for i := 0; i < 6; i++ {
+		keys = append(keys, fmt.Sprintf("dev-%d", i))
+	}
+	addrs, err := a.Assign(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := map[netip.Addr]string{}
+	for key, addr := range addrs {
+		if other, ok := seen[addr]; ok {
+			t.Errorf("%s and %s both got %s", key, other, addr)
+		}
+		seen[addr] = key
+		if addr == netip.MustParseAddr("10.0.0.0") || addr == netip.MustParseAddr("10.0.0.7") {
+			t.Errorf("%s got the network or broadcast address %s", key, addr)
+		}
+	}
+	if _, err := a.Assign(append(keys, "dev-6")); err == nil {
+		t.Error("expected the prefix to be full")
+	}
+
+	// the ones that joined first keep their addresses as more join, whatever they hash to
+	b, _ := New(netip.MustParsePrefix("10.0.0.0/29"))
+	for n := 1; n <= len(keys); n++ {
+		again, err := b.Assign(keys[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range keys[:n] {
+			if again[key] != addrs[key] {
+				t.Errorf("%d devices: %s has %s, not %s", n, key, again[key], addrs[key])
+			}
+		}
+	}
+}
+
+func TestAssignSkipsReserved(t *testing.T) {
+	a, _ := New(netip.MustParsePrefix("10.1.0.0/30"))
+	a.Reserve(netip.MustParseAddr("10.1.0.1"))
+	addrs, err := a.Assign([]string{"dev-a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addrs["dev-a"] != netip.MustParseAddr("10.1.0.2") {
+		t.Errorf("got %s", addrs["dev-a"])
+	}
+}
+
+func TestNth(t *testing.T) {
+	a, _ := New(netip.MustParsePrefix("192.169.99.0/24"))
+	for n, want := range map[uint32]string{2: "192.169.99.2", 254: "192.169.99.254", 0: "", 255: "", 300: ""} {
+		addr, err := a.Nth(n)
+		if want == "" {
+			if err == nil {
+				t.Errorf("%d: expected an error, got %s", n, addr)
+			}
+			continue
+		}
+		if err != nil || addr.String() != want {
+			t.Errorf("%d: got %s (%v), expected %s", n, addr, err, want)
+		}
+	}
+
+	b, _ := New(netip.MustParsePrefix("fdda:99::/64"))
+	if addr, err := b.Nth(258); err != nil || addr.String() != "fdda:99::102" {
+		t.Errorf("got %s (%v)", addr, err)
+	}
+}
+
+func TestNewRejectsTinyPrefixes(t *testing.T) {
+	if _, err := New(netip.MustParsePrefix("10.0.0.1/32")); err == nil {
+		t.Error("expected a /32 to be too small")
+	}
+}
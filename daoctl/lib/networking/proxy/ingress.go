@@ -0,0 +1,186 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/rs/cors"
+)
+
+// Ingress is the agent's HTTP reverse proxy, it sends each request on to the
+// service its Host names, so the http publishers can be reached by name
+// (eg <service>.<host>.dmesh) rather than address and port. It streams, so
+// websockets and server-sent events go through too.
+type Ingress struct {
+	mu           sync.RWMutex
+	routes       map[string]IngressRoute
+	wireguardNet MeshNet
+
+	proxy   *httputil.ReverseProxy
+	handler http.Handler
+}
+
+// IngressRoute is where a hostname's requests go
+type IngressRoute struct {
+	// Addrs are tried in order, eg a device's IPv4 and IPv6 mesh addresses with the port
+	Addrs []string
+	// Local services (this device's) are dialled directly, not through the mesh
+	Local bool
+}
+
+type ingressRouteKey struct{}
+
+// NewIngress makes an Ingress that leaves CORS to the services, unless it's
+// given corsOrigins, then it answers CORS requests from those itself, for all
+// of the services, and drops theirs
+func NewIngress(corsOrigins []string) *Ingress {
+	i := &Ingress{routes: map[string]IngressRoute{}}
+	i.proxy = &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			route := req.Context().Value(ingressRouteKey{}).(IngressRoute)
+			req.URL.Scheme = "http"
+			// the transport dials the route, this is what it pools connections by
+			req.URL.Host = route.Addrs[0]
+			proto := "http"
+			if req.TLS != nil {
+				proto = "https"
+			}
+			// ReverseProxy adds X-Forwarded-For
+			req.Header.Set("X-Forwarded-Host", req.Host)
+			req.Header.Set("X-Forwarded-Proto", proto)
+			if _, ok := req.Header["User-Agent"]; !ok {
+				// don't let the transport add Go's
+				req.Header.Set("User-Agent", "")
+			}
+		},
+		Transport: &http.Transport{
+			DialContext:           i.dial,
+			MaxIdleConns:          100,
+			IdleConnTimeout:       90 * time.Second,
+			ExpectContinueTimeout: 1 * time.Second,
+		},
+		// flush straight away, eg server-sent events
+		FlushInterval: -1,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log := logr.FromContextOrDiscard(r.Context())
+			log.Error(err, "error proxying request", "host", r.Host, "path", r.URL.Path)
+			http.Error(w, fmt.Sprintf("dmesh: %s unreachable: %s", r.Host, err), http.StatusBadGateway)
+		},
+	}
+	i.handler = http.HandlerFunc(i.route)
+
+	if len(corsOrigins) > 0 {
+		// the services' own CORS headers would end up next to ours
+		i.proxy.ModifyResponse = func(res *http.Response) error {
+			for name := range res.Header {
+				if strings.HasPrefix(name, "Access-Control-") {
+					res.Header.Del(name)
+				}
+			}
+			return nil
+		}
+		i.handler = cors.New(cors.Options{
+			AllowedOrigins: corsOrigins,
+			AllowedMethods: []string{
+				http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+				http.MethodPatch, http.MethodDelete, http.MethodOptions,
+			},
+			AllowedHeaders: []string{"*"},
+			// TODO: credentials, with cookies any site in corsOrigins could call the services as the user
+		}).Handler(i.handler)
+	}
+	return i
+}
+
+// SetRoutes replaces the hostnames the ingress knows, wireguardNet is how it
+// gets to the ones that aren't local
+func (i *Ingress) SetRoutes(wireguardNet MeshNet, routes map[string]IngressRoute) {
+	clean := make(map[string]IngressRoute, len(routes))
+	for host, route := range routes {
+		if len(route.Addrs) == 0 {
+			continue
+		}
+		clean[ingressHost(host)] = route
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.routes = clean
+	i.wireguardNet = wireguardNet
+}
+
+func (i *Ingress) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	i.handler.ServeHTTP(w, r)
+}
+
+func (i *Ingress) route(w http.ResponseWriter, r *http.Request) {
+	host := ingressHost(r.Host)
+	i.mu.RLock()
+	route, ok := i.routes[host]
+	i.mu.RUnlock()
+	if !ok {
+		http.Error(w, fmt.Sprintf("dmesh: no http service called %s", host), http.StatusNotFound)
+		return
+	}
+	i.proxy.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ingressRouteKey{}, route)))
+}
+
+func (i *Ingress) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	route, ok := ctx.Value(ingressRouteKey{}).(IngressRoute)
+	if !ok {
+		return nil, fmt.Errorf("no route to %s", addr)
+	}
+	if route.Local {
+		dialer := net.Dialer{Timeout: meshDialTimeout}
+		return dialer.DialContext(ctx, network, route.Addrs[0])
+	}
+	i.mu.RLock()
+	wireguardNet := i.wireguardNet
+	i.mu.RUnlock()
+	if wireguardNet == nil {
+		return nil, errors.New("mesh not ready")
+	}
+	return dialMesh(ctx, network, route.Addrs, wireguardNet)
+}
+
+// ListenAndServe serves the ingress on addr until ctx is done, then lets the
+// requests in flight finish, for as long as Drain waits for the forwarded connections
+func (i *Ingress) ListenAndServe(ctx context.Context, addr string) error {
+	drain := currentDrainCtx()
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           i,
+		ReadHeaderTimeout: 30 * time.Second,
+		BaseContext: func(net.Listener) context.Context {
+			return connContext{Context: drain, values: ctx}
+		},
+	}
+	activeConnections.Add(1)
+	go func() {
+		defer activeConnections.Done()
+		<-ctx.Done()
+		// TODO: websockets are hijacked, so Shutdown doesn't wait for them
+		server.Shutdown(drain)
+		server.Close()
+	}()
+	err := server.ListenAndServe()
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// ingressHost is the hostname without the port or the trailing dot
+func ingressHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
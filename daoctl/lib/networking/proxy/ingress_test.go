@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestIngressRoutesByHost(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "https://backend.example")
+		io.WriteString(w, strings.Join([]string{
+			r.Host,
+			r.Header.Get("X-Forwarded-Host"),
+			r.Header.Get("X-Forwarded-Proto"),
+			r.Header.Get("X-Forwarded-For"),
+		}, " "))
+	}))
+	defer backend.Close()
+
+	ingress := NewIngress([]string{"*"})
+	ingress.SetRoutes(nil, map[string]IngressRoute{
+		"Web.Laptop.dmesh": {Addrs: []string{backend.Listener.Addr().String()}, Local: true},
+	})
+	front := httptest.NewServer(ingress)
+	defer front.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, front.URL+"/", nil)
+	req.Host = "web.laptop.dmesh."
+	req.Header.Set("Origin", "https://app.example")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("got %s: %s", res.Status, body)
+	}
+	if want := "web.laptop.dmesh. web.laptop.dmesh. http 127.0.0.1"; string(body) != want {
+		t.Errorf("backend saw %q, want %q", body, want)
+	}
+	if origins := res.Header.Values("Access-Control-Allow-Origin"); len(origins) != 1 || origins[0] != "*" {
+		t.Errorf("Access-Control-Allow-Origin: %q", origins)
+	}
+
+	req, _ = http.NewRequest(http.MethodGet, front.URL+"/", nil)
+	req.Host = "other.laptop.dmesh"
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown host got %s", res.Status)
+	}
+}
+
+func TestIngressUpgrades(t *testing.T) {
+	// an echo after a 101, like a websocket
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "echo" {
+			http.Error(w, "upgrade please", http.StatusBadRequest)
+			return
+		}
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		line, _ := buf.ReadString('\n')
+		io.WriteString(conn, line)
+	}))
+	defer backend.Close()
+
+	ingress := NewIngress(nil)
+	ingress.SetRoutes(nil, map[string]IngressRoute{
+		"echo.laptop.dmesh": {Addrs: []string{backend.Listener.Addr().String()}, Local: true},
+	})
+	front := httptest.NewServer(ingress)
+	defer front.Close()
+
+	conn, err := net.Dial("tcp", front.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: echo.laptop.dmesh\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+	r := bufio.NewReader(conn)
+	res, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("got %s", res.Status)
+	}
+	io.WriteString(conn, "hello\n")
+	if line, _ := r.ReadString('\n'); line != "hello\n" {
+		t.Errorf("echoed %q", line)
+	}
+}
+
+func TestIngressLeavesCORSToServices(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "https://backend.example")
+	}))
+	defer backend.Close()
+
+	ingress := NewIngress(nil)
+	ingress.SetRoutes(nil, map[string]IngressRoute{
+		"web.laptop.dmesh": {Addrs: []string{backend.Listener.Addr().String()}, Local: true},
+	})
+	front := httptest.NewServer(ingress)
+	defer front.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, front.URL+"/", nil)
+	req.Host = "web.laptop.dmesh"
+	req.Header.Set("Origin", "https://app.example")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if origins := res.Header.Values("Access-Control-Allow-Origin"); len(origins) != 1 || origins[0] != "https://backend.example" {
+		t.Errorf("Access-Control-Allow-Origin: %q", origins)
+	}
+}
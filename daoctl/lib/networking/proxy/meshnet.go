@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"golang.zx2c4.com/wireguard/tun/netstack"
+)
+
+// MeshNet is how connections get into and out of the mesh, either wireguard-go's
+// userspace netstack, that only the agent can use, or the host's network stack
+// when there's a kernel wireguard interface
+type MeshNet interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+	// ListenTCPPort listens on port on the local device's mesh addresses
+	ListenTCPPort(port int) (net.Listener, error)
+	// ListenUDPPort is the same for UDP, with a socket per address it listens on
+	ListenUDPPort(port int) ([]net.PacketConn, error)
+}
+
+// ErrServedByHost is from a kernel MeshNet's ListenTCPPort or ListenUDPPort, when something on
+// the host already listens on every address on that port, so mesh connections
+// get to it without being forwarded
+var ErrServedByHost = errors.New("port already served on all of the host's addresses")
+
+// NetstackNet is the userspace mesh
+type NetstackNet struct {
+	*netstack.Net
+}
+
+func (n NetstackNet) ListenTCPPort(port int) (net.Listener, error) {
+	return n.Net.ListenTCP(&net.TCPAddr{Port: port})
+}
+
+func (n NetstackNet) ListenUDPPort(port int) ([]net.PacketConn, error) {
+	conn, err := n.Net.ListenUDP(&net.UDPAddr{Port: port})
+	if err != nil {
+		return nil, err
+	}
+	return []net.PacketConn{conn}, nil
+}
+
+// KernelNet is the mesh through a kernel wireguard interface with Addrs on it
+type KernelNet struct {
+	Addrs []netip.Addr
+}
+
+func (k KernelNet) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	dialer := net.Dialer{}
+	return dialer.DialContext(ctx, network, address)
+}
+
+func (k KernelNet) ListenTCPPort(port int) (net.Listener, error) {
+	listeners := []net.Listener{}
+	for _, addr := range k.Addrs {
+		// only the mesh addresses, the port shouldn't show up on the device's other networks
+		listener, err := net.Listen("tcp", net.JoinHostPort(addr.String(), strconv.Itoa(port)))
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			if errors.Is(err, syscall.EADDRINUSE) {
+				// eg docker publishing a deployment's port on 0.0.0.0
+				return nil, ErrServedByHost
+			}
+			return nil, err
+		}
+		listeners = append(listeners, listener)
+	}
+	if len(listeners) == 0 {
+		return nil, errors.New("no mesh addresses to listen on")
+	}
+	return newMultiListener(listeners), nil
+}
+
+func (k KernelNet) ListenUDPPort(port int) ([]net.PacketConn, error) {
+	conns := []net.PacketConn{}
+	for _, addr := range k.Addrs {
+		conn, err := net.ListenPacket("udp", net.JoinHostPort(addr.String(), strconv.Itoa(port)))
+		if err != nil {
+			for _, c := range conns {
+				c.Close()
+			}
+			if errors.Is(err, syscall.EADDRINUSE) {
+				return nil, ErrServedByHost
+			}
+			return nil, err
+		}
+		conns = append(conns, conn)
+	}
+	if len(conns) == 0 {
+		return nil, errors.New("no mesh addresses to listen on")
+	}
+	return conns, nil
+}
+
+// multiListener accepts from several listeners, eg IPv4 and IPv6
+type multiListener struct {
+	listeners []net.Listener
+	conns     chan net.Conn
+	errs      chan error
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newMultiListener(listeners []net.Listener) *multiListener {
+	m := &multiListener{
+		listeners: listeners,
+		conns:     make(chan net.Conn),
+		errs:      make(chan error, len(listeners)),
+		closed:    make(chan struct{}),
+	}
+	for _, listener := range listeners {
+		go func(listener net.Listener) {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					m.errs <- err
+					return
+				}
+				select {
+				case m.conns <- conn:
+				case <-m.closed:
+					conn.Close()
+					return
+				}
+			}
+		}(listener)
+	}
+	return m
+}
+
+func (m *multiListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-m.conns:
+		return conn, nil
+	case err := <-m.errs:
+		// one's broken, don't carry on with half of them
+		m.Close()
+		return nil, err
+	case <-m.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (m *multiListener) Close() error {
+	m.closeOnce.Do(func() {
+		close(m.closed)
+		for _, listener := range m.listeners {
+			listener.Close()
+		}
+	})
+	return nil
+}
+
+func (m *multiListener) Addr() net.Addr {
+	return m.listeners[0].Addr()
+}
@@ -2,20 +2,17 @@ package proxy
 
 import (
 	"context"
+	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"net"
-	"net/http"
+	"sync"
 	"time"
 
 	"github.com/go-logr/logr"
 	"github.com/northbright/iocopy"
-	"github.com/rs/cors"
-	"github.com/workbenchapp/worknet/daoctl/lib/options"
 	"github.com/workbenchapp/worknet/daoctl/lib/telemetry"
 	"go.opentelemetry.io/otel/attribute"
-	"golang.zx2c4.com/wireguard/tun/netstack"
 )
 
 const (
@@ -24,53 +21,160 @@ const (
 	forwardTimeout = 30 * time.Minute
 )
 
-// UDP: https://github.com/1lann/udp-forward ?
-// TODO: one big reason to be http/https aware, is to add cors magic :/
-// forward connection into the mesh
-func ForwardTCPToMesh(ctx context.Context, listenAddr, localDNSAddr, meshAddr string, wireguardNet *netstack.Net) error {
+// forwarded connections outlive the listener that accepted them, so a restart
+// or shutdown can let them finish, see Drain
+var (
+	activeConnections sync.WaitGroup
+	// drainMu guards drainCtx and killConnections, Drain replaces them
+	drainMu                   sync.Mutex
+	drainCtx, killConnections = context.WithCancel(context.Background())
+)
+
+// currentDrainCtx is done when Drain gives up on the connections started now
+func currentDrainCtx() context.Context {
+	drainMu.Lock()
+	defer drainMu.Unlock()
+	return drainCtx
+}
+
+// connContext keeps the listener ctx's values (logger, tracer), but is only
+// done when Drain gives up on the connection
+type connContext struct {
+	context.Context
+	values context.Context
+}
+
+func (c connContext) Value(key interface{}) interface{} {
+	return c.values.Value(key)
+}
+
+// forwardConnection forwards between two connections in the background, tracked for Drain
+func forwardConnection(ctx context.Context, from, to net.Conn) {
+	tcpCtx, cancel := context.WithTimeout(connContext{Context: currentDrainCtx(), values: ctx}, forwardTimeout)
+	activeConnections.Add(1)
+	go func() {
+		defer activeConnections.Done()
+		defer cancel()
+		forwardTCPConnection(tcpCtx, from, to)
+	}()
+}
+
+// Drain waits up to timeout for the forwarded connections to finish, once the
+// listeners have been stopped by cancelling their context, then closes the rest.
+// It says if they all finished by themselves.
+func Drain(ctx context.Context, timeout time.Duration) bool {
+	log := logr.FromContextOrDiscard(ctx)
+	done := make(chan struct{})
+	go func() {
+		activeConnections.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+	}
+	log.Info("Closing forwarded connections that didn't finish", "timeout", timeout)
+	drainMu.Lock()
+	kill := killConnections
+	drainMu.Unlock()
+	kill()
+	<-done
+	// ready for the next lot
+	drainMu.Lock()
+	drainCtx, killConnections = context.WithCancel(context.Background())
+	drainMu.Unlock()
+	return false
+}
+
+// forward connection into the mesh, from each of listenAddrs (the IPv4 and IPv6
+// local addresses), to the first of meshAddrs that answers
+func ForwardTCPToMesh(ctx context.Context, listenAddrs []string, localDNSAddr string, meshAddrs []string, wireguardNet MeshNet) error {
 	log := logr.FromContextOrDiscard(ctx)
 	lc := net.ListenConfig{}
-	listener, err := lc.Listen(ctx, "tcp", listenAddr)
-	if err != nil {
-		log.Error(err, "error listening")
-		return err
+	listeners := []net.Listener{}
+	for _, listenAddr := range listenAddrs {
+		listener, err := lc.Listen(ctx, "tcp", listenAddr)
+		if err != nil {
+			log.Error(err, "error listening", "addr", listenAddr)
+			if len(listeners) == 0 {
+				// the first is the IPv4 one, the others are nice to have
+				return err
+			}
+			continue
+		}
+		listeners = append(listeners, listener)
 	}
 	aborted := false
 	go func() {
 		<-ctx.Done()
 		aborted = true
-		listener.Close()
+		for _, listener := range listeners {
+			listener.Close()
+		}
 	}()
-	for {
-		incomingConnection, err := listener.Accept()
-		if err != nil {
-			if aborted {
-				log.Info("context canceled")
-				return err
+
+	errs := make(chan error, len(listeners))
+	for _, listener := range listeners {
+		go func(listener net.Listener) {
+			for {
+				incomingConnection, err := listener.Accept()
+				if err != nil {
+					if aborted {
+						errs <- err
+						return
+					}
+					log.Error(err, "error accepting connection")
+					continue
+				}
+
+				wgConnection, err := dialMesh(ctx, "tcp", meshAddrs, wireguardNet)
+				if err != nil {
+					incomingConnection.Close()
+					log.Error(err, "error forwarding connection")
+					continue
+				}
+
+				forwardConnection(ctx, wgConnection, incomingConnection)
 			}
-			log.Error(err, "error accepting connection")
-			continue
-		}
+		}(listener)
+	}
+	var err error
+	for range listeners {
+		err = <-errs
+	}
+	log.Info("context canceled")
+	return err
+}
 
-		tcpCtx, cancel := context.WithTimeout(ctx, forwardTimeout)
+// meshDialTimeout is how long to try each of a device's mesh addresses
+const meshDialTimeout = 10 * time.Second
 
-		// No DialTimeout in wg apparently
-		wgConnection, err := wireguardNet.Dial("tcp", meshAddr)
-		if err != nil {
-			cancel()
-			incomingConnection.Close()
-			log.Error(err, "error forwarding connection")
-			continue
+// dialMesh connects to the first of meshAddrs that answers
+func dialMesh(ctx context.Context, network string, meshAddrs []string, wireguardNet MeshNet) (net.Conn, error) {
+	err := fmt.Errorf("no mesh addresses")
+	for _, meshAddr := range meshAddrs {
+		dialCtx, cancel := context.WithTimeout(ctx, meshDialTimeout)
+		conn, dialErr := wireguardNet.DialContext(dialCtx, network, meshAddr)
+		cancel()
+		if dialErr == nil {
+			return conn, nil
 		}
-
-		go forwardTCPConnection(tcpCtx, wgConnection, incomingConnection)
+		err = dialErr
 	}
+	return nil, err
 }
 
 // forward connection out of the mesh to the actual network service
-func ReceiveFromMesh(ctx context.Context, listenAddr string, meshPort int, wireguardNet *netstack.Net) error {
+func ReceiveFromMesh(ctx context.Context, listenAddr string, meshPort int, wireguardNet MeshNet) error {
 	log := logr.FromContextOrDiscard(ctx)
-	listener, err := wireguardNet.ListenTCP(&net.TCPAddr{Port: meshPort})
+	listener, err := wireguardNet.ListenTCPPort(meshPort)
+	if err == ErrServedByHost {
+		// nothing to forward, wait for the next ctx like the listener would have
+		log.V(1).Info("Mesh port already served by the host", "port", meshPort)
+		<-ctx.Done()
+		return ctx.Err()
+	}
 	if err != nil {
 		return err
 	}
@@ -92,17 +196,14 @@ func ReceiveFromMesh(ctx context.Context, listenAddr string, meshPort int, wireg
 			continue
 		}
 
-		ctx, cancel := context.WithTimeout(ctx, forwardTimeout)
-
 		serviceConnection, err := net.DialTimeout("tcp", listenAddr, 10*time.Second)
 		if err != nil {
-			cancel()
 			wgConnection.Close()
 			log.Error(err, "error forwarding connection")
 			continue
 		}
 
-		go forwardTCPConnection(ctx, serviceConnection, wgConnection)
+		forwardConnection(ctx, serviceConnection, wgConnection)
 	}
 }
 
@@ -168,23 +269,25 @@ func forwardTCPConnection(ctx context.Context, from, to net.Conn) {
 		forwardTCPSpan.End()
 	}()
 
-	errCh := make(chan error)
+	// buffered, so the copies can finish after we've given up on them
+	errCh := make(chan error, 2)
 
 	go connCopy(ctx, to, from, errCh)
 	go connCopy(ctx, from, to, errCh)
-	eofs := 0
+	finished := 0
 	for {
 		select {
 		case err := <-errCh:
+			// connCopy says nil for a clean EOF
 			if err != nil && err != io.EOF {
 				forwardTCPSpan.SetAttributes(attribute.String("error", err.Error()))
 				log.Error(err, "error copying connection")
+				// closing both ends stops the other copy
+				return
 			}
-			if err == io.EOF {
-				eofs += 1
-				if eofs == 2 {
-					return
-				}
+			finished++
+			if finished == 2 {
+				return
 			}
 		case <-ctx.Done():
 			log.Error(ctx.Err(), "context cancelled in connection copy")
@@ -193,43 +296,3 @@ func forwardTCPConnection(ctx context.Context, from, to net.Conn) {
 		}
 	}
 }
-
-// http original code
-func forwardHTTPToMesh(gOpts *options.GlobalOptions, localAddr, remoteDeployAddress string, wireguardNet *netstack.Net) {
-	//gOpts *options.GlobalOptions, deploymentName string, wireguardNet *netstack.Net, pDev *ProxyDevice, deploymentPort int)
-
-	mux := http.NewServeMux()
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		var replyBytes []byte
-
-		// TODO: check that this is a valid hostname in this workgroup...
-		U := r.URL
-		U.Host = remoteDeployAddress
-		requestURL := "http:" + U.String()
-		gOpts.VDebug().Info(".. Proxying HTTP request to wg", "local addr", localAddr, "wg addr", requestURL)
-
-		client := http.Client{
-			Transport: &http.Transport{
-				DialContext: wireguardNet.DialContext,
-			},
-		}
-		res, err := client.Get(requestURL)
-		if err != nil {
-			w.Header().Set("Proxy-Error", err.Error())
-		} else {
-			// TODO: yeah, never do this - there's real streaming ffs.
-			replyBytes, err = ioutil.ReadAll(res.Body)
-			if err != nil {
-				w.Header().Set("ProxyReadAll-Error", err.Error())
-			}
-		}
-
-		w.Write(replyBytes)
-	})
-
-	// cors.Default() setup the middleware with default options being
-	// all origins accepted with simple methods (GET, POST). See
-	// documentation below for more options.
-	handler := cors.Default().Handler(mux)
-	go http.ListenAndServe(localAddr, handler)
-}
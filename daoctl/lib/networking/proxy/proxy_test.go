@@ -0,0 +1,40 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestForwardTCPConnectionFinishesOnEOF(t *testing.T) {
+	ctx, cancel := testContext()
+	defer cancel()
+
+	client, fromClient := net.Pipe()
+	toService, service := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		forwardTCPConnection(ctx, fromClient, toService)
+		close(done)
+	}()
+
+	go func() {
+		io.WriteString(client, "hello")
+		client.Close()
+	}()
+	got := make([]byte, 5)
+	if _, err := io.ReadFull(service, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello" {
+		t.Errorf("service got %q", got)
+	}
+	service.Close()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the forward to finish when both sides closed")
+	}
+}
@@ -0,0 +1,217 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/workbenchapp/worknet/daoctl/lib/telemetry"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// UDPIdleTimeout is how long a UDP session lasts without a datagram either way,
+// there's no close in UDP, so that's the only way they end. It's read when a
+// forwarder starts.
+var UDPIdleTimeout = 2 * time.Minute
+
+// biggest UDP payload there can be
+const maxDatagramSize = 64 * 1024
+
+// ForwardUDPToMesh is ForwardTCPToMesh for UDP. Each client address gets its own
+// session, a socket into the mesh, so the replies can find their way back to it.
+func ForwardUDPToMesh(ctx context.Context, listenAddrs []string, meshAddrs []string, wireguardNet MeshNet) error {
+	log := logr.FromContextOrDiscard(ctx)
+	lc := net.ListenConfig{}
+	conns := []net.PacketConn{}
+	for _, listenAddr := range listenAddrs {
+		conn, err := lc.ListenPacket(ctx, "udp", listenAddr)
+		if err != nil {
+			log.Error(err, "error listening", "addr", listenAddr)
+			if len(conns) == 0 {
+				return err
+			}
+			continue
+		}
+		conns = append(conns, conn)
+	}
+	relay := &udpRelay{idleTimeout: UDPIdleTimeout, dial: func(ctx context.Context) (net.Conn, error) {
+		// nothing answers a UDP dial, so this is the IPv4 address unless it can't be routed
+		return dialMesh(ctx, "udp", meshAddrs, wireguardNet)
+	}}
+	return relay.run(ctx, conns)
+}
+
+// ReceiveUDPFromMesh is ReceiveFromMesh for UDP, each device (address and port)
+// sending to meshPort gets its own socket to the service at listenAddr
+func ReceiveUDPFromMesh(ctx context.Context, listenAddr string, meshPort int, wireguardNet MeshNet) error {
+	log := logr.FromContextOrDiscard(ctx)
+	conns, err := wireguardNet.ListenUDPPort(meshPort)
+	if err == ErrServedByHost {
+		log.V(1).Info("Mesh port already served by the host", "port", meshPort, "protocol", "udp")
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	if err != nil {
+		return err
+	}
+	relay := &udpRelay{idleTimeout: UDPIdleTimeout, dial: func(ctx context.Context) (net.Conn, error) {
+		dialer := net.Dialer{Timeout: 10 * time.Second}
+		return dialer.DialContext(ctx, "udp", listenAddr)
+	}}
+	return relay.run(ctx, conns)
+}
+
+// udpRelay sends datagrams on through a session per sender, made with dial
+type udpRelay struct {
+	idleTimeout time.Duration
+	dial        func(context.Context) (net.Conn, error)
+	// sessionEnded is for tests, it's called with the sender once its session is closed
+	sessionEnded func(from string)
+}
+
+// udpSession is one sender's socket to the other side
+type udpSession struct {
+	conn        net.Conn
+	idleTimeout time.Duration
+	// unix nanos of the last datagram either way
+	lastActive int64
+}
+
+func (s *udpSession) touch() {
+	atomic.StoreInt64(&s.lastActive, time.Now().UnixNano())
+}
+
+func (s *udpSession) idleUntil() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&s.lastActive)).Add(s.idleTimeout)
+}
+
+// run reads the datagrams arriving on conns, and sends each on through its
+// sender's session, made with dial the first time. Sessions are closed after
+// idleTimeout, or when ctx is done, run returns once they all have. Unlike TCP
+// connections, Drain doesn't wait for them, a UDP session never says it's
+// finished.
+func (r *udpRelay) run(ctx context.Context, conns []net.PacketConn) error {
+	log := logr.FromContextOrDiscard(ctx)
+	var mu sync.Mutex
+	sessions := map[string]*udpSession{}
+	var running sync.WaitGroup
+
+	go func() {
+		<-ctx.Done()
+		for _, conn := range conns {
+			conn.Close()
+		}
+		mu.Lock()
+		for _, s := range sessions {
+			s.conn.Close()
+		}
+		mu.Unlock()
+	}()
+
+	errs := make(chan error, len(conns))
+	for _, conn := range conns {
+		go func(conn net.PacketConn) {
+			buf := make([]byte, maxDatagramSize)
+			for {
+				n, from, err := conn.ReadFrom(buf)
+				if err != nil {
+					if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+						errs <- err
+						return
+					}
+					log.Error(err, "error reading datagram")
+					continue
+				}
+
+				key := from.String()
+				mu.Lock()
+				s, ok := sessions[key]
+				mu.Unlock()
+				if !ok {
+					// each conn has its own senders, so nothing else can be adding this one
+					out, err := r.dial(ctx)
+					if err != nil {
+						log.Error(err, "error forwarding datagram", "from", key)
+						continue
+					}
+					s = &udpSession{conn: out, idleTimeout: r.idleTimeout}
+					s.touch()
+					mu.Lock()
+					sessions[key] = s
+					mu.Unlock()
+					running.Add(1)
+					go func() {
+						defer running.Done()
+						forwardUDPReplies(ctx, s, conn, from)
+						mu.Lock()
+						delete(sessions, key)
+						mu.Unlock()
+						s.conn.Close()
+						if r.sessionEnded != nil {
+							r.sessionEnded(key)
+						}
+					}()
+				}
+				s.touch()
+				if _, err := s.conn.Write(buf[:n]); err != nil {
+					log.V(1).Info("error forwarding datagram", "from", key, "err", err)
+				}
+			}
+		}(conn)
+	}
+	var err error
+	for range conns {
+		err = <-errs
+	}
+	running.Wait()
+	log.Info("context canceled")
+	return err
+}
+
+// forwardUDPReplies sends what comes back on a session to the sender, until the
+// session's been idle for its idleTimeout
+func forwardUDPReplies(ctx context.Context, s *udpSession, conn net.PacketConn, to net.Addr) {
+	tracer := telemetry.TracerFromContext(ctx)
+	log := logr.FromContextOrDiscard(ctx)
+
+	_, span := tracer.Start(ctx, "forwardUDPSession")
+	span.SetAttributes(
+		attribute.String("conn.localAddr", conn.LocalAddr().String()),
+		attribute.String("conn.remoteAddr", to.String()),
+	)
+	defer span.End()
+	log.V(1).Info("UDP session started", "from", to, "to", s.conn.RemoteAddr())
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		idleUntil := s.idleUntil()
+		if !time.Now().Before(idleUntil) {
+			log.V(1).Info("UDP session idle, closing", "from", to)
+			return
+		}
+		s.conn.SetReadDeadline(idleUntil)
+		n, err := s.conn.Read(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				// the sender might have kept it going
+				continue
+			}
+			if ctx.Err() == nil {
+				// eg ICMP port unreachable, the next datagram makes a new session
+				span.SetAttributes(attribute.String("error", err.Error()))
+				log.V(1).Info("UDP session closed", "from", to, "err", err)
+			}
+			return
+		}
+		s.touch()
+		if _, err := conn.WriteTo(buf[:n], to); err != nil {
+			span.SetAttributes(attribute.String("error", err.Error()))
+			return
+		}
+	}
+}
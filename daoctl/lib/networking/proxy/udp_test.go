@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/workbenchapp/worknet/daoctl/lib/options"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// testContext has the tracer the forwarders expect
+func testContext() (context.Context, context.CancelFunc) {
+	ctx := context.WithValue(context.Background(), options.TracerKey, trace.NewNoopTracerProvider().Tracer("test"))
+	return context.WithCancel(ctx)
+}
+
+// udpEcho answers each datagram with itself, and says where it came from
+func udpEcho(t *testing.T) (net.PacketConn, <-chan string) {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	froms := make(chan string, 10)
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			froms <- from.String()
+			conn.WriteTo(buf[:n], from)
+		}
+	}()
+	return conn, froms
+}
+
+// startRelay runs relay to to, until the test's done
+func startRelay(t *testing.T, relay *udpRelay, to string) net.Addr {
+	t.Helper()
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay.dial = func(ctx context.Context) (net.Conn, error) {
+		return net.Dial("udp", to)
+	}
+	ctx, cancel := testContext()
+	done := make(chan struct{})
+	go func() {
+		relay.run(ctx, []net.PacketConn{listener})
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return listener.LocalAddr()
+}
+
+func roundTrip(t *testing.T, client net.Conn, msg string) {
+	t.Helper()
+	if _, err := client.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 100)
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != msg {
+		t.Errorf("got %q back, sent %q", buf[:n], msg)
+	}
+}
+
+func TestRelayUDPSessions(t *testing.T) {
+	echo, froms := udpEcho(t)
+	defer echo.Close()
+	relay := startRelay(t, &udpRelay{idleTimeout: time.Minute}, echo.LocalAddr().String())
+
+	a, _ := net.Dial("udp", relay.String())
+	defer a.Close()
+	b, _ := net.Dial("udp", relay.String())
+	defer b.Close()
+
+	roundTrip(t, a, "a1")
+	fromA := <-froms
+	roundTrip(t, b, "b1")
+	fromB := <-froms
+	roundTrip(t, a, "a2")
+	if from := <-froms; from != fromA {
+		t.Errorf("a's session moved from %s to %s", fromA, from)
+	}
+	if fromA == fromB {
+		t.Errorf("a and b share the session from %s", fromA)
+	}
+}
+
+func TestRelayUDPIdleTimeout(t *testing.T) {
+	echo, froms := udpEcho(t)
+	defer echo.Close()
+	ended := make(chan string, 1)
+	relay := startRelay(t, &udpRelay{
+		idleTimeout:  100 * time.Millisecond,
+		sessionEnded: func(from string) { ended <- from },
+	}, echo.LocalAddr().String())
+
+	client, _ := net.Dial("udp", relay.String())
+	defer client.Close()
+	roundTrip(t, client, "one")
+	first := <-froms
+	select {
+	case <-ended:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the idle session to be closed")
+	}
+	roundTrip(t, client, "two")
+	if second := <-froms; second == first {
+		t.Errorf("the idle session from %s was kept", first)
+	}
+}
@@ -0,0 +1,35 @@
+package wgctl
+
+import (
+	"strings"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// ParseConfig turns a configuration protocol "set" (what wireguard-go's IpcSet
+// takes) into a wgctrl Config, that replaces all the device's peers with its own
+func ParseConfig(uapi string) (wgtypes.Config, error) {
+	device, err := ParseDevice(strings.NewReader(uapi))
+	if err != nil {
+		return wgtypes.Config{}, err
+	}
+	config := wgtypes.Config{
+		PrivateKey:   &device.PrivateKey,
+		ReplacePeers: true,
+		Peers:        make([]wgtypes.PeerConfig, 0, len(device.Peers)),
+	}
+	if device.ListenPort != 0 {
+		config.ListenPort = &device.ListenPort
+	}
+	for i := range device.Peers {
+		peer := &device.Peers[i]
+		config.Peers = append(config.Peers, wgtypes.PeerConfig{
+			PublicKey:                   peer.PublicKey,
+			Endpoint:                    peer.Endpoint,
+			PersistentKeepaliveInterval: &peer.PersistentKeepaliveInterval,
+			ReplaceAllowedIPs:           true,
+			AllowedIPs:                  peer.AllowedIPs,
+		})
+	}
+	return config, nil
+}
@@ -0,0 +1,40 @@
+package wgctl
+
+import (
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestParseConfig(t *testing.T) {
+	private, _ := wgtypes.GeneratePrivateKey()
+	peerPrivate, _ := wgtypes.GeneratePrivateKey()
+	peer := peerPrivate.PublicKey()
+	uapi := "private_key=" + hex.EncodeToString(private[:]) + `
+listen_port=12912
+public_key=` + hex.EncodeToString(peer[:]) + `
+endpoint=127.1.0.3:12913
+persistent_keepalive_interval=25
+allowed_ip=192.169.99.3/32
+allowed_ip=fdda:99::3/128`
+
+	config, err := ParseConfig(uapi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *config.PrivateKey != private || *config.ListenPort != 12912 || !config.ReplacePeers {
+		t.Errorf("unexpected interface config %+v", config)
+	}
+	if len(config.Peers) != 1 {
+		t.Fatalf("expected one peer, got %d", len(config.Peers))
+	}
+	p := config.Peers[0]
+	if p.PublicKey != peer || p.Endpoint.String() != "127.1.0.3:12913" {
+		t.Errorf("unexpected peer %+v", p)
+	}
+	if *p.PersistentKeepaliveInterval != 25*time.Second || !p.ReplaceAllowedIPs || len(p.AllowedIPs) != 2 {
+		t.Errorf("unexpected peer %+v", p)
+	}
+}
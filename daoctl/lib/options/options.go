@@ -53,10 +53,24 @@ type WorknetConfig struct {
 	Ports   []Publisher `yaml:"ports"`
 }
 
+// SpecSourcesConfig is where the agent looks for specs besides WorkSpec.UrlOrContents,
+// empty gateway lists use the public ones
+type SpecSourcesConfig struct {
+	IPFSGateways    []string `yaml:"ipfs_gateways,omitempty"`
+	ArweaveGateways []string `yaml:"arweave_gateways,omitempty"`
+	// Mirrors serve specs by hash, at <mirror>/sha256/<hash>
+	Mirrors []string `yaml:"mirrors,omitempty"`
+}
+
 type AgentConfig struct {
 	Version   string                    `yaml:"version"`
 	ActiveNet string                    `yaml:"active"`
 	Worknets  map[string]*WorknetConfig `yaml:"worknets"`
+	Specs     SpecSourcesConfig         `yaml:"specs,omitempty"`
+	// FeatureFlags are added to the agent's --feature-flags, and can be changed without a restart (SIGHUP)
+	FeatureFlags []string `yaml:"feature_flags,omitempty"`
+	// Labels are reported with the device's capacity, for deployments' placement constraints (node.labels.<name>)
+	Labels map[string]string `yaml:"labels,omitempty"`
 }
 
 func LicenseMint(ctx context.Context) gagliardetto.PublicKey {
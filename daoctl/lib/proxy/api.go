@@ -1,15 +1,14 @@
 package proxy
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
 	"net/http"
 
 	"github.com/davecgh/go-spew/spew"
 	"github.com/workbenchapp/worknet/daoctl/lib/networking/ice"
-	"github.com/workbenchapp/worknet/daoctl/lib/networking/wgctl"
 	"github.com/workbenchapp/worknet/daoctl/lib/solana"
+	"github.com/workbenchapp/worknet/daoctl/lib/workgroup"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
@@ -27,6 +26,34 @@ func updateEndpointProxyInfo(deploymentName string, port int, localAddress strin
 	key := fmt.Sprintf("%s:%d", deploymentName, port)
 	endpointProxyInfo[key] = localAddress
 }
+
+func removeEndpointProxyInfo(deploymentName string, port int) {
+	delete(endpointProxyInfo, fmt.Sprintf("%s:%d", deploymentName, port))
+}
+
+// advertiseEndpoints only lists the device's services that are healthy, the
+// listeners stay up so they're ready when it comes back
+func advertiseEndpoints(pDev *ProxyDevice, deviceInfo *workgroup.DeviceStatusInfo) {
+	if pDev.Info == nil || deviceInfo == nil {
+		return
+	}
+	for _, info := range deviceInfo.DeployState {
+		for _, state := range info.States {
+			for _, publish := range state.Publishers {
+				if publish.PublishedPort == 0 {
+					continue
+				}
+				port := int(publish.PublishedPort)
+				if !state.Healthy() {
+					removeEndpointProxyInfo(publish.Name, port)
+					continue
+				}
+				updateEndpointProxyInfo(publish.Name, port, fmt.Sprintf("%s.%s:%d", pDev.Info.Hostname, "dmesh", port))
+			}
+		}
+	}
+}
+
 func initAPIHandlers() {
 	endpointProxyInfo = make(map[string]string)
 
@@ -65,13 +92,11 @@ func initAPIHandlers() {
 		w.Header().Set("Content-Type", "application/json")
 		//IpComment := fmt.Sprintf("# MY IP: %s\n", wireguardAddress)
 		//w.Write([]byte(IpComment))
-		var b bytes.Buffer
 		if wireguardDev == nil {
 			w.Header().Set("Error", "Not ready yet")
 			return
 		}
-		wireguardDev.IpcGetOperation(&b)
-		device, err := wgctl.ParseDevice(&b)
+		device, err := wireguardDev.Device()
 		if err != nil {
 			spew.Fdump(w, err)
 			return
@@ -6,8 +6,11 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/http/httputil"
 	"net/http/pprof"
 	"net/url"
+	"sync"
+	"time"
 
 	"github.com/go-logr/logr"
 	"github.com/rs/cors"
@@ -17,9 +20,15 @@ import (
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 )
 
+// how long the API server waits for requests in flight when the agent stops
+const apiShutdownTimeout = 5 * time.Second
+
 // TODO: this needs to not be a global...
 var mux *http.ServeMux //http.NewServeMux()
 
+// the patterns added with AddPrivateAPIHandler, they're added while it's serving
+var privateAPIPatterns sync.Map
+
 func AddAPIHandler(pattern string, handler func(http.ResponseWriter, *http.Request)) {
 	if mux == nil {
 		// TODO: er, this ain't goroutinesafe..
@@ -29,6 +38,19 @@ func AddAPIHandler(pattern string, handler func(http.ResponseWriter, *http.Reque
 	mux.HandleFunc(pattern, handler)
 }
 
+// AddPrivateAPIHandler is AddAPIHandler for routes web pages mustn't use, they
+// don't get the DAPP's CORS headers, so a browser won't let a page read them or
+// preflight anything that isn't a simple request
+func AddPrivateAPIHandler(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	AddAPIHandler(pattern, handler)
+	privateAPIPatterns.Store(pattern, true)
+}
+
+func isPrivateAPIPattern(pattern string) bool {
+	_, ok := privateAPIPatterns.Load(pattern)
+	return ok
+}
+
 // ListenAndServeLocalhost is used to serve workgroup device info for all hosts to the DAPP - only http://localhost:9495 is safe from cors and mixed-tls-insecure errors (except on safari)
 func ListenAndServeLocalhost(ctx context.Context, addr string) {
 	cLog := logr.FromContextOrDiscard(ctx)
@@ -70,6 +92,10 @@ func ListenAndServeLocalhost(ctx context.Context, addr string) {
 				replyBytes, err = UpdateDeviceInfoFromMesh(ctx, pDev)
 				if err != nil {
 					w.Header().Set("GetDeviceInfo-Proxy-Error", err.Error())
+					// say what we last knew, and if it's gone delinquent
+					if cached := workgroup.GetCachedDeviceStatusInfo(pDev.Info.DeviceAuthority.String()); cached != nil {
+						replyBytes, _ = json.MarshalIndent(cached, "", "  ")
+					}
 				}
 			}
 		}
@@ -81,16 +107,29 @@ func ListenAndServeLocalhost(ctx context.Context, addr string) {
 	// cors.Default() setup the middleware with default options being
 	// all origins accepted with simple methods (GET, POST). See
 	// documentation below for more options.
-	handler := cors.Default().Handler(mux)
+	apiMux := mux
+	corsHandler := cors.Default().Handler(apiMux)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, pattern := apiMux.Handler(r); isPrivateAPIPattern(pattern) {
+			apiMux.ServeHTTP(w, r)
+			return
+		}
+		corsHandler.ServeHTTP(w, r)
+	})
 	httpServer := http.Server{
 		Addr:    addr,
 		Handler: otelhttp.NewHandler(handler, "daoctl"),
 	}
 	go func() {
 		<-ctx.Done()
-		// TODO: this should really be a timeOut based Shutdown...
 		mux = nil
-		httpServer.Close()
+		// let requests in flight finish, but not long polls like following logs
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), apiShutdownTimeout)
+		defer cancel()
+		if err := httpServer.Shutdown(shutdownCtx); err != nil {
+			cLog.Info("API server didn't shut down cleanly, closing", "err", err)
+			httpServer.Close()
+		}
 	}()
 
 	go httpServer.ListenAndServe()
@@ -133,3 +172,30 @@ func UpdateDeviceInfoFromMesh(ctx context.Context, pDev *ProxyDevice) (replyByte
 	//}
 	return replyBytes, err
 }
+
+// ForwardToDevice sends an API request on to the device called name (hostname
+// or device authority) over the mesh, and streams its reply back. Upgraded
+// connections (websockets etc) are passed through too.
+func ForwardToDevice(w http.ResponseWriter, r *http.Request, name string) {
+	pDev := GetProxyDeviceInfoByName(name)
+	if pDev == nil {
+		http.Error(w, name+" deviceInfo not cached yet", http.StatusNotFound)
+		return
+	}
+	target := &url.URL{
+		Scheme: "http",
+		Host:   fmt.Sprintf("%s:%d", pDev.ProxyAddress, 9495), // ALWAYS listen to port 9495 on the wireguard network
+	}
+	reverseProxy := httputil.NewSingleHostReverseProxy(target)
+	// flush as we go, logs get followed
+	reverseProxy.FlushInterval = -1
+	director := reverseProxy.Director
+	reverseProxy.Director = func(req *http.Request) {
+		director(req)
+		// don't make the other device forward it again
+		query := req.URL.Query()
+		query.Del("proxy")
+		req.URL.RawQuery = query.Encode()
+	}
+	reverseProxy.ServeHTTP(w, r)
+}
@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os/exec"
+	"runtime"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"github.com/workbenchapp/worknet/daoctl/lib/networking/dns"
+	netproxy "github.com/workbenchapp/worknet/daoctl/lib/networking/proxy"
+)
+
+var (
+	// IngressAddress is where the HTTP ingress listens, the <service>.<host>.dmesh
+	// names of the http publishers resolve to its IP. "" turns it off.
+	IngressAddress = "127.1.0.1:80"
+	// IngressCORSOrigins are the origins browsers can call the http publishers
+	// from, the ingress answers CORS for all of them, replacing the services' own
+	// headers. None (the default) leaves it to the services.
+	IngressCORSOrigins []string
+)
+
+var (
+	ingress   *netproxy.Ingress
+	ingressIP net.IP
+	// the <service>.<host> names in the DNS for the ingress
+	ingressNames = map[string]bool{}
+)
+
+// StartIngress runs the HTTP ingress in the background until ctx is done
+func StartIngress(ctx context.Context) error {
+	log := logr.FromContextOrDiscard(ctx)
+	if IngressAddress == "" {
+		log.Info("HTTP ingress disabled")
+		return nil
+	}
+	host, _, err := net.SplitHostPort(IngressAddress)
+	if err != nil {
+		return fmt.Errorf("invalid ingress address %q: %s", IngressAddress, err)
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("invalid ingress address %q: not an IP", IngressAddress)
+	}
+	if runtime.GOOS == "darwin" && ip.IsLoopback() && !ip.Equal(net.IPv4(127, 0, 0, 1)) {
+		// like the device proxy addresses, only 127.0.0.1 is there by default
+		if err := exec.Command("ifconfig", "lo0", "alias", host).Run(); err != nil {
+			log.Error(err, "Failed to configure ingress network alias")
+		}
+	}
+
+	origins := []string{}
+	for _, origin := range IngressCORSOrigins {
+		// eg --ingress-cors=""
+		if origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+	ingress, ingressIP = netproxy.NewIngress(origins), ip
+	go func(i *netproxy.Ingress) {
+		log.Info("HTTP ingress listening", "addr", IngressAddress, "cors", origins)
+		if err := i.ListenAndServe(ctx, IngressAddress); err != nil {
+			log.Error(err, "HTTP ingress stopped")
+		}
+	}(ingress)
+	return nil
+}
+
+// ingressHostname is the name a device's http publisher gets
+// TODO: no, this is not where we should know the dns domain either...
+func ingressHostname(service, hostname string) string {
+	return strings.ToLower(fmt.Sprintf("%s.%s.%s", service, hostname, "dmesh"))
+}
+
+// updateIngressRoutes points the ingress, and the DNS names, at the http publishers
+func updateIngressRoutes(ctx context.Context, routes map[string]netproxy.IngressRoute) {
+	log := logr.FromContextOrDiscard(ctx)
+	if ingress == nil {
+		return
+	}
+	ingress.SetRoutes(wireguardNet, routes)
+
+	names := map[string]bool{}
+	for hostname := range routes {
+		name := strings.TrimSuffix(hostname, ".dmesh")
+		names[name] = true
+		if !ingressNames[name] {
+			log.Info("HTTP service routed", "name", hostname, "addrs", routes[hostname].Addrs)
+		}
+		dns.UpdateDnsHostRecord(name, ingressIP)
+	}
+	for name := range ingressNames {
+		if !names[name] {
+			log.Info("HTTP service gone", "name", name)
+			dns.RemoveDnsHostRecord(name)
+		}
+	}
+	ingressNames = names
+}
@@ -0,0 +1,242 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+
+	ag_solanago "github.com/gagliardetto/solana-go"
+	"github.com/go-logr/logr"
+	"github.com/workbenchapp/worknet/daoctl/lib/agentstate"
+	"github.com/workbenchapp/worknet/daoctl/lib/networking/meship"
+)
+
+const (
+	// MeshAddressingIndex gives each device the address at its position in the
+	// workgroup's device list, like the agents before key addressing
+	MeshAddressingIndex = "index"
+	// MeshAddressingKey derives each device's addresses from its key, collisions
+	// going to the device that joined first, so they don't move when devices join
+	// or leave, every device has to use it at once
+	MeshAddressingKey = "key"
+
+	// DefaultIndexMeshCIDR is where the devices' wireguard addresses come from with index addressing
+	DefaultIndexMeshCIDR = "192.169.99.0/24"
+	// DefaultMeshCIDR is where they come from with key addressing
+	DefaultMeshCIDR = "10.99.0.0/16"
+	// DefaultMeshCIDR6 is the IPv6 (ULA) equivalent
+	DefaultMeshCIDR6 = "fdda:99::/64"
+
+	// the local aliases that forward to each device, 127.1.0.1 is the DNS server
+	proxyCIDR = "127.1.0.0/16"
+	// IPv6 only has ::1 for loopback, so these get added to the loopback interface
+	proxyCIDR6 = "fd7f:1::/64"
+)
+
+// meshAddress is what a device gets, kept in the state db's MeshAddresses bucket,
+// keyed by device key, to say when one has moved
+type meshAddress struct {
+	IPv4   netip.Addr `json:"ipv4"`
+	IPv6   netip.Addr `json:"ipv6"`
+	Proxy  netip.Addr `json:"proxy"`
+	Proxy6 netip.Addr `json:"proxy6"`
+}
+
+type meshAllocators struct {
+	addressing                        string
+	db                                *agentstate.DB
+	ipv4, ipv6, proxyAddr, proxyAddr6 *meship.Allocator
+	saved                             map[string]meshAddress
+}
+
+var meshAddresses *meshAllocators
+
+// SetupMeshAddresses sets how the devices get their mesh addresses, and the CIDRs
+// they come from ("" for addressing's default), every device in the workgroup
+// needs the same ones. db (if not nil) keeps the addresses handed out, to log
+// the ones that move.
+func SetupMeshAddresses(ctx context.Context, db *agentstate.DB, addressing, cidr, cidr6 string) error {
+	log := logr.FromContextOrDiscard(ctx)
+
+	switch addressing {
+	case MeshAddressingIndex:
+		if cidr == "" {
+			cidr = DefaultIndexMeshCIDR
+		}
+	case MeshAddressingKey:
+		if cidr == "" {
+			cidr = DefaultMeshCIDR
+		}
+	default:
+		return fmt.Errorf("unknown mesh addressing %q", addressing)
+	}
+	if cidr6 == "" {
+		cidr6 = DefaultMeshCIDR6
+	}
+
+	m := &meshAllocators{addressing: addressing, db: db, saved: map[string]meshAddress{}}
+	for _, a := range []struct {
+		cidr      string
+		allocator **meship.Allocator
+	}{
+		{cidr, &m.ipv4},
+		{cidr6, &m.ipv6},
+		{proxyCIDR, &m.proxyAddr},
+		{proxyCIDR6, &m.proxyAddr6},
+	} {
+		prefix, err := meship.ParsePrefix(a.cidr)
+		if err != nil {
+			return err
+		}
+		if *a.allocator, err = meship.New(prefix); err != nil {
+			return err
+		}
+	}
+	if !m.ipv4.Prefix().Addr().Is4() {
+		return fmt.Errorf("mesh CIDR %s isn't IPv4", cidr)
+	}
+	if !m.ipv6.Prefix().Addr().Is6() {
+		return fmt.Errorf("mesh CIDR %s isn't IPv6", cidr6)
+	}
+	m.proxyAddr.Reserve(netip.MustParseAddr("127.1.0.1"))
+
+	if db != nil {
+		// only what we had last time, the addresses come from the device list alone
+		err := db.ForEach(agentstate.MeshAddresses, func(key string, data []byte) error {
+			saved := meshAddress{}
+			if err := json.Unmarshal(data, &saved); err != nil {
+				return err
+			}
+			m.saved[key] = saved
+			return nil
+		})
+		if err != nil {
+			log.Error(err, "Couldn't read saved mesh addresses")
+		}
+	}
+	log.Info("Mesh addresses", "addressing", addressing, "cidr", m.ipv4.Prefix(), "cidr6", m.ipv6.Prefix(), "saved", len(m.saved))
+	meshAddresses = m
+	return nil
+}
+
+// assignMeshAddresses gives each of the workgroup's devices its addresses.
+// devices are in the workgroup's order, which is the order they joined in (it's
+// only appended to, removed ones are left as a gap), and slots is where each one
+// is in it, for index addressing.
+func assignMeshAddresses(ctx context.Context, devices []ag_solanago.PublicKey, slots map[string]int) map[string]meshAddress {
+	log := logr.FromContextOrDiscard(ctx)
+	if meshAddresses == nil {
+		if err := SetupMeshAddresses(ctx, nil, MeshAddressingIndex, "", ""); err != nil {
+			log.Error(err, "Couldn't set up mesh addresses")
+			return nil
+		}
+	}
+	m := meshAddresses
+	if len(devices) == 0 {
+		// no workgroup info yet
+		return nil
+	}
+
+	keys := make([]string, 0, len(devices))
+	for _, device := range devices {
+		keys = append(keys, device.String())
+	}
+	addrs := map[string]meshAddress{}
+	for _, a := range []*meship.Allocator{m.ipv4, m.ipv6, m.proxyAddr, m.proxyAddr6} {
+		var assigned map[string]netip.Addr
+		if m.addressing == MeshAddressingIndex {
+			assigned = bySlot(ctx, a, keys, slots)
+		} else {
+			var err error
+			if assigned, err = a.Assign(keys); err != nil {
+				log.Error(err, "Couldn't assign mesh addresses")
+				return nil
+			}
+		}
+		for key, addr := range assigned {
+			record, ok := addrs[key]
+			if !ok && a != m.ipv4 {
+				// no IPv4 address, so it's left off the mesh
+				continue
+			}
+			switch a {
+			case m.ipv4:
+				record.IPv4 = addr
+			case m.ipv6:
+				record.IPv6 = addr
+			case m.proxyAddr:
+				record.Proxy = addr
+			default:
+				record.Proxy6 = addr
+			}
+			addrs[key] = record
+		}
+	}
+
+	for key, addr := range addrs {
+		if saved, ok := m.saved[key]; ok && (saved.IPv4 != addr.IPv4 || saved.IPv6 != addr.IPv6) {
+			// the device list changed under it, or a device that joined before it left
+			log.Info("Device's mesh address moved", "device", key, "from", saved.IPv4, "to", addr.IPv4, "from6", saved.IPv6, "to6", addr.IPv6)
+		}
+	}
+	if !sameMeshAddresses(m.saved, addrs) {
+		records := make(map[string]interface{}, len(addrs))
+		for key, addr := range addrs {
+			records[key] = addr
+		}
+		if m.db == nil {
+			m.saved = addrs
+		} else if err := m.db.ReplaceAll(agentstate.MeshAddresses, records); err != nil {
+			log.Error(err, "Couldn't save mesh addresses")
+		} else {
+			m.saved = addrs
+		}
+	}
+	return addrs
+}
+
+// bySlot gives each of keys the address at its slot (+2, the first's the DNS
+// server for the proxy addresses) in a's prefix
+func bySlot(ctx context.Context, a *meship.Allocator, keys []string, slots map[string]int) map[string]netip.Addr {
+	log := logr.FromContextOrDiscard(ctx)
+	addrs := make(map[string]netip.Addr, len(keys))
+	for _, key := range keys {
+		slot, ok := slots[key]
+		if !ok {
+			continue
+		}
+		addr, err := a.Nth(uint32(slot + 2))
+		if err != nil {
+			log.Error(err, "Couldn't give device a mesh address, it's too far down the workgroup's device list", "device", key)
+			continue
+		}
+		addrs[key] = addr
+	}
+	return addrs
+}
+
+// meshPrefix is addr with the length of the mesh CIDR it's from, for routing to the mesh
+func meshPrefix(addr netip.Addr) netip.Prefix {
+	bits := addr.BitLen()
+	if meshAddresses != nil {
+		if addr.Is4() {
+			bits = meshAddresses.ipv4.Prefix().Bits()
+		} else {
+			bits = meshAddresses.ipv6.Prefix().Bits()
+		}
+	}
+	return netip.PrefixFrom(addr, bits)
+}
+
+func sameMeshAddresses(a, b map[string]meshAddress) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, addr := range a {
+		if other, ok := b[key]; !ok || other != addr {
+			return false
+		}
+	}
+	return true
+}
@@ -6,6 +6,9 @@ import (
 	"net"
 	"os/exec"
 	"runtime"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gagliardetto/solana-go"
@@ -17,7 +20,6 @@ import (
 	netproxy "github.com/workbenchapp/worknet/daoctl/lib/networking/proxy"
 	"github.com/workbenchapp/worknet/daoctl/lib/solana/anchor/generated/worknet"
 	"github.com/workbenchapp/worknet/daoctl/lib/workgroup"
-	"golang.zx2c4.com/wireguard/tun/netstack"
 )
 
 // TODO: this will ultimately be caddy with its l4 support
@@ -30,20 +32,28 @@ func init() {
 }
 
 // TODO: getDeviceList should move to something solana
-func getDeviceList(ctx context.Context) []ag_solanago.PublicKey {
+// getDeviceList also says where each device is in the workgroup's list, deleted ones included
+func getDeviceList(ctx context.Context) ([]ag_solanago.PublicKey, map[string]int) {
 	devices := make([]ag_solanago.PublicKey, 0)
+	slots := map[string]int{}
 	log := logr.FromContextOrDiscard(ctx)
 
 	group := workgroup.GetCachedWorkGroupInfo()
 	if group == nil {
 		log.Info("No workgroupinfo cached")
-		return devices
+		return devices, slots
 	}
 	if len(group.Devices) == 0 {
 		log.Info("workgroupinfo devices list empty")
 	}
-	// Can't filter out the "deleted" devices - the index in the list is used for the meshIP
-	return group.Devices
+	for idx, device := range group.Devices {
+		if device.String() == "11111111111111111111111111111111" {
+			continue // skip deleted devices
+		}
+		devices = append(devices, device)
+		slots[device.String()] = idx
+	}
+	return devices, slots
 }
 
 // And this is then the proxy bit
@@ -54,6 +64,10 @@ type ProxyDevice struct {
 	WireguardAddress string
 	WireguardPeerKey string
 
+	// the IPv6 equivalents, ProxyAddress6 is "" if it couldn't be added to the loopback interface
+	ProxyAddress6     string
+	WireguardAddress6 string
+
 	WireguardListeners  map[string]interface{}
 	LocalProxyListeners map[string]string
 }
@@ -68,18 +82,18 @@ func knownDevice(device ag_solanago.PublicKey) bool {
 	return ok
 }
 
-func getDeviceProxyInfo(ctx context.Context, device ag_solanago.PublicKey, idx int) {
+func getDeviceProxyInfo(ctx context.Context, device ag_solanago.PublicKey, addr meshAddress) {
 	log := logr.FromContextOrDiscard(ctx)
 	// TODO: only recreate if needed...
 	info, err := workgroup.GetDeviceInfoByKey(ctx, device)
 	if err != nil {
 		return
 	}
-	if info.Status != worknet.DeviceStatusRegistered || info.Hostname == "" {
+	if !onMesh(info.Status) || info.Hostname == "" {
 		// device not registered yet..
 		return
 	}
-	proxyAddress := fmt.Sprintf("127.1.0.%d", idx+2)
+	proxyAddress := addr.Proxy.String()
 	// TODO: need a good place to put this magic
 	// TODO: Windows is argh! https://stackoverflow.com/questions/7535060/powershell-how-to-create-network-adapter-loopback
 	// https://github.com/PlagueHO/LoopbackAdapter
@@ -94,16 +108,52 @@ func getDeviceProxyInfo(ctx context.Context, device ag_solanago.PublicKey, idx i
 			log.Error(err, "Failed to configure proxy network alias")
 		}
 	}
+	proxyAddress6 := addr.Proxy6.String()
+	if err := addLoopbackAlias6(proxyAddress6); err != nil {
+		log.Error(err, "Failed to configure IPv6 proxy network alias, only using IPv4", "addr", proxyAddress6)
+		proxyAddress6 = ""
+	}
 	proxiedDevices[device.String()] = &ProxyDevice{
 		Info: info,
 		//DeviceKey:           device,
 		ProxyAddress:        proxyAddress,
-		WireguardAddress:    fmt.Sprintf("192.169.99.%d", idx+2),
+		ProxyAddress6:       proxyAddress6,
+		WireguardAddress:    addr.IPv4.String(),
+		WireguardAddress6:   addr.IPv6.String(),
 		WireguardListeners:  make(map[string]interface{}),
 		LocalProxyListeners: make(map[string]string),
 	}
-	dns.UpdateDnsHostRecord(info.Hostname, net.ParseIP(proxyAddress).To4())
-	dns.UpdateDnsHostRecord(device.String(), net.ParseIP(proxyAddress).To4())
+	ips := []net.IP{net.ParseIP(proxyAddress).To4()}
+	if proxyAddress6 != "" {
+		ips = append(ips, net.ParseIP(proxyAddress6))
+	}
+	dns.UpdateDnsHostRecord(info.Hostname, ips...)
+	dns.UpdateDnsHostRecord(device.String(), ips...)
+}
+
+// addLoopbackAlias6 adds addr to the loopback interface, IPv6 has no 127/8 to
+// listen on without asking
+// TODO: they're never removed, and Windows needs a loopback adapter for it
+func addLoopbackAlias6(addr string) error {
+	var c *exec.Cmd
+	switch runtime.GOOS {
+	case "linux":
+		c = exec.Command("ip", "-6", "addr", "replace", addr+"/128", "dev", "lo")
+	case "darwin":
+		c = exec.Command("ifconfig", "lo0", "inet6", addr, "prefixlen", "128", "alias")
+	default:
+		return fmt.Errorf("not supported on %s", runtime.GOOS)
+	}
+	if out, err := c.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// onMesh says if a device with this status gets connected to, Cordoned ones
+// still run what they had, they just don't get anything new
+func onMesh(status worknet.DeviceStatus) bool {
+	return status == worknet.DeviceStatusRegistered || status == worknet.DeviceStatusCordoned
 }
 
 func setDeviceOff(deviceKey string) {
@@ -127,23 +177,22 @@ func ProxyToDevices(ctx context.Context, deviceAuthorityWallet *types.Account, d
 	log := logr.FromContextOrDiscard(ctx)
 	var localDevice *ProxyDevice
 
-	deviceKeys := getDeviceList(ctx)
-	for idx, deviceKey := range deviceKeys {
-		if deviceKey.String() == "11111111111111111111111111111111" {
-			continue // skip deleted devices
+	deviceKeys, slots := getDeviceList(ctx)
+	addrs := assignMeshAddresses(ctx, deviceKeys, slots)
+	for _, deviceKey := range deviceKeys {
+		addr, ok := addrs[deviceKey.String()]
+		if !ok {
+			continue
 		}
 		// TODO: add a timeout in case the chain info changes,
 		if !knownDevice(deviceKey) {
-			log.Info("Found new device", "name", deviceKey)
-			getDeviceProxyInfo(ctx, deviceKey, idx)
+			log.Info("Found new device", "name", deviceKey, "meshIP", addr.IPv4, "meshIP6", addr.IPv6)
+			getDeviceProxyInfo(ctx, deviceKey, addr)
 		}
 	}
 
 	// try making tunnels
 	for _, deviceKey := range deviceKeys {
-		if deviceKey.String() == "11111111111111111111111111111111" {
-			continue // skip deleted devices
-		}
 		// TODO: this is to proxy any requests to 127.1.0.x to the wireguard ip's
 		device, ok := proxiedDevices[deviceKey.String()]
 		if ok {
@@ -165,17 +214,18 @@ func ProxyToDevices(ctx context.Context, deviceAuthorityWallet *types.Account, d
 	// TODO: extract to evented, which needs proxiedDevices to be a safe cache
 	UpdateWireGuardNetwork(ctx, deviceAuthorityWallet, proxiedDevices)
 
+	// the http publishers, by <service>.<host>.dmesh, set once everything's been looked at
+	ingressRoutes := map[string]netproxy.IngressRoute{}
+	defer updateIngressRoutes(ctx, ingressRoutes)
+
 	// make remove device things available here
 	for _, deviceKey := range deviceKeys {
-		if deviceKey.String() == "11111111111111111111111111111111" {
-			continue // skip deleted devices
-		}
 		// TODO: this is to proxy any requests to 127.1.0.x to the wireguard ip's
 		pDev, ok := proxiedDevices[deviceKey.String()]
 		if !ok || pDev.Info == nil {
 			continue
 		}
-		if pDev.Info.Status != worknet.DeviceStatusRegistered {
+		if !onMesh(pDev.Info.Status) {
 			continue
 		}
 		//spew.Dump("device", device.String(), pDev)
@@ -191,7 +241,7 @@ func ProxyToDevices(ctx context.Context, deviceAuthorityWallet *types.Account, d
 		}
 		// TODO: this should be "foreach non-local device's active deployment"
 		// TODO: 9495 is a cli option - not a constant!
-		ListenAndServeFromWireguard(ctx, pDev.Info.Hostname+"-deviceAPI", wireguardNet, pDev, 9495)
+		ListenAndServeFromWireguard(ctx, pDev.Info.Hostname+"-deviceAPI", wireguardNet, pDev, 9495, "tcp")
 		deviceInfo := workgroup.GetCachedDeviceStatusInfo(pDev.Info.DeviceAuthority.String())
 		if deviceInfo == nil {
 			// And try to prime the deployments cache so we can create the port mappings
@@ -211,22 +261,29 @@ func ProxyToDevices(ctx context.Context, deviceAuthorityWallet *types.Account, d
 					for _, publish := range state.Publishers {
 						log.V(2).Info("Listening on port", "name", publish.Name, "protocol", publish.Protocol, "port", publish.PublishedPort)
 						if publish.PublishedPort > 0 {
-							ListenAndServeFromWireguard(ctx, publish.Name, wireguardNet, pDev, publish.PublishedPort)
+							ListenAndServeFromWireguard(ctx, publish.Name, wireguardNet, pDev, publish.PublishedPort, publish.Protocol)
+						}
+						if publish.PublishedPort > 0 && publish.Protocol == "http" {
+							ingressRoutes[ingressHostname(publish.Name, pDev.Info.Hostname)] = netproxy.IngressRoute{
+								Addrs: meshEndpoints(pDev, publish.PublishedPort),
+							}
 						}
 					}
 				}
 			}
+			advertiseEndpoints(pDev, deviceInfo)
 		}
 	}
 
 	// Expose the thigns running on the local device
-	ListenToWireguardAndServeFromLocalDeployments(ctx, wireguardNet, localDevice, deviceInfoListenAddress, 9495) // so the other devices can talk to local 9495
+	ListenToWireguardAndServeFromLocalDeployments(ctx, wireguardNet, localDevice, deviceInfoListenAddress, 9495, "tcp") // so the other devices can talk to local 9495
 	localDeviceInfo := workgroup.GetCachedDeviceStatusInfo("")
 	if localDeviceInfo == nil {
 		return
 	}
 
 	// TODO: this should be "foreach localDevice's active deployment"
+	published := map[string]bool{":9495": true}
 	for deploymentHash, deployment := range localDeviceInfo.DeployState {
 		log.V(2).Info("Looking at deployment", "deployment hash", deploymentHash)
 
@@ -236,17 +293,44 @@ func ProxyToDevices(ctx context.Context, deviceAuthorityWallet *types.Account, d
 				localUrl := fmt.Sprintf("%s:%d", publish.URL, int(publish.PublishedPort))
 
 				if publish.PublishedPort > 0 {
-					ListenToWireguardAndServeFromLocalDeployments(ctx, wireguardNet, localDevice, localUrl, publish.PublishedPort)
+					published[listenerKey(fmt.Sprintf(":%d", publish.PublishedPort), publish.Protocol)] = true
+					ListenToWireguardAndServeFromLocalDeployments(ctx, wireguardNet, localDevice, localUrl, publish.PublishedPort, publish.Protocol)
+				}
+				if publish.PublishedPort > 0 && publish.Protocol == "http" && localDevice != nil && localDevice.Info != nil {
+					// no need to go round the mesh for our own
+					ingressRoutes[ingressHostname(publish.Name, localDevice.Info.Hostname)] = netproxy.IngressRoute{
+						Addrs: []string{localUrl},
+						Local: true,
+					}
 				}
 			}
 		}
 	}
+	stopLocalListeners(ctx, localDevice, published)
+}
+
+// stopLocalListeners closes the mesh listeners for ports that aren't published
+// any more, e.g. after the agent config's ports change
+func stopLocalListeners(ctx context.Context, localDevice *ProxyDevice, published map[string]bool) {
+	log := logr.FromContextOrDiscard(ctx)
+	if localDevice == nil {
+		return
+	}
+	for addr, listener := range localDevice.WireguardListeners {
+		if published[addr] {
+			continue
+		}
+		if cancel, ok := listener.(context.CancelFunc); ok {
+			log.Info("Port no longer published, closing mesh listener", "addr", addr)
+			cancel()
+		}
+	}
 }
 
 func GetProxyDeviceInfoByName(name string) *ProxyDevice {
 	// TODO: if name=="" we mean local..
 	for _, pDev := range proxiedDevices {
-		if pDev.Info != nil && pDev.Info.Status == worknet.DeviceStatusRegistered {
+		if pDev.Info != nil && onMesh(pDev.Info.Status) {
 			// match by hostname (human useful)
 			if pDev.Info.Hostname == name {
 				return pDev
@@ -264,9 +348,28 @@ func GetProxyDeviceInfoByName(name string) *ProxyDevice {
 	return nil
 }
 
+// listenerKey is what the listener maps are keyed by, so a port can have TCP and
+// UDP listeners, TCP (and no protocol) is just the address
+func listenerKey(addr, protocol string) string {
+	if protocol == "udp" {
+		return addr + "/udp"
+	}
+	return addr
+}
+
+// meshEndpoints are the addresses of port on pDev over the mesh, IPv4 first,
+// devices that haven't got an IPv6 mesh address yet only answer on that
+func meshEndpoints(pDev *ProxyDevice, port int) []string {
+	addrs := []string{fmt.Sprintf("%s:%d", pDev.WireguardAddress, port)}
+	if pDev.WireguardAddress6 != "" {
+		addrs = append(addrs, net.JoinHostPort(pDev.WireguardAddress6, strconv.Itoa(port)))
+	}
+	return addrs
+}
+
 // ListenAndServe should add a listener for each port on each device to the
 // 127.1.0.x range, that then talks to the wireguard tun
-func ListenAndServeFromWireguard(ctx context.Context, deploymentName string, tnet *netstack.Net, pDev *ProxyDevice, deploymentPort int) {
+func ListenAndServeFromWireguard(ctx context.Context, deploymentName string, tnet netproxy.MeshNet, pDev *ProxyDevice, deploymentPort int, protocol string) {
 	log := logr.FromContextOrDiscard(ctx)
 	// localPort := deploymentPort
 	// TODO: should do a bump if there's a clash with an existing port __maybe__
@@ -287,24 +390,30 @@ func ListenAndServeFromWireguard(ctx context.Context, deploymentName string, tne
 		return
 	}
 
-	if _, ok := pDev.LocalProxyListeners[localAddr]; ok {
+	listenerAddr := listenerKey(localAddr, protocol)
+	if _, ok := pDev.LocalProxyListeners[listenerAddr]; ok {
 		return
 	}
+	listenAddrs := []string{localAddr}
+	if pDev.ProxyAddress6 != "" {
+		listenAddrs = append(listenAddrs, net.JoinHostPort(pDev.ProxyAddress6, strconv.Itoa(deploymentPort)))
+	}
 	// This will become variable
-	remoteDeployAddress := fmt.Sprintf("%s:%d", pDev.WireguardAddress, deploymentPort)
+	remoteDeployAddresses := meshEndpoints(pDev, deploymentPort)
+	remoteDeployAddress := remoteDeployAddresses[0]
 
 	// TODO: no, this is not where we should know the dns domain...
 	localDNSAddr := fmt.Sprintf("%s.%s:%d", pDev.Info.Hostname, "dmesh", deploymentPort)
 
 	updateEndpointProxyInfo(deploymentName, deploymentPort, localDNSAddr)
-	pDev.LocalProxyListeners[localAddr] = deploymentName
+	pDev.LocalProxyListeners[listenerAddr] = deploymentName
 	go func() {
 		const beNice = 1 * time.Second
 
 		for stop := false; !stop; {
 			select {
 			case <-ctx.Done():
-				delete(pDev.LocalProxyListeners, localAddr)
+				delete(pDev.LocalProxyListeners, listenerAddr)
 				stop = true
 
 			default:
@@ -312,12 +421,17 @@ func ListenAndServeFromWireguard(ctx context.Context, deploymentName string, tne
 				log.Info("================ Listen and Serve from Wireguard",
 					"remote", pDev.Info.Hostname,
 					"remote addr", remoteDeployAddress,
-					"local addr", localAddr,
+					"local addrs", listenAddrs,
 					"local dns", localDNSAddr,
+					"protocol", protocol,
 					"device ATA", pDev.Info.DeviceAuthority.String(),
 				)
 
-				netproxy.ForwardTCPToMesh(ctx, localAddr, localDNSAddr, remoteDeployAddress, tnet)
+				if protocol == "udp" {
+					netproxy.ForwardUDPToMesh(ctx, listenAddrs, remoteDeployAddresses, tnet)
+				} else {
+					netproxy.ForwardTCPToMesh(ctx, listenAddrs, localDNSAddr, remoteDeployAddresses, tnet)
+				}
 				time.Sleep(time.Duration(beNice))
 			}
 		}
@@ -325,9 +439,9 @@ func ListenAndServeFromWireguard(ctx context.Context, deploymentName string, tne
 }
 
 // This is the listener for the wireguard ports that should then request to the local deployment
-func ListenToWireguardAndServeFromLocalDeployments(ctx context.Context, tnet *netstack.Net /*port, handler, idk*/, pDev *ProxyDevice, localDeploymentAddress string, wgDeploymentPort int) {
+func ListenToWireguardAndServeFromLocalDeployments(ctx context.Context, tnet netproxy.MeshNet /*port, handler, idk*/, pDev *ProxyDevice, localDeploymentAddress string, wgDeploymentPort int, protocol string) {
 	log := logr.FromContextOrDiscard(ctx)
-	wireguardListenAddr := fmt.Sprintf(":%d", wgDeploymentPort)
+	wireguardListenAddr := listenerKey(fmt.Sprintf(":%d", wgDeploymentPort), protocol)
 	if tnet == nil {
 		// wg not ready yet
 		log.V(1).Info("no wg net", "node", wireguardListenAddr)
@@ -344,7 +458,9 @@ func ListenToWireguardAndServeFromLocalDeployments(ctx context.Context, tnet *ne
 		return
 	}
 
-	pDev.WireguardListeners[wireguardListenAddr] = true
+	// so stopLocalListeners can close it when the port's no longer published
+	ctx, cancel := context.WithCancel(ctx)
+	pDev.WireguardListeners[wireguardListenAddr] = context.CancelFunc(cancel)
 	go func() {
 		const beNice = 1 * time.Second
 
@@ -359,13 +475,77 @@ func ListenToWireguardAndServeFromLocalDeployments(ctx context.Context, tnet *ne
 					"wg addr", pDev.WireguardAddress,
 					"wg port", wgDeploymentPort,
 					"local addr", localDeploymentAddress,
+					"protocol", protocol,
 				)
 
 				// TODO: could also consider just deleteing and allowing the next pollInterval to re-init it...
-				netproxy.ReceiveFromMesh(ctx, localDeploymentAddress, wgDeploymentPort, tnet)
+				if protocol == "udp" {
+					netproxy.ReceiveUDPFromMesh(ctx, localDeploymentAddress, wgDeploymentPort, tnet)
+				} else {
+					netproxy.ReceiveFromMesh(ctx, localDeploymentAddress, wgDeploymentPort, tnet)
+				}
 				time.Sleep(time.Duration(beNice))
 			}
 		}
 	}()
 
 }
+
+// PeerAPIURLs are the device API base URLs of the other registered devices in
+// the workgroup, reached over the mesh
+func PeerAPIURLs(self string) []string {
+	urls := []string{}
+	for _, pDev := range proxiedDevices {
+		if pDev.Info == nil || !onMesh(pDev.Info.Status) {
+			continue
+		}
+		if pDev.Info.DeviceAuthority.String() == self || pDev.WireguardPeerKey == "no" {
+			continue
+		}
+		urls = append(urls, fmt.Sprintf("http://%s:%d", pDev.ProxyAddress, 9495)) // ALWAYS listen to port 9495 on the wireguard network
+	}
+	return urls
+}
+
+// heartbeatTimeout is how long a peer gets to answer a heartbeat
+const heartbeatTimeout = 10 * time.Second
+
+// CheckHeartbeats asks each of the other devices on the mesh for its status,
+// and flags the ones that haven't answered for workgroup.DelinquentAfter. They're
+// all asked at once, so it takes at most heartbeatTimeout however many there are.
+func CheckHeartbeats(ctx context.Context, deviceAuthorityWallet *types.Account) {
+	log := logr.FromContextOrDiscard(ctx)
+	peers := []*ProxyDevice{}
+	for _, pDev := range proxiedDevices {
+		if pDev.Info == nil || !onMesh(pDev.Info.Status) {
+			continue
+		}
+		if pDev.Info.DeviceAuthority.Equals(solana.PublicKey(deviceAuthorityWallet.PublicKey)) {
+			continue
+		}
+		peers = append(peers, pDev)
+	}
+
+	errs := make([]error, len(peers))
+	var wg sync.WaitGroup
+	for i, pDev := range peers {
+		wg.Add(1)
+		go func(i int, pDev *ProxyDevice) {
+			defer wg.Done()
+			heartbeatCtx, cancel := context.WithTimeout(ctx, heartbeatTimeout)
+			defer cancel()
+			_, errs[i] = UpdateDeviceInfoFromMesh(heartbeatCtx, pDev)
+		}(i, pDev)
+	}
+	wg.Wait()
+
+	for i, pDev := range peers {
+		if errs[i] != nil {
+			log.V(1).Info("No heartbeat from device", "hostname", pDev.Info.Hostname, "err", errs[i])
+			workgroup.MissedHeartbeat(ctx, *pDev.Info)
+			continue
+		}
+		// pick up services that have gone (un)healthy since the last reconcile
+		advertiseEndpoints(pDev, workgroup.GetCachedDeviceStatusInfo(pDev.Info.DeviceAuthority.String()))
+	}
+}
@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"bytes"
 	"context"
 	"encoding/hex"
 	"fmt"
@@ -9,11 +10,15 @@ import (
 	"net"
 	"net/http"
 	"net/netip"
+	"strings"
 
 	"github.com/gagliardetto/solana-go"
 	"github.com/go-logr/logr"
 	"github.com/portto/solana-go-sdk/common"
 	"github.com/portto/solana-go-sdk/types"
+	"github.com/workbenchapp/worknet/daoctl/lib/agentstate"
+	netproxy "github.com/workbenchapp/worknet/daoctl/lib/networking/proxy"
+	"github.com/workbenchapp/worknet/daoctl/lib/networking/wgctl"
 	"github.com/workbenchapp/worknet/daoctl/lib/solana/memo"
 	"golang.zx2c4.com/wireguard/conn"
 	"golang.zx2c4.com/wireguard/device"
@@ -23,9 +28,34 @@ import (
 
 const wireguardPublicPeerKeyName = "wgPeerKey"
 
+// what we keep in the state db's WireGuard bucket
+type wireguardState struct {
+	DeviceAuthority string `json:"device_authority"`
+	// PublishedPeerKey is the hex public key we've seen (or put) on chain
+	PublishedPeerKey string `json:"published_peer_key"`
+}
+
 // EnsureOnchainWireguardPeerKey checks if the on-chain wg-pubkey exists, or will put it on the chain.
-func EnsureOnchainWireguardPeerKey(ctx context.Context, deviceAuthorityWallet *types.Account) string {
+// Once it's there it's remembered in db (if not nil), so restarts don't need to look again.
+func EnsureOnchainWireguardPeerKey(ctx context.Context, db *agentstate.DB, deviceAuthorityWallet *types.Account) string {
 	log := logr.FromContextOrDiscard(ctx)
+
+	dWgPrivateKey := getLocalDeviceWireguardPrivateKey(deviceAuthorityWallet)
+	dWgPublicKey := dWgPrivateKey.PublicKey()
+	// OH wow - the config format needs the key in kex format, and that's not native to the wgtypes.Key
+	publickeyInHex := hex.EncodeToString(dWgPublicKey[:])
+
+	saved := wireguardState{}
+	if db != nil {
+		if _, err := db.Get(agentstate.WireGuard, "local", &saved); err != nil {
+			log.Error(err, "Couldn't read saved wireguard state")
+		}
+	}
+	if saved.DeviceAuthority == deviceAuthorityWallet.PublicKey.ToBase58() && saved.PublishedPeerKey == publickeyInHex {
+		log.V(1).Info("Wireguard peer key already on-chain", "deviceAuthority", deviceAuthorityWallet.PublicKey)
+		return dWgPublicKey.PublicKey().String()
+	}
+
 	log.Info("Ensuring there is a wireguard peer key on-chain", "deviceAuthority", deviceAuthorityWallet.PublicKey)
 	var memoInfo *memo.DaoletInfoMemo
 	memoInfo, err := memo.GetFirstInfoMemo(ctx, deviceAuthorityWallet.PublicKey)
@@ -37,25 +67,40 @@ func EnsureOnchainWireguardPeerKey(ctx context.Context, deviceAuthorityWallet *t
 		}
 	}
 
-	dWgPrivateKey := getLocalDeviceWireguardPrivateKey(deviceAuthorityWallet)
-	dWgPublicKey := dWgPrivateKey.PublicKey()
-
 	if err != nil || memoInfo == nil { // TODO: or without peerKey?
 		log.Info("No wireguard key found, making a new one")
-		// OH wow - the config format needs the key in kex format, and that's not native to the wgtypes.Key
-		publickeyInHex := hex.EncodeToString(dWgPublicKey[:])
-
 		memoInfo = &memo.DaoletInfoMemo{
 			wireguardPublicPeerKeyName: publickeyInHex,
 		}
+		// TODO: AddInfoMemo doesn't say if it worked, so only remember keys we've seen on chain
 		memo.AddInfoMemo(ctx, memoInfo)
+	} else if (*memoInfo)[wireguardPublicPeerKeyName] == publickeyInHex && db != nil {
+		saved = wireguardState{
+			DeviceAuthority:  deviceAuthorityWallet.PublicKey.ToBase58(),
+			PublishedPeerKey: publickeyInHex,
+		}
+		if err := db.Put(agentstate.WireGuard, "local", saved); err != nil {
+			log.Error(err, "Couldn't save wireguard state")
+		}
 	}
 	return dWgPublicKey.PublicKey().String()
 }
 
-// generateWireguardConfig generates both the cross-platform ipc config, and a wg-quick config
-func generateWireguardConfig(ctx context.Context, dWgPrivateKey wgtypes.Key, deviceAuthorityWallet *types.Account, devices ProxyDeviceList) (string, string) {
-	// etcWireguardConfig  is only for debugging - can be used with wg-quick to connect to the secret network
+// meshAddrs are the device's IPv4 and (if it has one) IPv6 mesh addresses
+func meshAddrs(device *ProxyDevice) []netip.Addr {
+	addrs := []netip.Addr{}
+	for _, addr := range []string{device.WireguardAddress, device.WireguardAddress6} {
+		if ip, err := netip.ParseAddr(addr); err == nil {
+			addrs = append(addrs, ip)
+		}
+	}
+	return addrs
+}
+
+// generateWireguardConfig generates both the cross-platform ipc config, and a wg-quick config,
+// and says what the local device's mesh addresses are
+func generateWireguardConfig(ctx context.Context, dWgPrivateKey wgtypes.Key, deviceAuthorityWallet *types.Account, devices ProxyDeviceList) (string, string, []netip.Addr) {
+	// etcWireguardConfig can be used with wg-quick to connect to the secret network
 	log := logr.FromContextOrDiscard(ctx)
 	// OH wow - the configuration-protocol format needs the key in kex format, and that's not native to the wgtypes.Key
 	// TODO: need to add Address=localDevice.wireguardAddress
@@ -104,7 +149,11 @@ listen_port=12912`, privatekeyInHex)
 			if peerKey, ok := (*devMemoInfo)[wireguardPublicPeerKeyName]; ok {
 
 				//AllowedIPs := "0.0.0.0/0"
-				AllowedIPs := fmt.Sprintf("%s/32", device.WireguardAddress)
+				allowedIPs := []string{}
+				for _, addr := range meshAddrs(device) {
+					allowedIPs = append(allowedIPs, netip.PrefixFrom(addr, addr.BitLen()).String())
+				}
+				AllowedIPs := strings.Join(allowedIPs, ", ")
 
 				keyInBytes, err := hex.DecodeString(peerKey)
 				if err != nil {
@@ -125,8 +174,10 @@ PersistentKeepalive=25`, wgKey.String(), deviceAddr, AllowedIPs /*device.wiregua
 
 				devConfig := fmt.Sprintf(`public_key=%s
 endpoint=%s
-allowed_ip=%s
-persistent_keepalive_interval=25`, peerKey, deviceAddr, AllowedIPs /*device.wireguardAddress*/)
+persistent_keepalive_interval=25`, peerKey, deviceAddr)
+				for _, allowedIP := range allowedIPs {
+					devConfig += "\nallowed_ip=" + allowedIP
+				}
 				config = config + "\n" + devConfig
 			} else {
 				setDeviceOff(deviceKey)
@@ -136,18 +187,60 @@ persistent_keepalive_interval=25`, peerKey, deviceAddr, AllowedIPs /*device.wire
 
 	if localDevice == nil {
 		log.Info("Device info not cached yet, skipping wg config")
-		return "", ""
+		return "", "", nil
 	}
 
 	// TODO: Log this more elegantly
 	log.V(1).Info("Wireguard config", "/etc/wireguard/wg0.conf", etcWireguardConfig)
 
-	return config, localDevice.WireguardAddress
+	return config, etcWireguardConfig, meshAddrs(localDevice)
+}
+
+const (
+	// WireguardNetstack is wireguard-go with a userspace network stack, the mesh
+	// is only reachable through the agent's forwarders
+	WireguardNetstack = "netstack"
+	// WireguardKernel is a kernel wireguard interface with routes for the mesh,
+	// so anything on the device (containers too) can reach the peers
+	WireguardKernel = "kernel"
+)
+
+// WireguardMode is how the mesh is set up, kernel falls back to netstack if the
+// interface can't be made (not Linux, not root, no wireguard module or iptables)
+var WireguardMode = WireguardNetstack
+
+// wireguardDevice is the local end of the mesh
+type wireguardDevice interface {
+	// Configure sets the peers, from uapi (the configuration protocol)
+	Configure(uapi string) error
+	Device() (*wgtypes.Device, error)
+	Close()
+}
+
+// userspaceWireguard is wireguard-go, on a netstack tun
+type userspaceWireguard struct {
+	dev *device.Device
+}
+
+func (u *userspaceWireguard) Configure(uapi string) error {
+	return u.dev.IpcSet(uapi)
+}
+
+func (u *userspaceWireguard) Device() (*wgtypes.Device, error) {
+	var b bytes.Buffer
+	if err := u.dev.IpcGetOperation(&b); err != nil {
+		return nil, err
+	}
+	return wgctl.ParseDevice(&b)
+}
+
+func (u *userspaceWireguard) Close() {
+	u.dev.Close()
 }
 
 // TODO: by putting these into a struct, we can probably talk to more than one workgroup
-var wireguardNet *netstack.Net
-var wireguardDev *device.Device
+var wireguardNet netproxy.MeshNet
+var wireguardDev wireguardDevice
 
 // UpdateWireGuardNetwork should be triggered whenever a probable network topology change is detected
 func UpdateWireGuardNetwork(ctx context.Context, deviceAuthorityWallet *types.Account, devices ProxyDeviceList) {
@@ -158,44 +251,60 @@ func UpdateWireGuardNetwork(ctx context.Context, deviceAuthorityWallet *types.Ac
 		// TODO: really should make a wireguard service specific context, so we can cancel it, and start fresh.
 
 		log.V(1).Info("Initializing wireguard network")
-		initializeWireGuardNetwork(ctx, deviceAuthorityWallet, devices)
+		if err := initializeWireGuardNetwork(ctx, deviceAuthorityWallet, devices); err != nil {
+			// tried again on the next update
+			log.Error(err, "Couldn't set up wireguard")
+		}
 	} else {
 		log.V(1).Info("Updating wireguard network")
 		dWgPrivateKey := getLocalDeviceWireguardPrivateKey(deviceAuthorityWallet)
 		// TODO: ARGH! devices is a global, stopit!
-		wireguardConfig, wireguardAddress := generateWireguardConfig(ctx, dWgPrivateKey, deviceAuthorityWallet, devices)
-		if wireguardConfig == "" && wireguardAddress == "" {
+		wireguardConfig, _, wireguardAddrs := generateWireguardConfig(ctx, dWgPrivateKey, deviceAuthorityWallet, devices)
+		if wireguardConfig == "" && len(wireguardAddrs) == 0 {
 			return
 		}
 
-		log.V(1).Info("Wireguard config generated", "myIP", wireguardAddress, "wireguardConfig", wireguardConfig)
+		log.V(1).Info("Wireguard config generated", "myIPs", wireguardAddrs, "wireguardConfig", wireguardConfig)
 
 		// TODO: check if the config is differemt, if not, don't IpcSet..
-		err := wireguardDev.IpcSet(wireguardConfig)
-		if err != nil {
-			panic(err)
+		if err := wireguardDev.Configure(wireguardConfig); err != nil {
+			// the device keeps the peers it had, and the next update tries again.
+			// the listeners hold on to wireguardNet, so swapping it for netstack here
+			// would strand them
+			log.Error(err, "Couldn't update wireguard config, keeping the last one")
 		}
 	}
 
 }
 
-func initializeWireGuardNetwork(ctx context.Context, deviceAuthorityWallet *types.Account, devices ProxyDeviceList) (*netstack.Net, error) {
+func initializeWireGuardNetwork(ctx context.Context, deviceAuthorityWallet *types.Account, devices ProxyDeviceList) error {
 	log := logr.FromContextOrDiscard(ctx)
 	dWgPrivateKey := getLocalDeviceWireguardPrivateKey(deviceAuthorityWallet)
-	wireguardConfig, wireguardAddress := generateWireguardConfig(ctx, dWgPrivateKey, deviceAuthorityWallet, devices)
-	if wireguardConfig == "" && wireguardAddress == "" {
-		return nil, fmt.Errorf("device info not cached yet, skipping wg config")
+	wireguardConfig, _, wireguardAddrs := generateWireguardConfig(ctx, dWgPrivateKey, deviceAuthorityWallet, devices)
+	if wireguardConfig == "" && len(wireguardAddrs) == 0 {
+		return fmt.Errorf("device info not cached yet, skipping wg config")
 	}
 
-	log.Info("Creating net TUN", "myIP", wireguardAddress, "wireguardConfig", wireguardConfig)
+	if WireguardMode == WireguardKernel {
+		kernel, err := newKernelWireguard(ctx, wireguardAddrs, wireguardConfig)
+		if err == nil {
+			wireguardDev = kernel
+			wireguardNet = netproxy.KernelNet{Addrs: wireguardAddrs}
+			log.Info("Local device configured on kernel wireguard", "interface", kernelInterface, "wireguardAddresses", wireguardAddrs)
+			return nil
+		}
+		log.Error(err, "Couldn't set up kernel wireguard, falling back to netstack")
+	}
+
+	log.Info("Creating net TUN", "myIPs", wireguardAddrs, "wireguardConfig", wireguardConfig)
 
 	tun, tnet, err := netstack.CreateNetTUN(
-		[]netip.Addr{netip.MustParseAddr(wireguardAddress)},
+		wireguardAddrs,
 		[]netip.Addr{netip.MustParseAddr("8.8.8.8"), netip.MustParseAddr("8.8.4.4")},
 		1420,
 	)
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("couldn't create net TUN: %s", err)
 	}
 	logLevel := device.LogLevelError // TODO: set to verbose if -V
 	//logLevel = device.LogLevelVerbose
@@ -208,29 +317,33 @@ func initializeWireGuardNetwork(ctx context.Context, deviceAuthorityWallet *type
 	// allowed_ip=0.0.0.0/0
 	// persistent_keepalive_interval=25
 	// `)
-	err = dev.IpcSet(wireguardConfig)
-	if err != nil {
-		panic(err)
-	}
-	err = dev.Up()
-	if err != nil {
-		panic(err)
+	if err := dev.IpcSet(wireguardConfig); err != nil {
+		dev.Close()
+		return fmt.Errorf("couldn't configure wireguard: %s", err)
 	}
-	if err == nil {
-		wireguardNet = tnet
-		wireguardDev = dev
-		go func() {
-			<-ctx.Done()
-			// TODO: OMG Don't ask (there's at least 40 goroutines that continue to exist if you don't close the wireguardDevice)
-			// TODO: no utterly not goroutinesafe.
-			wireguardDev.Close()
-			wireguardDev = nil
-			wireguardNet = nil
-		}()
+	if err := dev.Up(); err != nil {
+		dev.Close()
+		return fmt.Errorf("couldn't bring wireguard up: %s", err)
 	}
-	log.Info("Local device configured on wireguard", "wireguardAddress", wireguardAddress)
+	wireguardNet = netproxy.NetstackNet{Net: tnet}
+	wireguardDev = &userspaceWireguard{dev: dev}
+	log.Info("Local device configured on wireguard", "wireguardAddresses", wireguardAddrs)
+
+	return nil
+}
 
-	return tnet, err
+// CloseWireGuard takes down the wireguard device, once nothing is using the mesh any more.
+// The agent does this after its context is cancelled and the forwarded connections are drained.
+func CloseWireGuard(ctx context.Context) {
+	if wireguardDev == nil {
+		return
+	}
+	logr.FromContextOrDiscard(ctx).Info("Closing wireguard device")
+	// TODO: OMG Don't ask (there's at least 40 goroutines that continue to exist if you don't close the wireguardDevice)
+	// TODO: no utterly not goroutinesafe.
+	wireguardDev.Close()
+	wireguardDev = nil
+	wireguardNet = nil
 }
 
 func getLocalDeviceWireguardPrivateKey(deviceAuthorityWallet *types.Account) wgtypes.Key {
@@ -0,0 +1,180 @@
+//go:build linux
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"github.com/vishvananda/netlink"
+	"github.com/workbenchapp/worknet/daoctl/lib/networking/wgctl"
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// kernelInterface is the wireguard interface the kernel mode makes
+const kernelInterface = "dmesh0"
+
+// meshAPIPort is the agent API the peers reach over the mesh
+// TODO: 9495 is a cli option - not a constant!
+const meshAPIPort = "9495"
+
+// kernelWireguard is a kernel wireguard interface, made with netlink and
+// configured with wgctrl. The firewall rules still need iptables(8).
+type kernelWireguard struct {
+	ctx    context.Context
+	client *wgctrl.Client
+	link   netlink.Link
+	// the iptables rules we added, to take out again
+	rules [][]string
+}
+
+func newKernelWireguard(ctx context.Context, addrs []netip.Addr, uapi string) (wireguardDevice, error) {
+	if os.Geteuid() != 0 {
+		return nil, errors.New("kernel wireguard needs root")
+	}
+	for _, iptables := range []string{"iptables", "ip6tables"} {
+		if _, err := exec.LookPath(iptables); err != nil {
+			return nil, fmt.Errorf("kernel wireguard needs %s to firewall the mesh: %s", iptables, err)
+		}
+	}
+	client, err := wgctrl.New()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't open wireguard netlink: %s", err)
+	}
+	// whatever an agent that didn't get to clean up left behind
+	if old, err := netlink.LinkByName(kernelInterface); err == nil {
+		netlink.LinkDel(old)
+	}
+
+	link := &netlink.GenericLink{
+		LinkAttrs: netlink.LinkAttrs{Name: kernelInterface, MTU: 1420},
+		LinkType:  "wireguard",
+	}
+	if err := netlink.LinkAdd(link); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("couldn't add %s (is the wireguard module loaded?): %s", kernelInterface, err)
+	}
+	k := &kernelWireguard{ctx: ctx, client: client, link: link}
+	if err := k.setup(addrs, uapi); err != nil {
+		k.Close()
+		return nil, err
+	}
+	return k, nil
+}
+
+func (k *kernelWireguard) setup(addrs []netip.Addr, uapi string) error {
+	log := logr.FromContextOrDiscard(k.ctx)
+
+	// with the mesh CIDR's length, so the kernel routes all of the mesh to the interface
+	prefixes := []netip.Prefix{}
+	for _, addr := range addrs {
+		prefix := meshPrefix(addr)
+		prefixes = append(prefixes, prefix)
+		ipNet := &net.IPNet{IP: addr.AsSlice(), Mask: net.CIDRMask(prefix.Bits(), addr.BitLen())}
+		if err := netlink.AddrAdd(k.link, &netlink.Addr{IPNet: ipNet}); err != nil {
+			return fmt.Errorf("couldn't add %s to %s: %s", prefix, kernelInterface, err)
+		}
+	}
+	if err := k.Configure(uapi); err != nil {
+		return err
+	}
+	if err := netlink.LinkSetUp(k.link); err != nil {
+		return fmt.Errorf("couldn't bring %s up: %s", kernelInterface, err)
+	}
+	// the addresses make these routes too, but don't count on it
+	for _, prefix := range prefixes {
+		route := &netlink.Route{
+			LinkIndex: k.link.Attrs().Index,
+			Dst:       &net.IPNet{IP: prefix.Masked().Addr().AsSlice(), Mask: net.CIDRMask(prefix.Bits(), prefix.Addr().BitLen())},
+			Scope:     netlink.SCOPE_LINK,
+		}
+		if err := netlink.RouteReplace(route); err != nil {
+			return fmt.Errorf("couldn't route %s to %s: %s", prefix, kernelInterface, err)
+		}
+	}
+
+	// containers' connections come from their own addresses, which the peers won't
+	// accept, so they need to look like they're from us
+	for _, iptables := range []string{"iptables", "ip6tables"} {
+		rule := []string{"POSTROUTING", "-t", "nat", "-o", kernelInterface, "-j", "MASQUERADE"}
+		if err := k.addRule(iptables, "-A", rule); err != nil {
+			log.Error(err, "Couldn't masquerade mesh traffic, containers won't reach the peers", "iptables", iptables)
+		}
+	}
+
+	// but that would let them into the agent APIs too, the peers' (forwarded out
+	// of the mesh interface) and ours (on our mesh address, from anywhere but the mesh)
+	for _, addr := range addrs {
+		iptables := "iptables"
+		if addr.Is6() {
+			iptables = "ip6tables"
+		}
+		for _, rule := range [][]string{
+			{"FORWARD", "-o", kernelInterface, "-p", "tcp", "--dport", meshAPIPort, "-j", "REJECT"},
+			{"INPUT", "!", "-i", kernelInterface, "-d", addr.String(), "-p", "tcp", "--dport", meshAPIPort, "-j", "REJECT"},
+		} {
+			if err := k.addRule(iptables, "-I", rule); err != nil {
+				return fmt.Errorf("couldn't firewall the mesh API from containers: %s", err)
+			}
+		}
+	}
+	return nil
+}
+
+// addRule adds an iptables rule (with -A or -I), unless it's there already
+func (k *kernelWireguard) addRule(iptables, add string, rule []string) error {
+	if runNetCommand(iptables, append([]string{"-C"}, rule...)...) == nil {
+		return nil
+	}
+	if err := runNetCommand(iptables, append([]string{add}, rule...)...); err != nil {
+		return err
+	}
+	k.rules = append(k.rules, append([]string{iptables}, rule...))
+	return nil
+}
+
+func (k *kernelWireguard) Configure(uapi string) error {
+	config, err := wgctl.ParseConfig(uapi)
+	if err != nil {
+		return fmt.Errorf("invalid wireguard config: %s", err)
+	}
+	if err := k.client.ConfigureDevice(kernelInterface, config); err != nil {
+		return fmt.Errorf("couldn't configure %s: %s", kernelInterface, err)
+	}
+	return nil
+}
+
+func (k *kernelWireguard) Device() (*wgtypes.Device, error) {
+	return k.client.Device(kernelInterface)
+}
+
+func (k *kernelWireguard) Close() {
+	log := logr.FromContextOrDiscard(k.ctx)
+	for _, rule := range k.rules {
+		if err := runNetCommand(rule[0], append([]string{"-D"}, rule[1:]...)...); err != nil {
+			log.Error(err, "Couldn't remove mesh iptables rule", "rule", rule)
+		}
+	}
+	k.rules = nil
+	if err := netlink.LinkDel(k.link); err != nil {
+		log.Error(err, "Couldn't remove kernel wireguard interface")
+	}
+	k.client.Close()
+}
+
+// runNetCommand runs a network config command, with its output in the error
+func runNetCommand(name string, args ...string) error {
+	c := exec.Command(name, args...)
+	if out, err := c.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s %s: %s: %s", name, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"runtime"
+)
+
+const kernelInterface = "dmesh0"
+
+func newKernelWireguard(ctx context.Context, addrs []netip.Addr, uapi string) (wireguardDevice, error) {
+	return nil, fmt.Errorf("kernel wireguard isn't supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,209 @@
+// Package scheduler works out which devices deployment replicas go on. Getting
+// the state from chain and the mesh, and sending the Schedule instructions, is
+// `daoctl scheduler`'s job.
+package scheduler
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/workbenchapp/worknet/daoctl/lib/workgroup"
+	"github.com/workbenchapp/worknet/daoctl/lib/workload"
+)
+
+type Strategy string
+
+const (
+	// Spread puts each replica on the device with the fewest replicas of its deployment
+	Spread Strategy = "spread"
+	// Binpack puts each replica on the busiest device it still fits on
+	Binpack Strategy = "binpack"
+)
+
+// Node is a device in the workgroup
+type Node struct {
+	// Key is the device authority
+	Key      string
+	Hostname string
+	Capacity workgroup.DeviceCapacity
+	// Schedulable is false for Delinquent and Cordoned devices, and ones we couldn't reach
+	Schedulable bool
+	// Grace is set for an unschedulable device that might come back soon, its
+	// replicas aren't replaced yet, so they don't end up scheduled twice
+	Grace bool
+	// Replicas is how many tokens of each deployment (by key) the device holds
+	Replicas map[string]int
+}
+
+// Deployment is a deployment that might need replicas placing
+type Deployment struct {
+	Key  string
+	Name string
+	// Replicas is how many the deployment wants running
+	Replicas int
+	// Unscheduled is how many tokens are left to hand out
+	Unscheduled int
+	// Requirements is what one replica needs
+	Requirements workload.Requirements
+}
+
+// Placement is sending Replicas more of a deployment's tokens to a device
+type Placement struct {
+	Deployment string
+	Node       string
+	Replicas   int
+}
+
+type usage struct {
+	cpus   float64
+	memory int64
+	gpus   int
+}
+
+// Plan places the replicas of each deployment that aren't on a schedulable
+// device, which includes replacing the ones on Delinquent or Cordoned devices
+// (that aren't in their Grace) as far as the unscheduled tokens go. short has how many replicas couldn't be
+// placed, by deployment key.
+func Plan(strategy Strategy, nodes []*Node, deployments []*Deployment) (placements []Placement, short map[string]int, err error) {
+	if strategy != Spread && strategy != Binpack {
+		return nil, nil, fmt.Errorf("unknown strategy %q", strategy)
+	}
+	short = make(map[string]int)
+
+	requirements := make(map[string]workload.Requirements)
+	for _, d := range deployments {
+		requirements[d.Key] = d.Requirements
+	}
+	used := make(map[string]*usage)
+	for _, node := range nodes {
+		if node.Replicas == nil {
+			node.Replicas = make(map[string]int)
+		}
+		u := &usage{}
+		for key, count := range node.Replicas {
+			req := requirements[key]
+			u.cpus += req.CPUs * float64(count)
+			u.memory += req.MemoryBytes * int64(count)
+			u.gpus += req.GPUs * count
+		}
+		used[node.Key] = u
+	}
+
+	sorted := append([]*Deployment{}, deployments...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Key < sorted[j].Key })
+
+	placed := make(map[[2]string]int)
+	for _, d := range sorted {
+		missing := d.Replicas - running(nodes, d)
+		if missing <= 0 {
+			continue
+		}
+		toPlace := missing
+		if toPlace > d.Unscheduled {
+			toPlace = d.Unscheduled
+		}
+		short[d.Key] += missing - toPlace
+
+		for i := 0; i < toPlace; i++ {
+			node := pick(strategy, nodes, used, d)
+			if node == nil {
+				short[d.Key] += toPlace - i
+				break
+			}
+			node.Replicas[d.Key]++
+			u := used[node.Key]
+			u.cpus += d.Requirements.CPUs
+			u.memory += d.Requirements.MemoryBytes
+			u.gpus += d.Requirements.GPUs
+			placed[[2]string{d.Key, node.Key}]++
+		}
+		if short[d.Key] == 0 {
+			delete(short, d.Key)
+		}
+	}
+
+	for key, count := range placed {
+		placements = append(placements, Placement{Deployment: key[0], Node: key[1], Replicas: count})
+	}
+	sort.Slice(placements, func(i, j int) bool {
+		if placements[i].Deployment != placements[j].Deployment {
+			return placements[i].Deployment < placements[j].Deployment
+		}
+		return placements[i].Node < placements[j].Node
+	})
+	return placements, short, nil
+}
+
+// Excess has how many more replicas than it wants each deployment (by key) has
+// running, which happens when a device comes back after its replicas were
+// replaced. There's no unschedule instruction, so they can only be reported.
+func Excess(nodes []*Node, deployments []*Deployment) map[string]int {
+	excess := make(map[string]int)
+	for _, d := range deployments {
+		if extra := running(nodes, d) - d.Replicas; extra > 0 {
+			excess[d.Key] = extra
+		}
+	}
+	return excess
+}
+
+// running counts d's replicas on devices that are up, or might be soon
+func running(nodes []*Node, d *Deployment) int {
+	count := 0
+	for _, node := range nodes {
+		if node.Schedulable || node.Grace {
+			count += node.Replicas[d.Key]
+		}
+	}
+	return count
+}
+
+// pick finds the node for one more replica of d, nil if it doesn't fit anywhere
+func pick(strategy Strategy, nodes []*Node, used map[string]*usage, d *Deployment) *Node {
+	var best *Node
+	for _, node := range nodes {
+		if !node.Schedulable || !fits(node, used[node.Key], d.Requirements) {
+			continue
+		}
+		if best == nil || better(strategy, node, best, d.Key) {
+			best = node
+		}
+	}
+	return best
+}
+
+func better(strategy Strategy, a, b *Node, deployment string) bool {
+	totalA, totalB := total(a), total(b)
+	switch {
+	case strategy == Spread && a.Replicas[deployment] != b.Replicas[deployment]:
+		return a.Replicas[deployment] < b.Replicas[deployment]
+	case strategy == Spread && totalA != totalB:
+		return totalA < totalB
+	case strategy == Binpack && totalA != totalB:
+		return totalA > totalB
+	}
+	return a.Key < b.Key
+}
+
+func total(node *Node) int {
+	count := 0
+	for _, c := range node.Replicas {
+		count += c
+	}
+	return count
+}
+
+// fits checks what's left on the node, a zero capacity is unknown so isn't checked
+func fits(node *Node, u *usage, req workload.Requirements) bool {
+	capacity := node.Capacity
+	if capacity.CPUs > 0 && u.cpus+req.CPUs > float64(capacity.CPUs) {
+		return false
+	}
+	if capacity.MemoryBytes > 0 && u.memory+req.MemoryBytes > int64(capacity.MemoryBytes) {
+		return false
+	}
+	if req.GPUs > 0 && u.gpus+req.GPUs > capacity.GPUs {
+		return false
+	}
+	return req.CheckConstraints(capacity, node.Hostname) == nil
+}
@@ -0,0 +1,111 @@
+package scheduler
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/workbenchapp/worknet/daoctl/lib/workgroup"
+	"github.com/workbenchapp/worknet/daoctl/lib/workload"
+)
+
+func nodes() []*Node {
+	return []*Node{
+		{Key: "a", Hostname: "a", Schedulable: true, Capacity: workgroup.DeviceCapacity{CPUs: 4}, Replicas: map[string]int{"other": 2}},
+		{Key: "b", Hostname: "b", Schedulable: true, Capacity: workgroup.DeviceCapacity{CPUs: 4}},
+		{Key: "c", Hostname: "c", Schedulable: true, Capacity: workgroup.DeviceCapacity{CPUs: 4, Labels: map[string]string{"gpu": "yes"}}},
+	}
+}
+
+func TestPlanStrategies(t *testing.T) {
+	web := &Deployment{Key: "web", Replicas: 3, Unscheduled: 3, Requirements: workload.Requirements{CPUs: 1}}
+
+	placements, short, err := Plan(Spread, nodes(), []*Deployment{web})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Placement{{"web", "a", 1}, {"web", "b", 1}, {"web", "c", 1}}
+	if !reflect.DeepEqual(placements, want) || len(short) != 0 {
+		t.Errorf("spread = %v, short %v, want %v", placements, short, want)
+	}
+
+	placements, _, err = Plan(Binpack, nodes(), []*Deployment{web})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a is busiest, and fits 4 cpus worth
+	want = []Placement{{"web", "a", 3}}
+	if !reflect.DeepEqual(placements, want) {
+		t.Errorf("binpack = %v, want %v", placements, want)
+	}
+
+	if _, _, err := Plan("random", nodes(), nil); err == nil {
+		t.Errorf("Plan with an unknown strategy didn't fail")
+	}
+}
+
+func TestPlanReplacesAndRespectsLimits(t *testing.T) {
+	n := nodes()
+	// b is cordoned with 2 replicas, only one token left to replace them with
+	n[1].Schedulable = false
+	n[1].Replicas = map[string]int{"web": 2}
+	web := &Deployment{Key: "web", Replicas: 2, Unscheduled: 1}
+	// only c has the label, and it only fits one
+	gpu := &Deployment{
+		Key: "gpu", Replicas: 2, Unscheduled: 2,
+		Requirements: workload.Requirements{CPUs: 3, Constraints: []string{"node.labels.gpu==yes"}},
+	}
+
+	placements, short, err := Plan(Spread, n, []*Deployment{web, gpu})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// c has the fewest replicas in total, even after the gpu one
+	want := []Placement{{"gpu", "c", 1}, {"web", "c", 1}}
+	if !reflect.DeepEqual(placements, want) {
+		t.Errorf("placements = %v, want %v", placements, want)
+	}
+	if !reflect.DeepEqual(short, map[string]int{"web": 1, "gpu": 1}) {
+		t.Errorf("short = %v", short)
+	}
+}
+
+func TestPlanWaitsOutGrace(t *testing.T) {
+	n := nodes()
+	// b only just dropped off, its replicas stay put for now
+	n[1].Schedulable = false
+	n[1].Grace = true
+	n[1].Replicas = map[string]int{"web": 2}
+	web := &Deployment{Key: "web", Replicas: 3, Unscheduled: 3}
+
+	placements, _, err := Plan(Spread, n, []*Deployment{web})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// only the one that was never placed, and not on b
+	want := []Placement{{"web", "c", 1}}
+	if !reflect.DeepEqual(placements, want) {
+		t.Errorf("placements = %v, want %v", placements, want)
+	}
+}
+
+func TestExcessAfterDeviceReturns(t *testing.T) {
+	n := nodes()
+	// b came back after its 2 replicas were replaced on a and c
+	n[0].Replicas = map[string]int{"web": 1}
+	n[1].Replicas = map[string]int{"web": 2}
+	n[2].Replicas = map[string]int{"web": 1}
+	web := &Deployment{Key: "web", Replicas: 2, Unscheduled: 1}
+	other := &Deployment{Key: "other", Replicas: 1, Unscheduled: 1}
+
+	excess := Excess(n, []*Deployment{web, other})
+	if !reflect.DeepEqual(excess, map[string]int{"web": 2}) {
+		t.Errorf("excess = %v", excess)
+	}
+	placements, short, err := Plan(Spread, n, []*Deployment{web})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(placements) != 0 || len(short) != 0 {
+		t.Errorf("placements = %v, short %v, want none", placements, short)
+	}
+}
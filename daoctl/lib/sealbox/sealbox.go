@@ -0,0 +1,64 @@
+// Package sealbox encrypts things to a device, using the ed25519 key it already
+// has (its device authority wallet), so nothing else needs distributing.
+//
+// The ed25519 keys are converted to X25519 (as libsodium does) for a nacl
+// anonymous box, so only the device can open it, and anyone can seal to it.
+package sealbox
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+
+	"filippo.io/edwards25519"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// Seal encrypts message so only the holder of to's private key can Open it
+func Seal(to ed25519.PublicKey, message []byte) ([]byte, error) {
+	recipient, err := publicKeyToX25519(to)
+	if err != nil {
+		return nil, err
+	}
+	return box.SealAnonymous(nil, message, recipient, rand.Reader)
+}
+
+// Open decrypts something Seal'd to key's public key
+func Open(key ed25519.PrivateKey, sealed []byte) ([]byte, error) {
+	if len(key) != ed25519.PrivateKeySize {
+		return nil, errors.New("bad ed25519 private key")
+	}
+	public, err := publicKeyToX25519(key.Public().(ed25519.PublicKey))
+	if err != nil {
+		return nil, err
+	}
+	private := privateKeyToX25519(key)
+	message, ok := box.OpenAnonymous(nil, sealed, public, private)
+	if !ok {
+		return nil, errors.New("couldn't open sealed box, it's not for this key")
+	}
+	return message, nil
+}
+
+func publicKeyToX25519(key ed25519.PublicKey) (*[32]byte, error) {
+	if len(key) != ed25519.PublicKeySize {
+		return nil, errors.New("bad ed25519 public key")
+	}
+	point, err := new(edwards25519.Point).SetBytes(key)
+	if err != nil {
+		return nil, fmt.Errorf("bad ed25519 public key: %s", err)
+	}
+	var x [32]byte
+	copy(x[:], point.BytesMontgomery())
+	return &x, nil
+}
+
+// privateKeyToX25519 is the scalar ed25519 derives from the seed, curve25519 clamps it
+func privateKeyToX25519(key ed25519.PrivateKey) *[32]byte {
+	digest := sha512.Sum512(key.Seed())
+	var x [32]byte
+	copy(x[:], digest[:32])
+	return &x
+}
@@ -0,0 +1,30 @@
+package sealbox
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+)
+
+func TestSealOpen(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := Seal(public, []byte("hunter2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	opened, err := Open(private, sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(opened) != "hunter2" {
+		t.Errorf("expected hunter2, got %q", opened)
+	}
+
+	_, other, _ := ed25519.GenerateKey(rand.Reader)
+	if _, err := Open(other, sealed); err == nil {
+		t.Error("expected another key to not open it")
+	}
+}
@@ -50,6 +50,27 @@ func derivedWallet(
 	}, ctx.Value(options.GokiProgramPubkey).(gagliardetto.PublicKey))
 }
 
+// DerivedWallet is the smart wallet's SOL holding wallet, a workgroup's GroupAuthority
+func DerivedWallet(ctx context.Context, smartWalletPDA gagliardetto.PublicKey) (gagliardetto.PublicKey, error) {
+	derived, _, err := derivedWallet(ctx, smartWalletPDA)
+	return derived, err
+}
+
+// SmartWalletOwners are the keys that can propose and approve the smart wallet's
+// transactions, and threshold is how many of them have to approve one
+func SmartWalletOwners(ctx context.Context, client *gagliardettorpc.Client, smartWalletPDA gagliardetto.PublicKey) (owners []gagliardetto.PublicKey, threshold uint64, err error) {
+	info, err := client.GetAccountInfo(ctx, smartWalletPDA)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error looking for smart wallet %s: %s", smartWalletPDA, err)
+	}
+	gokiWallet := smartwallet.SmartWallet{}
+	decoder := bin.NewDecoderWithEncoding(info.Value.Data.GetBinary(), bin.EncodingBorsh)
+	if err := gokiWallet.UnmarshalWithDecoder(decoder); err != nil {
+		return nil, 0, fmt.Errorf("decoding smart wallet failed: %s", err)
+	}
+	return gokiWallet.Owners, gokiWallet.Threshold, nil
+}
+
 type PDA struct {
 	Key  gagliardetto.PublicKey
 	Bump uint8
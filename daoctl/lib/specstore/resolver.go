@@ -0,0 +1,168 @@
+package specstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+var (
+	DefaultIPFSGateways    = []string{"https://ipfs.io", "https://cloudflare-ipfs.com"}
+	DefaultArweaveGateways = []string{"https://arweave.net"}
+)
+
+// Resolver gets a spec's content from wherever WorkSpec.UrlOrContents says,
+// falling back to content addressed mirrors and workgroup peers. Since
+// ContentsSha256 pins the content, it doesn't matter who we get it from.
+type Resolver struct {
+	Store *Store
+
+	IPFSGateways    []string
+	ArweaveGateways []string
+	// Mirrors are base URLs that serve <mirror>/sha256/<hash>
+	Mirrors []string
+	// Peers returns the mirror base URLs of the other devices in the workgroup
+	Peers func() []string
+
+	// Timeout is per source tried
+	Timeout time.Duration
+	MaxSize int64
+	Client  *http.Client
+}
+
+type source struct {
+	name string
+	open func(ctx context.Context) (io.ReadCloser, error)
+}
+
+// Open returns the spec content, from the cache if we already have it
+func (r *Resolver) Open(ctx context.Context, urlOrContents string, hash string) (io.ReadCloser, error) {
+	if err := r.Fetch(ctx, urlOrContents, hash); err != nil {
+		return nil, err
+	}
+	return r.Store.Open(hash)
+}
+
+// Fetch makes sure the cache has the spec, trying each source in turn until one matches the hash
+func (r *Resolver) Fetch(ctx context.Context, urlOrContents string, hash string) error {
+	log := logr.FromContextOrDiscard(ctx)
+
+	if r.Store.Has(hash) {
+		return nil
+	}
+	sources, err := r.sources(urlOrContents, hash)
+	if err != nil {
+		return err
+	}
+
+	errs := []string{}
+	for _, src := range sources {
+		if err := r.fetchFrom(ctx, src, hash); err != nil {
+			log.V(1).Info("Couldn't fetch spec", "source", src.name, "err", err.Error())
+			errs = append(errs, fmt.Sprintf("%s: %s", src.name, err))
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+		log.Info("Fetched spec", "source", src.name, "sha256", hash)
+		return nil
+	}
+	return fmt.Errorf("couldn't fetch spec %s: %s", hash, strings.Join(errs, "; "))
+}
+
+func (r *Resolver) fetchFrom(ctx context.Context, src source, hash string) error {
+	if r.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.Timeout)
+		defer cancel()
+	}
+	body, err := src.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	return r.Store.Put(hash, body, r.MaxSize)
+}
+
+func (r *Resolver) sources(urlOrContents string, hash string) ([]source, error) {
+	sources := []source{}
+	switch {
+	case strings.HasPrefix(urlOrContents, "https://"), strings.HasPrefix(urlOrContents, "http://"):
+		sources = append(sources, r.httpSource(urlOrContents))
+	case strings.HasPrefix(urlOrContents, "ipfs://"):
+		// ipfs://<cid>[/path]
+		cidPath := strings.TrimPrefix(urlOrContents, "ipfs://")
+		for _, gateway := range r.IPFSGateways {
+			sources = append(sources, r.httpSource(strings.TrimSuffix(gateway, "/")+"/ipfs/"+cidPath))
+		}
+	case strings.HasPrefix(urlOrContents, "ar://"):
+		// ar://<transaction id>
+		txID := strings.TrimPrefix(urlOrContents, "ar://")
+		for _, gateway := range r.ArweaveGateways {
+			sources = append(sources, r.httpSource(strings.TrimSuffix(gateway, "/")+"/"+txID))
+		}
+	case strings.HasPrefix(urlOrContents, "file://"):
+		u, err := url.Parse(urlOrContents)
+		if err != nil {
+			return nil, fmt.Errorf("invalid spec url %q: %s", urlOrContents, err)
+		}
+		sources = append(sources, source{
+			name: urlOrContents,
+			open: func(ctx context.Context) (io.ReadCloser, error) {
+				return os.Open(u.Path)
+			},
+		})
+	default:
+		// contents...
+		sources = append(sources, source{
+			name: "inline contents",
+			open: func(ctx context.Context) (io.ReadCloser, error) {
+				return io.NopCloser(strings.NewReader(urlOrContents)), nil
+			},
+		})
+	}
+
+	// the original can go away, so anyone who has the content will do
+	mirrors := append([]string{}, r.Mirrors...)
+	if r.Peers != nil {
+		mirrors = append(mirrors, r.Peers()...)
+	}
+	for _, mirror := range mirrors {
+		sources = append(sources, r.httpSource(strings.TrimSuffix(mirror, "/")+"/"+hashDirName+"/"+hash))
+	}
+	return sources, nil
+}
+
+func (r *Resolver) httpSource(specURL string) source {
+	return source{
+		name: specURL,
+		open: func(ctx context.Context) (io.ReadCloser, error) {
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, specURL, nil)
+			if err != nil {
+				return nil, err
+			}
+			client := r.Client
+			if client == nil {
+				client = http.DefaultClient
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				return nil, err
+			}
+			if resp.StatusCode != http.StatusOK {
+				resp.Body.Close()
+				return nil, errors.New(resp.Status)
+			}
+			return resp.Body, nil
+		},
+	}
+}
@@ -0,0 +1,85 @@
+package specstore
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func hashOf(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestResolverFallsBackToPeers(t *testing.T) {
+	content := "services:\n  web:\n    image: nginx\n"
+	hash := hashOf(content)
+
+	peerStore, err := NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := peerStore.Put(hash, strings.NewReader(content), 1024); err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/specs/", peerStore)
+	peer := httptest.NewServer(mux)
+	defer peer.Close()
+
+	// the original is gone
+	origin := httptest.NewServer(http.NotFoundHandler())
+	defer origin.Close()
+
+	store, err := NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolver := &Resolver{
+		Store:   store,
+		Peers:   func() []string { return []string{peer.URL + "/specs"} },
+		MaxSize: 1024,
+	}
+	spec, err := resolver.Open(context.Background(), origin.URL+"/docker-compose.yaml", hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spec.Close()
+	got, _ := ioutil.ReadAll(spec)
+	if string(got) != content {
+		t.Fatalf("unexpected content %q", got)
+	}
+	if !store.Has(hash) {
+		t.Fatal("spec wasn't cached")
+	}
+}
+
+func TestResolverRejectsWrongContent(t *testing.T) {
+	store, err := NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolver := &Resolver{Store: store, MaxSize: 1024}
+
+	if err := resolver.Fetch(context.Background(), "not the spec", hashOf("the spec")); err == nil {
+		t.Fatal("expected a checksum mismatch")
+	}
+	failed, _ := filepath.Glob(filepath.Join(store.Dir, failedDirName, "*"))
+	if len(failed) != 1 {
+		t.Fatalf("expected the failed fetch to be kept, got %v", failed)
+	}
+
+	if err := resolver.Fetch(context.Background(), "small", hashOf("small")); err != nil {
+		t.Fatal(err)
+	}
+	resolver.MaxSize = 3
+	if err := resolver.Fetch(context.Background(), "also too big", hashOf("also too big")); err == nil {
+		t.Fatal("expected the size limit to be enforced")
+	}
+}
@@ -0,0 +1,153 @@
+package specstore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// content is kept under <dir>/sha256/<hex hash>
+	hashDirName = "sha256"
+	// fetches whose content didn't match the hash, kept for inspection
+	failedDirName = "failed"
+	// only keep the most recent failures, a broken spec is retried every poll
+	maxFailed = 5
+)
+
+// Store is a local content addressed cache of specs, keyed by their sha256
+type Store struct {
+	Dir string
+}
+
+func NewStore(dir string) (*Store, error) {
+	if err := os.MkdirAll(filepath.Join(dir, hashDirName), os.ModePerm); err != nil {
+		return nil, err
+	}
+	return &Store{Dir: dir}, nil
+}
+
+func validHash(hash string) bool {
+	if len(hash) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil
+}
+
+func (s *Store) path(hash string) string {
+	return filepath.Join(s.Dir, hashDirName, strings.ToLower(hash))
+}
+
+// Open returns the cached content for hash, or an os.ErrNotExist error
+func (s *Store) Open(hash string) (*os.File, error) {
+	if !validHash(hash) {
+		return nil, fmt.Errorf("invalid sha256 %q", hash)
+	}
+	return os.Open(s.path(hash))
+}
+
+func (s *Store) Has(hash string) bool {
+	if !validHash(hash) {
+		return false
+	}
+	_, err := os.Stat(s.path(hash))
+	return err == nil
+}
+
+// Put reads at most maxSize bytes from r into the cache, and only keeps them if they hash to hash
+func (s *Store) Put(hash string, r io.Reader, maxSize int64) error {
+	if !validHash(hash) {
+		return fmt.Errorf("invalid sha256 %q", hash)
+	}
+	staging, err := ioutil.TempFile(filepath.Join(s.Dir, hashDirName), ".staging-*")
+	if err != nil {
+		return err
+	}
+	stagingPath := staging.Name()
+
+	contentHash := sha256.New()
+	// read one more than allowed, so we can tell a spec that's exactly the max from one that's too big
+	n, err := io.Copy(io.MultiWriter(staging, contentHash), io.LimitReader(r, maxSize+1))
+	if err == nil && n > maxSize {
+		err = fmt.Errorf("spec is larger than the %d byte limit", maxSize)
+	}
+	if err == nil {
+		err = staging.Sync()
+	}
+	if closeErr := staging.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(stagingPath)
+		return err
+	}
+
+	actual := hex.EncodeToString(contentHash.Sum(nil))
+	if actual != strings.ToLower(hash) {
+		KeepFailed(stagingPath, filepath.Join(s.Dir, failedDirName), hash)
+		return fmt.Errorf("checksum mismatch with spec: expected=%s actual=%s", hash, actual)
+	}
+	if err := os.Chmod(stagingPath, 0644); err != nil {
+		return err
+	}
+	return os.Rename(stagingPath, s.path(hash))
+}
+
+// ServeHTTP serves GET <prefix>/<hash>, so peers can fetch specs from us over the mesh
+func (s *Store) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	hash := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+	f, err := s.Open(hash)
+	if errors.Is(err, os.ErrNotExist) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("ETag", `"`+hash+`"`)
+	http.ServeContent(w, r, "", stat.ModTime(), f)
+}
+
+// KeepFailed moves a failed staging file into failedDir, and prunes old failures
+func KeepFailed(stagingPath string, failedDir string, name string) {
+	if err := os.MkdirAll(failedDir, os.ModePerm); err != nil {
+		os.Remove(stagingPath)
+		return
+	}
+	failedPath := filepath.Join(failedDir, fmt.Sprintf("%s-%d", name, time.Now().UnixNano()))
+	if err := os.Rename(stagingPath, failedPath); err != nil {
+		os.Remove(stagingPath)
+		return
+	}
+
+	entries, err := ioutil.ReadDir(failedDir)
+	if err != nil || len(entries) <= maxFailed {
+		return
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ModTime().Before(entries[j].ModTime()) })
+	for _, entry := range entries[:len(entries)-maxFailed] {
+		os.Remove(filepath.Join(failedDir, entry.Name()))
+	}
+}
@@ -0,0 +1,29 @@
+package util
+
+import (
+	"bufio"
+	"io"
+)
+
+type PrefixWriter struct {
+	io.Writer
+}
+
+func NewPrefixWriter(w io.Writer, prefix string) *PrefixWriter {
+	pipeReader, pipeWriter := io.Pipe()
+	scanner := bufio.NewScanner(pipeReader)
+	go func() {
+		for scanner.Scan() {
+			if _, err := w.Write([]byte(prefix + scanner.Text() + "\n")); err != nil {
+				panic(err)
+			}
+		}
+	}()
+	return &PrefixWriter{
+		Writer: pipeWriter,
+	}
+}
+
+func (pw *PrefixWriter) Write(p []byte) (n int, err error) {
+	return pw.Writer.Write(p)
+}
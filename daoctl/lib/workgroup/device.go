@@ -6,11 +6,13 @@ import (
 	"errors"
 	"fmt"
 	"sync"
+	"time"
 
 	bin "github.com/gagliardetto/binary"
 	gagliardetto "github.com/gagliardetto/solana-go"
 	gagliardettorpc "github.com/gagliardetto/solana-go/rpc"
 	"github.com/go-logr/logr"
+	"github.com/workbenchapp/worknet/daoctl/lib/agentstate"
 	"github.com/workbenchapp/worknet/daoctl/lib/options"
 	"github.com/workbenchapp/worknet/daoctl/lib/solana"
 	"github.com/workbenchapp/worknet/daoctl/lib/solana/anchor/generated/worknet"
@@ -18,18 +20,135 @@ import (
 	"github.com/workbenchapp/worknet/daoctl/lib/version"
 )
 
+// DeployState is one service of a deployment, it matches `docker-compose ps --format json`
 type DeployState struct {
-	Publishers []options.Publisher
+	Name         string
+	Service      string
+	State        string
+	Health       string `json:",omitempty"`
+	ExitCode     int
+	RestartCount int
+	StartedAt    *time.Time `json:",omitempty"`
+	Publishers   []options.Publisher
+
+	// HealthError is why the agent's probe last failed
+	HealthError string `json:",omitempty"`
+	// HealthRestarts is how many times the agent restarted it for being unhealthy, since it was last healthy for a while
+	HealthRestarts int `json:",omitempty"`
 }
 
+// Healthy is false for services that aren't running, or whose health check is
+// failing or hasn't passed yet. Ports from the agent config have no State, and
+// count as healthy.
+func (s DeployState) Healthy() bool {
+	if s.State != "" && s.State != "running" {
+		return false
+	}
+	return s.Health == "" || s.Health == "healthy"
+}
+
+// PullProgress is how far along pulling one of a deployment's images is
+type PullProgress struct {
+	Image string `json:"image"`
+	// Status is pulling, pulled or failed
+	Status string `json:"status"`
+	// Current and Total are bytes, of the layers docker has told us about so far
+	Current int64  `json:"current,omitempty"`
+	Total   int64  `json:"total,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+const (
+	PullPulling = "pulling"
+	PullPulled  = "pulled"
+	PullFailed  = "failed"
+)
+
+// DeploymentPhase is where one replica of a deployment is at, on this device
+type DeploymentPhase string
+
+const (
+	// PhasePending is a deployment we haven't deployed yet
+	PhasePending DeploymentPhase = "Pending"
+	// PhasePulling is a deployment being (re)deployed, which is mostly pulling images
+	PhasePulling DeploymentPhase = "Pulling"
+	// PhaseRunning is a deployment with all its services running
+	PhaseRunning DeploymentPhase = "Running"
+	// PhaseFailed is a deployment that couldn't be deployed, or has services that keep dying
+	PhaseFailed DeploymentPhase = "Failed"
+	// PhaseStopped is a deployment whose services have all exited
+	PhaseStopped DeploymentPhase = "Stopped"
+)
+
 type DeploymentInfo struct {
 	Deployment worknet.Deployment `json:"deployment"`
 	Spec       worknet.WorkSpec   `json:"spec"`
 	States     []DeployState      `json:"state"`
+
+	DeploymentPDA string          `json:"deployment_pda,omitempty"`
+	Replica       int             `json:"replica"`
+	Phase         DeploymentPhase `json:"phase,omitempty"`
+	LastError     string          `json:"last_error,omitempty"`
+	LastErrorAt   *time.Time      `json:"last_error_at,omitempty"`
+	// Restarts adds up the services' RestartCount
+	Restarts   int        `json:"restarts"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	DeployedAt *time.Time `json:"deployed_at,omitempty"`
+	UpdatedAt  *time.Time `json:"updated_at,omitempty"`
+
+	// Pulls is how the image pulls for the last (re)deploy went
+	Pulls []PullProgress `json:"pulls,omitempty"`
+}
+
+// PhaseFromStates works out the phase from the services' states, lastErr is
+// why the last attempt to deploy failed, if it did
+func PhaseFromStates(states []DeployState, lastErr error) DeploymentPhase {
+	if len(states) == 0 {
+		if lastErr != nil {
+			return PhaseFailed
+		}
+		return PhasePending
+	}
+	running := 0
+	for _, state := range states {
+		switch {
+		case state.State == "restarting", state.State == "dead", state.Health == "unhealthy":
+			return PhaseFailed
+		case state.State == "running":
+			running++
+		}
+	}
+	switch {
+	case running == len(states):
+		// a failed update leaves the previous version running
+		return PhaseRunning
+	case lastErr != nil:
+		return PhaseFailed
+	case running > 0:
+		// one shot services that have finished
+		return PhaseRunning
+	}
+	return PhaseStopped
+}
+
+// DeviceCapacity is what this device has to run deployments on
+type DeviceCapacity struct {
+	CPUs int `json:"cpus"`
+	// MemoryBytes is the total RAM
+	MemoryBytes uint64 `json:"memory_bytes"`
+	// DiskBytes is the space free where the agent keeps deployments
+	DiskBytes uint64 `json:"disk_bytes"`
+	// GPUs is how many (NVIDIA) GPUs were found
+	GPUs int    `json:"gpus"`
+	OS   string `json:"os"`
+	Arch string `json:"arch"`
+	// Labels come from the agent config, for placement constraints
+	Labels map[string]string `json:"labels,omitempty"`
 }
 
 type DeviceStatusInfo struct {
 	DeployState      map[string]DeploymentInfo `json:"deploy_state"`
+	Capacity         DeviceCapacity            `json:"capacity"`
 	DeviceInfo       worknet.Device            `json:"deviceInfo"`
 	GroupInfo        worknet.WorkGroup         `json:"groupInfo"`
 	DeviceInfoKey    string                    `json:"deviceInfoKey"`
@@ -37,6 +156,12 @@ type DeviceStatusInfo struct {
 	DeviceWallet     string                    `json:"deviceWallet"`
 	Validator        string                    `json:"validator"`
 
+	// Draining is set while the device stops its workloads to hand their tokens back
+	Draining bool `json:"draining,omitempty"`
+	// LastSeen is when we last heard from the device over the mesh, see heartbeat.go
+	LastSeen   *time.Time `json:"last_seen,omitempty"`
+	Delinquent bool       `json:"delinquent,omitempty"`
+
 	// Agent code version
 	Version         string
 	VersionRevision string
@@ -47,8 +172,41 @@ type DeviceStatusInfo struct {
 
 // the remote status cache (keyd by deviceATA)
 var remoteDeviceCache sync.Map // map[string]*DeviceStatusInfo
-func InitDeviceCache() {
+
+// where the cache is kept between restarts, nil to only keep it in memory
+var stateDB *agentstate.DB
+
+// InitDeviceCache (re)loads the device cache from db, so we start with what we
+// knew before the restart, and keeps it up to date there from then on
+func InitDeviceCache(ctx context.Context, db *agentstate.DB) {
+	log := logr.FromContextOrDiscard(ctx)
 	remoteDeviceCache = sync.Map{} // map[string]*DeviceStatusInfo
+	stateDB = db
+	if db == nil {
+		return
+	}
+	err := db.ForEach(agentstate.Devices, func(deviceATA string, data []byte) error {
+		info := &DeviceStatusInfo{}
+		if err := json.Unmarshal(data, info); err != nil {
+			// not worth failing over, it'll get refreshed
+			log.Error(err, "Couldn't decode cached device status", "deviceTokenAccount", deviceATA)
+			return nil
+		}
+		remoteDeviceCache.Store(deviceATA, info)
+		return nil
+	})
+	if err != nil {
+		log.Error(err, "Couldn't load device cache")
+	}
+}
+
+func persistDeviceStatus(ctx context.Context, deviceATA string, info *DeviceStatusInfo) {
+	if stateDB == nil {
+		return
+	}
+	if err := stateDB.Put(agentstate.Devices, deviceATA, info); err != nil {
+		logr.FromContextOrDiscard(ctx).Error(err, "Couldn't save device status", "deviceTokenAccount", deviceATA)
+	}
 }
 
 func UpdateDeployState(ctx context.Context, deviceATA, deployKey string, data DeploymentInfo) {
@@ -69,6 +227,49 @@ func UpdateDeployState(ctx context.Context, deviceATA, deployKey string, data De
 	}
 	currentInfo.DeployState[deployKey] = data
 	remoteDeviceCache.Store(deviceATA, currentInfo)
+	persistDeviceStatus(ctx, deviceATA, currentInfo)
+}
+
+func RemoveDeployState(ctx context.Context, deviceATA, deployKey string) {
+	log := logr.FromContextOrDiscard(ctx)
+	if deviceATA == "" {
+		deviceATA = "local"
+	}
+	log.V(1).Info("Removing deploy state", "deviceTokenAccount", deviceATA, "deployKey", deployKey)
+
+	loadCurrentInfo, ok := remoteDeviceCache.Load(deviceATA)
+	if !ok {
+		return
+	}
+	currentInfo := loadCurrentInfo.(*DeviceStatusInfo)
+	delete(currentInfo.DeployState, deployKey)
+	persistDeviceStatus(ctx, deviceATA, currentInfo)
+}
+
+// SetDeviceCapacity records what this device has to run deployments on, for /device
+func SetDeviceCapacity(ctx context.Context, capacity DeviceCapacity) {
+	deviceATA := "local"
+	currentInfo := &DeviceStatusInfo{}
+	loadCurrentInfo, ok := remoteDeviceCache.Load(deviceATA)
+	if ok {
+		currentInfo = loadCurrentInfo.(*DeviceStatusInfo)
+	}
+	currentInfo.Capacity = capacity
+	remoteDeviceCache.Store(deviceATA, currentInfo)
+	persistDeviceStatus(ctx, deviceATA, currentInfo)
+}
+
+// SetDeviceDraining records whether this device is draining, for /device
+func SetDeviceDraining(ctx context.Context, draining bool) {
+	deviceATA := "local"
+	currentInfo := &DeviceStatusInfo{}
+	loadCurrentInfo, ok := remoteDeviceCache.Load(deviceATA)
+	if ok {
+		currentInfo = loadCurrentInfo.(*DeviceStatusInfo)
+	}
+	currentInfo.Draining = draining
+	remoteDeviceCache.Store(deviceATA, currentInfo)
+	persistDeviceStatus(ctx, deviceATA, currentInfo)
 }
 
 // from the proxy requests...
@@ -86,7 +287,13 @@ func UpdateDeviceStatusInfo(ctx context.Context, data []byte) {
 
 	log.V(1).Info("Caching UpdateDeviceStatue for current device", "deviceAuthority", currentInfo.DeviceInfo.DeviceAuthority.String())
 
+	// it answered, so that's a heartbeat
+	now := time.Now()
+	currentInfo.LastSeen = &now
+	currentInfo.Delinquent = currentInfo.DeviceInfo.Status == worknet.DeviceStatusDelinquent
+
 	remoteDeviceCache.Store(currentInfo.DeviceInfo.DeviceAuthority.String(), &currentInfo)
+	persistDeviceStatus(ctx, currentInfo.DeviceInfo.DeviceAuthority.String(), &currentInfo)
 }
 
 // TODO: yeah.
@@ -122,6 +329,7 @@ func GetDeviceInfo(ctx context.Context) (*DeviceStatusInfo, error) {
 	defer func() {
 		// cache whatever info we got...
 		remoteDeviceCache.Store(deviceATA, currentInfo)
+		persistDeviceStatus(ctx, deviceATA, currentInfo)
 	}()
 
 	ourWallet, err := solana.MustGetAgentWallet(ctx)
@@ -196,7 +404,37 @@ func GetDeviceInfo(ctx context.Context) (*DeviceStatusInfo, error) {
 	return currentInfo, nil
 }
 
+// GetDeviceInfoByKey gets a peer's device account from chain, falling back to
+// what we last got if the chain can't be reached
 func GetDeviceInfoByKey(ctx context.Context, deviceKey gagliardetto.PublicKey) (info *worknet.Device, err error) {
+	info, err = getDeviceInfoByKey(ctx, deviceKey)
+	if stateDB == nil {
+		if err == gagliardettorpc.ErrNotFound {
+			return nil, errors.New("device " + deviceKey.String() + " not found on chain")
+		}
+		return info, err
+	}
+	log := logr.FromContextOrDiscard(ctx)
+	if err == nil {
+		if err := stateDB.Put(agentstate.Peers, deviceKey.String(), info); err != nil {
+			log.Error(err, "Couldn't save peer device", "device", deviceKey)
+		}
+		return info, nil
+	}
+	if err == gagliardettorpc.ErrNotFound {
+		// it's gone, so don't keep falling back to it
+		stateDB.Delete(agentstate.Peers, deviceKey.String())
+		return nil, errors.New("device " + deviceKey.String() + " not found on chain")
+	}
+	cached := &worknet.Device{}
+	if found, _ := stateDB.Get(agentstate.Peers, deviceKey.String(), cached); found {
+		log.V(1).Info("Using saved peer device", "device", deviceKey, "err", err)
+		return cached, nil
+	}
+	return nil, err
+}
+
+func getDeviceInfoByKey(ctx context.Context, deviceKey gagliardetto.PublicKey) (info *worknet.Device, err error) {
 	client := gagliardettorpc.New(options.SolanaCluster(ctx).RPC)
 	// wsClient, err := gagliardettorws.Connect(gOpts.Ctx, options.SolanaCluster(gOpts.Ctx).WS)
 	// if err != nil {
@@ -206,11 +444,7 @@ func GetDeviceInfoByKey(ctx context.Context, deviceKey gagliardetto.PublicKey) (
 	var deviceAccountResp *gagliardettorpc.GetAccountInfoResult
 
 	if deviceAccountResp, err = client.GetAccountInfo(ctx, deviceKey); err != nil {
-		if err == gagliardettorpc.ErrNotFound {
-			return nil, errors.New("device " + deviceKey.String() + " not found on chain")
-		} else {
-			return nil, err
-		}
+		return nil, err // GetDeviceInfoByKey sorts out ErrNotFound
 	}
 
 	device := &worknet.Device{}
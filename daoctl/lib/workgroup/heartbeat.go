@@ -0,0 +1,52 @@
+package workgroup
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/workbenchapp/worknet/daoctl/lib/solana/anchor/generated/worknet"
+)
+
+// Only the device itself can change its status on chain, so the others can't
+// set it Delinquent there. Instead each agent keeps track of when it last heard
+// from its peers over the mesh, and flags the ones that have gone quiet in its
+// cache (and so in /device?proxy=<hostname>), which the scheduler skips.
+
+// DelinquentAfter is how long a device can go without answering before it's flagged
+var DelinquentAfter = 5 * time.Minute
+
+// devices we've never heard from count from when we started looking
+var heartbeatsSince = time.Now()
+
+// MissedHeartbeat records that the device (by device authority) didn't answer,
+// and flags it as Delinquent once it hasn't for DelinquentAfter
+func MissedHeartbeat(ctx context.Context, device worknet.Device) {
+	log := logr.FromContextOrDiscard(ctx)
+	deviceATA := device.DeviceAuthority.String()
+
+	currentInfo := &DeviceStatusInfo{DeviceInfo: device}
+	loadCurrentInfo, ok := remoteDeviceCache.Load(deviceATA)
+	if ok {
+		currentInfo = loadCurrentInfo.(*DeviceStatusInfo)
+	}
+	if currentInfo.Delinquent {
+		return
+	}
+	lastSeen := heartbeatsSince
+	if currentInfo.LastSeen != nil && currentInfo.LastSeen.After(lastSeen) {
+		lastSeen = *currentInfo.LastSeen
+	}
+	if time.Since(lastSeen) < DelinquentAfter {
+		return
+	}
+	log.Info("Device stopped answering, flagging it delinquent", "hostname", device.Hostname, "deviceAuthority", deviceATA, "lastSeen", lastSeen)
+	currentInfo.Delinquent = true
+	remoteDeviceCache.Store(deviceATA, currentInfo)
+	persistDeviceStatus(ctx, deviceATA, currentInfo)
+}
+
+// IsDelinquent says if the device's status is Delinquent on chain, or it's stopped answering
+func IsDelinquent(info *DeviceStatusInfo) bool {
+	return info.Delinquent || info.DeviceInfo.Status == worknet.DeviceStatusDelinquent
+}
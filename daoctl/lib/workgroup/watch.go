@@ -0,0 +1,191 @@
+package workgroup
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	gagliardetto "github.com/gagliardetto/solana-go"
+	gagliardettorpc "github.com/gagliardetto/solana-go/rpc"
+	gagliardettorws "github.com/gagliardetto/solana-go/rpc/ws"
+	"github.com/go-logr/logr"
+	"github.com/jpillora/backoff"
+)
+
+const (
+	// SPL token accounts are 165 bytes, and the owner starts after the 32 byte mint
+	tokenAccountSize        = 165
+	tokenAccountOwnerOffset = 32
+)
+
+const (
+	// SourceDropped is the ChainChange Source when the subscriptions drop, the
+	// agent needs to start polling
+	SourceDropped = "dropped"
+	// SourceSubscribed is the ChainChange Source when the subscriptions are back,
+	// the agent needs to catch up on what changed while they were down
+	SourceSubscribed = "subscribed"
+)
+
+// ChainChange says which of the watched accounts changed on chain, or that the
+// subscriptions went down or came back (with no Account)
+type ChainChange struct {
+	Source  string
+	Account gagliardetto.PublicKey
+	Slot    uint64
+}
+
+// ChainWatcher subscribes to the accounts the agent needs to reconcile on, and
+// sends a ChainChange to Changes whenever one of them is updated on chain, and
+// when the subscriptions drop or come back.
+type ChainWatcher struct {
+	WSEndpoint      string
+	DevicePDA       gagliardetto.PublicKey
+	WorkGroup       gagliardetto.PublicKey
+	DeviceAuthority gagliardetto.PublicKey
+
+	Changes chan ChainChange
+
+	// set by Run, 1 while the subscriptions are up
+	connected int32
+}
+
+func NewChainWatcher(wsEndpoint string, devicePDA, workGroup, deviceAuthority gagliardetto.PublicKey) *ChainWatcher {
+	return &ChainWatcher{
+		WSEndpoint:      wsEndpoint,
+		DevicePDA:       devicePDA,
+		WorkGroup:       workGroup,
+		DeviceAuthority: deviceAuthority,
+		Changes:         make(chan ChainChange, 16),
+	}
+}
+
+// Subscribed is true while the websocket subscriptions are up - when false, callers should fall back to polling
+func (w *ChainWatcher) Subscribed() bool {
+	return atomic.LoadInt32(&w.connected) == 1
+}
+
+// Run keeps the subscriptions alive until ctx is cancelled, reconnecting with backoff when the websocket drops
+func (w *ChainWatcher) Run(ctx context.Context) {
+	log := logr.FromContextOrDiscard(ctx)
+	b := &backoff.Backoff{
+		Min:    time.Second,
+		Max:    2 * time.Minute,
+		Jitter: true,
+	}
+
+	for {
+		started := time.Now()
+		err := w.watch(ctx)
+		wasConnected := atomic.SwapInt32(&w.connected, 0) == 1
+		if ctx.Err() != nil {
+			return
+		}
+		if wasConnected {
+			w.notify(ctx, ChainChange{Source: SourceDropped})
+		}
+		if time.Since(started) > b.Max {
+			// it was up for a while, so don't punish this drop
+			b.Reset()
+		}
+		d := b.Duration()
+		log.Info("Chain subscription dropped, falling back to polling", "err", err, "retry_in", d)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(d):
+		}
+	}
+}
+
+func (w *ChainWatcher) watch(ctx context.Context) error {
+	log := logr.FromContextOrDiscard(ctx)
+
+	wsClient, err := gagliardettorws.Connect(ctx, w.WSEndpoint)
+	if err != nil {
+		return fmt.Errorf("couldn't connect to %s: %s", w.WSEndpoint, err)
+	}
+	defer wsClient.Close()
+
+	errCh := make(chan error, 3)
+
+	for source, account := range map[string]gagliardetto.PublicKey{
+		"device":    w.DevicePDA,
+		"workgroup": w.WorkGroup,
+	} {
+		sub, err := wsClient.AccountSubscribe(account, gagliardettorpc.CommitmentConfirmed)
+		if err != nil {
+			return fmt.Errorf("couldn't subscribe to %s account %s: %s", source, account, err)
+		}
+		defer sub.Unsubscribe()
+
+		go func(source string, account gagliardetto.PublicKey) {
+			for {
+				res, err := sub.Recv()
+				if err != nil {
+					errCh <- err
+					return
+				}
+				w.notify(ctx, ChainChange{Source: source, Account: account, Slot: res.Context.Slot})
+			}
+		}(source, account)
+	}
+
+	// The device's deployment tokens can come and go, so watch every token
+	// account owned by the device authority rather than a fixed list
+	tokenSub, err := wsClient.ProgramSubscribeWithOpts(
+		gagliardetto.TokenProgramID,
+		gagliardettorpc.CommitmentConfirmed,
+		"",
+		[]gagliardettorpc.RPCFilter{
+			{DataSize: tokenAccountSize},
+			{Memcmp: &gagliardettorpc.RPCFilterMemcmp{
+				Offset: tokenAccountOwnerOffset,
+				Bytes:  w.DeviceAuthority.Bytes(),
+			}},
+		},
+	)
+	if err != nil {
+		return fmt.Errorf("couldn't subscribe to device token accounts: %s", err)
+	}
+	defer tokenSub.Unsubscribe()
+
+	go func() {
+		for {
+			res, err := tokenSub.Recv()
+			if err != nil {
+				errCh <- err
+				return
+			}
+			w.notify(ctx, ChainChange{Source: "tokens", Account: res.Value.Pubkey, Slot: res.Context.Slot})
+		}
+	}()
+
+	atomic.StoreInt32(&w.connected, 1)
+	log.Info("Subscribed to chain changes",
+		"devicePDA", w.DevicePDA,
+		"workgroup", w.WorkGroup,
+		"deviceAuthority", w.DeviceAuthority,
+	)
+	// anything could have changed while we weren't subscribed
+	w.notify(ctx, ChainChange{Source: SourceSubscribed})
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case err := <-errCh:
+		return err
+	}
+}
+
+func (w *ChainWatcher) notify(ctx context.Context, change ChainChange) {
+	log := logr.FromContextOrDiscard(ctx)
+	log.V(1).Info("Chain change", "source", change.Source, "account", change.Account, "slot", change.Slot)
+	select {
+	case w.Changes <- change:
+	default:
+		// a reconcile is already queued, and it will see this change too
+	}
+}
@@ -0,0 +1,105 @@
+package workload
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/workbenchapp/worknet/daoctl/lib/solana/anchor/generated/worknet"
+	"gopkg.in/yaml.v2"
+)
+
+// the agent sets these itself, deployments can't override them
+const reservedEnvPrefix = "DAONETES_"
+
+// DeploymentArgsEnv checks a deployment's args against their types, and turns them
+// into KEY=value pairs for the workload's environment and spec interpolation
+func DeploymentArgsEnv(args []worknet.DeploymentArg) ([]string, error) {
+	env := []string{}
+	seen := map[string]bool{}
+	for _, arg := range args {
+		if !isVarName(arg.ArgName) {
+			return nil, fmt.Errorf("invalid arg name %q, must be letters, digits and _", arg.ArgName)
+		}
+		if strings.HasPrefix(strings.ToUpper(arg.ArgName), reservedEnvPrefix) {
+			return nil, fmt.Errorf("invalid arg name %q, %s is reserved", arg.ArgName, reservedEnvPrefix)
+		}
+		if seen[arg.ArgName] {
+			return nil, fmt.Errorf("arg %q is set more than once", arg.ArgName)
+		}
+		seen[arg.ArgName] = true
+
+		switch arg.ArgType {
+		case worknet.DeploymentArgTypeString:
+		case worknet.DeploymentArgTypeNumber:
+			if _, err := strconv.ParseFloat(arg.ArgValue, 64); err != nil {
+				return nil, fmt.Errorf("arg %q is a Number, but %q isn't a number", arg.ArgName, arg.ArgValue)
+			}
+		default:
+			return nil, fmt.Errorf("arg %q has unknown type %d", arg.ArgName, arg.ArgType)
+		}
+		env = append(env, arg.ArgName+"="+arg.ArgValue)
+	}
+	return env, nil
+}
+
+// envOverrideFile is the compose file ComposeRuntime adds to the spec, to get
+// Workload.Env into the containers like DockerRuntime does, it's in the WorkDir
+const envOverrideFile = "docker-compose.env.yml"
+
+// writeEnvOverride writes envOverrideFile, setting w.Env in each of the spec's
+// services that doesn't set the same var itself
+func writeEnvOverride(w *Workload, compose *ComposeFile) (string, error) {
+	if w.WorkDir == "" {
+		return "", nil
+	}
+	type overrideService struct {
+		Environment map[string]string `yaml:"environment"`
+	}
+	override := struct {
+		Version  string                     `yaml:"version,omitempty"`
+		Services map[string]overrideService `yaml:"services"`
+	}{
+		// has to match the spec's, docker-compose v1 won't merge them otherwise
+		Version:  compose.Version,
+		Services: map[string]overrideService{},
+	}
+	for name, service := range compose.Services {
+		env := map[string]string{}
+		for _, kv := range w.Env {
+			pair := strings.SplitN(kv, "=", 2)
+			if len(pair) != 2 {
+				continue
+			}
+			if _, ok := service.Environment[pair[0]]; ok {
+				continue
+			}
+			// docker-compose interpolates the override files too
+			env[pair[0]] = strings.ReplaceAll(pair[1], "$", "$$")
+		}
+		override.Services[name] = overrideService{Environment: env}
+	}
+	data, err := yaml.Marshal(override)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(w.WorkDir, envOverrideFile)
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+func isVarName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if !isVarNameByte(name[i], i == 0) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,78 @@
+package workload
+
+import (
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/workbenchapp/worknet/daoctl/lib/solana/anchor/generated/worknet"
+	"gopkg.in/yaml.v2"
+)
+
+func TestDeploymentArgsEnv(t *testing.T) {
+	env, err := DeploymentArgsEnv([]worknet.DeploymentArg{
+		{ArgName: "GREETING", ArgValue: "hello world", ArgType: worknet.DeploymentArgTypeString},
+		{ArgName: "PORT", ArgValue: "8080", ArgType: worknet.DeploymentArgTypeNumber},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(env, []string{"GREETING=hello world", "PORT=8080"}) {
+		t.Errorf("unexpected env %v", env)
+	}
+
+	for _, args := range [][]worknet.DeploymentArg{
+		{{ArgName: "PORT", ArgValue: "eighty", ArgType: worknet.DeploymentArgTypeNumber}},
+		{{ArgName: "1PORT", ArgValue: "80"}},
+		{{ArgName: "MY-PORT", ArgValue: "80"}},
+		{{ArgName: "DAONETES_REPLICA", ArgValue: "3"}},
+		{{ArgName: "A", ArgValue: "1"}, {ArgName: "A", ArgValue: "2"}},
+	} {
+		if _, err := DeploymentArgsEnv(args); err == nil {
+			t.Errorf("expected %v to be rejected", args)
+		}
+	}
+}
+
+func TestEnvOverride(t *testing.T) {
+	compose, err := ParseComposeFile([]byte(`
+services:
+  web:
+    image: nginx
+    environment:
+      PORT: "80"
+  worker:
+    image: busybox
+`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &Workload{WorkDir: t.TempDir(), Env: []string{"DAONETES_REPLICA=1", "PORT=8080", "PRICE=$5"}}
+	path, err := writeEnvOverride(w, compose)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	override := struct {
+		Services map[string]struct {
+			Environment MappingOrList `yaml:"environment"`
+		} `yaml:"services"`
+	}{}
+	if err := yaml.Unmarshal(data, &override); err != nil {
+		t.Fatal(err)
+	}
+	// the spec's own PORT wins, like DockerRuntime
+	expected := map[string]string{
+		"web":    "DAONETES_REPLICA=1 PRICE=$$5",
+		"worker": "DAONETES_REPLICA=1 PORT=8080 PRICE=$$5",
+	}
+	for name, env := range expected {
+		if got := strings.Join(override.Services[name].Environment.List(), " "); got != env {
+			t.Errorf("%s: expected %q, got %q", name, env, got)
+		}
+	}
+}
@@ -0,0 +1,21 @@
+package workload
+
+import (
+	"runtime"
+
+	"github.com/workbenchapp/worknet/daoctl/lib/workgroup"
+)
+
+// GetDeviceCapacity works out what this device has for running deployments,
+// dir is where their work dirs go (for the free disk space)
+func GetDeviceCapacity(dir string, labels map[string]string) workgroup.DeviceCapacity {
+	return workgroup.DeviceCapacity{
+		CPUs:        runtime.NumCPU(),
+		MemoryBytes: memoryBytes(),
+		DiskBytes:   diskFreeBytes(dir),
+		GPUs:        gpusFound(),
+		OS:          runtime.GOOS,
+		Arch:        runtime.GOARCH,
+		Labels:      labels,
+	}
+}
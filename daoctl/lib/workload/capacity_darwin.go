@@ -0,0 +1,26 @@
+package workload
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+func memoryBytes() uint64 {
+	memory, err := unix.SysctlUint64("hw.memsize")
+	if err != nil {
+		return 0
+	}
+	return memory
+}
+
+func diskFreeBytes(dir string) uint64 {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(dir, &stat); err != nil {
+		return 0
+	}
+	return stat.Bavail * uint64(stat.Bsize)
+}
+
+// docker on a mac can't get at the GPU
+func gpusFound() int {
+	return 0
+}
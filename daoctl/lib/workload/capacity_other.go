@@ -0,0 +1,17 @@
+//go:build !linux && !darwin && !windows
+
+package workload
+
+// TODO: only linux, darwin and windows know what they have, 0 means unknown (so it isn't checked)
+
+func memoryBytes() uint64 {
+	return 0
+}
+
+func diskFreeBytes(dir string) uint64 {
+	return 0
+}
+
+func gpusFound() int {
+	return 0
+}
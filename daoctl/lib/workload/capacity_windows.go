@@ -0,0 +1,15 @@
+package workload
+
+// TODO: we don't support windows yet, 0 means unknown (so it isn't checked)
+
+func memoryBytes() uint64 {
+	return 0
+}
+
+func diskFreeBytes(dir string) uint64 {
+	return 0
+}
+
+func gpusFound() int {
+	return 0
+}
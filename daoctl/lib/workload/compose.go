@@ -0,0 +1,233 @@
+package workload
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/go-logr/logr"
+	"github.com/workbenchapp/worknet/daoctl/lib/solana/anchor/generated/worknet"
+	"github.com/workbenchapp/worknet/daoctl/lib/util"
+	"github.com/workbenchapp/worknet/daoctl/lib/workgroup"
+)
+
+func init() {
+	Register(worknet.WorkTypeDockerCompose, &ComposeRuntime{})
+}
+
+// ComposeRuntime runs docker-compose specs by exec'ing the docker-compose binary
+//
+// Groan, stack deploy is a magic abstraction that
+// doesn't exist first class in the Docker API. See
+// https://stackoverflow.com/questions/42155978/docker-stack-deploy-using-the-client-api
+//
+// So we just send it and exec for now.
+type ComposeRuntime struct {
+	// Credentials are the registry logins for pulling images, docker's own are used if nil
+	Credentials Credentials
+}
+
+func (c *ComposeRuntime) command(ctx context.Context, w *Workload, args ...string) *exec.Cmd {
+	// --compatibility so v1 applies the deploy.resources limits too
+	composeArgs := []string{"--compatibility", "--project-name", w.Name, "--file", w.SpecPath}
+	if w.WorkDir != "" {
+		// Deploy writes it, the secrets override comes after so the secrets win
+		override := filepath.Join(w.WorkDir, envOverrideFile)
+		if _, err := os.Stat(override); err == nil {
+			composeArgs = append(composeArgs, "--file", override)
+		}
+	}
+	if w.SecretsDir != "" {
+		// Deploy writes it, if the spec has secrets
+		override := filepath.Join(w.SecretsDir, secretsOverrideFile)
+		if _, err := os.Stat(override); err == nil {
+			composeArgs = append(composeArgs, "--file", override)
+		}
+	}
+	cmd := exec.CommandContext(ctx, "docker-compose", append(composeArgs, args...)...)
+	// for ${NAME} interpolation, the env override gets w.Env into the containers
+	cmd.Env = append(os.Environ(), w.Env...)
+	return cmd
+}
+
+func (c *ComposeRuntime) Deploy(ctx context.Context, w *Workload) error {
+	log := logr.FromContextOrDiscard(ctx)
+
+	compose, err := LoadComposeFile(w.SpecPath, append(os.Environ(), w.Env...))
+	if err != nil {
+		return err
+	}
+	if _, err := writeEnvOverride(w, compose); err != nil {
+		return fmt.Errorf("couldn't write env for docker-compose: %s", err)
+	}
+	if _, err := writeSecretsOverride(w, compose); err != nil {
+		return fmt.Errorf("couldn't write secrets for docker-compose: %s", err)
+	}
+
+	deployCmd := c.command(ctx, w, "up", "-d")
+	deployCmd.Stdout = util.NewPrefixWriter(os.Stdout, "DOCKEROUT => ")
+	deployCmd.Stderr = util.NewPrefixWriter(os.Stderr, "DOCKERERR => ")
+	log.Info("Deploying Compose spec", "projectName", w.Name, "specPath", w.SpecPath)
+	return deployCmd.Run()
+}
+
+// Pull runs docker-compose pull, with a docker config that has our registry
+// logins if the images need any. docker-compose's progress output is for
+// terminals, so progress is only per image.
+func (c *ComposeRuntime) Pull(ctx context.Context, w *Workload, progress func([]workgroup.PullProgress)) error {
+	log := logr.FromContextOrDiscard(ctx)
+
+	compose, err := LoadComposeFile(w.SpecPath, append(os.Environ(), w.Env...))
+	if err != nil {
+		return err
+	}
+	images, err := serviceImages(compose)
+	if err != nil {
+		return err
+	}
+	report := func(status string, pullErr error) {
+		if progress == nil {
+			return
+		}
+		pulls := []workgroup.PullProgress{}
+		for _, image := range images {
+			pull := workgroup.PullProgress{Image: image, Status: status}
+			if pullErr != nil {
+				pull.Error = pullErr.Error()
+			}
+			pulls = append(pulls, pull)
+		}
+		progress(pulls)
+	}
+
+	pullCmd := c.command(ctx, w, "pull", "--quiet")
+	// not in the work dir, it gets archived
+	configDir, err := ioutil.TempDir("", "daonetes-docker-config")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(configDir)
+	authenticated, err := writeDockerConfig(configDir, c.Credentials, images)
+	if err != nil {
+		return err
+	}
+	if authenticated {
+		// TODO: this hides the user's own docker logins from the pull
+		pullCmd.Env = append(pullCmd.Env, "DOCKER_CONFIG="+configDir)
+	}
+	pullCmd.Stdout = util.NewPrefixWriter(os.Stdout, "DOCKEROUT => ")
+	pullCmd.Stderr = util.NewPrefixWriter(os.Stderr, "DOCKERERR => ")
+	log.Info("Pulling images", "projectName", w.Name, "images", images, "authenticated", authenticated)
+	report(workgroup.PullPulling, nil)
+	if err := pullCmd.Run(); err != nil {
+		err = fmt.Errorf("docker-compose pull failed: %s", err)
+		report(workgroup.PullFailed, err)
+		return err
+	}
+	report(workgroup.PullPulled, nil)
+	return nil
+}
+
+func (c *ComposeRuntime) Status(ctx context.Context, w *Workload) ([]workgroup.DeployState, error) {
+	states := []workgroup.DeployState{}
+	stateBytes, err := c.command(ctx, w, "ps", "--all", "--format", "json").Output()
+	if err != nil {
+		return states, fmt.Errorf("getting compose ps failed: %s", err)
+	}
+	if err := json.Unmarshal(stateBytes, &states); err != nil {
+		return states, fmt.Errorf("couldn't decode compose ps: %s", err)
+	}
+	return states, nil
+}
+
+// Drifted only notices missing or stopped services, docker-compose doesn't tell us
+// if a container's config has changed underneath it
+func (c *ComposeRuntime) Drifted(ctx context.Context, w *Workload) (string, error) {
+	servicesBytes, err := c.command(ctx, w, "config", "--services").Output()
+	if err != nil {
+		return "", fmt.Errorf("getting compose services failed: %s", err)
+	}
+	compose, err := LoadComposeFile(w.SpecPath, append(os.Environ(), w.Env...))
+	if err != nil {
+		return "", err
+	}
+	states, err := c.Status(ctx, w)
+	if err != nil {
+		return "", err
+	}
+	byService := map[string]workgroup.DeployState{}
+	for _, state := range states {
+		// a running one wins, if there's more than one
+		if current, ok := byService[state.Service]; !ok || current.State != "running" {
+			byService[state.Service] = state
+		}
+	}
+	for _, service := range strings.Fields(string(servicesBytes)) {
+		state, ok := byService[service]
+		if !ok {
+			return fmt.Sprintf("service %s has no container", service), nil
+		}
+		if state.State == "running" {
+			continue
+		}
+		// one shot services are allowed to have finished
+		if spec := compose.Services[service]; spec != nil && (spec.Restart == "" || spec.Restart == "no") &&
+			state.State == "exited" && state.ExitCode == 0 {
+			continue
+		}
+		return fmt.Sprintf("service %s is %s", service, state.State), nil
+	}
+	return "", nil
+}
+
+func (c *ComposeRuntime) Restart(ctx context.Context, w *Workload, service string) error {
+	return c.command(ctx, w, "restart", service).Run()
+}
+
+func (c *ComposeRuntime) Stop(ctx context.Context, w *Workload) error {
+	downCmd := c.command(ctx, w, "down", "--remove-orphans")
+	downCmd.Stdout = util.NewPrefixWriter(os.Stdout, "DOCKEROUT => ")
+	downCmd.Stderr = util.NewPrefixWriter(os.Stderr, "DOCKERERR => ")
+	return downCmd.Run()
+}
+
+// Exec never gives the command a tty, docker-compose wants a terminal of its own for that
+func (c *ComposeRuntime) Exec(ctx context.Context, w *Workload, service string, cmd []string, tty bool, in io.Reader, out io.Writer) error {
+	execCmd := c.command(ctx, w, append([]string{"exec", "-T", service}, cmd...)...)
+	execCmd.Stdin = in
+	if tty {
+		execCmd.Stdout = out
+		execCmd.Stderr = out
+	} else {
+		locked := &lockedWriter{w: out}
+		execCmd.Stdout = stdcopy.NewStdWriter(locked, stdcopy.Stdout)
+		execCmd.Stderr = stdcopy.NewStdWriter(locked, stdcopy.Stderr)
+	}
+	return execCmd.Run()
+}
+
+func (c *ComposeRuntime) Logs(ctx context.Context, w *Workload, follow bool) (io.ReadCloser, error) {
+	args := []string{"logs", "--no-color", "--timestamps"}
+	if follow {
+		args = append(args, "--follow")
+	}
+	logsCmd := c.command(ctx, w, args...)
+
+	pipeReader, pipeWriter := io.Pipe()
+	logsCmd.Stdout = pipeWriter
+	logsCmd.Stderr = pipeWriter
+	if err := logsCmd.Start(); err != nil {
+		return nil, err
+	}
+	go func() {
+		pipeWriter.CloseWithError(logsCmd.Wait())
+	}()
+	return pipeReader, nil
+}
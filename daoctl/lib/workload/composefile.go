@@ -0,0 +1,442 @@
+package workload
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// ComposeFile is the subset of the compose spec the docker runtime understands
+// https://github.com/compose-spec/compose-spec/blob/master/spec.md
+type ComposeFile struct {
+	Version  string                     `yaml:"version"`
+	Services map[string]*ComposeService `yaml:"services"`
+	Networks map[string]*ComposeNetwork `yaml:"networks"`
+	Volumes  map[string]*ComposeVolume  `yaml:"volumes"`
+	Secrets  map[string]*ComposeSecret  `yaml:"secrets"`
+	// Daonetes is our extension, compose (3.4+) ignores x- keys
+	Daonetes ComposeExtensions `yaml:"x-daonetes"`
+}
+
+// ComposeExtensions is the spec metadata that compose doesn't have a place for
+type ComposeExtensions struct {
+	// Probes are HTTP or TCP health checks run by the agent, keyed by service, see health.go
+	Probes map[string]*ComposeProbe `yaml:"probes"`
+	// SecretEnv sets env vars from secrets, keyed by service then env var, the
+	// value is the secret's key in the top level secrets, see secrets.go
+	SecretEnv map[string]map[string]string `yaml:"secret_env"`
+}
+
+type ComposeService struct {
+	Image       string              `yaml:"image"`
+	Command     StringOrList        `yaml:"command"`
+	Entrypoint  StringOrList        `yaml:"entrypoint"`
+	Environment MappingOrList       `yaml:"environment"`
+	Labels      MappingOrList       `yaml:"labels"`
+	Ports       []string            `yaml:"ports"`
+	Volumes     []string            `yaml:"volumes"`
+	Networks    ListOrMapKeys       `yaml:"networks"`
+	DependsOn   ListOrMapKeys       `yaml:"depends_on"`
+	Restart     string              `yaml:"restart"`
+	WorkingDir  string              `yaml:"working_dir"`
+	User        string              `yaml:"user"`
+	Hostname    string              `yaml:"hostname"`
+	Privileged  bool                `yaml:"privileged"`
+	Deploy      ComposeDeploy       `yaml:"deploy"`
+	Healthcheck *ComposeHealthcheck `yaml:"healthcheck"`
+	Secrets     []ServiceSecret     `yaml:"secrets"`
+}
+
+// ComposeSecret is a top level secret, external ones are the workgroup's
+// secrets the agent was sent, see secrets.go
+type ComposeSecret struct {
+	File     string `yaml:"file"`
+	External bool   `yaml:"external"`
+	// Name is the workgroup secret's name, when it isn't the key
+	Name string `yaml:"name"`
+}
+
+// ServiceSecret is `secrets: [key]` or `secrets: [{source: key, target: path}]`,
+// mounted at /run/secrets/<target>
+type ServiceSecret struct {
+	Source string `yaml:"source"`
+	Target string `yaml:"target"`
+}
+
+func (s *ServiceSecret) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var source string
+	if err := unmarshal(&source); err == nil {
+		*s = ServiceSecret{Source: source}
+		return nil
+	}
+	type plain ServiceSecret
+	return unmarshal((*plain)(s))
+}
+
+// ComposeHealthcheck is a compose healthcheck, docker runs it, see health.go
+type ComposeHealthcheck struct {
+	Test        HealthcheckTest `yaml:"test"`
+	Interval    string          `yaml:"interval"`
+	Timeout     string          `yaml:"timeout"`
+	Retries     int             `yaml:"retries"`
+	StartPeriod string          `yaml:"start_period"`
+	Disable     bool            `yaml:"disable"`
+}
+
+// HealthcheckTest is ["CMD", ...], ["CMD-SHELL", "..."], ["NONE"], or a string to run in a shell
+type HealthcheckTest []string
+
+func (t *HealthcheckTest) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var str string
+	if err := unmarshal(&str); err == nil {
+		*t = []string{"CMD-SHELL", str}
+		return nil
+	}
+	var list []string
+	if err := unmarshal(&list); err != nil {
+		return err
+	}
+	*t = list
+	return nil
+}
+
+// ComposeProbe is checked by the agent from outside the container, so the
+// service's image doesn't need curl in it. Port is the container port, which
+// has to be published.
+type ComposeProbe struct {
+	// HTTP is the path to GET, anything under 400 is healthy, otherwise it's a TCP connect
+	HTTP     string `yaml:"http"`
+	Port     int    `yaml:"port"`
+	Interval string `yaml:"interval"`
+	Timeout  string `yaml:"timeout"`
+	// Retries is how many failures in a row make it unhealthy
+	Retries int `yaml:"retries"`
+}
+
+// ComposeDeploy is the bit of `deploy:` the agent uses, see resources.go
+type ComposeDeploy struct {
+	Resources struct {
+		Limits       ComposeResources `yaml:"limits"`
+		Reservations ComposeResources `yaml:"reservations"`
+	} `yaml:"resources"`
+	Placement struct {
+		Constraints []string `yaml:"constraints"`
+	} `yaml:"placement"`
+}
+
+type ComposeResources struct {
+	// CPUs is a fraction of cores, e.g. "0.5"
+	CPUs string `yaml:"cpus"`
+	// Memory is a byte value, e.g. "512M"
+	Memory  string          `yaml:"memory"`
+	Devices []ComposeDevice `yaml:"devices"`
+}
+
+// ComposeDevice is a device reservation, which is how compose asks for GPUs
+type ComposeDevice struct {
+	Capabilities []string `yaml:"capabilities"`
+	Driver       string   `yaml:"driver"`
+	// Count is a number, or "all"
+	Count     string   `yaml:"count"`
+	DeviceIDs []string `yaml:"device_ids"`
+}
+
+type ComposeNetwork struct {
+	Driver   string        `yaml:"driver"`
+	External bool          `yaml:"external"`
+	Name     string        `yaml:"name"`
+	Labels   MappingOrList `yaml:"labels"`
+}
+
+type ComposeVolume struct {
+	Driver   string        `yaml:"driver"`
+	External bool          `yaml:"external"`
+	Name     string        `yaml:"name"`
+	Labels   MappingOrList `yaml:"labels"`
+}
+
+// StringOrList is for `command: echo hi` vs `command: ["echo", "hi"]`
+type StringOrList []string
+
+func (s *StringOrList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var str string
+	if err := unmarshal(&str); err == nil {
+		*s = shellSplit(str)
+		return nil
+	}
+	var list []string
+	if err := unmarshal(&list); err != nil {
+		return err
+	}
+	*s = list
+	return nil
+}
+
+// shellSplit splits a command line on spaces, keeping quoted strings together
+// TODO: no escapes, it's good enough for the specs we've seen
+func shellSplit(str string) []string {
+	words := []string{}
+	var word strings.Builder
+	inWord := false
+	var quote rune
+	for _, c := range str {
+		switch {
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote != 0:
+			word.WriteRune(c)
+		case c == '"' || c == '\'':
+			quote = c
+			inWord = true
+		case c == ' ' || c == '\t' || c == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(c)
+			inWord = true
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words
+}
+
+// MappingOrList is for `environment: {A: b}` vs `environment: ["A=b"]`
+type MappingOrList map[string]string
+
+func (m *MappingOrList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	result := make(map[string]string)
+	var list []string
+	if err := unmarshal(&list); err == nil {
+		for _, item := range list {
+			kv := strings.SplitN(item, "=", 2)
+			if len(kv) == 2 {
+				result[kv[0]] = kv[1]
+			} else {
+				// `- NAME` means take it from the agent's environment
+				result[kv[0]] = os.Getenv(kv[0])
+			}
+		}
+		*m = result
+		return nil
+	}
+	var mapping map[string]interface{}
+	if err := unmarshal(&mapping); err != nil {
+		return err
+	}
+	for k, v := range mapping {
+		if v == nil {
+			result[k] = os.Getenv(k)
+		} else {
+			result[k] = fmt.Sprintf("%v", v)
+		}
+	}
+	*m = result
+	return nil
+}
+
+// List returns the mapping as sorted KEY=value pairs, the way docker wants them
+func (m MappingOrList) List() []string {
+	list := make([]string, 0, len(m))
+	for k, v := range m {
+		list = append(list, k+"="+v)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// ListOrMapKeys is for `networks: [a, b]` vs `networks: {a: {aliases: ...}}`, we only keep the names
+type ListOrMapKeys []string
+
+func (l *ListOrMapKeys) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var list []string
+	if err := unmarshal(&list); err == nil {
+		*l = list
+		return nil
+	}
+	var mapping map[string]interface{}
+	if err := unmarshal(&mapping); err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(mapping))
+	for k := range mapping {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	*l = keys
+	return nil
+}
+
+// LoadComposeFile reads and interpolates a compose file using env (KEY=value pairs)
+func LoadComposeFile(path string, env []string) (*ComposeFile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseComposeFile(data, env)
+}
+
+func ParseComposeFile(data []byte, env []string) (*ComposeFile, error) {
+	vars := make(map[string]string)
+	for _, kv := range env {
+		pair := strings.SplitN(kv, "=", 2)
+		if len(pair) == 2 {
+			vars[pair[0]] = pair[1]
+		}
+	}
+	interpolated, err := Interpolate(string(data), vars)
+	if err != nil {
+		return nil, err
+	}
+
+	compose := &ComposeFile{}
+	if err := yaml.Unmarshal([]byte(interpolated), compose); err != nil {
+		return nil, fmt.Errorf("couldn't parse compose file: %s", err)
+	}
+	if len(compose.Services) == 0 {
+		return nil, fmt.Errorf("compose file has no services")
+	}
+	for name, service := range compose.Services {
+		if service == nil || service.Image == "" {
+			// TODO: build: isn't something a device should be doing
+			return nil, fmt.Errorf("service %q has no image", name)
+		}
+		for _, dep := range service.DependsOn {
+			if _, ok := compose.Services[dep]; !ok {
+				return nil, fmt.Errorf("service %q depends on unknown service %q", name, dep)
+			}
+		}
+		for _, secret := range service.Secrets {
+			if _, ok := compose.Secrets[secret.Source]; !ok {
+				return nil, fmt.Errorf("service %q uses unknown secret %q", name, secret.Source)
+			}
+		}
+	}
+	for key, secret := range compose.Secrets {
+		if secret == nil || (!secret.External && secret.File == "") {
+			return nil, fmt.Errorf("secret %q needs to be external (a workgroup secret) or a file", key)
+		}
+	}
+	for name, env := range compose.Daonetes.SecretEnv {
+		if _, ok := compose.Services[name]; !ok {
+			return nil, fmt.Errorf("secret_env for unknown service %q", name)
+		}
+		for envVar, key := range env {
+			if _, ok := compose.Secrets[key]; !ok {
+				return nil, fmt.Errorf("secret_env %s for service %q uses unknown secret %q", envVar, name, key)
+			}
+		}
+	}
+	return compose, nil
+}
+
+// Interpolate does compose style variable substitution: $VAR, ${VAR},
+// ${VAR:-default}, ${VAR-default}, ${VAR:?err}, ${VAR?err}, and $$ for a literal $
+func Interpolate(data string, vars map[string]string) (string, error) {
+	var out strings.Builder
+	for i := 0; i < len(data); i++ {
+		if data[i] != '$' || i+1 == len(data) {
+			out.WriteByte(data[i])
+			continue
+		}
+		next := data[i+1]
+		switch {
+		case next == '$':
+			out.WriteByte('$')
+			i++
+		case next == '{':
+			end := strings.IndexByte(data[i+2:], '}')
+			if end < 0 {
+				return "", fmt.Errorf("unterminated variable at offset %d", i)
+			}
+			value, err := expandBraced(data[i+2:i+2+end], vars)
+			if err != nil {
+				return "", err
+			}
+			out.WriteString(value)
+			i += 2 + end
+		case isVarNameByte(next, true):
+			end := i + 1
+			for end < len(data) && isVarNameByte(data[end], end == i+1) {
+				end++
+			}
+			out.WriteString(vars[data[i+1:end]])
+			i = end - 1
+		default:
+			out.WriteByte(data[i])
+		}
+	}
+	return out.String(), nil
+}
+
+func expandBraced(expr string, vars map[string]string) (string, error) {
+	for _, op := range []string{":-", ":?", "-", "?"} {
+		idx := strings.Index(expr, op)
+		if idx <= 0 {
+			continue
+		}
+		name, arg := expr[:idx], expr[idx+len(op):]
+		value, set := vars[name]
+		empty := !set || (op[0] == ':' && value == "")
+		switch {
+		case !empty:
+			return value, nil
+		case strings.HasSuffix(op, "-"):
+			return arg, nil
+		default:
+			return "", fmt.Errorf("required variable %s is missing: %s", name, arg)
+		}
+	}
+	return vars[expr], nil
+}
+
+func isVarNameByte(c byte, first bool) bool {
+	if c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') {
+		return true
+	}
+	return !first && c >= '0' && c <= '9'
+}
+
+// ServiceOrder returns the service names so that each comes after the services it depends on
+func (c *ComposeFile) ServiceOrder() ([]string, error) {
+	names := make([]string, 0, len(c.Services))
+	for name := range c.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	order := make([]string, 0, len(names))
+	state := make(map[string]int) // 1 = visiting, 2 = done
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch state[name] {
+		case 1:
+			return fmt.Errorf("dependency cycle at service %q", name)
+		case 2:
+			return nil
+		}
+		state[name] = 1
+		for _, dep := range c.Services[name].DependsOn {
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		state[name] = 2
+		order = append(order, name)
+		return nil
+	}
+	for _, name := range names {
+		if err := visit(name); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
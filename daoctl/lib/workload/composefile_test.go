@@ -0,0 +1,79 @@
+package workload
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestInterpolate(t *testing.T) {
+	vars := map[string]string{"NAME": "web", "EMPTY": ""}
+	for in, expected := range map[string]string{
+		"image: $NAME":             "image: web",
+		"image: ${NAME}:1":         "image: web:1",
+		"port: ${PORT:-8080}":      "port: 8080",
+		"port: ${EMPTY:-8080}":     "port: 8080",
+		"port: ${EMPTY-8080}":      "port: ",
+		"cost: $$5":                "cost: $5",
+		"unset: ${MISSING}":        "unset: ",
+		"trailing $":               "trailing $",
+		"name: ${NAME:?need name}": "name: web",
+	} {
+		out, err := Interpolate(in, vars)
+		if err != nil {
+			t.Fatalf("%q: %s", in, err)
+		}
+		if out != expected {
+			t.Errorf("%q: expected %q, got %q", in, expected, out)
+		}
+	}
+
+	if _, err := Interpolate("${MISSING:?need it}", vars); err == nil {
+		t.Error("expected an error for a required variable")
+	}
+}
+
+func TestParseComposeFile(t *testing.T) {
+	compose, err := ParseComposeFile([]byte(`
+services:
+  web:
+    image: nginx:${TAG:-latest}
+    command: nginx -g "daemon off;"
+    environment:
+      - GREETING=hi
+    depends_on:
+      - db
+    networks:
+      front: {}
+  db:
+    image: postgres
+    environment:
+      POSTGRES_PASSWORD: ${PASSWORD}
+`), []string{"PASSWORD=secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if compose.Services["web"].Image != "nginx:latest" {
+		t.Errorf("unexpected image %q", compose.Services["web"].Image)
+	}
+	if !reflect.DeepEqual([]string(compose.Services["web"].Command), []string{"nginx", "-g", "daemon off;"}) {
+		t.Errorf("unexpected command %v", compose.Services["web"].Command)
+	}
+	if compose.Services["db"].Environment["POSTGRES_PASSWORD"] != "secret" {
+		t.Errorf("password not interpolated: %v", compose.Services["db"].Environment)
+	}
+	if !reflect.DeepEqual([]string(compose.Services["web"].Networks), []string{"front"}) {
+		t.Errorf("unexpected networks %v", compose.Services["web"].Networks)
+	}
+
+	order, err := compose.ServiceOrder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(order, []string{"db", "web"}) {
+		t.Errorf("expected db before web, got %v", order)
+	}
+
+	if _, err := ParseComposeFile([]byte("services:\n  a:\n    image: x\n    depends_on: [b]\n"), nil); err == nil {
+		t.Error("expected an error for an unknown dependency")
+	}
+}
@@ -0,0 +1,974 @@
+package workload
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	dockertypes "github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/network"
+	volumetypes "github.com/docker/docker/api/types/volume"
+	dockercli "github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/docker/go-connections/nat"
+	"github.com/go-logr/logr"
+	"github.com/workbenchapp/worknet/daoctl/lib/options"
+	"github.com/workbenchapp/worknet/daoctl/lib/workgroup"
+)
+
+const (
+	// our own labels, tying containers back to the on chain deployment
+	LabelDeployment = "org.daonetes.deployment"
+	LabelReplica    = "org.daonetes.replica"
+	LabelWorkload   = "org.daonetes.workload"
+	LabelConfigHash = "org.daonetes.config-hash"
+
+	// the docker-compose labels, so `docker compose ls/ps/logs` still work on our projects,
+	// and so we pick up projects that were started by ComposeRuntime
+	labelComposeProject   = "com.docker.compose.project"
+	labelComposeService   = "com.docker.compose.service"
+	labelComposeNumber    = "com.docker.compose.container-number"
+	labelComposeOneoff    = "com.docker.compose.oneoff"
+	labelComposeNetwork   = "com.docker.compose.network"
+	labelComposeVolume    = "com.docker.compose.volume"
+	labelComposeConfigDir = "com.docker.compose.project.working_dir"
+
+	defaultNetworkName = "default"
+
+	// ownEventsGrace is how long after we've changed a workload its events are
+	// still taken to be ours, docker sends them asynchronously
+	ownEventsGrace = 5 * time.Second
+)
+
+// DockerRuntime runs docker-compose specs by talking to the Docker Engine API
+// directly, so devices don't need the docker-compose binary installed.
+//
+// It only understands the parts of the compose spec in ComposeFile, anything
+// else in the spec is ignored.
+type DockerRuntime struct {
+	client *dockercli.Client
+
+	// changing is the workloads we're deploying, stopping or restarting, and
+	// until when, so Events doesn't report what we did ourselves
+	changingMu sync.Mutex
+	changing   map[string]time.Time
+
+	// Credentials are the registry logins for pulling images, docker's own are used if nil
+	Credentials Credentials
+}
+
+func NewDockerRuntime() (*DockerRuntime, error) {
+	docker, err := dockercli.NewClientWithOpts(dockercli.FromEnv, dockercli.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil, fmt.Errorf("unable to create docker client: %s", err)
+	}
+	return &DockerRuntime{client: docker, changing: map[string]time.Time{}}, nil
+}
+
+// change marks the workload as being changed by us, until a little after the returned func is called
+func (d *DockerRuntime) change(name string) func() {
+	d.changingMu.Lock()
+	d.changing[name] = time.Time{}
+	d.changingMu.Unlock()
+	return func() {
+		d.changingMu.Lock()
+		d.changing[name] = time.Now().Add(ownEventsGrace)
+		d.changingMu.Unlock()
+	}
+}
+
+// ours says if an event for the workload is most likely from something we did
+func (d *DockerRuntime) ours(name string) bool {
+	d.changingMu.Lock()
+	defer d.changingMu.Unlock()
+	until, ok := d.changing[name]
+	if !ok {
+		return false
+	}
+	if until.IsZero() || time.Now().Before(until) {
+		return true
+	}
+	delete(d.changing, name)
+	return false
+}
+
+func (d *DockerRuntime) projectFilter(w *Workload, extra ...filters.KeyValuePair) filters.Args {
+	return filters.NewArgs(append(extra, filters.Arg("label", labelComposeProject+"="+w.Name))...)
+}
+
+func (d *DockerRuntime) labels(w *Workload) map[string]string {
+	return map[string]string{
+		LabelDeployment:     w.DeploymentPDA,
+		LabelReplica:        strconv.Itoa(w.Replica),
+		LabelWorkload:       w.Name,
+		labelComposeProject: w.Name,
+	}
+}
+
+func (d *DockerRuntime) load(w *Workload) (*ComposeFile, error) {
+	return LoadComposeFile(w.SpecPath, append(os.Environ(), w.Env...))
+}
+
+func (d *DockerRuntime) Deploy(ctx context.Context, w *Workload) error {
+	log := logr.FromContextOrDiscard(ctx)
+	log.Info("Deploying Compose spec", "projectName", w.Name, "specPath", w.SpecPath)
+	defer d.change(w.Name)()
+
+	compose, err := d.load(w)
+	if err != nil {
+		return err
+	}
+	order, err := compose.ServiceOrder()
+	if err != nil {
+		return err
+	}
+
+	networks, err := d.ensureNetworks(ctx, w, compose)
+	if err != nil {
+		return err
+	}
+	volumes, err := d.ensureVolumes(ctx, w, compose)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range order {
+		if err := d.ensureService(ctx, w, compose, name, networks, volumes); err != nil {
+			return fmt.Errorf("service %s: %s", name, err)
+		}
+	}
+
+	// remove containers for services that were taken out of the spec
+	containers, err := d.client.ContainerList(ctx, dockertypes.ContainerListOptions{
+		All:     true,
+		Filters: d.projectFilter(w),
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't list containers: %s", err)
+	}
+	for _, c := range containers {
+		if _, ok := compose.Services[c.Labels[labelComposeService]]; ok {
+			continue
+		}
+		log.Info("Removing orphan container", "projectName", w.Name, "container", c.ID[:12], "service", c.Labels[labelComposeService])
+		if err := d.client.ContainerRemove(ctx, c.ID, dockertypes.ContainerRemoveOptions{Force: true}); err != nil {
+			return fmt.Errorf("couldn't remove orphan container %s: %s", c.ID[:12], err)
+		}
+	}
+	return nil
+}
+
+// ensureNetworks creates the project's networks, returning compose network name => docker network name
+func (d *DockerRuntime) ensureNetworks(ctx context.Context, w *Workload, compose *ComposeFile) (map[string]string, error) {
+	log := logr.FromContextOrDiscard(ctx)
+
+	wanted := map[string]*ComposeNetwork{}
+	for _, service := range compose.Services {
+		if len(service.Networks) == 0 {
+			wanted[defaultNetworkName] = compose.Networks[defaultNetworkName]
+		}
+		for _, net := range service.Networks {
+			wanted[net] = compose.Networks[net]
+		}
+	}
+
+	networks := map[string]string{}
+	for key, cfg := range wanted {
+		if cfg == nil {
+			if key != defaultNetworkName {
+				return nil, fmt.Errorf("service uses undefined network %q", key)
+			}
+			cfg = &ComposeNetwork{}
+		}
+		name := w.Name + "_" + key
+		if cfg.Name != "" {
+			name = cfg.Name
+		}
+		networks[key] = name
+		if cfg.External {
+			continue
+		}
+
+		existing, err := d.client.NetworkList(ctx, dockertypes.NetworkListOptions{
+			Filters: filters.NewArgs(filters.Arg("name", name)),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("couldn't list networks: %s", err)
+		}
+		found := false
+		for _, n := range existing {
+			// the name filter is a substring match
+			if n.Name == name {
+				found = true
+			}
+		}
+		if found {
+			continue
+		}
+
+		labels := d.labels(w)
+		labels[labelComposeNetwork] = key
+		for k, v := range cfg.Labels {
+			labels[k] = v
+		}
+		log.Info("Creating network", "projectName", w.Name, "network", name)
+		if _, err := d.client.NetworkCreate(ctx, name, dockertypes.NetworkCreate{
+			CheckDuplicate: true,
+			Driver:         cfg.Driver,
+			Labels:         labels,
+		}); err != nil {
+			return nil, fmt.Errorf("couldn't create network %s: %s", name, err)
+		}
+	}
+	return networks, nil
+}
+
+// volumeNames maps compose volume names to docker volume names
+func volumeNames(w *Workload, compose *ComposeFile) map[string]string {
+	volumes := map[string]string{}
+	for key, cfg := range compose.Volumes {
+		volumes[key] = w.Name + "_" + key
+		if cfg != nil && cfg.Name != "" {
+			volumes[key] = cfg.Name
+		}
+	}
+	return volumes
+}
+
+// ensureVolumes creates the project's named volumes, returning compose volume name => docker volume name
+func (d *DockerRuntime) ensureVolumes(ctx context.Context, w *Workload, compose *ComposeFile) (map[string]string, error) {
+	volumes := volumeNames(w, compose)
+	for key, cfg := range compose.Volumes {
+		if cfg == nil {
+			cfg = &ComposeVolume{}
+		}
+		name := volumes[key]
+		if cfg.External {
+			continue
+		}
+
+		labels := d.labels(w)
+		labels[labelComposeVolume] = key
+		for k, v := range cfg.Labels {
+			labels[k] = v
+		}
+		// VolumeCreate is a noop for an existing volume with the same name
+		if _, err := d.client.VolumeCreate(ctx, volumetypes.VolumeCreateBody{
+			Name:   name,
+			Driver: cfg.Driver,
+			Labels: labels,
+		}); err != nil {
+			return nil, fmt.Errorf("couldn't create volume %s: %s", name, err)
+		}
+	}
+	return volumes, nil
+}
+
+func (d *DockerRuntime) ensureService(
+	ctx context.Context,
+	w *Workload,
+	compose *ComposeFile,
+	name string,
+	networks map[string]string,
+	volumes map[string]string,
+) error {
+	log := logr.FromContextOrDiscard(ctx)
+
+	service := compose.Services[name]
+	config, hostConfig, serviceNetworks, err := d.serviceConfig(w, compose, name, volumes)
+	if err != nil {
+		return err
+	}
+	hash := config.Labels[LabelConfigHash]
+
+	containers, err := d.client.ContainerList(ctx, dockertypes.ContainerListOptions{
+		All:     true,
+		Filters: d.projectFilter(w, filters.Arg("label", labelComposeService+"="+name)),
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't list containers: %s", err)
+	}
+	for _, c := range containers {
+		if c.Labels[LabelConfigHash] == hash && !d.imageChanged(ctx, c, service.Image) {
+			if c.State == "running" {
+				return nil
+			}
+			log.Info("Starting container", "projectName", w.Name, "service", name)
+			return d.client.ContainerStart(ctx, c.ID, dockertypes.ContainerStartOptions{})
+		}
+		log.Info("Container config changed, recreating", "projectName", w.Name, "service", name, "container", c.ID[:12])
+		if err := d.client.ContainerRemove(ctx, c.ID, dockertypes.ContainerRemoveOptions{Force: true}); err != nil {
+			return fmt.Errorf("couldn't remove container %s: %s", c.ID[:12], err)
+		}
+	}
+
+	// Pull usually got it already
+	if err := d.pullImage(ctx, service.Image, nil); err != nil {
+		return err
+	}
+
+	networkingConfig := &network.NetworkingConfig{
+		EndpointsConfig: map[string]*network.EndpointSettings{
+			networks[serviceNetworks[0]]: {Aliases: []string{name}},
+		},
+	}
+	containerName := fmt.Sprintf("%s-%s-1", w.Name, name)
+	log.Info("Creating container", "projectName", w.Name, "service", name, "image", service.Image)
+	created, err := d.client.ContainerCreate(ctx, config, hostConfig, networkingConfig, nil, containerName)
+	if err != nil {
+		return fmt.Errorf("couldn't create container: %s", err)
+	}
+	for _, net := range serviceNetworks[1:] {
+		if err := d.client.NetworkConnect(ctx, networks[net], created.ID, &network.EndpointSettings{Aliases: []string{name}}); err != nil {
+			return fmt.Errorf("couldn't connect to network %s: %s", net, err)
+		}
+	}
+	return d.client.ContainerStart(ctx, created.ID, dockertypes.ContainerStartOptions{})
+}
+
+// serviceConfig is the service's container config, labeled with its hash, and the compose networks it's on
+func (d *DockerRuntime) serviceConfig(
+	w *Workload,
+	compose *ComposeFile,
+	name string,
+	volumes map[string]string,
+) (*container.Config, *container.HostConfig, []string, error) {
+	service := compose.Services[name]
+	config, hostConfig, err := d.containerConfig(w, compose, name, volumes)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	serviceNetworks := []string(service.Networks)
+	if len(serviceNetworks) == 0 {
+		serviceNetworks = []string{defaultNetworkName}
+	}
+
+	// anything that changes the container means a new one, the same as compose does
+	hash, err := configHash(config, hostConfig, serviceNetworks)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	config.Labels[LabelConfigHash] = hash
+	return config, hostConfig, serviceNetworks, nil
+}
+
+// imageChanged is true when the local image for the service's tag isn't the one the container runs, eg it was pulled since
+func (d *DockerRuntime) imageChanged(ctx context.Context, c dockertypes.Container, image string) bool {
+	inspect, _, err := d.client.ImageInspectWithRaw(ctx, image)
+	if err != nil {
+		// gone, or docker is having a moment, either way don't recreate over it
+		return false
+	}
+	return inspect.ID != c.ImageID
+}
+
+func (d *DockerRuntime) containerConfig(
+	w *Workload,
+	compose *ComposeFile,
+	name string,
+	volumes map[string]string,
+) (*container.Config, *container.HostConfig, error) {
+	service := compose.Services[name]
+	exposed, bindings, err := nat.ParsePortSpecs(service.Ports)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid ports: %s", err)
+	}
+
+	labels := d.labels(w)
+	labels[labelComposeService] = name
+	labels[labelComposeNumber] = "1"
+	labels[labelComposeOneoff] = "False"
+	labels[labelComposeConfigDir] = filepath.Dir(w.SpecPath)
+	for k, v := range service.Labels {
+		labels[k] = v
+	}
+
+	binds := []string{}
+	for _, v := range service.Volumes {
+		bind, err := volumeBind(v, filepath.Dir(w.SpecPath), volumes)
+		if err != nil {
+			return nil, nil, err
+		}
+		binds = append(binds, bind)
+	}
+	secrets, err := secretBinds(w, compose, service)
+	if err != nil {
+		return nil, nil, err
+	}
+	binds = append(binds, secrets...)
+	env, err := secretEnv(w, compose, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	// the secrets win over anything the spec sets
+	for k, v := range service.Environment {
+		if _, ok := env[k]; !ok {
+			env[k] = v
+		}
+	}
+	if versions := secretVersionsLabel(w, compose, name, service); versions != "" {
+		labels[LabelSecrets] = versions
+	}
+
+	config := &container.Config{
+		Image:        service.Image,
+		Cmd:          []string(service.Command),
+		Entrypoint:   []string(service.Entrypoint),
+		Env:          containerEnv(w.Env, env),
+		Labels:       labels,
+		ExposedPorts: exposed,
+		WorkingDir:   service.WorkingDir,
+		User:         service.User,
+		Hostname:     service.Hostname,
+	}
+	hostConfig := &container.HostConfig{
+		Binds:        binds,
+		PortBindings: bindings,
+		Privileged:   service.Privileged,
+		RestartPolicy: container.RestartPolicy{
+			Name: service.Restart,
+		},
+	}
+	if service.Restart == "no" {
+		hostConfig.RestartPolicy.Name = ""
+	}
+	if hostConfig.Resources, err = serviceResources(service); err != nil {
+		return nil, nil, err
+	}
+	if config.Healthcheck, err = healthConfig(service.Healthcheck); err != nil {
+		return nil, nil, err
+	}
+	return config, hostConfig, nil
+}
+
+// containerEnv gives every container the workload's env (deployment args etc),
+// with anything the service sets itself taking precedence
+func containerEnv(workloadEnv []string, serviceEnv MappingOrList) []string {
+	env := MappingOrList{}
+	for _, kv := range workloadEnv {
+		pair := strings.SplitN(kv, "=", 2)
+		if len(pair) == 2 {
+			env[pair[0]] = pair[1]
+		}
+	}
+	for k, v := range serviceEnv {
+		env[k] = v
+	}
+	return env.List()
+}
+
+// volumeBind turns a compose `src:dst[:mode]` into a docker bind
+func volumeBind(spec string, specDir string, volumes map[string]string) (string, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) == 1 {
+		// anonymous volume, let docker make one
+		return parts[0], nil
+	}
+	src := parts[0]
+	switch {
+	case strings.HasPrefix(src, "."):
+		parts[0] = filepath.Join(specDir, src)
+	case strings.HasPrefix(src, "~"):
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		parts[0] = filepath.Join(home, src[1:])
+	case filepath.IsAbs(src):
+	default:
+		name, ok := volumes[src]
+		if !ok {
+			return "", fmt.Errorf("volume %q is not defined in the spec", src)
+		}
+		parts[0] = name
+	}
+	return strings.Join(parts, ":"), nil
+}
+
+func configHash(config *container.Config, hostConfig *container.HostConfig, networks []string) (string, error) {
+	data, err := json.Marshal([]interface{}{config, hostConfig, networks})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// pullProgressInterval is how often pullImage reports progress
+const pullProgressInterval = time.Second
+
+// Pull fetches the images the workload's services need that aren't here yet
+func (d *DockerRuntime) Pull(ctx context.Context, w *Workload, progress func([]workgroup.PullProgress)) error {
+	compose, err := d.load(w)
+	if err != nil {
+		return err
+	}
+	images, err := serviceImages(compose)
+	if err != nil {
+		return err
+	}
+	pulls := make([]workgroup.PullProgress, len(images))
+	for i, image := range images {
+		pulls[i] = workgroup.PullProgress{Image: image, Status: workgroup.PullPulling}
+	}
+	report := func() {
+		if progress != nil {
+			progress(append([]workgroup.PullProgress{}, pulls...))
+		}
+	}
+	for i, image := range images {
+		err := d.pullImage(ctx, image, func(current, total int64) {
+			pulls[i].Current, pulls[i].Total = current, total
+			report()
+		})
+		if err != nil {
+			pulls[i].Status, pulls[i].Error = workgroup.PullFailed, err.Error()
+			report()
+			return err
+		}
+		pulls[i].Status = workgroup.PullPulled
+		report()
+	}
+	return nil
+}
+
+// pullImage pulls image if it isn't here, calling onProgress (if set) with the
+// bytes done so far every pullProgressInterval
+func (d *DockerRuntime) pullImage(ctx context.Context, image string, onProgress func(current, total int64)) error {
+	log := logr.FromContextOrDiscard(ctx)
+
+	if _, _, err := d.client.ImageInspectWithRaw(ctx, image); err == nil {
+		// TODO: images with a moving tag like :latest never get updated
+		return nil
+	}
+	credential, err := credentialFor(d.Credentials, image)
+	if err != nil {
+		return err
+	}
+	auth, err := registryAuth(credential)
+	if err != nil {
+		return err
+	}
+	log.Info("Pulling image", "image", image, "authenticated", credential != nil)
+	progress, err := d.client.ImagePull(ctx, image, dockertypes.ImagePullOptions{RegistryAuth: auth})
+	if err != nil {
+		return fmt.Errorf("couldn't pull image %s: %s", image, err)
+	}
+	defer progress.Close()
+
+	// the pull is only done when the progress stream is, and errors turn up in it
+	type layerProgress struct {
+		current, total int64
+	}
+	layers := map[string]layerProgress{}
+	lastReport := time.Time{}
+	decoder := json.NewDecoder(progress)
+	for {
+		var message struct {
+			ID             string `json:"id"`
+			Status         string `json:"status"`
+			Error          string `json:"error"`
+			ProgressDetail struct {
+				Current int64 `json:"current"`
+				Total   int64 `json:"total"`
+			} `json:"progressDetail"`
+		}
+		if err := decoder.Decode(&message); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("couldn't pull image %s: %s", image, err)
+		}
+		if message.Error != "" {
+			return fmt.Errorf("couldn't pull image %s: %s", image, message.Error)
+		}
+		// only the downloads, extracting counts the same bytes again
+		if message.ID == "" || message.Status != "Downloading" || message.ProgressDetail.Total == 0 {
+			continue
+		}
+		layers[message.ID] = layerProgress{message.ProgressDetail.Current, message.ProgressDetail.Total}
+		if onProgress == nil || time.Since(lastReport) < pullProgressInterval {
+			continue
+		}
+		lastReport = time.Now()
+		var current, total int64
+		for _, layer := range layers {
+			current += layer.current
+			total += layer.total
+		}
+		onProgress(current, total)
+	}
+}
+
+// Drifted compares the spec with the project's containers, and says why they don't match
+func (d *DockerRuntime) Drifted(ctx context.Context, w *Workload) (string, error) {
+	compose, err := d.load(w)
+	if err != nil {
+		return "", err
+	}
+	containers, err := d.client.ContainerList(ctx, dockertypes.ContainerListOptions{
+		All:     true,
+		Filters: d.projectFilter(w),
+	})
+	if err != nil {
+		return "", fmt.Errorf("couldn't list containers: %s", err)
+	}
+	byService := map[string]dockertypes.Container{}
+	for _, c := range containers {
+		service := c.Labels[labelComposeService]
+		if _, ok := compose.Services[service]; !ok {
+			return fmt.Sprintf("container %s isn't in the spec", c.ID[:12]), nil
+		}
+		byService[service] = c
+	}
+
+	volumes := volumeNames(w, compose)
+	order, err := compose.ServiceOrder()
+	if err != nil {
+		return "", err
+	}
+	for _, name := range order {
+		service := compose.Services[name]
+		c, ok := byService[name]
+		if !ok {
+			return fmt.Sprintf("service %s has no container", name), nil
+		}
+		config, _, _, err := d.serviceConfig(w, compose, name, volumes)
+		if err != nil {
+			return "", err
+		}
+		if c.Labels[LabelConfigHash] != config.Labels[LabelConfigHash] {
+			return fmt.Sprintf("service %s container config changed", name), nil
+		}
+		if d.imageChanged(ctx, c, service.Image) {
+			return fmt.Sprintf("service %s image changed", name), nil
+		}
+		// one shot services are allowed to have finished
+		if c.State != "running" && service.Restart != "" && service.Restart != "no" {
+			return fmt.Sprintf("service %s is %s", name, c.State), nil
+		}
+	}
+	return "", nil
+}
+
+func (d *DockerRuntime) Status(ctx context.Context, w *Workload) ([]workgroup.DeployState, error) {
+	states := []workgroup.DeployState{}
+	containers, err := d.client.ContainerList(ctx, dockertypes.ContainerListOptions{
+		All:     true,
+		Filters: d.projectFilter(w),
+	})
+	if err != nil {
+		return states, fmt.Errorf("couldn't list containers: %s", err)
+	}
+	for _, c := range containers {
+		state := workgroup.DeployState{
+			Service:    c.Labels[labelComposeService],
+			State:      c.State,
+			Publishers: []options.Publisher{},
+		}
+		if len(c.Names) > 0 {
+			// remove leading slash
+			state.Name = c.Names[0][1:]
+		}
+		if inspect, err := d.client.ContainerInspect(ctx, c.ID); err == nil {
+			state.RestartCount = inspect.RestartCount
+			if inspect.State != nil {
+				state.ExitCode = inspect.State.ExitCode
+				if inspect.State.Health != nil {
+					state.Health = inspect.State.Health.Status
+				}
+				if startedAt, err := time.Parse(time.RFC3339Nano, inspect.State.StartedAt); err == nil && !startedAt.IsZero() {
+					state.StartedAt = &startedAt
+				}
+			}
+		}
+		for _, port := range c.Ports {
+			if port.PublicPort == 0 {
+				continue
+			}
+			state.Publishers = append(state.Publishers, options.Publisher{
+				URL:           port.IP,
+				TargetPort:    int(port.PrivatePort),
+				PublishedPort: int(port.PublicPort),
+				Protocol:      port.Type,
+			})
+		}
+		states = append(states, state)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Name < states[j].Name })
+	return states, nil
+}
+
+func (d *DockerRuntime) Restart(ctx context.Context, w *Workload, service string) error {
+	defer d.change(w.Name)()
+	filter := d.projectFilter(w)
+	filter.Add("label", labelComposeService+"="+service)
+	containers, err := d.client.ContainerList(ctx, dockertypes.ContainerListOptions{
+		All:     true,
+		Filters: filter,
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't list containers: %s", err)
+	}
+	timeout := 10 * time.Second
+	for _, c := range containers {
+		if err := d.client.ContainerRestart(ctx, c.ID, &timeout); err != nil {
+			return fmt.Errorf("couldn't restart container %s: %s", c.ID[:12], err)
+		}
+	}
+	return nil
+}
+
+func (d *DockerRuntime) Stop(ctx context.Context, w *Workload) error {
+	log := logr.FromContextOrDiscard(ctx)
+	defer d.change(w.Name)()
+
+	containers, err := d.client.ContainerList(ctx, dockertypes.ContainerListOptions{
+		All:     true,
+		Filters: d.projectFilter(w),
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't list containers: %s", err)
+	}
+	timeout := 10 * time.Second
+	for _, c := range containers {
+		log.Info("Stopping container", "projectName", w.Name, "container", c.ID[:12], "service", c.Labels[labelComposeService])
+		if err := d.client.ContainerStop(ctx, c.ID, &timeout); err != nil {
+			log.Error(err, "Stopping container failed, removing anyway", "container", c.ID[:12])
+		}
+		if err := d.client.ContainerRemove(ctx, c.ID, dockertypes.ContainerRemoveOptions{Force: true}); err != nil {
+			return fmt.Errorf("couldn't remove container %s: %s", c.ID[:12], err)
+		}
+	}
+
+	// same as `down`, the volumes stay around in case the data matters
+	networks, err := d.client.NetworkList(ctx, dockertypes.NetworkListOptions{Filters: d.projectFilter(w)})
+	if err != nil {
+		return fmt.Errorf("couldn't list networks: %s", err)
+	}
+	for _, n := range networks {
+		if err := d.client.NetworkRemove(ctx, n.ID); err != nil {
+			return fmt.Errorf("couldn't remove network %s: %s", n.Name, err)
+		}
+	}
+	return nil
+}
+
+// Logs merges the output of all the project's containers, with each line
+// prefixed by the container name like `docker-compose logs` does
+func (d *DockerRuntime) Logs(ctx context.Context, w *Workload, follow bool) (io.ReadCloser, error) {
+	containers, err := d.client.ContainerList(ctx, dockertypes.ContainerListOptions{
+		All:     true,
+		Filters: d.projectFilter(w),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("couldn't list containers: %s", err)
+	}
+
+	// cancelled to stop the containers' streams, if we fail part way or the reader is closed
+	ctx, cancel := context.WithCancel(ctx)
+	pipeReader, pipeWriter := io.Pipe()
+	out := &lockedWriter{w: pipeWriter}
+	wg := sync.WaitGroup{}
+	errs := make(chan error, len(containers))
+	fail := func(err error) (io.ReadCloser, error) {
+		cancel()
+		pipeWriter.CloseWithError(err)
+		wg.Wait()
+		return nil, err
+	}
+	for _, c := range containers {
+		name := c.ID[:12]
+		if len(c.Names) > 0 {
+			name = c.Names[0][1:]
+		}
+		inspect, err := d.client.ContainerInspect(ctx, c.ID)
+		if err != nil {
+			return fail(fmt.Errorf("couldn't inspect container %s: %s", name, err))
+		}
+		logs, err := d.client.ContainerLogs(ctx, c.ID, dockertypes.ContainerLogsOptions{
+			ShowStdout: true,
+			ShowStderr: true,
+			Timestamps: true,
+			Follow:     follow,
+		})
+		if err != nil {
+			return fail(fmt.Errorf("couldn't get logs for container %s: %s", name, err))
+		}
+
+		wg.Add(1)
+		go func(name string, tty bool, logs io.ReadCloser) {
+			defer wg.Done()
+			defer logs.Close()
+
+			lineReader, lineWriter := io.Pipe()
+			go func() {
+				if tty {
+					_, err := io.Copy(lineWriter, logs)
+					lineWriter.CloseWithError(err)
+					return
+				}
+				// without a tty stdout and stderr come multiplexed in one stream
+				_, err := stdcopy.StdCopy(lineWriter, lineWriter, logs)
+				lineWriter.CloseWithError(err)
+			}()
+
+			scanner := bufio.NewScanner(lineReader)
+			for scanner.Scan() {
+				if _, err := fmt.Fprintf(out, "%s  | %s\n", name, scanner.Text()); err != nil {
+					lineReader.CloseWithError(err)
+					return
+				}
+			}
+			if err := scanner.Err(); err != nil && !errors.Is(err, context.Canceled) {
+				errs <- err
+			}
+		}(name, inspect.Config.Tty, logs)
+	}
+	go func() {
+		wg.Wait()
+		cancel()
+		close(errs)
+		pipeWriter.CloseWithError(<-errs)
+	}()
+	return &cancelOnClose{ReadCloser: pipeReader, cancel: cancel}, nil
+}
+
+// cancelOnClose cancels the context that's feeding it when it's closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	c.cancel()
+	return c.ReadCloser.Close()
+}
+
+func (d *DockerRuntime) Exec(ctx context.Context, w *Workload, service string, cmd []string, tty bool, in io.Reader, out io.Writer) error {
+	containers, err := d.client.ContainerList(ctx, dockertypes.ContainerListOptions{
+		Filters: d.projectFilter(w, filters.Arg("label", labelComposeService+"="+service)),
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't list containers: %s", err)
+	}
+	if len(containers) == 0 {
+		return fmt.Errorf("service %s has no running container", service)
+	}
+
+	exec, err := d.client.ContainerExecCreate(ctx, containers[0].ID, dockertypes.ExecConfig{
+		Cmd:          cmd,
+		Tty:          tty,
+		AttachStdin:  in != nil,
+		AttachStdout: true,
+		AttachStderr: true,
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't create exec: %s", err)
+	}
+	attached, err := d.client.ContainerExecAttach(ctx, exec.ID, dockertypes.ExecStartCheck{Tty: tty})
+	if err != nil {
+		return fmt.Errorf("couldn't attach to exec: %s", err)
+	}
+	defer attached.Close()
+
+	if in != nil {
+		go func() {
+			io.Copy(attached.Conn, in)
+			attached.CloseWrite()
+		}()
+	}
+	// without a tty this is already stdcopy multiplexed, which is what we hand on
+	_, err = io.Copy(out, attached.Reader)
+	return err
+}
+
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (l *lockedWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(p)
+}
+
+// Events tells us when one of our containers goes away outside of a
+// Deploy/Stop/Restart, eg it crashed or someone `docker rm`'d it. Starts aren't
+// reported, they're almost always our own deploys.
+func (d *DockerRuntime) Events(ctx context.Context) <-chan Event {
+	log := logr.FromContextOrDiscard(ctx)
+	changes := make(chan Event, 16)
+
+	go func() {
+		defer close(changes)
+		for {
+			messages, errs := d.client.Events(ctx, dockertypes.EventsOptions{
+				Filters: filters.NewArgs(
+					filters.Arg("type", events.ContainerEventType),
+					filters.Arg("label", LabelWorkload),
+					filters.Arg("event", "die"),
+					filters.Arg("event", "oom"),
+					filters.Arg("event", "destroy"),
+				),
+			})
+		loop:
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case msg := <-messages:
+					if d.ours(msg.Actor.Attributes[LabelWorkload]) {
+						continue
+					}
+					event := Event{
+						Name:    msg.Actor.Attributes[LabelWorkload],
+						Service: msg.Actor.Attributes[labelComposeService],
+						Action:  msg.Action,
+					}
+					select {
+					case changes <- event:
+					default:
+						// the receiver only needs to know something happened
+					}
+				case err := <-errs:
+					log.Error(err, "Docker event stream failed, reconnecting")
+					break loop
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(10 * time.Second):
+			}
+		}
+	}()
+	return changes
+}
+
+// DockerAvailable checks that the docker daemon answers, so the agent can fall back to docker-compose
+func (d *DockerRuntime) DockerAvailable(ctx context.Context) error {
+	pingCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	_, err := d.client.Ping(pingCtx)
+	return err
+}
+
+var _ EventSource = &DockerRuntime{}
+var _ DriftDetector = &DockerRuntime{}
+var _ Execer = &DockerRuntime{}
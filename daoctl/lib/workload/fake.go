@@ -0,0 +1,111 @@
+package workload
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/workbenchapp/worknet/daoctl/lib/workgroup"
+)
+
+// FakeRuntime keeps workloads in memory instead of running them, so the
+// reconciliation logic can be tested without docker
+type FakeRuntime struct {
+	mu sync.Mutex
+
+	// Running is keyed by Workload.Name
+	Running map[string]*Workload
+	// Deployed and Stopped record the Name of each call, in order
+	Deployed []string
+	Stopped  []string
+	// Restarted records "name/service" of each Restart call
+	Restarted []string
+	// Pulled records the Name of each Pull call
+	Pulled []string
+
+	// States is keyed by Workload.Name, set it to control what Status reports
+	States map[string][]workgroup.DeployState
+
+	// Drift is keyed by Workload.Name, set it to make Drifted report a reason
+	Drift map[string]string
+
+	// set these to make the matching call fail
+	DeployErr error
+	StopErr   error
+	PullErr   error
+}
+
+func NewFakeRuntime() *FakeRuntime {
+	return &FakeRuntime{
+		Running: make(map[string]*Workload),
+		Drift:   make(map[string]string),
+		States:  make(map[string][]workgroup.DeployState),
+	}
+}
+
+func (f *FakeRuntime) Deploy(ctx context.Context, w *Workload) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.DeployErr != nil {
+		return f.DeployErr
+	}
+	f.Deployed = append(f.Deployed, w.Name)
+	f.Running[w.Name] = w
+	return nil
+}
+
+func (f *FakeRuntime) Pull(ctx context.Context, w *Workload, progress func([]workgroup.PullProgress)) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.PullErr != nil {
+		return f.PullErr
+	}
+	f.Pulled = append(f.Pulled, w.Name)
+	return nil
+}
+
+func (f *FakeRuntime) Status(ctx context.Context, w *Workload) ([]workgroup.DeployState, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.Running[w.Name]; !ok {
+		return []workgroup.DeployState{}, nil
+	}
+	if states, ok := f.States[w.Name]; ok {
+		// a copy, so callers can't change what we report next time
+		return append([]workgroup.DeployState{}, states...), nil
+	}
+	return []workgroup.DeployState{{}}, nil
+}
+
+func (f *FakeRuntime) Drifted(ctx context.Context, w *Workload) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.Running[w.Name]; !ok {
+		return "not running", nil
+	}
+	return f.Drift[w.Name], nil
+}
+
+func (f *FakeRuntime) Stop(ctx context.Context, w *Workload) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.StopErr != nil {
+		return f.StopErr
+	}
+	f.Stopped = append(f.Stopped, w.Name)
+	delete(f.Running, w.Name)
+	return nil
+}
+
+func (f *FakeRuntime) Logs(ctx context.Context, w *Workload, follow bool) (io.ReadCloser, error) {
+	return ioutil.NopCloser(strings.NewReader("")), nil
+}
+
+func (f *FakeRuntime) Restart(ctx context.Context, w *Workload, service string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Restarted = append(f.Restarted, w.Name+"/"+service)
+	return nil
+}
@@ -0,0 +1,358 @@
+package workload
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/go-logr/logr"
+	"github.com/workbenchapp/worknet/daoctl/lib/solana/anchor/generated/worknet"
+	"github.com/workbenchapp/worknet/daoctl/lib/workgroup"
+)
+
+// Compose healthchecks are run by docker, and show up in DeployState.Health.
+// Probes (x-daonetes.probes in the spec) are run by the agent, from outside the
+// container. Either way, an unhealthy service gets restarted, backing off
+// between restarts so one that can't come up doesn't get hammered. The probes
+// and restarts run in the background, Status only reports what they last found.
+
+const (
+	HealthHealthy   = "healthy"
+	HealthUnhealthy = "unhealthy"
+	HealthStarting  = "starting"
+)
+
+const (
+	defaultProbeInterval = 10 * time.Second
+	defaultProbeTimeout  = 2 * time.Second
+	defaultProbeRetries  = 3
+
+	defaultMinBackoff = 10 * time.Second
+	defaultMaxBackoff = 5 * time.Minute
+)
+
+// HealthMonitor probes the workloads' services, and restarts the unhealthy ones
+type HealthMonitor struct {
+	Runtimes *Registry
+	// MinBackoff is the wait after a service's first restart, it doubles with each
+	// restart up to MaxBackoff, and resets once the service stays up for MaxBackoff
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	mu sync.Mutex
+	// keyed by workload name, then service
+	services map[string]map[string]*serviceHealth
+	probes   map[string]specProbes
+	// the probes and restarts that are running
+	running sync.WaitGroup
+
+	// for tests
+	now   func() time.Time
+	probe func(ctx context.Context, addr string, probe *ComposeProbe) error
+}
+
+type serviceHealth struct {
+	failures     int
+	lastProbe    time.Time
+	probeHealth  string
+	probeErr     string
+	probing      bool
+	restarting   bool
+	restarts     int
+	nextRestart  time.Time
+	healthySince time.Time
+}
+
+// specProbes are the probes from one version of a workload's spec
+type specProbes struct {
+	specSha256 string
+	probes     map[string]*ComposeProbe
+}
+
+func NewHealthMonitor(runtimes *Registry) *HealthMonitor {
+	return &HealthMonitor{
+		Runtimes:   runtimes,
+		MinBackoff: defaultMinBackoff,
+		MaxBackoff: defaultMaxBackoff,
+		services:   make(map[string]map[string]*serviceHealth),
+		probes:     make(map[string]specProbes),
+		now:        time.Now,
+		probe:      probeService,
+	}
+}
+
+// Status gets the workload's states from its runtime, with the last probe results
+// in their Health. It starts the probes that are due, and restarts the services
+// that are unhealthy and due a restart, without waiting for either.
+func (m *HealthMonitor) Status(ctx context.Context, w *Workload) ([]workgroup.DeployState, error) {
+	runtime, err := m.Runtimes.Get(w.WorkType)
+	if err != nil {
+		return nil, err
+	}
+	states, err := runtime.Status(ctx, w)
+	if err != nil {
+		return states, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	probes := m.specProbes(ctx, w)
+	services := m.services[w.Name]
+	if services == nil {
+		services = make(map[string]*serviceHealth)
+		m.services[w.Name] = services
+	}
+	seen := make(map[string]bool)
+	for i := range states {
+		state := &states[i]
+		seen[state.Service] = true
+		h, ok := services[state.Service]
+		if !ok {
+			h = &serviceHealth{}
+			services[state.Service] = h
+		}
+		if probe, ok := probes[state.Service]; ok {
+			m.runProbe(ctx, h, state, probe)
+		}
+		m.restartIfUnhealthy(ctx, runtime, w, state, h)
+		state.HealthRestarts = h.restarts
+	}
+	for service := range services {
+		if !seen[service] {
+			delete(services, service)
+		}
+	}
+	return states, nil
+}
+
+// Forget drops what we know about a workload's health, once it's been torn down
+func (m *HealthMonitor) Forget(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.services, name)
+	delete(m.probes, name)
+}
+
+func (m *HealthMonitor) specProbes(ctx context.Context, w *Workload) map[string]*ComposeProbe {
+	if w.WorkType != worknet.WorkTypeDockerCompose || w.SpecPath == "" {
+		return nil
+	}
+	if cached, ok := m.probes[w.Name]; ok && cached.specSha256 == w.SpecSha256 {
+		return cached.probes
+	}
+	compose, err := LoadComposeFile(w.SpecPath, w.Env)
+	if err != nil {
+		// it'll fail to deploy too, which says why
+		logr.FromContextOrDiscard(ctx).V(1).Info("Couldn't read spec for probes", "name", w.Name, "err", err)
+		return nil
+	}
+	m.probes[w.Name] = specProbes{specSha256: w.SpecSha256, probes: compose.Daonetes.Probes}
+	return compose.Daonetes.Probes
+}
+
+// wait is for tests, it waits for the running probes and restarts to finish
+func (m *HealthMonitor) wait() {
+	m.running.Wait()
+}
+
+// runProbe starts the service's probe if it's due, and puts the last result in state. m.mu is held.
+func (m *HealthMonitor) runProbe(ctx context.Context, h *serviceHealth, state *workgroup.DeployState, probe *ComposeProbe) {
+	if state.State != "running" {
+		// nothing to probe, it's up to the restart policy
+		h.failures, h.probeHealth, h.probeErr = 0, "", ""
+		return
+	}
+	now := m.now()
+	if !h.probing && !h.restarting && now.Sub(h.lastProbe) >= durationOr(probe.Interval, defaultProbeInterval) {
+		h.lastProbe = now
+		h.probing = true
+		addr, addrErr := probeAddress(state, probe.Port)
+		m.running.Add(1)
+		go func() {
+			defer m.running.Done()
+			err := addrErr
+			if err == nil {
+				probeCtx, cancel := context.WithTimeout(ctx, durationOr(probe.Timeout, defaultProbeTimeout))
+				err = m.probe(probeCtx, addr, probe)
+				cancel()
+			}
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			h.probing = false
+			m.probed(h, probe, err)
+		}()
+	}
+	// docker's healthcheck wins if it's failing
+	if state.Health != HealthUnhealthy && h.probeHealth != "" {
+		state.Health = h.probeHealth
+	}
+	state.HealthError = h.probeErr
+}
+
+// probed records a probe's result. m.mu is held.
+func (m *HealthMonitor) probed(h *serviceHealth, probe *ComposeProbe, err error) {
+	retries := probe.Retries
+	if retries <= 0 {
+		retries = defaultProbeRetries
+	}
+	switch {
+	case err == nil:
+		h.failures, h.probeHealth, h.probeErr = 0, HealthHealthy, ""
+	case h.failures+1 >= retries:
+		h.failures, h.probeHealth, h.probeErr = h.failures+1, HealthUnhealthy, err.Error()
+	default:
+		h.failures, h.probeErr = h.failures+1, err.Error()
+		if h.probeHealth == "" {
+			h.probeHealth = HealthStarting
+		}
+	}
+}
+
+// restartIfUnhealthy starts restarting the service if it's unhealthy and due a restart. m.mu is held.
+func (m *HealthMonitor) restartIfUnhealthy(ctx context.Context, runtime Runtime, w *Workload, state *workgroup.DeployState, h *serviceHealth) {
+	log := logr.FromContextOrDiscard(ctx)
+	now := m.now()
+
+	if state.Health != HealthUnhealthy && state.State != "dead" {
+		if state.Healthy() {
+			if h.healthySince.IsZero() {
+				h.healthySince = now
+			}
+			// only forget the backoff once it's stayed up for a while
+			if now.Sub(h.healthySince) >= m.MaxBackoff {
+				h.restarts = 0
+			}
+		}
+		return
+	}
+	h.healthySince = time.Time{}
+	if h.restarting || now.Before(h.nextRestart) {
+		return
+	}
+	restarter, ok := runtime.(Restarter)
+	if !ok {
+		return
+	}
+	backoff := m.backoff(h.restarts + 1)
+	log.Info("Restarting unhealthy service",
+		"name", w.Name,
+		"service", state.Service,
+		"health", state.Health,
+		"state", state.State,
+		"restarts", h.restarts,
+		"next_restart_in", backoff,
+	)
+	h.restarting = true
+	service := state.Service
+	m.running.Add(1)
+	go func() {
+		defer m.running.Done()
+		if err := restarter.Restart(ctx, w, service); err != nil {
+			log.Error(err, "Restarting service failed", "name", w.Name, "service", service)
+		}
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		h.restarting = false
+	}()
+	h.restarts++
+	h.nextRestart = now.Add(backoff)
+	h.failures, h.probeHealth = 0, HealthStarting
+}
+
+// backoff is how long to wait after the nth restart
+func (m *HealthMonitor) backoff(n int) time.Duration {
+	backoff := m.MinBackoff
+	for i := 1; i < n && backoff < m.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > m.MaxBackoff {
+		backoff = m.MaxBackoff
+	}
+	return backoff
+}
+
+// probeAddress finds where the service's container port is published on this device
+func probeAddress(state *workgroup.DeployState, port int) (string, error) {
+	for _, p := range state.Publishers {
+		if p.TargetPort != port || p.PublishedPort == 0 || (p.Protocol != "" && p.Protocol != "tcp") {
+			continue
+		}
+		host := p.URL
+		if host == "" || host == "0.0.0.0" || host == "::" {
+			host = "127.0.0.1"
+		}
+		return net.JoinHostPort(host, strconv.Itoa(p.PublishedPort)), nil
+	}
+	return "", fmt.Errorf("port %d isn't published", port)
+}
+
+func probeService(ctx context.Context, addr string, probe *ComposeProbe) error {
+	if probe.HTTP == "" {
+		conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	path := probe.HTTP
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+addr+path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("GET %s: %s", path, resp.Status)
+	}
+	return nil
+}
+
+// healthConfig is the compose healthcheck for docker
+func healthConfig(healthcheck *ComposeHealthcheck) (*container.HealthConfig, error) {
+	if healthcheck == nil {
+		return nil, nil
+	}
+	if healthcheck.Disable {
+		return &container.HealthConfig{Test: []string{"NONE"}}, nil
+	}
+	config := &container.HealthConfig{
+		Test:    []string(healthcheck.Test),
+		Retries: healthcheck.Retries,
+	}
+	var err error
+	for _, d := range []struct {
+		value string
+		to    *time.Duration
+	}{
+		{healthcheck.Interval, &config.Interval},
+		{healthcheck.Timeout, &config.Timeout},
+		{healthcheck.StartPeriod, &config.StartPeriod},
+	} {
+		if d.value == "" {
+			continue
+		}
+		if *d.to, err = time.ParseDuration(d.value); err != nil {
+			return nil, fmt.Errorf("invalid healthcheck duration %q: %s", d.value, err)
+		}
+	}
+	return config, nil
+}
+
+func durationOr(value string, def time.Duration) time.Duration {
+	if d, err := time.ParseDuration(value); err == nil && d > 0 {
+		return d
+	}
+	return def
+}
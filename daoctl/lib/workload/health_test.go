@@ -0,0 +1,190 @@
+package workload
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/workbenchapp/worknet/daoctl/lib/options"
+	"github.com/workbenchapp/worknet/daoctl/lib/solana/anchor/generated/worknet"
+	"github.com/workbenchapp/worknet/daoctl/lib/workgroup"
+)
+
+func newTestHealthMonitor() (*HealthMonitor, *FakeRuntime, *time.Time) {
+	fake := NewFakeRuntime()
+	registry := NewRegistry()
+	registry.Register(worknet.WorkTypeDockerCompose, fake)
+	monitor := NewHealthMonitor(registry)
+	now := time.Unix(1000, 0)
+	monitor.now = func() time.Time { return now }
+	return monitor, fake, &now
+}
+
+func TestHealthBackoff(t *testing.T) {
+	monitor := NewHealthMonitor(NewRegistry())
+	for n, expected := range map[int]time.Duration{
+		1:  10 * time.Second,
+		2:  20 * time.Second,
+		3:  40 * time.Second,
+		10: 5 * time.Minute,
+	} {
+		if backoff := monitor.backoff(n); backoff != expected {
+			t.Errorf("restart %d: expected %s, got %s", n, expected, backoff)
+		}
+	}
+}
+
+func TestHealthRestartsUnhealthyWithBackoff(t *testing.T) {
+	monitor, fake, now := newTestHealthMonitor()
+	w := &Workload{Name: "a", WorkType: worknet.WorkTypeDockerCompose}
+	fake.Running["a"] = w
+	fake.States["a"] = []workgroup.DeployState{{Service: "web", State: "running", Health: HealthUnhealthy}}
+	ctx := context.Background()
+
+	states, err := monitor.Status(ctx, w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	monitor.wait()
+	if len(fake.Restarted) != 1 || states[0].HealthRestarts != 1 {
+		t.Fatalf("expected one restart, got %v", fake.Restarted)
+	}
+
+	// still unhealthy, but inside the backoff
+	*now = now.Add(5 * time.Second)
+	monitor.Status(ctx, w)
+	monitor.wait()
+	if len(fake.Restarted) != 1 {
+		t.Fatalf("expected to wait for the backoff, got %v", fake.Restarted)
+	}
+
+	*now = now.Add(10 * time.Second)
+	states, _ = monitor.Status(ctx, w)
+	monitor.wait()
+	if len(fake.Restarted) != 2 || states[0].HealthRestarts != 2 {
+		t.Fatalf("expected a second restart, got %v", fake.Restarted)
+	}
+
+	// healthy for long enough forgets the restarts
+	fake.States["a"] = []workgroup.DeployState{{Service: "web", State: "running", Health: HealthHealthy}}
+	monitor.Status(ctx, w)
+	*now = now.Add(monitor.MaxBackoff)
+	states, _ = monitor.Status(ctx, w)
+	if states[0].HealthRestarts != 0 {
+		t.Fatalf("expected restarts to reset, got %d", states[0].HealthRestarts)
+	}
+}
+
+func TestHealthProbe(t *testing.T) {
+	monitor, fake, now := newTestHealthMonitor()
+	specPath := filepath.Join(t.TempDir(), "docker-compose.yml")
+	spec := `
+services:
+  web:
+    image: nginx
+    ports: ["8080:80"]
+x-daonetes:
+  probes:
+    web:
+      http: /healthz
+      port: 80
+      retries: 2
+`
+	if err := ioutil.WriteFile(specPath, []byte(spec), 0644); err != nil {
+		t.Fatal(err)
+	}
+	w := &Workload{Name: "a", WorkType: worknet.WorkTypeDockerCompose, SpecPath: specPath, SpecSha256: "1"}
+	fake.Running["a"] = w
+	fake.States["a"] = []workgroup.DeployState{{
+		Service:    "web",
+		State:      "running",
+		Publishers: []options.Publisher{{Protocol: "tcp", PublishedPort: 8080, TargetPort: 80}},
+	}}
+	probed := []string{}
+	var probeErr error
+	monitor.probe = func(ctx context.Context, addr string, probe *ComposeProbe) error {
+		probed = append(probed, addr+probe.HTTP)
+		return probeErr
+	}
+	ctx := context.Background()
+
+	// the probe runs in the background, the next Status has its result
+	monitor.Status(ctx, w)
+	monitor.wait()
+	if len(probed) != 1 || probed[0] != "127.0.0.1:8080/healthz" {
+		t.Fatalf("expected the published port to be probed, got %v", probed)
+	}
+	states, _ := monitor.Status(ctx, w)
+	if states[0].Health != HealthHealthy || !states[0].Healthy() {
+		t.Fatalf("expected healthy, got %q", states[0].Health)
+	}
+
+	probeErr = errors.New("connection refused")
+	*now = now.Add(defaultProbeInterval)
+	monitor.Status(ctx, w)
+	monitor.wait()
+	states, _ = monitor.Status(ctx, w)
+	if states[0].Health != HealthHealthy || len(fake.Restarted) != 0 {
+		t.Fatalf("expected one failure to be retried, got %q", states[0].Health)
+	}
+
+	*now = now.Add(defaultProbeInterval)
+	monitor.Status(ctx, w)
+	monitor.wait()
+	states, _ = monitor.Status(ctx, w)
+	monitor.wait()
+	if states[0].Health != HealthUnhealthy || states[0].HealthError != "connection refused" {
+		t.Fatalf("expected unhealthy, got %q %q", states[0].Health, states[0].HealthError)
+	}
+	if len(fake.Restarted) != 1 || fake.Restarted[0] != "a/web" {
+		t.Fatalf("expected web to be restarted, got %v", fake.Restarted)
+	}
+}
+
+func TestHealthProbeDoesntBlockStatus(t *testing.T) {
+	monitor, fake, _ := newTestHealthMonitor()
+	specPath := filepath.Join(t.TempDir(), "docker-compose.yml")
+	spec := `
+services:
+  web:
+    image: nginx
+    ports: ["8080:80"]
+x-daonetes:
+  probes:
+    web:
+      port: 80
+`
+	if err := ioutil.WriteFile(specPath, []byte(spec), 0644); err != nil {
+		t.Fatal(err)
+	}
+	w := &Workload{Name: "a", WorkType: worknet.WorkTypeDockerCompose, SpecPath: specPath, SpecSha256: "1"}
+	fake.Running["a"] = w
+	fake.States["a"] = []workgroup.DeployState{{
+		Service:    "web",
+		State:      "running",
+		Publishers: []options.Publisher{{Protocol: "tcp", PublishedPort: 8080, TargetPort: 80}},
+	}}
+	release := make(chan struct{})
+	monitor.probe = func(ctx context.Context, addr string, probe *ComposeProbe) error {
+		<-release
+		return nil
+	}
+	ctx := context.Background()
+
+	done := make(chan struct{})
+	go func() {
+		monitor.Status(ctx, w)
+		monitor.Status(ctx, w)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected Status not to wait for the probe")
+	}
+	close(release)
+	monitor.wait()
+}
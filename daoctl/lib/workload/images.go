@@ -0,0 +1,153 @@
+package workload
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+	dockertypes "github.com/docker/docker/api/types"
+	"github.com/workbenchapp/worknet/daoctl/lib/workgroup"
+)
+
+// DockerHubRegistry is what ImageRegistry calls images with no registry in their name
+const DockerHubRegistry = "docker.io"
+
+// docker keys its Docker Hub logins by the v1 index
+const dockerHubAuthKey = "https://index.docker.io/v1/"
+
+// RegistryCredential is a login for one registry, as `docker login` would keep it
+type RegistryCredential struct {
+	Registry string `json:"registry"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// Credentials finds the login for a registry, nil if there isn't one. The
+// agent keeps the ones its workgroup has sent it.
+type Credentials interface {
+	Credential(registry string) (*RegistryCredential, error)
+}
+
+// Puller is implemented by runtimes that can fetch a workload's images ahead of
+// Deploy, so a deployment isn't switched over until everything it needs is here.
+// progress is called with the state of every image, as it changes.
+type Puller interface {
+	Pull(ctx context.Context, w *Workload, progress func([]workgroup.PullProgress)) error
+}
+
+// ImageRegistry is the registry an image is pulled from, eg ghcr.io, or docker.io for Docker Hub
+func ImageRegistry(image string) (string, error) {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return "", fmt.Errorf("invalid image %q: %s", image, err)
+	}
+	return reference.Domain(named), nil
+}
+
+// NormalizeRegistry turns what people pass `docker login` (https://ghcr.io/,
+// index.docker.io...) into the registry ImageRegistry would give
+func NormalizeRegistry(server string) string {
+	server = strings.TrimPrefix(strings.TrimPrefix(server, "https://"), "http://")
+	server = strings.SplitN(server, "/", 2)[0]
+	switch server {
+	case "", "index.docker.io", "registry-1.docker.io", "registry.hub.docker.com":
+		return DockerHubRegistry
+	}
+	return strings.ToLower(server)
+}
+
+// serviceImages are the images the spec's services use, each once, in service order
+func serviceImages(compose *ComposeFile) ([]string, error) {
+	order, err := compose.ServiceOrder()
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	images := []string{}
+	for _, name := range order {
+		image := compose.Services[name].Image
+		if image == "" || seen[image] {
+			continue
+		}
+		seen[image] = true
+		images = append(images, image)
+	}
+	return images, nil
+}
+
+func credentialFor(credentials Credentials, image string) (*RegistryCredential, error) {
+	if credentials == nil {
+		return nil, nil
+	}
+	registry, err := ImageRegistry(image)
+	if err != nil {
+		return nil, err
+	}
+	credential, err := credentials.Credential(registry)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get credentials for %s: %s", registry, err)
+	}
+	return credential, nil
+}
+
+// registryAuth is the X-Registry-Auth header the Docker API wants for a pull
+func registryAuth(credential *RegistryCredential) (string, error) {
+	if credential == nil {
+		return "", nil
+	}
+	server := credential.Registry
+	if server == DockerHubRegistry {
+		server = dockerHubAuthKey
+	}
+	data, err := json.Marshal(dockertypes.AuthConfig{
+		Username:      credential.Username,
+		Password:      credential.Password,
+		ServerAddress: server,
+	})
+	if err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(data), nil
+}
+
+// writeDockerConfig writes a docker config.json with the logins for images into
+// dir, for DOCKER_CONFIG, so docker-compose can pull them. It returns false if
+// none of the images need a login.
+func writeDockerConfig(dir string, credentials Credentials, images []string) (bool, error) {
+	type auth struct {
+		Auth string `json:"auth"`
+	}
+	auths := map[string]auth{}
+	for _, image := range images {
+		credential, err := credentialFor(credentials, image)
+		if err != nil {
+			return false, err
+		}
+		if credential == nil {
+			continue
+		}
+		key := credential.Registry
+		if key == DockerHubRegistry {
+			key = dockerHubAuthKey
+		}
+		auths[key] = auth{Auth: base64.StdEncoding.EncodeToString([]byte(credential.Username + ":" + credential.Password))}
+	}
+	if len(auths) == 0 {
+		return false, nil
+	}
+	data, err := json.Marshal(map[string]interface{}{"auths": auths})
+	if err != nil {
+		return false, err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return false, err
+	}
+	// it has the passwords in it, so only for us
+	return true, ioutil.WriteFile(filepath.Join(dir, "config.json"), data, 0600)
+}
@@ -0,0 +1,33 @@
+package workload
+
+import "testing"
+
+func TestImageRegistry(t *testing.T) {
+	for image, expected := range map[string]string{
+		"nginx":                       "docker.io",
+		"library/nginx:1.23":          "docker.io",
+		"ghcr.io/workbenchapp/app:v1": "ghcr.io",
+		"localhost:5000/app":          "localhost:5000",
+	} {
+		registry, err := ImageRegistry(image)
+		if err != nil {
+			t.Fatalf("%s: %s", image, err)
+		}
+		if registry != expected {
+			t.Errorf("%s: expected %s, got %s", image, expected, registry)
+		}
+	}
+}
+
+func TestNormalizeRegistry(t *testing.T) {
+	for server, expected := range map[string]string{
+		"https://index.docker.io/v1/": "docker.io",
+		"docker.io":                   "docker.io",
+		"https://GHCR.io/":            "ghcr.io",
+		"localhost:5000":              "localhost:5000",
+	} {
+		if registry := NormalizeRegistry(server); registry != expected {
+			t.Errorf("%s: expected %s, got %s", server, expected, registry)
+		}
+	}
+}
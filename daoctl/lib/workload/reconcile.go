@@ -0,0 +1,298 @@
+package workload
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/workbenchapp/worknet/daoctl/lib/workgroup"
+)
+
+const (
+	// where the work dirs of torn down workloads get moved to
+	archiveDirName = "archive"
+
+	// the workloads this agent has started, so we know what to stop
+	StartedWorkloadsFile = "started.json"
+)
+
+// StartedWorkload is the record the Reconciler keeps of each workload it started
+type StartedWorkload struct {
+	Workload
+	StartedAt time.Time `json:"started_at"`
+	// DeployedAt is the last time Deploy succeeded, zero if it's never been needed
+	DeployedAt time.Time `json:"deployed_at"`
+}
+
+// RecordStore is where the Reconciler keeps its StartedWorkload records, keyed by Workload.Name
+type RecordStore interface {
+	LoadRecords() (map[string]StartedWorkload, error)
+	SaveRecords(records map[string]StartedWorkload) error
+}
+
+// Reconciler makes the workloads running on this device match the desired set,
+// and remembers what it started (in Store, or StartedWorkloadsFile in StateDir)
+// so it can tear it down later. Torn down work dirs are archived in StateDir.
+type Reconciler struct {
+	Runtimes *Registry
+	StateDir string
+	Store    RecordStore
+
+	// Force redeploys every desired workload, even UpToDate ones
+	Force bool
+
+	// OnDeploy is called just before a workload is (re)deployed
+	OnDeploy func(w *Workload)
+	// OnPull is called as the images for a (re)deploy are pulled, for runtimes that are Pullers
+	OnPull func(w *Workload, pulls []workgroup.PullProgress)
+	// Errors has why each workload failed in the last Reconcile, keyed by Workload.Name
+	Errors map[string]error
+}
+
+func NewReconciler(runtimes *Registry, stateDir string) *Reconciler {
+	return &Reconciler{
+		Runtimes: runtimes,
+		StateDir: stateDir,
+	}
+}
+
+// Reconcile deploys each desired workload that isn't UpToDate, has changed, or
+// has drifted from its spec, and stops every workload we started earlier that is
+// no longer desired. It returns the workloads
+// that were stopped, and keeps going past individual failures.
+func (r *Reconciler) Reconcile(ctx context.Context, desired []*Workload) ([]*Workload, error) {
+	log := logr.FromContextOrDiscard(ctx)
+	errs := []string{}
+	r.Errors = make(map[string]error)
+	fail := func(name string, err error) {
+		r.Errors[name] = err
+		errs = append(errs, fmt.Sprintf("%s: %s", name, err))
+	}
+
+	started, err := r.loadStarted()
+	if err != nil {
+		return nil, err
+	}
+
+	wanted := make(map[string]bool)
+	for _, w := range desired {
+		wanted[w.Name] = true
+
+		runtime, err := r.Runtimes.Get(w.WorkType)
+		if err != nil {
+			fail(w.Name, err)
+			continue
+		}
+		record, ok := started[w.Name]
+		if !ok {
+			record.StartedAt = time.Now()
+		}
+		if w.Hold {
+			if !ok {
+				record.Workload = *w
+				started[w.Name] = record
+			}
+			continue
+		}
+		if reason := r.needsDeploy(ctx, runtime, w, record, ok); reason != "" {
+			log.Info("Deploying workload", "name", w.Name, "deploymentPDA", w.DeploymentPDA, "reason", reason)
+			if r.OnDeploy != nil {
+				r.OnDeploy(w)
+			}
+			// get all the images before touching what's running, a failed pull leaves it be
+			if puller, ok := runtime.(Puller); ok {
+				err := puller.Pull(ctx, w, func(pulls []workgroup.PullProgress) {
+					if r.OnPull != nil {
+						r.OnPull(w, pulls)
+					}
+				})
+				if err != nil {
+					log.Error(err, "Pulling images failed", "name", w.Name, "deploymentPDA", w.DeploymentPDA)
+					fail(w.Name, err)
+					continue
+				}
+			}
+			if err := runtime.Deploy(ctx, w); err != nil {
+				log.Error(err, "Deploying workload failed", "name", w.Name, "deploymentPDA", w.DeploymentPDA)
+				fail(w.Name, err)
+				continue
+			}
+			record.DeployedAt = time.Now()
+		}
+		// also record UpToDate workloads, they may have been deployed before we kept records
+		record.Workload = *w
+		started[w.Name] = record
+	}
+
+	stopped := []*Workload{}
+	for name, s := range started {
+		if wanted[name] {
+			continue
+		}
+		w := s.Workload
+		log.Info("Workload no longer wanted, tearing down",
+			"name", name,
+			"deploymentPDA", w.DeploymentPDA,
+			"replica", w.Replica,
+		)
+
+		runtime, err := r.Runtimes.Get(w.WorkType)
+		if err != nil {
+			fail(name, err)
+			continue
+		}
+		if err := runtime.Stop(ctx, &w); err != nil {
+			// leave it in the list so we try again next time round
+			log.Error(err, "Stopping workload failed", "name", name)
+			fail(name, err)
+			continue
+		}
+		if err := r.archiveWorkDir(w.WorkDir); err != nil {
+			log.Error(err, "Could not archive workload work dir", "dirpath", w.WorkDir)
+		}
+		delete(started, name)
+		stopped = append(stopped, &w)
+	}
+
+	if err := r.saveStarted(started); err != nil {
+		errs = append(errs, fmt.Sprintf("couldn't save started workloads: %s", err))
+	}
+
+	if len(errs) > 0 {
+		return stopped, errors.New(strings.Join(errs, "; "))
+	}
+	return stopped, nil
+}
+
+// needsDeploy says why w needs (re)deploying, or "" if what's running is fine
+func (r *Reconciler) needsDeploy(ctx context.Context, runtime Runtime, w *Workload, last StartedWorkload, deployed bool) string {
+	log := logr.FromContextOrDiscard(ctx)
+
+	switch {
+	case r.Force:
+		return "forced update"
+	case !w.UpToDate:
+		return "spec updated"
+	case !deployed:
+		// no record, it was deployed before we kept them or its first deploy
+		// failed, what's running says which
+		detector, ok := runtime.(DriftDetector)
+		if !ok {
+			return "not deployed yet"
+		}
+		reason, err := detector.Drifted(ctx, w)
+		if err != nil {
+			log.Error(err, "Checking unrecorded workload failed", "name", w.Name)
+			return "not deployed yet"
+		}
+		if reason != "" {
+			return "not deployed yet: " + reason
+		}
+		return ""
+	// records from before we kept the spec hash don't have one
+	case last.SpecSha256 != "" && last.SpecSha256 != w.SpecSha256:
+		return "spec content changed"
+	case strings.Join(last.Env, "\n") != strings.Join(w.Env, "\n"):
+		return "args changed"
+	case !sameSecretVersions(last.SecretVersions, w.SecretVersions):
+		return "secrets rotated"
+	}
+
+	detector, ok := runtime.(DriftDetector)
+	if !ok {
+		return ""
+	}
+	reason, err := detector.Drifted(ctx, w)
+	if err != nil {
+		// don't redeploy on a hunch, we'll look again next time
+		log.Error(err, "Checking workload for drift failed", "name", w.Name)
+		return ""
+	}
+	if reason != "" {
+		return "drifted: " + reason
+	}
+	return ""
+}
+
+// Records has what we know about each workload we've started, keyed by Workload.Name
+func (r *Reconciler) Records() (map[string]StartedWorkload, error) {
+	return r.loadStarted()
+}
+
+// Started lists the workloads we've started and not yet torn down
+func (r *Reconciler) Started() ([]*Workload, error) {
+	started, err := r.loadStarted()
+	if err != nil {
+		return nil, err
+	}
+	workloads := []*Workload{}
+	for _, s := range started {
+		w := s.Workload
+		workloads = append(workloads, &w)
+	}
+	return workloads, nil
+}
+
+func (r *Reconciler) loadStarted() (map[string]StartedWorkload, error) {
+	if r.Store != nil {
+		return r.Store.LoadRecords()
+	}
+	started := make(map[string]StartedWorkload)
+	data, err := ioutil.ReadFile(filepath.Join(r.StateDir, StartedWorkloadsFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return started, nil
+	}
+	if err != nil {
+		return started, err
+	}
+	if err := json.Unmarshal(data, &started); err != nil {
+		return started, fmt.Errorf("couldn't decode %s: %s", StartedWorkloadsFile, err)
+	}
+	return started, nil
+}
+
+func (r *Reconciler) saveStarted(started map[string]StartedWorkload) error {
+	if r.Store != nil {
+		return r.Store.SaveRecords(started)
+	}
+	if err := os.MkdirAll(r.StateDir, os.ModePerm); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(started, "", " ")
+	if err != nil {
+		return err
+	}
+	// write then rename, so a crash doesn't lose track of everything we're running
+	tmpPath := filepath.Join(r.StateDir, StartedWorkloadsFile+".tmp")
+	if err := ioutil.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, filepath.Join(r.StateDir, StartedWorkloadsFile))
+}
+
+// archiveWorkDir moves a torn down workload's state out of the way, keeping it for later inspection
+func (r *Reconciler) archiveWorkDir(workDir string) error {
+	if workDir == "" {
+		return nil
+	}
+	if _, err := os.Stat(workDir); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	archiveDir := filepath.Join(r.StateDir, archiveDirName)
+	if err := os.MkdirAll(archiveDir, os.ModePerm); err != nil {
+		return err
+	}
+	// work dirs are <deploymentPDA>/<replica>, keep both in the archived name
+	archivedPath := filepath.Join(
+		archiveDir,
+		fmt.Sprintf("%s-%s-%d", filepath.Base(filepath.Dir(workDir)), filepath.Base(workDir), time.Now().Unix()),
+	)
+	return os.Rename(workDir, archivedPath)
+}
@@ -0,0 +1,201 @@
+package workload
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/workbenchapp/worknet/daoctl/lib/solana/anchor/generated/worknet"
+)
+
+func newTestReconciler(t *testing.T) (*Reconciler, *FakeRuntime) {
+	fake := NewFakeRuntime()
+	registry := NewRegistry()
+	registry.Register(worknet.WorkTypeDockerCompose, fake)
+	return NewReconciler(registry, t.TempDir()), fake
+}
+
+func TestReconcileDeploysAndSkipsUpToDate(t *testing.T) {
+	reconciler, fake := newTestReconciler(t)
+	// deployed before we kept records
+	fake.Running["b"] = &Workload{Name: "b"}
+
+	_, err := reconciler.Reconcile(context.Background(), []*Workload{
+		{Name: "a", DeploymentPDA: "pda"},
+		{Name: "b", DeploymentPDA: "pda", Replica: 1, UpToDate: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.Deployed) != 1 || fake.Deployed[0] != "a" {
+		t.Fatalf("expected only a to be deployed, got %v", fake.Deployed)
+	}
+
+	started, err := reconciler.Started()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(started) != 2 {
+		t.Fatalf("expected both workloads to be recorded, got %d", len(started))
+	}
+}
+
+func TestReconcileStopsUnwanted(t *testing.T) {
+	reconciler, fake := newTestReconciler(t)
+	ctx := context.Background()
+
+	workDir := filepath.Join(reconciler.StateDir, "pda", "1")
+	if err := os.MkdirAll(workDir, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := reconciler.Reconcile(ctx, []*Workload{
+		{Name: "a", DeploymentPDA: "pda"},
+		{Name: "a-1", DeploymentPDA: "pda", Replica: 1, WorkDir: workDir},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the token balance dropped to one
+	stopped, err := reconciler.Reconcile(ctx, []*Workload{
+		{Name: "a", DeploymentPDA: "pda", UpToDate: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stopped) != 1 || stopped[0].Name != "a-1" {
+		t.Fatalf("expected a-1 to be stopped, got %v", stopped)
+	}
+	if _, ok := fake.Running["a-1"]; ok {
+		t.Fatal("a-1 still running")
+	}
+	if _, err := os.Stat(workDir); !errors.Is(err, os.ErrNotExist) {
+		t.Fatal("a-1 work dir wasn't archived")
+	}
+	archived, _ := filepath.Glob(filepath.Join(reconciler.StateDir, archiveDirName, "pda-1-*"))
+	if len(archived) != 1 {
+		t.Fatalf("expected one archived work dir, got %v", archived)
+	}
+}
+
+func TestReconcileRetriesFailedStop(t *testing.T) {
+	reconciler, fake := newTestReconciler(t)
+	ctx := context.Background()
+
+	if _, err := reconciler.Reconcile(ctx, []*Workload{{Name: "a"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	fake.StopErr = errors.New("docker went away")
+	if _, err := reconciler.Reconcile(ctx, nil); err == nil {
+		t.Fatal("expected the failed stop to be reported")
+	}
+
+	fake.StopErr = nil
+	stopped, err := reconciler.Reconcile(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stopped) != 1 || stopped[0].Name != "a" {
+		t.Fatalf("expected a to be stopped on retry, got %v", stopped)
+	}
+}
+
+func TestReconcileUnknownWorkType(t *testing.T) {
+	reconciler, fake := newTestReconciler(t)
+
+	_, err := reconciler.Reconcile(context.Background(), []*Workload{
+		{Name: "a", WorkType: worknet.WorkType(42)},
+		{Name: "b"},
+	})
+	if err == nil {
+		t.Fatal("expected an error for the unknown work type")
+	}
+	if len(fake.Deployed) != 1 || fake.Deployed[0] != "b" {
+		t.Fatalf("expected b to still be deployed, got %v", fake.Deployed)
+	}
+}
+
+func TestReconcileRedeploysOnChangeOrDrift(t *testing.T) {
+	reconciler, fake := newTestReconciler(t)
+	ctx := context.Background()
+
+	deployed := func(desired ...*Workload) []string {
+		fake.Deployed = nil
+		if _, err := reconciler.Reconcile(ctx, desired); err != nil {
+			t.Fatal(err)
+		}
+		return fake.Deployed
+	}
+
+	if got := deployed(&Workload{Name: "a", SpecSha256: "1", Env: []string{"A=1"}}); len(got) != 1 {
+		t.Fatalf("expected a to be deployed, got %v", got)
+	}
+	if got := deployed(&Workload{Name: "a", SpecSha256: "1", Env: []string{"A=1"}, UpToDate: true}); len(got) != 0 {
+		t.Fatalf("expected nothing to be deployed, got %v", got)
+	}
+	if got := deployed(&Workload{Name: "a", SpecSha256: "1", Env: []string{"A=2"}, UpToDate: true}); len(got) != 1 {
+		t.Fatalf("expected changed args to redeploy, got %v", got)
+	}
+	if got := deployed(&Workload{Name: "a", SpecSha256: "2", Env: []string{"A=2"}, UpToDate: true}); len(got) != 1 {
+		t.Fatalf("expected changed spec to redeploy, got %v", got)
+	}
+
+	// someone docker rm'd it
+	delete(fake.Running, "a")
+	if got := deployed(&Workload{Name: "a", SpecSha256: "2", Env: []string{"A=2"}, UpToDate: true}); len(got) != 1 {
+		t.Fatalf("expected drift to redeploy, got %v", got)
+	}
+	if got := deployed(&Workload{Name: "a", SpecSha256: "2", Env: []string{"A=2"}, UpToDate: true, Hold: true}); len(got) != 0 {
+		t.Fatalf("expected held workload to be left alone, got %v", got)
+	}
+
+	reconciler.Force = true
+	if got := deployed(&Workload{Name: "a", SpecSha256: "2", Env: []string{"A=2"}, UpToDate: true}); len(got) != 1 {
+		t.Fatalf("expected forced update to redeploy, got %v", got)
+	}
+}
+
+func TestReconcileRetriesFailedFirstDeploy(t *testing.T) {
+	reconciler, fake := newTestReconciler(t)
+	ctx := context.Background()
+
+	fake.DeployErr = errors.New("port is already allocated")
+	if _, err := reconciler.Reconcile(ctx, []*Workload{{Name: "a", SpecSha256: "1"}}); err == nil {
+		t.Fatal("expected the failed deploy to be reported")
+	}
+	// the work dir is there now, so it looks up to date
+	fake.DeployErr = nil
+	if _, err := reconciler.Reconcile(ctx, []*Workload{{Name: "a", SpecSha256: "1", UpToDate: true}}); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.Deployed) != 1 || fake.Deployed[0] != "a" {
+		t.Fatalf("expected the deploy to be retried, got %v", fake.Deployed)
+	}
+}
+
+func TestReconcileFailedPullLeavesRunning(t *testing.T) {
+	reconciler, fake := newTestReconciler(t)
+	ctx := context.Background()
+
+	if _, err := reconciler.Reconcile(ctx, []*Workload{{Name: "a", SpecSha256: "1"}}); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.Pulled) != 1 {
+		t.Fatalf("expected the images to be pulled before deploying, got %v", fake.Pulled)
+	}
+
+	fake.PullErr = errors.New("unauthorized")
+	fake.Deployed = nil
+	if _, err := reconciler.Reconcile(ctx, []*Workload{{Name: "a", SpecSha256: "2", UpToDate: true}}); err == nil {
+		t.Fatal("expected the failed pull to be reported")
+	}
+	if len(fake.Deployed) != 0 {
+		t.Fatalf("expected no deploy after a failed pull, got %v", fake.Deployed)
+	}
+	if _, ok := fake.Running["a"]; !ok {
+		t.Fatal("expected the old version to be left running")
+	}
+}
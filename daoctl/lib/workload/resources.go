@@ -0,0 +1,216 @@
+package workload
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/workbenchapp/worknet/daoctl/lib/workgroup"
+)
+
+// Requirements is what a compose file needs from a device, added up over its
+// services. Specs set it with the compose `deploy:` section, which can use
+// deployment args, e.g. `cpus: ${CPUS:-1}`.
+type Requirements struct {
+	CPUs        float64
+	MemoryBytes int64
+	GPUs        int
+	// Constraints are swarm style, e.g. node.labels.region==eu, node.platform.arch==x86_64
+	Constraints []string
+}
+
+// Requirements adds up the services' reservations, or their limits if they
+// don't reserve anything
+func (c *ComposeFile) Requirements() (Requirements, error) {
+	req := Requirements{}
+	for name, service := range c.Services {
+		resources := service.Deploy.Resources.Reservations
+		if resources.CPUs == "" && resources.Memory == "" {
+			resources = service.Deploy.Resources.Limits
+		}
+		cpus, err := parseCPUs(resources.CPUs)
+		if err != nil {
+			return req, fmt.Errorf("service %q: %s", name, err)
+		}
+		memory, err := parseBytes(resources.Memory)
+		if err != nil {
+			return req, fmt.Errorf("service %q: %s", name, err)
+		}
+		req.CPUs += cpus
+		req.MemoryBytes += memory
+		for _, device := range service.Deploy.Resources.Reservations.Devices {
+			gpus, err := gpuCount(device)
+			if err != nil {
+				return req, fmt.Errorf("service %q: %s", name, err)
+			}
+			req.GPUs += gpus
+		}
+		req.Constraints = append(req.Constraints, service.Deploy.Placement.Constraints...)
+	}
+	return req, nil
+}
+
+// Check says why the device can't run something with these requirements, if it can't.
+// TODO: doesn't take into account what's already running on the device
+func (req Requirements) Check(capacity workgroup.DeviceCapacity, hostname string) error {
+	if capacity.CPUs > 0 && req.CPUs > float64(capacity.CPUs) {
+		return fmt.Errorf("needs %g cpus, device has %d", req.CPUs, capacity.CPUs)
+	}
+	if capacity.MemoryBytes > 0 && req.MemoryBytes > int64(capacity.MemoryBytes) {
+		return fmt.Errorf("needs %d bytes of memory, device has %d", req.MemoryBytes, capacity.MemoryBytes)
+	}
+	if req.GPUs > capacity.GPUs {
+		return fmt.Errorf("needs %d gpus, device has %d", req.GPUs, capacity.GPUs)
+	}
+	return req.CheckConstraints(capacity, hostname)
+}
+
+// CheckConstraints is Check without the resources, for when the caller is
+// keeping track of what's left on the device
+func (req Requirements) CheckConstraints(capacity workgroup.DeviceCapacity, hostname string) error {
+	for _, constraint := range req.Constraints {
+		ok, err := matchConstraint(constraint, capacity, hostname)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("placement constraint %q not met", constraint)
+		}
+	}
+	return nil
+}
+
+func matchConstraint(constraint string, capacity workgroup.DeviceCapacity, hostname string) (bool, error) {
+	op := "=="
+	parts := strings.SplitN(constraint, "==", 2)
+	if len(parts) != 2 {
+		op = "!="
+		parts = strings.SplitN(constraint, "!=", 2)
+	}
+	if len(parts) != 2 {
+		return false, fmt.Errorf("invalid placement constraint %q", constraint)
+	}
+	key, want := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+
+	var have string
+	switch {
+	case key == "node.hostname":
+		have = hostname
+	case key == "node.platform.os":
+		have = capacity.OS
+	case key == "node.platform.arch":
+		have, want = normalizeArch(capacity.Arch), normalizeArch(want)
+	case strings.HasPrefix(key, "node.labels."):
+		have = capacity.Labels[strings.TrimPrefix(key, "node.labels.")]
+	default:
+		return false, fmt.Errorf("unsupported placement constraint %q", constraint)
+	}
+	return (have == want) == (op == "=="), nil
+}
+
+// normalizeArch maps uname style arches (what swarm uses) to GOARCH ones
+func normalizeArch(arch string) string {
+	switch arch {
+	case "x86_64":
+		return "amd64"
+	case "aarch64":
+		return "arm64"
+	case "armv7l":
+		return "arm"
+	}
+	return arch
+}
+
+// serviceResources turns the service's `deploy.resources` into container limits
+func serviceResources(service *ComposeService) (container.Resources, error) {
+	resources := container.Resources{}
+	limits := service.Deploy.Resources.Limits
+	reservations := service.Deploy.Resources.Reservations
+
+	cpus, err := parseCPUs(limits.CPUs)
+	if err != nil {
+		return resources, err
+	}
+	resources.NanoCPUs = int64(cpus * 1e9)
+	if resources.Memory, err = parseBytes(limits.Memory); err != nil {
+		return resources, err
+	}
+	if resources.MemoryReservation, err = parseBytes(reservations.Memory); err != nil {
+		return resources, err
+	}
+	for _, device := range reservations.Devices {
+		count := -1 // all
+		if device.Count != "" && device.Count != "all" {
+			if count, err = strconv.Atoi(device.Count); err != nil {
+				return resources, fmt.Errorf("invalid device count %q", device.Count)
+			}
+		}
+		if len(device.DeviceIDs) > 0 {
+			count = 0
+		}
+		resources.DeviceRequests = append(resources.DeviceRequests, container.DeviceRequest{
+			Driver:       device.Driver,
+			Count:        count,
+			DeviceIDs:    device.DeviceIDs,
+			Capabilities: [][]string{device.Capabilities},
+		})
+	}
+	return resources, nil
+}
+
+func gpuCount(device ComposeDevice) (int, error) {
+	isGPU := false
+	for _, capability := range device.Capabilities {
+		if capability == "gpu" {
+			isGPU = true
+		}
+	}
+	switch {
+	case !isGPU:
+		return 0, nil
+	case len(device.DeviceIDs) > 0:
+		return len(device.DeviceIDs), nil
+	case device.Count == "" || device.Count == "all":
+		// at least one
+		return 1, nil
+	}
+	count, err := strconv.Atoi(device.Count)
+	if err != nil {
+		return 0, fmt.Errorf("invalid device count %q", device.Count)
+	}
+	return count, nil
+}
+
+func parseCPUs(cpus string) (float64, error) {
+	if cpus == "" {
+		return 0, nil
+	}
+	value, err := strconv.ParseFloat(cpus, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid cpus %q", cpus)
+	}
+	return value, nil
+}
+
+// parseBytes parses compose byte values: 1024, 512k, 256m, 1.5g (the units are powers of 1024)
+func parseBytes(value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	number := strings.ToLower(strings.TrimSpace(value))
+	number = strings.TrimSuffix(number, "b")
+	multiplier := float64(1)
+	for suffix, m := range map[string]float64{"k": 1 << 10, "m": 1 << 20, "g": 1 << 30, "t": 1 << 40} {
+		if strings.HasSuffix(number, suffix) {
+			number = strings.TrimSuffix(number, suffix)
+			multiplier = m
+			break
+		}
+	}
+	parsed, err := strconv.ParseFloat(number, 64)
+	if err != nil || parsed < 0 {
+		return 0, fmt.Errorf("invalid byte value %q", value)
+	}
+	return int64(parsed * multiplier), nil
+}
@@ -0,0 +1,96 @@
+package workload
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/workbenchapp/worknet/daoctl/lib/workgroup"
+)
+
+func TestRequirements(t *testing.T) {
+	compose, err := ParseComposeFile([]byte(`
+services:
+  web:
+    image: nginx
+    deploy:
+      resources:
+        limits:
+          cpus: ${CPUS:-0.5}
+          memory: 512M
+  worker:
+    image: worker
+    deploy:
+      resources:
+        reservations:
+          cpus: 2
+          memory: 1g
+          devices:
+            - capabilities: [gpu]
+              count: 1
+      placement:
+        constraints: [node.labels.region==eu, node.platform.arch==x86_64]
+`), []string{"CPUS=1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := compose.Requirements()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.CPUs != 3 || req.MemoryBytes != 512<<20+1<<30 || req.GPUs != 1 || len(req.Constraints) != 2 {
+		t.Fatalf("Requirements() = %+v", req)
+	}
+
+	capacity := workgroup.DeviceCapacity{
+		CPUs:        4,
+		MemoryBytes: 8 << 30,
+		GPUs:        1,
+		OS:          "linux",
+		Arch:        "amd64",
+		Labels:      map[string]string{"region": "eu"},
+	}
+	if err := req.Check(capacity, "host"); err != nil {
+		t.Errorf("Check() = %s, want ok", err)
+	}
+
+	for _, tc := range []struct {
+		change func(c *workgroup.DeviceCapacity)
+		want   string
+	}{
+		{func(c *workgroup.DeviceCapacity) { c.CPUs = 2 }, "cpus"},
+		{func(c *workgroup.DeviceCapacity) { c.MemoryBytes = 1 << 30 }, "memory"},
+		{func(c *workgroup.DeviceCapacity) { c.GPUs = 0 }, "gpus"},
+		{func(c *workgroup.DeviceCapacity) { c.Labels = nil }, "node.labels.region"},
+		{func(c *workgroup.DeviceCapacity) { c.Arch = "arm64" }, "node.platform.arch"},
+	} {
+		c := capacity
+		tc.change(&c)
+		err := req.Check(c, "host")
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("Check() = %v, want an error about %s", err, tc.want)
+		}
+	}
+}
+
+func TestServiceResources(t *testing.T) {
+	service := &ComposeService{}
+	service.Deploy.Resources.Limits = ComposeResources{CPUs: "1.5", Memory: "256m"}
+	service.Deploy.Resources.Reservations = ComposeResources{
+		Devices: []ComposeDevice{{Capabilities: []string{"gpu"}, Count: "all"}},
+	}
+	resources, err := serviceResources(service)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resources.NanoCPUs != 1500000000 || resources.Memory != 256<<20 {
+		t.Errorf("serviceResources() = %+v", resources)
+	}
+	if len(resources.DeviceRequests) != 1 || resources.DeviceRequests[0].Count != -1 {
+		t.Errorf("DeviceRequests = %+v", resources.DeviceRequests)
+	}
+
+	service.Deploy.Resources.Limits.Memory = "lots"
+	if _, err := serviceResources(service); err == nil {
+		t.Errorf("serviceResources() with a bad memory value didn't fail")
+	}
+}
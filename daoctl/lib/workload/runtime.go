@@ -0,0 +1,122 @@
+package workload
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/workbenchapp/worknet/daoctl/lib/solana/anchor/generated/worknet"
+	"github.com/workbenchapp/worknet/daoctl/lib/workgroup"
+)
+
+// Workload is one replica of a deployment, as the agent runs it locally
+type Workload struct {
+	// Name is unique per device, and is what the runtime calls the workload (e.g. the compose project name)
+	Name          string           `json:"name"`
+	DeploymentPDA string           `json:"deployment_pda"`
+	Replica       int              `json:"replica"`
+	WorkType      worknet.WorkType `json:"work_type"`
+	WorkDir       string           `json:"work_dir"`
+	SpecPath      string           `json:"spec_path"`
+	// Env is KEY=value pairs (DAONETES_* and the deployment's args), used for ${NAME}
+	// interpolation in the spec, and set in the workload's containers where the runtime can
+	Env []string `json:"env"`
+
+	// SpecSha256 pins the spec content, a change to it (or to Env) means a redeploy
+	SpecSha256 string `json:"spec_sha256"`
+
+	// SecretsDir has the values of the workgroup secrets the spec uses, a file each, named for the secret
+	SecretsDir string `json:"secrets_dir,omitempty"`
+	// SecretVersions is the version of each of those secrets, a rotated secret means a redeploy
+	SecretVersions map[string]int `json:"secret_versions,omitempty"`
+
+	// UpToDate is set when the local spec is already what was last deployed, so Deploy can be skipped
+	UpToDate bool `json:"-"`
+	// Hold is set when the workload's spec couldn't be fetched, it's left as is, neither deployed nor torn down
+	Hold bool `json:"-"`
+}
+
+// Runtime runs workloads of one worknet.WorkType
+type Runtime interface {
+	// Deploy brings the workload up, or updates it to match its spec
+	Deploy(ctx context.Context, w *Workload) error
+	// Status reports the state of each of the workload's services
+	Status(ctx context.Context, w *Workload) ([]workgroup.DeployState, error)
+	// Stop tears the workload down
+	Stop(ctx context.Context, w *Workload) error
+	// Logs streams the workload's output, the caller needs to Close it
+	Logs(ctx context.Context, w *Workload, follow bool) (io.ReadCloser, error)
+}
+
+// Registry maps work types to the runtime that can run them
+type Registry struct {
+	mu       sync.RWMutex
+	runtimes map[worknet.WorkType]Runtime
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		runtimes: make(map[worknet.WorkType]Runtime),
+	}
+}
+
+// DefaultRegistry is what the agent uses, runtimes add themselves to it in init()
+var DefaultRegistry = NewRegistry()
+
+func (r *Registry) Register(workType worknet.WorkType, runtime Runtime) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.runtimes[workType] = runtime
+}
+
+func (r *Registry) Get(workType worknet.WorkType) (Runtime, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	runtime, ok := r.runtimes[workType]
+	if !ok {
+		return nil, fmt.Errorf("no runtime registered for work type %s", workType)
+	}
+	return runtime, nil
+}
+
+func Register(workType worknet.WorkType, runtime Runtime) {
+	DefaultRegistry.Register(workType, runtime)
+}
+
+func Get(workType worknet.WorkType) (Runtime, error) {
+	return DefaultRegistry.Get(workType)
+}
+
+// Event is a change to a running workload that didn't come from the agent
+type Event struct {
+	Name    string
+	Service string
+	Action  string
+}
+
+// EventSource is implemented by runtimes that can tell us when a workload
+// changes underneath us, so we don't have to wait for the next poll to notice
+type EventSource interface {
+	Events(ctx context.Context) <-chan Event
+}
+
+// DriftDetector is implemented by runtimes that can tell when a running workload
+// no longer matches its spec, eg a container was removed by hand
+type DriftDetector interface {
+	// Drifted returns why the workload doesn't match its spec, or "" if it does
+	Drifted(ctx context.Context, w *Workload) (string, error)
+}
+
+// Execer is implemented by runtimes that can run a command in one of a workload's services
+type Execer interface {
+	// Exec runs cmd in service, reading stdin from in if it isn't nil. Output goes
+	// to out, raw if tty is set, otherwise multiplexed the way pkg/stdcopy does it
+	Exec(ctx context.Context, w *Workload, service string, cmd []string, tty bool, in io.Reader, out io.Writer) error
+}
+
+// Restarter is implemented by runtimes that can restart one of a workload's
+// services, which the HealthMonitor does to unhealthy ones
+type Restarter interface {
+	Restart(ctx context.Context, w *Workload, service string) error
+}
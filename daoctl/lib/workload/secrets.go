@@ -0,0 +1,219 @@
+package workload
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Secrets are declared the compose way, an external secret is one of the
+// workgroup's, that the agent decrypts into Workload.SecretsDir before deploying:
+//
+//	services:
+//	  web:
+//	    secrets: [api_key]            # /run/secrets/api_key
+//	secrets:
+//	  api_key:
+//	    external: true
+//	    name: stripe-key              # the workgroup secret, if it isn't the key
+//	x-daonetes:
+//	  secret_env:
+//	    web:
+//	      STRIPE_KEY: api_key
+//
+// Rotating a secret (sending a new version) redeploys the workloads that use it.
+
+// LabelSecrets has the versions of the secrets a container was made with, so rotating one recreates it
+const LabelSecrets = "org.daonetes.secrets"
+
+// secretsMountDir is where compose mounts secrets in containers
+const secretsMountDir = "/run/secrets"
+
+// secretsOverrideFile is the compose file ComposeRuntime adds to the spec, to
+// get the secrets into the containers, it's in the SecretsDir
+const secretsOverrideFile = "docker-compose.secrets.yml"
+
+// WorkgroupSecret is the name of the workgroup secret for key, "" if it isn't one
+func (c *ComposeFile) WorkgroupSecret(key string) string {
+	secret, ok := c.Secrets[key]
+	if !ok || !secret.External {
+		return ""
+	}
+	if secret.Name != "" {
+		return secret.Name
+	}
+	return key
+}
+
+// WorkgroupSecrets are the names of the workgroup secrets the spec uses, sorted
+func (c *ComposeFile) WorkgroupSecrets() []string {
+	names := []string{}
+	seen := map[string]bool{}
+	for key := range c.Secrets {
+		name := c.WorkgroupSecret(key)
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// secretPath is the file on this device with the value of the secret
+func secretPath(w *Workload, compose *ComposeFile, key string) (string, error) {
+	if name := compose.WorkgroupSecret(key); name != "" {
+		if w.SecretsDir == "" {
+			return "", fmt.Errorf("workgroup secret %s hasn't been fetched", name)
+		}
+		return filepath.Join(w.SecretsDir, name), nil
+	}
+	secret, ok := compose.Secrets[key]
+	if !ok {
+		return "", fmt.Errorf("unknown secret %q", key)
+	}
+	if filepath.IsAbs(secret.File) {
+		return secret.File, nil
+	}
+	return filepath.Join(filepath.Dir(w.SpecPath), secret.File), nil
+}
+
+// secretBinds are the read only binds for the service's secrets
+func secretBinds(w *Workload, compose *ComposeFile, service *ComposeService) ([]string, error) {
+	binds := []string{}
+	for _, secret := range service.Secrets {
+		path, err := secretPath(w, compose, secret.Source)
+		if err != nil {
+			return nil, err
+		}
+		target := secret.Target
+		if target == "" {
+			target = secret.Source
+		}
+		if !filepath.IsAbs(target) {
+			target = secretsMountDir + "/" + target
+		}
+		binds = append(binds, path+":"+target+":ro")
+	}
+	return binds, nil
+}
+
+// secretEnv is the service's env vars that come from secrets
+func secretEnv(w *Workload, compose *ComposeFile, serviceName string) (MappingOrList, error) {
+	env := MappingOrList{}
+	for envVar, key := range compose.Daonetes.SecretEnv[serviceName] {
+		path, err := secretPath(w, compose, key)
+		if err != nil {
+			return nil, err
+		}
+		value, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read secret %s: %s", key, err)
+		}
+		// `echo value | daoctl secret set` leaves a newline nobody wants in an env var
+		env[envVar] = strings.TrimSuffix(string(value), "\n")
+	}
+	return env, nil
+}
+
+// secretVersionsLabel is name=version for each workgroup secret the service uses, for LabelSecrets
+func secretVersionsLabel(w *Workload, compose *ComposeFile, serviceName string, service *ComposeService) string {
+	keys := []string{}
+	for _, secret := range service.Secrets {
+		keys = append(keys, secret.Source)
+	}
+	for _, key := range compose.Daonetes.SecretEnv[serviceName] {
+		keys = append(keys, key)
+	}
+	versions := []string{}
+	seen := map[string]bool{}
+	for _, key := range keys {
+		name := compose.WorkgroupSecret(key)
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		versions = append(versions, name+"="+strconv.Itoa(w.SecretVersions[name]))
+	}
+	sort.Strings(versions)
+	return strings.Join(versions, ",")
+}
+
+// writeSecretsOverride writes a compose file for docker-compose to merge over the
+// spec, swapping the external secrets (which only swarm has) for the files the
+// agent wrote, and adding the secret env vars. It returns "" if there aren't any.
+func writeSecretsOverride(w *Workload, compose *ComposeFile) (string, error) {
+	if w.SecretsDir == "" {
+		return "", nil
+	}
+	type overrideSecret struct {
+		File     string `yaml:"file"`
+		External bool   `yaml:"external"`
+	}
+	type overrideService struct {
+		Environment map[string]string `yaml:"environment,omitempty"`
+		Labels      map[string]string `yaml:"labels,omitempty"`
+	}
+	override := struct {
+		Version  string                     `yaml:"version,omitempty"`
+		Services map[string]overrideService `yaml:"services,omitempty"`
+		Secrets  map[string]overrideSecret  `yaml:"secrets,omitempty"`
+	}{
+		// has to match the spec's, docker-compose v1 won't merge them otherwise
+		Version:  compose.Version,
+		Services: map[string]overrideService{},
+		Secrets:  map[string]overrideSecret{},
+	}
+	for key := range compose.Secrets {
+		if compose.WorkgroupSecret(key) == "" {
+			continue
+		}
+		path, err := secretPath(w, compose, key)
+		if err != nil {
+			return "", err
+		}
+		override.Secrets[key] = overrideSecret{File: path}
+	}
+	for name, service := range compose.Services {
+		env, err := secretEnv(w, compose, name)
+		if err != nil {
+			return "", err
+		}
+		versions := secretVersionsLabel(w, compose, name, service)
+		if len(env) == 0 && versions == "" {
+			continue
+		}
+		override.Services[name] = overrideService{
+			Environment: env,
+			Labels:      map[string]string{LabelSecrets: versions},
+		}
+	}
+	data, err := yaml.Marshal(override)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(w.SecretsDir, secretsOverrideFile)
+	// the env vars are in it
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+func sameSecretVersions(a, b map[string]int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, version := range a {
+		if other, ok := b[name]; !ok || other != version {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,109 @@
+package workload
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const secretsSpec = `
+services:
+  web:
+    image: nginx
+    secrets:
+      - api_key
+      - source: cert
+        target: /etc/ssl/cert.pem
+secrets:
+  api_key:
+    external: true
+    name: stripe-key
+  cert:
+    file: ./cert.pem
+x-daonetes:
+  secret_env:
+    web:
+      STRIPE_KEY: api_key
+`
+
+func TestSecrets(t *testing.T) {
+	compose, err := ParseComposeFile([]byte(secretsSpec), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := compose.WorkgroupSecrets(); !reflect.DeepEqual(names, []string{"stripe-key"}) {
+		t.Fatalf("expected the external secret, got %v", names)
+	}
+
+	secretsDir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(secretsDir, "stripe-key"), []byte("sk_123\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	w := &Workload{
+		SpecPath:       "/work/spec.yml",
+		SecretsDir:     secretsDir,
+		SecretVersions: map[string]int{"stripe-key": 2},
+	}
+	service := compose.Services["web"]
+
+	binds, err := secretBinds(w, compose, service)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		filepath.Join(secretsDir, "stripe-key") + ":/run/secrets/api_key:ro",
+		"/work/cert.pem:/etc/ssl/cert.pem:ro",
+	}
+	if !reflect.DeepEqual(binds, expected) {
+		t.Errorf("expected binds %v, got %v", expected, binds)
+	}
+
+	env, err := secretEnv(w, compose, "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env["STRIPE_KEY"] != "sk_123" {
+		t.Errorf("expected STRIPE_KEY from the secret, got %q", env["STRIPE_KEY"])
+	}
+	if label := secretVersionsLabel(w, compose, "web", service); label != "stripe-key=2" {
+		t.Errorf("expected the secret's version, got %q", label)
+	}
+
+	// not fetched yet
+	if _, err := secretBinds(&Workload{SpecPath: "/work/spec.yml"}, compose, service); err == nil {
+		t.Error("expected an error without a secrets dir")
+	}
+}
+
+func TestSecretsValidation(t *testing.T) {
+	for name, spec := range map[string]string{
+		"unknown secret": "services: {web: {image: nginx, secrets: [missing]}}",
+		"no source":      "services: {web: {image: nginx, secrets: [a]}}\nsecrets: {a: {}}",
+		"unknown env":    "services: {web: {image: nginx}}\nx-daonetes: {secret_env: {web: {A: missing}}}",
+	} {
+		if _, err := ParseComposeFile([]byte(spec), nil); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestReconcileRedeploysRotatedSecrets(t *testing.T) {
+	reconciler, fake := newTestReconciler(t)
+	ctx := context.Background()
+
+	w := func(version int) *Workload {
+		return &Workload{Name: "a", SpecSha256: "1", UpToDate: true, SecretVersions: map[string]int{"key": version}}
+	}
+	if _, err := reconciler.Reconcile(ctx, []*Workload{{Name: "a", SpecSha256: "1", SecretVersions: map[string]int{"key": 1}}}); err != nil {
+		t.Fatal(err)
+	}
+	fake.Deployed = nil
+	if _, err := reconciler.Reconcile(ctx, []*Workload{w(1)}); err != nil || len(fake.Deployed) != 0 {
+		t.Fatalf("expected nothing to be deployed, got %v, %v", fake.Deployed, err)
+	}
+	if _, err := reconciler.Reconcile(ctx, []*Workload{w(2)}); err != nil || len(fake.Deployed) != 1 {
+		t.Fatalf("expected the rotated secret to redeploy, got %v, %v", fake.Deployed, err)
+	}
+}